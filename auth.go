@@ -0,0 +1,386 @@
+package test
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"flag"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+var credFile = flag.String("credfile", "/tmp/clouddd/credentials",
+	"the local credential store, one \"accessKey secretKey\" per line")
+var allowAnonymous = flag.Bool("allowanonymous", false, "whether allow the requests without signature")
+var region = flag.String("region", "us-east-1", "the region of this S3 service, to check the credential scope")
+
+// CredentialStore keeps the access keys and secret keys
+type CredentialStore struct {
+	keys map[string]string
+}
+
+// NewCredentialStore loads the credentials from the local file. Every line
+// is "accessKey secretKey", the empty line and the line starts with "#" are
+// skipped. If the file does not exist, the store is empty.
+func NewCredentialStore(path string) *CredentialStore {
+	c := new(CredentialStore)
+	c.keys = make(map[string]string)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			glog.Warningln("credential file not exist, only anonymous requests are allowed if enabled", path)
+			return c
+		}
+		glog.Errorln("failed to open credential file", path, err)
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			glog.Errorln("invalid credential line", path, lineNum)
+			return nil
+		}
+		c.keys[fields[0]] = fields[1]
+	}
+	if err = scanner.Err(); err != nil {
+		glog.Errorln("failed to read credential file", path, err)
+		return nil
+	}
+
+	glog.Infoln("loaded credentials", path, len(c.keys))
+	return c
+}
+
+// GetSecretKey returns the secret key of the access key
+func (c *CredentialStore) GetSecretKey(accessKey string) (secretKey string, ok bool) {
+	secretKey, ok = c.keys[accessKey]
+	return secretKey, ok
+}
+
+// AuthInfo is the result of the request authentication
+type AuthInfo struct {
+	// the access key of the request, "" for the anonymous request
+	AccessKey string
+	// the signing key, time, scope and signature of the request, the streaming
+	// upload signs every chunk with them.
+	SigningKey []byte
+	Time       time.Time
+	Scope      string
+	Signature  string
+}
+
+// authInfoKey is the context key for the AuthInfo
+type authInfoKey int
+
+// newAuthContext returns a new Context that carries the AuthInfo
+func newAuthContext(ctx context.Context, info *AuthInfo) context.Context {
+	return context.WithValue(ctx, authInfoKey(0), info)
+}
+
+// getAuthInfoFromContext returns the AuthInfo of the request, the anonymous
+// AuthInfo if the request is not authenticated.
+func getAuthInfoFromContext(ctx context.Context) *AuthInfo {
+	info, ok := ctx.Value(authInfoKey(0)).(*AuthInfo)
+	if !ok || info == nil {
+		return &AuthInfo{}
+	}
+	return info
+}
+
+// getOwnerID returns the owner id of the request, the access key, or the
+// default owner for the anonymous request.
+func getOwnerID(ctx context.Context) string {
+	info := getAuthInfoFromContext(ctx)
+	if info.AccessKey == "" {
+		return DefaultOwnerID
+	}
+	return info.AccessKey
+}
+
+// the parsed signature of the request, from Authorization header or query
+type sigV4Request struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	terminator    string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	// the canonical query string
+	query string
+}
+
+// S3Auth authenticates the requests with AWS Signature Version 4
+type S3Auth struct {
+	creds          *CredentialStore
+	region         string
+	allowAnonymous bool
+}
+
+// NewS3Auth creates the S3Auth instance
+func NewS3Auth(creds *CredentialStore, region string, allowAnonymous bool) *S3Auth {
+	a := new(S3Auth)
+	a.creds = creds
+	a.region = region
+	a.allowAnonymous = allowAnonymous
+	return a
+}
+
+// AllowAnonymous returns whether the anonymous request is allowed when the
+// bucket policy does not explicitly allow it.
+func (a *S3Auth) AllowAnonymous() bool {
+	return a.allowAnonymous
+}
+
+// Authenticate checks the signature in the Authorization header or in the
+// query string. The request without signature gets the anonymous AuthInfo,
+// which is authorized by the bucket policy.
+func (a *S3Auth) Authenticate(ctx context.Context, r *http.Request) (info *AuthInfo, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	if auth := r.Header.Get(util.Authorization); auth != "" {
+		sr, status, errmsg := a.parseHeader(r, auth)
+		if status != StatusOK {
+			glog.Errorln("invalid Authorization header", requuid, r.Method, r.URL, status, errmsg)
+			return nil, status, errmsg
+		}
+
+		t, status, errmsg := a.checkTime(sr)
+		if status != StatusOK {
+			glog.Errorln("invalid request time", requuid, r.Method, r.URL, sr.amzDate, status, errmsg)
+			return nil, status, errmsg
+		}
+		skew := time.Since(t)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > MaxRequestTimeSkewSecs*time.Second {
+			glog.Errorln("request time too skewed", requuid, r.Method, r.URL, sr.amzDate)
+			return nil, RequestTimeTooSkewed, "RequestTimeTooSkewed"
+		}
+
+		return a.verify(ctx, r, sr, t)
+	}
+
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		sr, status, errmsg := a.parseQuery(r)
+		if status != StatusOK {
+			glog.Errorln("invalid query authentication", requuid, r.Method, r.URL, status, errmsg)
+			return nil, status, errmsg
+		}
+
+		t, status, errmsg := a.checkTime(sr)
+		if status != StatusOK {
+			glog.Errorln("invalid request time", requuid, r.Method, r.URL, sr.amzDate, status, errmsg)
+			if status == AuthorizationHeaderMalformed {
+				return nil, AuthorizationQueryParametersError, "AuthorizationQueryParametersError"
+			}
+			return nil, status, errmsg
+		}
+
+		status, errmsg = a.checkPresigned(r, sr, t)
+		if status != StatusOK {
+			glog.Errorln("invalid presigned request", requuid, r.Method, r.URL, sr.amzDate, status, errmsg)
+			return nil, status, errmsg
+		}
+
+		return a.verify(ctx, r, sr, t)
+	}
+
+	glog.V(2).Infoln("anonymous request", requuid, r.Method, r.URL)
+	return &AuthInfo{}, StatusOK, StatusOKStr
+}
+
+// parse the Authorization header, like
+// AWS4-HMAC-SHA256 Credential=AKID/20130524/us-east-1/s3/aws4_request,
+// SignedHeaders=host;range;x-amz-date, Signature=fe5f80f7...
+func (a *S3Auth) parseHeader(r *http.Request, auth string) (sr *sigV4Request, status int, errmsg string) {
+	if !strings.HasPrefix(auth, util.SigV4Algorithm+" ") {
+		return nil, AuthorizationHeaderMalformed, "AuthorizationHeaderMalformed"
+	}
+
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(auth[len(util.SigV4Algorithm)+1:], ",") {
+		strs := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(strs) != 2 {
+			return nil, AuthorizationHeaderMalformed, "AuthorizationHeaderMalformed"
+		}
+		fields[strs[0]] = strs[1]
+	}
+
+	sr = &sigV4Request{}
+	status, errmsg = a.parseCredential(sr, fields["Credential"], fields["SignedHeaders"], fields["Signature"])
+	if status != StatusOK {
+		return nil, AuthorizationHeaderMalformed, "AuthorizationHeaderMalformed"
+	}
+
+	// host, the request time and all x-amz-* headers must be signed
+	if !isSignedHeader(sr, "host") {
+		return nil, AuthorizationHeaderMalformed, "AuthorizationHeaderMalformed: host must be signed"
+	}
+	for k := range r.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-amz-") && !isSignedHeader(sr, name) {
+			return nil, AccessDenied, "AccessDenied: header " + name + " is not signed"
+		}
+	}
+
+	sr.amzDate = r.Header.Get(util.AmzDate)
+	if sr.amzDate == "" {
+		sr.amzDate = r.Header.Get(Date)
+		if !isSignedHeader(sr, "date") {
+			return nil, AccessDenied, "AccessDenied: header date is not signed"
+		}
+	}
+	sr.payloadHash = r.Header.Get(util.AmzContentSha256)
+	if sr.payloadHash == "" {
+		return nil, InvalidRequest, "InvalidRequest: missing x-amz-content-sha256"
+	}
+	sr.query = util.CanonicalQueryString(r.URL.Query(), "")
+	return sr, StatusOK, StatusOKStr
+}
+
+// parse the query string authentication
+func (a *S3Auth) parseQuery(r *http.Request) (sr *sigV4Request, status int, errmsg string) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != util.SigV4Algorithm {
+		return nil, AuthorizationQueryParametersError, "AuthorizationQueryParametersError"
+	}
+
+	sr = &sigV4Request{}
+	status, errmsg = a.parseCredential(sr, q.Get("X-Amz-Credential"),
+		q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature"))
+	if status != StatusOK {
+		return nil, AuthorizationQueryParametersError, "AuthorizationQueryParametersError"
+	}
+
+	sr.amzDate = q.Get("X-Amz-Date")
+	sr.payloadHash = q.Get(util.AmzContentSha256)
+	if sr.payloadHash == "" {
+		sr.payloadHash = util.UnsignedPayload
+	}
+	sr.query = util.CanonicalQueryString(q, "X-Amz-Signature")
+	return sr, StatusOK, StatusOKStr
+}
+
+// checkPresigned checks the presigned url is for GET, PUT or HEAD, the host
+// is signed, and the url is not expired.
+func (a *S3Auth) checkPresigned(r *http.Request, sr *sigV4Request, t time.Time) (status int, errmsg string) {
+	if r.Method != "GET" && r.Method != "PUT" && r.Method != "HEAD" {
+		return AccessDenied, "presigned url only supports GET, PUT and HEAD"
+	}
+
+	if !isSignedHeader(sr, "host") {
+		return AuthorizationQueryParametersError, "AuthorizationQueryParametersError: host must be signed"
+	}
+
+	expires, err := strconv.Atoi(r.URL.Query().Get("X-Amz-Expires"))
+	if err != nil || expires < 1 || expires > MaxPresignedExpiresSecs {
+		return AuthorizationQueryParametersError, "AuthorizationQueryParametersError: X-Amz-Expires must be between 1 and 604800"
+	}
+
+	now := time.Now()
+	if t.Sub(now) > MaxRequestTimeSkewSecs*time.Second {
+		return AccessDenied, "request is not valid yet"
+	}
+	if now.Sub(t) > time.Duration(expires)*time.Second {
+		return AccessDenied, "request has expired"
+	}
+	return StatusOK, StatusOKStr
+}
+
+func isSignedHeader(sr *sigV4Request, name string) bool {
+	for _, h := range sr.signedHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *S3Auth) parseCredential(sr *sigV4Request, cred string, signedHeaders string,
+	signature string) (status int, errmsg string) {
+	strs := strings.Split(cred, "/")
+	if len(strs) != 5 || signedHeaders == "" || signature == "" {
+		return InvalidRequest, "InvalidRequest: invalid credential"
+	}
+
+	sr.accessKey = strs[0]
+	sr.date = strs[1]
+	sr.region = strs[2]
+	sr.service = strs[3]
+	sr.terminator = strs[4]
+	sr.signedHeaders = strings.Split(signedHeaders, ";")
+	sr.signature = signature
+	return StatusOK, StatusOKStr
+}
+
+// parse the request time, and check the credential scope
+func (a *S3Auth) checkTime(sr *sigV4Request) (t time.Time, status int, errmsg string) {
+	t, err := time.Parse(util.AmzDateFormat, sr.amzDate)
+	if err != nil {
+		t, err = http.ParseTime(sr.amzDate)
+		if err != nil {
+			return t, AccessDenied, "invalid request date"
+		}
+	}
+
+	if sr.date != t.UTC().Format(util.ShortDateFormat) || sr.region != a.region ||
+		sr.service != util.SigV4Service || sr.terminator != util.SigV4Terminator {
+		return t, AuthorizationHeaderMalformed, "AuthorizationHeaderMalformed"
+	}
+	return t, StatusOK, StatusOKStr
+}
+
+// compute the signature and compare with the request signature
+func (a *S3Auth) verify(ctx context.Context, r *http.Request, sr *sigV4Request,
+	t time.Time) (info *AuthInfo, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	secretKey, ok := a.creds.GetSecretKey(sr.accessKey)
+	if !ok {
+		glog.Errorln("unknown access key", requuid, r.Method, r.URL, sr.accessKey)
+		return nil, InvalidAccessKeyID, "InvalidAccessKeyId"
+	}
+
+	if !sort.StringsAreSorted(sr.signedHeaders) {
+		glog.Errorln("signed headers are not sorted", requuid, r.Method, r.URL, sr.signedHeaders)
+		return nil, SignatureDoesNotMatch, "SignatureDoesNotMatch"
+	}
+
+	cr := util.CanonicalRequest(r.Method, r.URL.Path, sr.query, r.Header, r.Host,
+		sr.signedHeaders, sr.payloadHash)
+	scope := sr.date + "/" + sr.region + "/" + sr.service + "/" + sr.terminator
+	signingKey := util.SigningKey(secretKey, sr.date, sr.region)
+	signature := util.Signature(signingKey, util.StringToSign(t, scope, cr))
+
+	if !hmac.Equal([]byte(signature), []byte(sr.signature)) {
+		glog.Errorln("signature does not match", requuid, r.Method, r.URL, sr.accessKey)
+		glog.V(5).Infoln("canonical request", requuid, cr)
+		return nil, SignatureDoesNotMatch, "SignatureDoesNotMatch"
+	}
+
+	info = &AuthInfo{AccessKey: sr.accessKey, SigningKey: signingKey, Time: t,
+		Scope: scope, Signature: signature}
+	return info, StatusOK, StatusOKStr
+}
@@ -0,0 +1,442 @@
+package test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+var gcDir = flag.String("gcdir", "/tmp/clouddd/gc/", "the local dir of the block refs log")
+var gcIntervalSecs = flag.Int("gcinterval", 3600, "the interval seconds to scan and collect the data blocks")
+var gcGraceSecs = flag.Int("gcgrace", 3600,
+	"the data block is collected only if it is not referenced and not used by put for the grace seconds")
+
+// Misc const definition for BlockGC
+const (
+	// the prefix of the positive and negative refs log record
+	gcPositivePrefix = "p."
+	gcNegativePrefix = "n."
+	// the number of data blocks to list at a time
+	gcListMaxKeys = 1000
+)
+
+// BlockGC tracks the references of the data blocks and collects the blocks
+// that are not referenced any more.
+//
+// Every object version and multipart upload part references its blocks with
+// the ref bucket/object.uuid. The pref is logged before the ObjectMD or the
+// upload part is written, and the nref is logged when the object is deleted
+// or overwritten. The log records are written to the local dir with the same
+// durability as the DeleteJournal, and the background worker applies them to
+// the BlockRefs of the blocks. A nref cancels the matching pref, so BlockRefs
+// only keep the live references.
+//
+// The worker periodically scans all data blocks. A block becomes a gc
+// candidate when it has no pref, and is deleted only when it is still not
+// referenced after the grace period. The puts record every block they use,
+// before checking IsDataBlockExist, and the block used within the grace
+// period is not deleted. This protects the block that S3PutObject finds to
+// exist but does not log the pref yet. The grace period should be longer than
+// the longest put.
+//
+// The inuse blocks and the candidates are tracked in the memory of the
+// process. The gateways sharing the same backend do not see the blocks used
+// by each other, so running multiple gateways on one backend is not safe.
+type BlockGC struct {
+	dir  string
+	s3io CloudIO
+
+	// serialize applying the refs log and collecting the blocks
+	applyMu sync.Mutex
+
+	mu sync.Mutex
+	// the last used time of the data blocks by the puts, key is md5
+	inuse map[string]int64
+	// the time when the data block becomes the gc candidate, key is md5
+	candidates map[string]int64
+	// the data blocks being deleted, the channel is closed when done
+	deleting map[string]chan struct{}
+
+	// notify the worker there are new log records
+	notifyChan chan bool
+}
+
+// NewBlockGC creates the BlockGC instance
+func NewBlockGC(dir string, s3io CloudIO) *BlockGC {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	err := os.MkdirAll(dir, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create gc dir", dir, err)
+		return nil
+	}
+
+	g := new(BlockGC)
+	g.dir = dir
+	g.s3io = s3io
+	g.inuse = make(map[string]int64)
+	g.candidates = make(map[string]int64)
+	g.deleting = make(map[string]chan struct{})
+	g.notifyChan = make(chan bool, 1)
+
+	// remove the incomplete records left by the last run. The ObjectMD or the
+	// upload part is written after the record is complete, so they are not
+	// referenced.
+	names, err := readDirNames(dir)
+	if err != nil {
+		glog.Errorln("failed to read gc dir", dir, err)
+		return nil
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, journalTmpSuffix) {
+			glog.Infoln("remove the incomplete block refs log", dir+name)
+			os.Remove(dir + name)
+		}
+	}
+	return g
+}
+
+// UseBlock records the data block is used by the put. The put should call it
+// before checking whether the block exists. If the block is being deleted,
+// UseBlock waits for the deletion and returns true, the put should write the
+// block again.
+func (g *BlockGC) UseBlock(md5str string) (deleted bool) {
+	g.mu.Lock()
+	g.inuse[md5str] = time.Now().Unix()
+	ch, ok := g.deleting[md5str]
+	g.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	<-ch
+	return true
+}
+
+// LogRefs durably logs the positive or negative ref for the data blocks
+func (g *BlockGC) LogRefs(ctx context.Context, ref string, positive bool, blocks []string) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	if len(blocks) == 0 {
+		return StatusOK, StatusOKStr
+	}
+
+	if positive {
+		// the blocks are not in BlockRefs until the record is applied
+		now := time.Now().Unix()
+		g.mu.Lock()
+		for _, md5str := range blocks {
+			g.inuse[md5str] = now
+		}
+		g.mu.Unlock()
+	}
+
+	rec := &BlockRefsRecord{}
+	rec.RequestId = requuid
+	rec.Ref = ref
+	rec.Positive = positive
+	rec.Blocks = blocks
+
+	b, err := proto.Marshal(rec)
+	if err != nil {
+		glog.Errorln("failed to Marshal BlockRefsRecord", requuid, ref, positive, err)
+		return InternalError, "failed to Marshal BlockRefsRecord"
+	}
+
+	// the same ref is logged to the same file, so logging again is idempotent
+	err = writeFileSync(g.dir, g.recordName(ref, positive), b)
+	if err != nil {
+		glog.Errorln("failed to write BlockRefsRecord", requuid, ref, positive, err)
+		return InternalError, "failed to write BlockRefsRecord"
+	}
+
+	select {
+	case g.notifyChan <- true:
+	default:
+	}
+
+	glog.V(2).Infoln("logged block refs", requuid, ref, positive, "blocks", len(blocks))
+	return StatusOK, StatusOKStr
+}
+
+func (g *BlockGC) recordName(ref string, positive bool) string {
+	m := md5.Sum([]byte(ref))
+	if positive {
+		return gcPositivePrefix + hex.EncodeToString(m[:])
+	}
+	return gcNegativePrefix + hex.EncodeToString(m[:])
+}
+
+// Start starts the background worker
+func (g *BlockGC) Start() {
+	go g.run()
+}
+
+func (g *BlockGC) run() {
+	lastCollect := time.Now()
+	for {
+		select {
+		case <-g.notifyChan:
+		case <-time.After(time.Duration(*gcIntervalSecs) * time.Second):
+		}
+
+		g.applyLogs()
+
+		if time.Since(lastCollect) >= time.Duration(*gcIntervalSecs)*time.Second {
+			g.collect()
+			lastCollect = time.Now()
+		}
+	}
+}
+
+// applyLogs applies all log records to BlockRefs
+func (g *BlockGC) applyLogs() {
+	g.applyMu.Lock()
+	defer g.applyMu.Unlock()
+
+	names, err := readDirNames(g.dir)
+	if err != nil {
+		glog.Errorln("failed to read gc dir", g.dir, err)
+		return
+	}
+
+	for _, name := range names {
+		if strings.HasSuffix(name, journalTmpSuffix) {
+			// the record is being written
+			continue
+		}
+
+		status, errmsg := g.applyLog(name)
+		if status != StatusOK {
+			// retry at the next run
+			glog.Errorln("failed to apply block refs log", name, status, errmsg)
+		}
+	}
+}
+
+func (g *BlockGC) applyLog(name string) (status int, errmsg string) {
+	fname := g.dir + name
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		glog.Errorln("failed to read block refs log", fname, err)
+		return InternalError, "failed to read block refs log"
+	}
+
+	rec := &BlockRefsRecord{}
+	err = proto.Unmarshal(b, rec)
+	if err != nil {
+		// should not happen as the record is renamed after fsync, keep the
+		// file for the manual check.
+		glog.Errorln("SanityError - failed to Unmarshal block refs log", fname, err)
+		return InternalError, "failed to Unmarshal block refs log"
+	}
+
+	for _, md5str := range rec.Blocks {
+		status, errmsg = g.updateBlockRefs(md5str, rec.Ref, rec.Positive)
+		if status != StatusOK {
+			glog.Errorln("failed to update BlockRefs", rec.RequestId, md5str, rec.Ref, rec.Positive, status, errmsg)
+			return status, errmsg
+		}
+	}
+
+	err = removeFileSync(g.dir, name)
+	if err != nil {
+		glog.Errorln("failed to remove block refs log", fname, err)
+		return InternalError, "failed to remove block refs log"
+	}
+
+	glog.V(1).Infoln("applied block refs", rec.RequestId, rec.Ref, rec.Positive, "blocks", len(rec.Blocks))
+	return StatusOK, StatusOKStr
+}
+
+// updateBlockRefs adds the ref to the BlockRefs of the block. If the
+// opposite ref exists, both are removed. Adding the same ref again is a no-op.
+func (g *BlockGC) updateBlockRefs(md5str string, ref string, positive bool) (status int, errmsg string) {
+	refs, status, errmsg := g.readBlockRefs(md5str)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	add := &refs.Pref
+	cancel := &refs.Nref
+	if !positive {
+		add, cancel = cancel, add
+	}
+
+	if removeRef(cancel, ref) {
+		glog.V(5).Infoln("cancelled block ref", md5str, ref, positive)
+	} else if !hasRef(*add, ref) {
+		*add = append(*add, ref)
+	} else {
+		glog.V(5).Infoln("block ref exists", md5str, ref, positive)
+		return StatusOK, StatusOKStr
+	}
+
+	b, err := proto.Marshal(refs)
+	if err != nil {
+		glog.Errorln("failed to Marshal BlockRefs", md5str, ref, err)
+		return InternalError, "failed to Marshal BlockRefs"
+	}
+
+	return g.s3io.WriteBlockRefs(md5str, b)
+}
+
+func (g *BlockGC) readBlockRefs(md5str string) (refs *BlockRefs, status int, errmsg string) {
+	b, status, errmsg := g.s3io.ReadBlockRefs(md5str)
+	if status == NoSuchKey {
+		return &BlockRefs{}, StatusOK, StatusOKStr
+	}
+	if status != StatusOK {
+		glog.Errorln("failed to read BlockRefs", md5str, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	refs = &BlockRefs{}
+	err := proto.Unmarshal(b, refs)
+	if err != nil {
+		glog.Errorln("failed to Unmarshal BlockRefs", md5str, err)
+		return nil, InternalError, "failed to Unmarshal BlockRefs"
+	}
+	return refs, StatusOK, StatusOKStr
+}
+
+func hasRef(refs []string, ref string) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+func removeRef(refs *[]string, ref string) bool {
+	for i, r := range *refs {
+		if r == ref {
+			*refs = append((*refs)[:i], (*refs)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// collect scans all data blocks and deletes the blocks that are not
+// referenced for the grace period.
+func (g *BlockGC) collect() {
+	g.applyMu.Lock()
+	defer g.applyMu.Unlock()
+
+	grace := int64(*gcGraceSecs)
+	marker := ""
+	total := 0
+	deleted := 0
+
+	// the candidates that are still not referenced in this scan
+	candidates := make(map[string]int64)
+
+	for {
+		md5strs, isTruncated, status, errmsg := g.s3io.ListDataBlocks(marker, gcListMaxKeys)
+		if status != StatusOK {
+			glog.Errorln("failed to list data blocks", marker, status, errmsg)
+			return
+		}
+
+		for _, md5str := range md5strs {
+			total++
+			marker = md5str
+
+			refs, status, errmsg := g.readBlockRefs(md5str)
+			if status != StatusOK {
+				glog.Errorln("failed to read BlockRefs, skip the block", md5str, status, errmsg)
+				continue
+			}
+			if len(refs.Pref) != 0 {
+				continue
+			}
+
+			now := time.Now().Unix()
+			g.mu.Lock()
+			since, ok := g.candidates[md5str]
+			if !ok {
+				since = now
+			}
+			candidates[md5str] = since
+
+			if now-since < grace || now-g.inuse[md5str] < grace {
+				g.mu.Unlock()
+				continue
+			}
+
+			// mark the block as deleting, the put that wants to use the block
+			// waits in UseBlock, and then writes the block again.
+			ch := make(chan struct{})
+			g.deleting[md5str] = ch
+			g.mu.Unlock()
+
+			status, errmsg = g.deleteBlock(md5str)
+
+			g.mu.Lock()
+			delete(g.deleting, md5str)
+			g.mu.Unlock()
+			close(ch)
+
+			if status == StatusOK {
+				delete(candidates, md5str)
+				deleted++
+			}
+		}
+
+		if !isTruncated {
+			break
+		}
+	}
+
+	// remove the expired inuse blocks
+	now := time.Now().Unix()
+	g.mu.Lock()
+	g.candidates = candidates
+	for md5str, t := range g.inuse {
+		if now-t >= grace {
+			delete(g.inuse, md5str)
+		}
+	}
+	g.mu.Unlock()
+
+	glog.Infoln("gc collected data blocks", deleted, "total", total, "candidates", len(candidates))
+}
+
+// deleteBlock deletes the BlockRefs and then the block. If crash in the
+// middle, the block is left without BlockRefs, and will be collected again.
+func (g *BlockGC) deleteBlock(md5str string) (status int, errmsg string) {
+	status, errmsg = g.s3io.DeleteBlockRefs(md5str)
+	if status != StatusOK && status != NoSuchKey {
+		glog.Errorln("failed to delete BlockRefs", md5str, status, errmsg)
+		return status, errmsg
+	}
+
+	status, errmsg = g.s3io.DeleteDataBlock(md5str)
+	if status != StatusOK && status != NoSuchKey {
+		glog.Errorln("failed to delete data block", md5str, status, errmsg)
+		return status, errmsg
+	}
+
+	glog.V(1).Infoln("collected data block", md5str)
+	return StatusOK, StatusOKStr
+}
+
+// Collect applies the refs log and collects the data blocks once. It could
+// be used to trigger gc manually.
+func (g *BlockGC) Collect() {
+	g.applyLogs()
+	g.collect()
+}
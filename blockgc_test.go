@@ -0,0 +1,143 @@
+package test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testBlockingIO blocks DeleteDataBlock until release is closed
+type testBlockingIO struct {
+	CloudIO
+
+	// the block being deleted is sent to deleting
+	deleting chan string
+	release  chan bool
+}
+
+func (c *testBlockingIO) DeleteDataBlock(md5str string) (status int, errmsg string) {
+	c.deleting <- md5str
+	<-c.release
+	return c.CloudIO.DeleteDataBlock(md5str)
+}
+
+// testBackdateBlocks moves the gc candidates and the inuse blocks back by secs
+func testBackdateBlocks(g *BlockGC, candidates bool, inuse bool, secs int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if candidates {
+		for md5str := range g.candidates {
+			g.candidates[md5str] -= secs
+		}
+	}
+	if inuse {
+		for md5str := range g.inuse {
+			g.inuse[md5str] -= secs
+		}
+	}
+}
+
+func TestBlockGCGracePeriod(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	// the first block is shared with the dup object
+	data := testObjectData(DataBlockSize + 100)
+	testS3OK(t, s, "PUT", "/bk/obj", nil, data)
+	testS3OK(t, s, "PUT", "/bk/dup", nil, data[:DataBlockSize])
+	blocks := testObjectBlocks(t, s, testReadObjectMD(t, s, "bk", "/obj"))
+	if len(blocks) != 2 {
+		t.Fatal("blocks", blocks)
+	}
+
+	testS3OK(t, s, "DELETE", "/bk/obj", nil, nil)
+	s.journal.ApplyBucket("bk")
+
+	// the not referenced block becomes the candidate, and is kept in the
+	// grace period
+	s.gc.Collect()
+	if !s.s3io.IsDataBlockExist(blocks[1]) {
+		t.Fatal("the block is deleted in the grace period")
+	}
+	if _, ok := s.gc.candidates[blocks[1]]; !ok || len(s.gc.candidates) != 1 {
+		t.Fatal("gc candidates", s.gc.candidates)
+	}
+
+	// the block used by the put in the grace period is kept
+	grace := int64(*gcGraceSecs)
+	testBackdateBlocks(s.gc, true, false, grace)
+	s.gc.Collect()
+	if !s.s3io.IsDataBlockExist(blocks[1]) {
+		t.Fatal("the block used in the grace period is deleted")
+	}
+
+	testBackdateBlocks(s.gc, false, true, grace)
+	s.gc.Collect()
+	if s.s3io.IsDataBlockExist(blocks[1]) {
+		t.Fatal("the block is not deleted after the grace period")
+	}
+	if _, status, _ := s.s3io.ReadBlockRefs(blocks[1]); status != NoSuchKey {
+		t.Fatal("the BlockRefs of the deleted block is left", status)
+	}
+	if len(s.gc.candidates) != 0 || len(s.gc.inuse) != 0 {
+		t.Fatal("gc candidates", s.gc.candidates, "inuse", s.gc.inuse)
+	}
+
+	// the referenced block is never deleted
+	if !s.s3io.IsDataBlockExist(blocks[0]) {
+		t.Fatal("the referenced block is deleted")
+	}
+	w := testS3OK(t, s, "GET", "/bk/dup", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), data[:DataBlockSize]) {
+		t.Fatal("dup object data mismatch", w.Body.Len())
+	}
+}
+
+func TestBlockGCDeletingHandoff(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	data := testObjectData(1000)
+	testS3OK(t, s, "PUT", "/bk/obj", nil, data)
+	blocks := testObjectBlocks(t, s, testReadObjectMD(t, s, "bk", "/obj"))
+	testS3OK(t, s, "DELETE", "/bk/obj", nil, nil)
+	s.journal.ApplyBucket("bk")
+	s.gc.Collect()
+	testBackdateBlocks(s.gc, true, true, int64(*gcGraceSecs))
+
+	// gc blocks in the middle of deleting the block
+	bio := &testBlockingIO{CloudIO: s.s3io, deleting: make(chan string), release: make(chan bool)}
+	s.gc.s3io = bio
+	collected := make(chan bool)
+	go func() {
+		s.gc.collect()
+		close(collected)
+	}()
+	if md5str := <-bio.deleting; md5str != blocks[0] {
+		t.Fatal("deleting block", md5str, blocks[0])
+	}
+
+	// the put of the same data waits for the deletion, and writes the block again
+	put := make(chan int)
+	go func() {
+		put <- testS3Request(s, "PUT", "/bk/obj2", nil, data).Code
+	}()
+	select {
+	case code := <-put:
+		t.Fatal("the put does not wait for the deleting block", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(bio.release)
+	<-collected
+	if code := <-put; code != 200 {
+		t.Fatal("put the deleting block", code)
+	}
+	if !s.s3io.IsDataBlockExist(blocks[0]) {
+		t.Fatal("the block is not written again")
+	}
+	w := testS3OK(t, s, "GET", "/bk/obj2", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatal("object data mismatch", w.Body.Len())
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"flag"
+	"sync"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+var bucketMDCacheSecs = flag.Int("bucketmdcachesecs", 10, "the seconds to cache the bucket metadata")
+
+// BucketMDCache caches the BucketMD of the buckets. The BucketMD is read at
+// every object put and delete, the cache saves the reads from CloudIO. The
+// update from the other gateway is visible after the cache entry expires.
+//
+// The cached BucketMD is shared, the caller should not change it. To update
+// the BucketMD, clone it, change the clone and Put it.
+type BucketMDCache struct {
+	s3io CloudIO
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*bucketMDEntry
+}
+
+type bucketMDEntry struct {
+	md     *BucketMD
+	expire time.Time
+}
+
+// NewBucketMDCache creates the BucketMDCache instance
+func NewBucketMDCache(s3io CloudIO, ttl time.Duration) *BucketMDCache {
+	c := new(BucketMDCache)
+	c.s3io = s3io
+	c.ttl = ttl
+	c.entries = make(map[string]*bucketMDEntry)
+	return c
+}
+
+// Get returns the BucketMD of the bucket. An empty BucketMD is returned if
+// the bucket does not have any configuration.
+func (c *BucketMDCache) Get(ctx context.Context, bkname string) (md *BucketMD, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	c.mu.Lock()
+	entry, ok := c.entries[bkname]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expire) {
+		return entry.md, StatusOK, StatusOKStr
+	}
+
+	md = &BucketMD{}
+	b, status, errmsg := c.s3io.ReadBucketMD(bkname)
+	if status == StatusOK {
+		err := proto.Unmarshal(b, md)
+		if err != nil {
+			glog.Errorln("failed to unmarshal BucketMD", requuid, bkname, err)
+			return nil, InternalError, "failed to unmarshal BucketMD"
+		}
+	} else if status != NoSuchKey {
+		glog.Errorln("failed to read BucketMD", requuid, bkname, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	c.add(bkname, md)
+	return md, StatusOK, StatusOKStr
+}
+
+// Put writes the BucketMD of the bucket
+func (c *BucketMDCache) Put(ctx context.Context, bkname string, md *BucketMD) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, err := proto.Marshal(md)
+	if err != nil {
+		glog.Errorln("failed to marshal BucketMD", requuid, bkname, err)
+		return InternalError, "failed to marshal BucketMD"
+	}
+
+	status, errmsg = c.s3io.WriteBucketMD(bkname, b)
+	if status != StatusOK {
+		glog.Errorln("failed to write BucketMD", requuid, bkname, status, errmsg)
+		c.Remove(bkname)
+		return status, errmsg
+	}
+
+	c.add(bkname, md)
+	glog.V(1).Infoln("put BucketMD", requuid, bkname, md)
+	return StatusOK, StatusOKStr
+}
+
+// Remove removes the cached BucketMD, such as the bucket is deleted
+func (c *BucketMDCache) Remove(bkname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, bkname)
+}
+
+func (c *BucketMDCache) add(bkname string, md *BucketMD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[bkname] = &bucketMDEntry{md: md, expire: time.Now().Add(c.ttl)}
+}
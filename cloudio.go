@@ -1,24 +1,66 @@
 package test
 
-import "io"
-
 // CloudIO defines the ioengine interfaces
 type CloudIO interface {
-	PutBucket(bkname string) (status int, errmsg string)
+	// PutBucket creates the bucket with its BucketMD. BucketAlreadyExists is
+	// returned if the bucket exists, and the BucketMD is not changed.
+	PutBucket(bkname string, mdbuf []byte) (status int, errmsg string)
+	// DeleteBucket deletes the bucket and its BucketMD. BucketNotEmpty is
+	// returned if the bucket has any object or object version.
 	DeleteBucket(bkname string) (status int, errmsg string)
-	GetBucket(bkname string) (body io.Reader, status int, errmsg string)
+	// ListObjects lists the system metadata of the objects, whose names start with
+	// prefix and are greater than marker, in the sorted name order. At most maxKeys
+	// objects are returned, isTruncated tells whether there are more objects.
+	ListObjects(bkname string, prefix string, marker string,
+		maxKeys int) (smds []*ObjectSMD, isTruncated bool, status int, errmsg string)
 	HeadBucket(bkname string) (status int, errmsg string)
+	// IsReservedBucket tells whether the bucket name is used by the ioengine
+	// itself, such bucket could not be accessed as the user bucket.
+	IsReservedBucket(bkname string) bool
+	// list the names of all buckets in the sorted order
+	ListBuckets() (bknames []string, status int, errmsg string)
+	// the BucketMD of the bucket, NoSuchKey if it is never written
+	WriteBucketMD(bkname string, b []byte) (status int, errmsg string)
+	ReadBucketMD(bkname string) (b []byte, status int, errmsg string)
 
 	IsDataBlockExist(md5str string) bool
 	WriteDataBlock(buf []byte, md5str string) (status int, errmsg string)
 	ReadDataBlockRange(md5str string, off int64, b []byte) (n int, status int, errmsg string)
+	DeleteDataBlock(md5str string) (status int, errmsg string)
+	// list the data blocks after marker in the sorted order, at most maxKeys blocks
+	ListDataBlocks(marker string, maxKeys int) (md5strs []string, isTruncated bool, status int, errmsg string)
+
+	// the BlockRefs of the data block
+	WriteBlockRefs(md5str string, b []byte) (status int, errmsg string)
+	ReadBlockRefs(md5str string) (b []byte, status int, errmsg string)
+	DeleteBlockRefs(md5str string) (status int, errmsg string)
 
 	// to reduce the bucket list latency, WriteObjectMD should store the default
 	// list metadata as the usermd of S3 object. So bucket list doesn't need to
 	// fetch the content of every object.
 	WriteObjectMD(bkname string, objname string, mdbuf []byte) (status int, errmsg string)
 	ReadObjectMD(bkname string, objname string) (b []byte, status int, errmsg string)
+	DeleteObjectMD(bkname string, objname string) (status int, errmsg string)
+
+	// the ObjectMD versions of the versioned bucket
+	WriteObjectVersion(bkname string, objname string, versionID string, mdbuf []byte) (status int, errmsg string)
+	ReadObjectVersion(bkname string, objname string, versionID string) (b []byte, status int, errmsg string)
+	DeleteObjectVersion(bkname string, objname string, versionID string) (status int, errmsg string)
+	// list the names of the objects that have versions, whose names start with
+	// prefix and are greater than marker, in the sorted name order.
+	ListVersionedObjects(bkname string, prefix string, marker string,
+		maxKeys int) (objnames []string, isTruncated bool, status int, errmsg string)
+	ListObjectVersionIDs(bkname string, objname string) (versionIDs []string, status int, errmsg string)
 
 	WriteDataPart(bkname string, partName string, b []byte) (status int, errmsg string)
 	ReadDataPart(bkname string, partName string) (b []byte, status int, errmsg string)
+	DeleteDataPart(bkname string, partName string) (status int, errmsg string)
+	// list the names of the data parts that start with prefix
+	ListDataParts(bkname string, prefix string) (partNames []string, status int, errmsg string)
+
+	// the metadata of the ongoing multipart uploads
+	WriteUploadMD(bkname string, uploadID string, mdbuf []byte) (status int, errmsg string)
+	ReadUploadMD(bkname string, uploadID string) (b []byte, status int, errmsg string)
+	DeleteUploadMD(bkname string, uploadID string) (status int, errmsg string)
+	ListUploads(bkname string) (uploadIDs []string, status int, errmsg string)
 }
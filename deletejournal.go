@@ -0,0 +1,446 @@
+package test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+var journalDir = flag.String("journaldir", "/tmp/clouddd/journal/", "the local dir of the delete journal")
+
+// the suffix of the journal record that is not fully written yet
+const journalTmpSuffix = ".tmp"
+
+// DeleteJournal logs the object deletes to the local file system (protected
+// by EBS or the underline storage of VMWare), and the background scanner
+// applies them.
+//
+// Every journal record is written to a temp file, fsync'd and renamed to the
+// request id with the sequence number, then the dir is fsync'd. So a record is either complete or left
+// as the temp file, which is discarded at replay. Applying a record is
+// idempotent and the record is removed after all its entries are applied. If
+// the process crashes in the middle, the record is applied again at restart.
+//
+// Before a record is applied, the deleted objects are kept in the pending
+// list, so get, head and list do not return them.
+type DeleteJournal struct {
+	dir  string
+	s3io CloudIO
+	gc   *BlockGC
+
+	// serialize the record applies of the scanner and ApplyBucket
+	applyMu sync.Mutex
+
+	mu sync.Mutex
+	// the sequence number of the record name
+	seq uint64
+	// the records that are not applied yet, key is record name
+	records map[string]*DeleteJournalRecord
+	// the pending deletes, key is bucket + object name
+	pending map[string][]*DeleteEntry
+
+	// notify the scanner there are new records
+	notifyChan chan bool
+}
+
+// NewDeleteJournal creates the DeleteJournal instance and loads the existing records
+func NewDeleteJournal(dir string, s3io CloudIO, gc *BlockGC) *DeleteJournal {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	err := os.MkdirAll(dir, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create journal dir", dir, err)
+		return nil
+	}
+
+	j := new(DeleteJournal)
+	j.dir = dir
+	j.s3io = s3io
+	j.gc = gc
+	j.records = make(map[string]*DeleteJournalRecord)
+	j.pending = make(map[string][]*DeleteEntry)
+	j.notifyChan = make(chan bool, 1)
+
+	err = j.load()
+	if err != nil {
+		return nil
+	}
+	return j
+}
+
+// load the records left by the last run
+func (j *DeleteJournal) load() error {
+	names, err := readDirNames(j.dir)
+	if err != nil {
+		glog.Errorln("failed to read journal dir", j.dir, err)
+		return err
+	}
+
+	for _, name := range names {
+		fname := j.dir + name
+
+		if strings.HasSuffix(name, journalTmpSuffix) {
+			// the record was not fully written, the delete was not returned
+			// to the client as success.
+			glog.Infoln("remove the incomplete journal record", fname)
+			err = os.Remove(fname)
+			if err != nil {
+				glog.Errorln("failed to remove the incomplete journal record", fname, err)
+				return err
+			}
+			continue
+		}
+
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			glog.Errorln("failed to read journal record", fname, err)
+			return err
+		}
+
+		rec := &DeleteJournalRecord{}
+		err = proto.Unmarshal(b, rec)
+		if err != nil {
+			// should not happen as the record is renamed after fsync, keep the
+			// file for the manual check.
+			glog.Errorln("SanityError - failed to Unmarshal journal record, skip it", fname, err)
+			continue
+		}
+		rec.Name = name
+
+		j.addRecord(rec)
+	}
+
+	glog.Infoln("loaded delete journal", j.dir, "records", len(j.records))
+	return nil
+}
+
+func (j *DeleteJournal) addRecord(rec *DeleteJournalRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.records[rec.Name] = rec
+	for _, entry := range rec.Entries {
+		if entry.Overwrite {
+			continue
+		}
+		key := entry.Bucket + entry.Name
+		j.pending[key] = append(j.pending[key], entry)
+	}
+}
+
+func (j *DeleteJournal) removeRecord(rec *DeleteJournalRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.records, rec.Name)
+	for _, entry := range rec.Entries {
+		if entry.Overwrite {
+			continue
+		}
+		key := entry.Bucket + entry.Name
+		entries := j.pending[key]
+		for i, e := range entries {
+			if e == entry {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+		if len(entries) == 0 {
+			delete(j.pending, key)
+		} else {
+			j.pending[key] = entries
+		}
+	}
+}
+
+// Log durably writes the deletes as one journal record. The deletes take
+// effect once Log returns success.
+func (j *DeleteJournal) Log(ctx context.Context, entries []*DeleteEntry) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	rec := &DeleteJournalRecord{}
+	rec.RequestId = requuid
+	rec.Mtime = time.Now().Unix()
+	rec.Entries = entries
+	rec.Name = requuid + "." + strconv.FormatUint(atomic.AddUint64(&j.seq, 1), 10)
+
+	b, err := proto.Marshal(rec)
+	if err != nil {
+		glog.Errorln("failed to Marshal journal record", requuid, len(entries), err)
+		return InternalError, "failed to Marshal journal record"
+	}
+
+	err = writeFileSync(j.dir, rec.Name, b)
+	if err != nil {
+		glog.Errorln("failed to write journal record", rec.Name, len(entries), err)
+		return InternalError, "failed to write journal record"
+	}
+
+	j.addRecord(rec)
+
+	// notify the scanner
+	select {
+	case j.notifyChan <- true:
+	default:
+	}
+
+	glog.V(1).Infoln("logged deletes", rec.Name, "entries", len(entries))
+	return StatusOK, StatusOKStr
+}
+
+// IsDeleted checks whether the object version is deleted but not applied yet
+func (j *DeleteJournal) IsDeleted(md *ObjectMD) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, entry := range j.pending[md.Smd.Bucket+md.Smd.Name] {
+		if entry.Md.Uuid == md.Uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// IsListDeleted checks whether the listed object is deleted but not applied yet.
+// The list result does not have uuid, the etag and mtime are compared.
+func (j *DeleteJournal) IsListDeleted(smd *ObjectSMD) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, entry := range j.pending[smd.Bucket+smd.Name] {
+		if entry.Md.Smd.Etag == smd.Etag && entry.Md.Smd.Mtime == smd.Mtime {
+			return true
+		}
+	}
+	return false
+}
+
+// Start starts the background scanner
+func (j *DeleteJournal) Start() {
+	go j.scan()
+}
+
+func (j *DeleteJournal) scan() {
+	for {
+		select {
+		case <-j.notifyChan:
+		case <-time.After(DeleteScanIntervalSecs * time.Second):
+		}
+
+		j.applyRecords("")
+	}
+}
+
+// ApplyBucket synchronously applies the pending deletes of the bucket, so the
+// bucket could be deleted right after all its objects are deleted.
+func (j *DeleteJournal) ApplyBucket(bkname string) {
+	j.applyRecords(bkname)
+}
+
+// apply the records that have entries in the bucket, or all records if bkname is ""
+func (j *DeleteJournal) applyRecords(bkname string) {
+	j.applyMu.Lock()
+	defer j.applyMu.Unlock()
+
+	j.mu.Lock()
+	recs := make([]*DeleteJournalRecord, 0, len(j.records))
+	for _, rec := range j.records {
+		for _, entry := range rec.Entries {
+			if bkname == "" || entry.Bucket == bkname {
+				recs = append(recs, rec)
+				break
+			}
+		}
+	}
+	j.mu.Unlock()
+
+	for _, rec := range recs {
+		j.applyRecord(rec)
+	}
+}
+
+func (j *DeleteJournal) applyRecord(rec *DeleteJournalRecord) {
+	ctx := util.NewRequestContext(context.Background(), rec.RequestId)
+
+	for _, entry := range rec.Entries {
+		status, errmsg := j.applyEntry(ctx, entry)
+		if status != StatusOK {
+			// retry at the next scan
+			glog.Errorln("failed to apply delete", rec.RequestId, entry.Bucket, entry.Name, status, errmsg)
+			return
+		}
+	}
+
+	// all entries are applied, remove the record
+	err := removeFileSync(j.dir, rec.Name)
+	if err != nil {
+		glog.Errorln("failed to remove journal record", rec.Name, err)
+		return
+	}
+
+	j.removeRecord(rec)
+
+	glog.V(1).Infoln("applied deletes", rec.Name, "entries", len(rec.Entries))
+}
+
+// remove the ObjectMD and its data parts, and log the nref for the data blocks.
+// The data blocks are collected by gc.
+func (j *DeleteJournal) applyEntry(ctx context.Context, entry *DeleteEntry) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	md := entry.Md
+
+	// the locked version is checked before the delete is logged. never remove
+	// it and its blocks here, such as the record logged before the lock check,
+	// the version is visible again after the record is removed.
+	status, errmsg = checkObjectLock(md, time.Now(), entry.BypassGovernance)
+	if status != StatusOK {
+		glog.Errorln("SanityError - skip the delete of the locked version", requuid, entry.Bucket, entry.Name,
+			md.Uuid, errmsg)
+		return StatusOK, StatusOKStr
+	}
+
+	status, errmsg = j.removeObjectMD(ctx, entry)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	// dereference the data blocks. If the data parts are already removed, the
+	// nref was logged before removing them.
+	blocks, status, errmsg := getObjectBlocks(ctx, j.s3io, md)
+	if status == StatusOK {
+		status, errmsg = j.gc.LogRefs(ctx, util.GenBlockRef(entry.Bucket, entry.Name, md.Uuid), false, blocks)
+		if status != StatusOK {
+			return status, errmsg
+		}
+	} else if status != NoSuchKey {
+		return status, errmsg
+	}
+
+	// remove the data parts, the first and last parts are embedded in ObjectMD
+	totalParts := len(md.Data.DataParts)
+	for i := 1; i < totalParts-1; i++ {
+		status, errmsg = j.s3io.DeleteDataPart(entry.Bucket, md.Data.DataParts[i].Name)
+		if status != StatusOK && status != NoSuchKey {
+			return status, errmsg
+		}
+	}
+
+	glog.V(2).Infoln("removed object", requuid, entry.Bucket, entry.Name, md.Uuid, "parts", totalParts)
+	return StatusOK, StatusOKStr
+}
+
+// removeObjectMD removes the ObjectMD and the object version of the entry if
+// they are not overwritten. The uuid check and the delete are serialized with
+// the puts by the commit lock of the object.
+func (j *DeleteJournal) removeObjectMD(ctx context.Context, entry *DeleteEntry) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	md := entry.Md
+
+	lock := commitLock(entry.Bucket, entry.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// remove the ObjectMD if it is not overwritten. The ObjectMD is gone if
+	// the bucket is deleted.
+	cur, status, errmsg := readObjectMD(ctx, j.s3io, entry.Bucket, entry.Name)
+	if status == StatusOK {
+		if cur.Uuid == md.Uuid {
+			status, errmsg = j.s3io.DeleteObjectMD(entry.Bucket, entry.Name)
+			if status != StatusOK && status != NoSuchKey {
+				return status, errmsg
+			}
+		} else {
+			glog.V(1).Infoln("object is overwritten, not delete ObjectMD", requuid,
+				entry.Bucket, entry.Name, md.Uuid, cur.Uuid)
+		}
+	} else if status != NoSuchKey && status != NoSuchBucket {
+		return status, errmsg
+	}
+
+	// remove the object version if it is not overwritten, such as the null
+	// version is replaced.
+	if entry.Version {
+		versionID := objectVersionID(md)
+		v, status, errmsg := readObjectVersion(ctx, j.s3io, entry.Bucket, entry.Name, versionID)
+		if status == StatusOK {
+			if v.Uuid == md.Uuid {
+				status, errmsg = j.s3io.DeleteObjectVersion(entry.Bucket, entry.Name, versionID)
+				if status != StatusOK && status != NoSuchKey {
+					return status, errmsg
+				}
+			}
+		} else if status != NoSuchKey {
+			return status, errmsg
+		}
+	}
+	return StatusOK, StatusOKStr
+}
+
+func readDirNames(dir string) (names []string, err error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return fd.Readdirnames(-1)
+}
+
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+// writeFileSync durably writes the file. The data is written to the temp
+// file, fsync'd and renamed, then the dir is fsync'd.
+func writeFileSync(dir string, name string, b []byte) error {
+	tmpname := dir + name + journalTmpSuffix
+	fd, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, DefaultFileMode)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(b)
+	if err == nil {
+		err = fd.Sync()
+	}
+	cerr := fd.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	err = os.Rename(tmpname, dir+name)
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// removeFileSync removes the file and fsyncs the dir
+func removeFileSync(dir string, name string) error {
+	err := os.Remove(dir + name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(dir)
+}
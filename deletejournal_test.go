@@ -0,0 +1,136 @@
+package test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"test/util"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func testObjectBlocks(t *testing.T, s *S3Server, md *ObjectMD) []string {
+	blocks, status, errmsg := getObjectBlocks(context.Background(), s.s3io, md)
+	if status != StatusOK {
+		t.Fatal("getObjectBlocks", status, errmsg)
+	}
+	return blocks
+}
+
+// testHasBlockRef checks whether all blocks have the pref of the object,
+// after the refs log is applied.
+func testHasBlockRef(t *testing.T, s *S3Server, md *ObjectMD, blocks []string) bool {
+	s.gc.applyLogs()
+
+	ref := util.GenBlockRef(md.Smd.Bucket, md.Smd.Name, md.Uuid)
+	for _, md5str := range blocks {
+		refs, status, errmsg := s.gc.readBlockRefs(md5str)
+		if status != StatusOK {
+			t.Fatal("readBlockRefs", md5str, status, errmsg)
+		}
+		found := false
+		for _, pref := range refs.Pref {
+			found = found || pref == ref
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func testReadObjectMD(t *testing.T, s *S3Server, bkname string, objname string) *ObjectMD {
+	md, status, errmsg := readObjectMD(context.Background(), s.s3io, bkname, objname)
+	if status != StatusOK {
+		t.Fatal("readObjectMD", bkname, objname, status, errmsg)
+	}
+	return md
+}
+
+func TestDeleteJournalReplay(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	// 3 DataParts, the middle part is the data part object
+	data := testObjectData(2*MaxDataBlocks*DataBlockSize + 1000)
+	testS3OK(t, s, "PUT", "/bk/obj", nil, data)
+	md := testReadObjectMD(t, s, "bk", "/obj")
+	blocks := testObjectBlocks(t, s, md)
+	if len(md.Data.DataParts) != 3 || !testHasBlockRef(t, s, md, blocks) {
+		t.Fatal("object parts", len(md.Data.DataParts))
+	}
+
+	// the deleted object is hidden before the delete is applied
+	testS3OK(t, s, "DELETE", "/bk/obj", nil, nil)
+	if code := testS3ErrorCode(testS3Request(s, "GET", "/bk/obj", nil, nil)); code != "NoSuchKey" {
+		t.Fatal("get the deleted object", code)
+	}
+	if _, status, _ := s.s3io.ReadObjectMD("bk", "/obj"); status != StatusOK {
+		t.Fatal("the ObjectMD is removed before the delete is applied", status)
+	}
+
+	dir := s.journal.dir
+	names, err := readDirNames(dir)
+	if err != nil || len(names) != 1 {
+		t.Fatal("journal records", names, err)
+	}
+	recName := names[0]
+	rec, err := ioutil.ReadFile(dir + recName)
+	if err != nil {
+		t.Fatal("read journal record", err)
+	}
+
+	// restart, the incomplete record is discarded
+	err = ioutil.WriteFile(dir+"incomplete"+journalTmpSuffix, []byte("partial"), DefaultFileMode)
+	if err != nil {
+		t.Fatal("write the incomplete record", err)
+	}
+	s.journal = NewDeleteJournal(dir, s.s3io, s.gc)
+	if s.journal == nil {
+		t.Fatal("failed to replay the journal")
+	}
+	if !s.journal.IsDeleted(md) {
+		t.Fatal("the replayed delete is not pending")
+	}
+	if names, _ = readDirNames(dir); len(names) != 1 {
+		t.Fatal("the incomplete record is not removed", names)
+	}
+
+	s.journal.ApplyBucket("bk")
+	if _, status, _ := s.s3io.ReadObjectMD("bk", "/obj"); status != NoSuchKey {
+		t.Fatal("the ObjectMD is not removed", status)
+	}
+	if parts, _, _ := s.s3io.ListDataParts("bk", ""); len(parts) != 0 {
+		t.Fatal("the data parts are not removed", parts)
+	}
+	if testHasBlockRef(t, s, md, blocks) {
+		t.Fatal("the blocks are still referenced by the deleted object")
+	}
+	if names, _ = readDirNames(dir); len(names) != 0 || s.journal.IsDeleted(md) {
+		t.Fatal("the applied record is not removed", names)
+	}
+
+	// the object is put again, and the applied record is replayed again, as
+	// the crash before the record is removed.
+	testS3OK(t, s, "PUT", "/bk/obj", nil, data)
+	md2 := testReadObjectMD(t, s, "bk", "/obj")
+	if err = writeFileSync(dir, recName, rec); err != nil {
+		t.Fatal("restore the journal record", err)
+	}
+	s.journal = NewDeleteJournal(dir, s.s3io, s.gc)
+	if s.journal == nil {
+		t.Fatal("failed to replay the journal")
+	}
+	s.journal.ApplyBucket("bk")
+	if names, _ = readDirNames(dir); len(names) != 0 {
+		t.Fatal("the replayed record is not removed", names)
+	}
+
+	w := testS3OK(t, s, "GET", "/bk/obj", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatal("the new object is changed by the replayed delete", w.Body.Len())
+	}
+	if !testHasBlockRef(t, s, md2, testObjectBlocks(t, s, md2)) {
+		t.Fatal("the blocks of the new object are not referenced")
+	}
+}
@@ -1,12 +1,14 @@
 package test
 
 import (
-	"encoding/xml"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/golang/glog"
 )
@@ -17,6 +19,19 @@ type FileIO struct {
 	rootBucketDir string
 	rootDataDir   string
 	rootPartDir   string
+	rootUploadDir string
+	rootRefDir    string
+	// the BucketMD files and the ObjectMD versions
+	rootBucketMDDir string
+	rootVersionDir  string
+
+	// the sorted object names of the listed buckets, for the list
+	// continuation not to read and sort the whole bucket dir for every
+	// page. The names are dropped when the ObjectMD is written, the
+	// generation of the bucket tells whether the names read are stale.
+	listMu    sync.Mutex
+	listNames map[string][]string
+	listGen   map[string]uint64
 }
 
 // Misc const definition for FileIO
@@ -28,11 +43,22 @@ const (
 
 // NewFileIO creates the FileIO instance
 func NewFileIO() *FileIO {
+	return newFileIO("/tmp/clouddd/")
+}
+
+// newFileIO creates the FileIO instance under rootDir, rootDir ends with "/"
+func newFileIO(rootDir string) *FileIO {
 	f := new(FileIO)
-	f.rootDir = "/tmp/clouddd/"
+	f.rootDir = rootDir
 	f.rootBucketDir = f.rootDir + "bucket/"
 	f.rootDataDir = f.rootDir + "data/"
 	f.rootPartDir = f.rootDir + "part/"
+	f.rootUploadDir = f.rootDir + "upload/"
+	f.rootRefDir = f.rootDir + "refs/"
+	f.rootBucketMDDir = f.rootDir + "bucketmd/"
+	f.rootVersionDir = f.rootDir + "version/"
+	f.listNames = make(map[string][]string)
+	f.listGen = make(map[string]uint64)
 
 	err := os.MkdirAll(f.rootBucketDir, DefaultDirMode)
 	if err != nil && !os.IsExist(err) {
@@ -52,11 +78,35 @@ func NewFileIO() *FileIO {
 		return nil
 	}
 
+	err = os.MkdirAll(f.rootUploadDir, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create", f.rootUploadDir, err)
+		return nil
+	}
+
+	err = os.MkdirAll(f.rootRefDir, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create", f.rootRefDir, err)
+		return nil
+	}
+
+	err = os.MkdirAll(f.rootBucketMDDir, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create", f.rootBucketMDDir, err)
+		return nil
+	}
+
+	err = os.MkdirAll(f.rootVersionDir, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create", f.rootVersionDir, err)
+		return nil
+	}
+
 	return f
 }
 
-// PutBucket creates the target bucket
-func (f *FileIO) PutBucket(bkname string) (status int, errmsg string) {
+// PutBucket creates the target bucket dir and writes the BucketMD file
+func (f *FileIO) PutBucket(bkname string, mdbuf []byte) (status int, errmsg string) {
 	path := f.rootBucketDir + bkname
 	err := os.Mkdir(path, DefaultDirMode)
 	if err != nil {
@@ -67,11 +117,33 @@ func (f *FileIO) PutBucket(bkname string) (status int, errmsg string) {
 		return InternalError, "failed to create bucket dir"
 	}
 
+	status, errmsg = f.WriteBucketMD(bkname, mdbuf)
+	if status != StatusOK {
+		os.Remove(path)
+		return status, errmsg
+	}
 	return StatusOK, StatusOKStr
 }
 
 // DeleteBucket deletes the target bucket
 func (f *FileIO) DeleteBucket(bkname string) (status int, errmsg string) {
+	// the bucket is not empty if any object has versions. the version dir
+	// could be left empty by the concurrent write and delete.
+	objnames, _, status, errmsg := f.ListVersionedObjects(bkname, "", "", math.MaxInt32)
+	if status != StatusOK {
+		return status, errmsg
+	}
+	for _, objname := range objnames {
+		versionIDs, status, errmsg := f.ListObjectVersionIDs(bkname, objname)
+		if status != StatusOK {
+			return status, errmsg
+		}
+		if len(versionIDs) != 0 {
+			glog.Errorln("bucket has object versions", bkname, objname, len(versionIDs))
+			return BucketNotEmpty, "BucketNotEmpty"
+		}
+	}
+
 	path := f.rootBucketDir + bkname
 	err := os.Remove(path)
 	if err != nil {
@@ -84,9 +156,30 @@ func (f *FileIO) DeleteBucket(bkname string) (status int, errmsg string) {
 		}
 		return InternalError, "failed to delete bucket"
 	}
+	f.dropObjectNames(bkname)
+
+	// remove the empty version dirs and the BucketMD
+	err = os.RemoveAll(f.rootVersionDir + bkname)
+	if err != nil {
+		glog.Errorln("failed to remove bucket version dir", bkname, err)
+	}
+	err = os.Remove(f.rootBucketMDDir + bkname)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Errorln("failed to remove BucketMD", bkname, err)
+	}
+	// the part dir is left if any part is not cleaned up yet
+	err = os.Remove(f.partDir(bkname))
+	if err != nil && !os.IsNotExist(err) {
+		glog.Errorln("failed to remove bucket part dir", bkname, err)
+	}
 	return StatusOK, StatusOKStr
 }
 
+// IsReservedBucket returns true for the names that are not the bucket dirs
+func (f *FileIO) IsReservedBucket(bkname string) bool {
+	return bkname == "." || bkname == ".."
+}
+
 // HeadBucket checks bucket existence and permission
 func (f *FileIO) HeadBucket(bkname string) (status int, errmsg string) {
 	fname := f.rootBucketDir + bkname
@@ -101,94 +194,167 @@ func (f *FileIO) HeadBucket(bkname string) (status int, errmsg string) {
 	return StatusOK, StatusOKStr
 }
 
-// The IOReader for object list
-type listObjectIOReader struct {
-	xmlbyte []byte
-	// the last read position
-	off int
+// ListBuckets lists the bucket dirs
+func (f *FileIO) ListBuckets() (bknames []string, status int, errmsg string) {
+	bknames, err := readDirNames(f.rootBucketDir)
+	if err != nil {
+		glog.Errorln("failed to read bucket dir", f.rootBucketDir, err)
+		return nil, InternalError, "failed to read bucket dir"
+	}
+	sort.Strings(bknames)
+	return bknames, StatusOK, StatusOKStr
 }
 
-func (l *listObjectIOReader) Read(p []byte) (n int, err error) {
-	glog.V(4).Infoln("listObjectIOReader p len", len(p), "xmlbyte len", len(l.xmlbyte), l.off)
-
-	if l.off >= len(l.xmlbyte) {
-		// all readed, return 0 + EOF
-		return 0, io.EOF
+// WriteBucketMD writes the BucketMD of the bucket
+func (f *FileIO) WriteBucketMD(bkname string, b []byte) (status int, errmsg string) {
+	fname := f.rootBucketMDDir + bkname
+	err := ioutil.WriteFile(fname, b, DefaultFileMode)
+	if err != nil {
+		glog.Errorln("failed to write BucketMD file", fname, err)
+		return InternalError, "failed to write BucketMD file"
 	}
+	return StatusOK, StatusOKStr
+}
 
-	t := l.off + len(p)
-	if t >= len(l.xmlbyte) {
-		copy(p, l.xmlbyte[l.off:])
-		t = len(l.xmlbyte) - l.off
-		l.off = len(l.xmlbyte)
-		return t, io.EOF
+// ReadBucketMD reads the BucketMD of the bucket
+func (f *FileIO) ReadBucketMD(bkname string) (b []byte, status int, errmsg string) {
+	fname := f.rootBucketMDDir + bkname
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NoSuchKey, "NoSuchKey"
+		}
+		glog.Errorln("failed to read BucketMD file", fname, err)
+		return nil, InternalError, "failed to read BucketMD file"
 	}
-
-	copy(p, l.xmlbyte[l.off:t])
-	l.off = t
-	return len(p), nil
+	return b, StatusOK, StatusOKStr
 }
 
-// GetBucket lists objects in the bucket.
-// Only support the simple list
-func (f *FileIO) GetBucket(bkname string) (body io.Reader, status int, errmsg string) {
-	type Content struct {
-		XMLName      xml.Name `xml:"Contents"`
-		Key          string   `xml:"Key"`
-		LastModified string   `xml:"LastModified"`
-		ETag         string   `xml:"ETag"`
-		Size         int64    `xml:"Size"`
-		StorageClass string   `xml:"StorageClass"`
+// objectFileName escapes the object key to one file name. url.PathEscape
+// keeps "." unescaped, the leading "." is escaped as well, so the keys "."
+// and ".." do not refer to the dir itself or the parent dir.
+func objectFileName(objname string) string {
+	name := url.PathEscape(objectKey(objname))
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
 	}
+	return name
+}
 
-	type ListBucketResult struct {
-		XMLName     xml.Name  `xml:"ListBucketResult"`
-		Xmlns       string    `xml:"xmlns,attr"`
-		Name        string    `xml:"Name"`
-		Prefix      string    `xml:"Prefix"`
-		KeyCount    int       `xml:"KeyCount"`
-		MaxKeys     int       `xml:"MaxKeys"`
-		IsTruncated bool      `xml:"IsTruncated"`
-		Contents    []Content `xml:"Contents"`
+// the metadata object file of the object. The object name is escaped, so the
+// object names with "/" are kept as the flat files under the bucket dir.
+func (f *FileIO) objectMDPath(bkname string, objname string) string {
+	return f.rootBucketDir + bkname + "/" + objectFileName(objname)
+}
+
+// listObjectNames returns the sorted names of the objects in the bucket.
+// The names of the last list are returned for the continued list, the
+// deleted objects may be still in the names.
+func (f *FileIO) listObjectNames(bkname string, continued bool) (names []string, status int, errmsg string) {
+	f.listMu.Lock()
+	names, ok := f.listNames[bkname]
+	gen := f.listGen[bkname]
+	f.listMu.Unlock()
+	if ok && continued {
+		return names, StatusOK, StatusOKStr
 	}
 
 	dirpath := f.rootBucketDir + bkname
 	fd, err := os.Open(dirpath)
 	if err != nil {
 		glog.Errorln("failed to open bucket dir", dirpath, err)
+		if os.IsNotExist(err) {
+			return nil, NoSuchBucket, "NoSuchBucket"
+		}
 		return nil, InternalError, InternalErrorStr
 	}
 
-	files, err := fd.Readdir(BucketListMaxKeys)
+	files, err := fd.Readdirnames(-1)
 	fd.Close()
 	if err != nil {
 		glog.Errorln("failed to read bucket dir", dirpath, err)
 		return nil, InternalError, InternalErrorStr
 	}
 
-	glog.V(2).Infoln("list bucket dir, files", len(files), dirpath)
+	names = make([]string, 0, len(files))
+	for _, file := range files {
+		key, err := url.PathUnescape(file)
+		if err != nil {
+			glog.Errorln("invalid object file name", dirpath, file, err)
+			continue
+		}
+		names = append(names, "/"+key)
+	}
+	sort.Strings(names)
+
+	// the names are stale if any object is written after the dir is read
+	f.listMu.Lock()
+	if f.listGen[bkname] == gen {
+		f.listNames[bkname] = names
+	}
+	f.listMu.Unlock()
 
-	res := &ListBucketResult{Xmlns: XMLNS, Name: bkname, KeyCount: len(files),
-		MaxKeys: BucketListMaxKeys, IsTruncated: false}
+	glog.V(2).Infoln("read bucket dir, files", len(files), dirpath)
+	return names, StatusOK, StatusOKStr
+}
+
+// dropObjectNames drops the listed names of the bucket, as the object is
+// written or the bucket is deleted.
+func (f *FileIO) dropObjectNames(bkname string) {
+	f.listMu.Lock()
+	f.listGen[bkname]++
+	delete(f.listNames, bkname)
+	f.listMu.Unlock()
+}
 
-	for _, fi := range files {
-		c := Content{Key: fi.Name(), LastModified: fi.ModTime().Format(time.RFC3339),
-			ETag: "ETag", Size: fi.Size(), StorageClass: "STANDARD"}
-		res.Contents = append(res.Contents, c)
+// ListObjects lists the objects in the bucket. The first page reads the whole
+// bucket dir, the continued pages, with marker, search the names of the last
+// list and only read the ObjectMDs of the page.
+func (f *FileIO) ListObjects(bkname string, prefix string, marker string,
+	maxKeys int) (smds []*ObjectSMD, isTruncated bool, status int, errmsg string) {
+	names, status, errmsg := f.listObjectNames(bkname, marker != "")
+	if status != StatusOK {
+		return nil, false, status, errmsg
 	}
 
-	b, err := xml.Marshal(res)
-	if err != nil {
-		glog.Errorln("failed to marshal ListBucketResult", dirpath, res, err)
-		return nil, InternalError, InternalErrorStr
+	// the first name after marker and with prefix
+	start := marker
+	if prefix > marker {
+		start = prefix
+	}
+	i := sort.SearchStrings(names, start)
+	if i < len(names) && names[i] == marker {
+		i++
 	}
 
-	glog.V(4).Infoln("ListBucketResult", res)
+	dirpath := f.rootBucketDir + bkname
+	for ; i < len(names) && strings.HasPrefix(names[i], prefix); i++ {
+		objname := names[i]
+		if len(smds) == maxKeys {
+			isTruncated = true
+			break
+		}
 
-	rd := new(listObjectIOReader)
-	rd.xmlbyte = b
+		b, err := ioutil.ReadFile(f.objectMDPath(bkname, objname))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// deleted after readdir
+				continue
+			}
+			glog.Errorln("failed to read metadata object file", dirpath, objname, err)
+			return nil, false, InternalError, InternalErrorStr
+		}
 
-	return rd, StatusOK, StatusOKStr
+		md, err := unmarshalObjectMD(b)
+		if err != nil {
+			glog.Errorln("failed to unmarshal ObjectMD", dirpath, objname, err)
+			return nil, false, InternalError, InternalErrorStr
+		}
+		smds = append(smds, md.Smd)
+	}
+
+	glog.V(2).Infoln("list bucket dir", dirpath, prefix, marker, "listed", len(smds), isTruncated)
+	return smds, isTruncated, StatusOK, StatusOKStr
 }
 
 // IsDataBlockExist checks if the data block exists
@@ -213,12 +379,90 @@ func (f *FileIO) WriteDataBlock(buf []byte, md5str string) (status int, errmsg s
 	return StatusOK, StatusOKStr
 }
 
+// DeleteDataBlock deletes the data block
+func (f *FileIO) DeleteDataBlock(md5str string) (status int, errmsg string) {
+	fname := f.rootDataDir + md5str
+	err := os.Remove(fname)
+	if err != nil {
+		glog.Errorln("failed to delete data block file", fname, err)
+		if os.IsNotExist(err) {
+			return NoSuchKey, "NoSuchKey"
+		}
+		return InternalError, "failed to delete data block file"
+	}
+	return StatusOK, StatusOKStr
+}
+
+// ListDataBlocks lists the data blocks after marker
+func (f *FileIO) ListDataBlocks(marker string, maxKeys int) (md5strs []string, isTruncated bool, status int, errmsg string) {
+	names, err := readDirNames(f.rootDataDir)
+	if err != nil {
+		glog.Errorln("failed to read data dir", f.rootDataDir, err)
+		return nil, false, InternalError, InternalErrorStr
+	}
+
+	sort.Strings(names)
+	i := sort.SearchStrings(names, marker)
+	if i < len(names) && names[i] == marker {
+		i++
+	}
+
+	names = names[i:]
+	if len(names) > maxKeys {
+		return names[:maxKeys], true, StatusOK, StatusOKStr
+	}
+	return names, false, StatusOK, StatusOKStr
+}
+
+// WriteBlockRefs writes the BlockRefs of the data block
+func (f *FileIO) WriteBlockRefs(md5str string, b []byte) (status int, errmsg string) {
+	fname := f.rootRefDir + md5str
+	err := ioutil.WriteFile(fname, b, DefaultFileMode)
+	if err != nil {
+		glog.Errorln("failed to write block refs file", fname, err)
+		return InternalError, "failed to write block refs file"
+	}
+	return StatusOK, StatusOKStr
+}
+
+// ReadBlockRefs reads the BlockRefs of the data block
+func (f *FileIO) ReadBlockRefs(md5str string) (b []byte, status int, errmsg string) {
+	fname := f.rootRefDir + md5str
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NoSuchKey, "NoSuchKey"
+		}
+		glog.Errorln("failed to read block refs file", fname, err)
+		return nil, InternalError, "failed to read block refs file"
+	}
+	return b, StatusOK, StatusOKStr
+}
+
+// DeleteBlockRefs deletes the BlockRefs of the data block
+func (f *FileIO) DeleteBlockRefs(md5str string) (status int, errmsg string) {
+	fname := f.rootRefDir + md5str
+	err := os.Remove(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NoSuchKey, "NoSuchKey"
+		}
+		glog.Errorln("failed to delete block refs file", fname, err)
+		return InternalError, "failed to delete block refs file"
+	}
+	return StatusOK, StatusOKStr
+}
+
 // WriteObjectMD creates the metadata object
 func (f *FileIO) WriteObjectMD(bkname string, objname string, mdbuf []byte) (status int, errmsg string) {
-	fname := f.rootBucketDir + bkname + objname
+	fname := f.objectMDPath(bkname, objname)
 	err := ioutil.WriteFile(fname, mdbuf, DefaultFileMode)
+	f.dropObjectNames(bkname)
 	if err != nil {
 		glog.Errorln("failed to create metadata object file", fname, err)
+		if os.IsNotExist(err) {
+			return NoSuchBucket, "NoSuchBucket"
+		}
 		return InternalError, "failed to create metadata file"
 	}
 	return StatusOK, StatusOKStr
@@ -228,19 +472,142 @@ func (f *FileIO) WriteObjectMD(bkname string, objname string, mdbuf []byte) (sta
 func (f *FileIO) ReadObjectMD(bkname string, objname string) (b []byte, status int, errmsg string) {
 	glog.V(4).Infoln("read ObjectMD", bkname, objname)
 
-	fname := f.rootBucketDir + bkname + objname
+	fname := f.objectMDPath(bkname, objname)
 	b, err := ioutil.ReadFile(fname)
 	if err != nil {
-		glog.Errorln("failed to read metadata object file", fname, err)
 		if os.IsNotExist(err) {
 			return nil, NoSuchKey, "NoSuchKey"
 		}
+		glog.Errorln("failed to read metadata object file", fname, err)
 		return nil, InternalError, "failed to read metadata object file"
 	}
 
 	return b, StatusOK, StatusOKStr
 }
 
+// DeleteObjectMD deletes the metadata object
+func (f *FileIO) DeleteObjectMD(bkname string, objname string) (status int, errmsg string) {
+	fname := f.objectMDPath(bkname, objname)
+	err := os.Remove(fname)
+	if err != nil {
+		glog.Errorln("failed to delete metadata object file", fname, err)
+		if os.IsNotExist(err) {
+			return NoSuchKey, "NoSuchKey"
+		}
+		return InternalError, "failed to delete metadata object file"
+	}
+	return StatusOK, StatusOKStr
+}
+
+// the dir of the object versions, every version is one file named by version id
+func (f *FileIO) objectVersionDir(bkname string, objname string) string {
+	return f.rootVersionDir + bkname + "/" + objectFileName(objname) + "/"
+}
+
+// WriteObjectVersion creates the metadata object of the object version
+func (f *FileIO) WriteObjectVersion(bkname string, objname string, versionID string,
+	mdbuf []byte) (status int, errmsg string) {
+	dirpath := f.objectVersionDir(bkname, objname)
+	fname := dirpath + versionID
+	for i := 0; i < 2; i++ {
+		err := os.MkdirAll(dirpath, DefaultDirMode)
+		if err != nil && !os.IsExist(err) {
+			glog.Errorln("failed to create version dir", dirpath, err)
+			return InternalError, "failed to create version dir"
+		}
+
+		err = ioutil.WriteFile(fname, mdbuf, DefaultFileMode)
+		if err == nil {
+			return StatusOK, StatusOKStr
+		}
+		if !os.IsNotExist(err) {
+			glog.Errorln("failed to create version file", fname, err)
+			return InternalError, "failed to create version file"
+		}
+		// the dir is removed by the concurrent DeleteObjectVersion, retry
+	}
+	glog.Errorln("failed to create version file, dir removed", fname)
+	return InternalError, "failed to create version file"
+}
+
+// ReadObjectVersion reads the metadata object of the object version
+func (f *FileIO) ReadObjectVersion(bkname string, objname string, versionID string) (b []byte, status int, errmsg string) {
+	fname := f.objectVersionDir(bkname, objname) + versionID
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NoSuchKey, "NoSuchKey"
+		}
+		glog.Errorln("failed to read version file", fname, err)
+		return nil, InternalError, "failed to read version file"
+	}
+	return b, StatusOK, StatusOKStr
+}
+
+// DeleteObjectVersion deletes the metadata object of the object version, and
+// the version dir if it becomes empty.
+func (f *FileIO) DeleteObjectVersion(bkname string, objname string, versionID string) (status int, errmsg string) {
+	dirpath := f.objectVersionDir(bkname, objname)
+	err := os.Remove(dirpath + versionID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NoSuchKey, "NoSuchKey"
+		}
+		glog.Errorln("failed to delete version file", dirpath, versionID, err)
+		return InternalError, "failed to delete version file"
+	}
+
+	// fails if there are other versions
+	os.Remove(dirpath)
+	return StatusOK, StatusOKStr
+}
+
+// ListVersionedObjects lists the names of the objects that have versions
+func (f *FileIO) ListVersionedObjects(bkname string, prefix string, marker string,
+	maxKeys int) (objnames []string, isTruncated bool, status int, errmsg string) {
+	dirpath := f.rootVersionDir + bkname
+	files, err := readDirNames(dirpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, StatusOK, StatusOKStr
+		}
+		glog.Errorln("failed to read version dir", dirpath, err)
+		return nil, false, InternalError, InternalErrorStr
+	}
+
+	for _, file := range files {
+		key, err := url.PathUnescape(file)
+		if err != nil {
+			glog.Errorln("invalid version dir name", dirpath, file, err)
+			continue
+		}
+		objname := "/" + key
+		if strings.HasPrefix(objname, prefix) && objname > marker {
+			objnames = append(objnames, objname)
+		}
+	}
+	sort.Strings(objnames)
+
+	if len(objnames) > maxKeys {
+		return objnames[:maxKeys], true, StatusOK, StatusOKStr
+	}
+	return objnames, false, StatusOK, StatusOKStr
+}
+
+// ListObjectVersionIDs lists the version ids of the object
+func (f *FileIO) ListObjectVersionIDs(bkname string, objname string) (versionIDs []string, status int, errmsg string) {
+	dirpath := f.objectVersionDir(bkname, objname)
+	names, err := readDirNames(dirpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, StatusOK, StatusOKStr
+		}
+		glog.Errorln("failed to read version dir", dirpath, err)
+		return nil, InternalError, InternalErrorStr
+	}
+	return names, StatusOK, StatusOKStr
+}
+
 // ReadDataBlockRange reads the data block
 func (f *FileIO) ReadDataBlockRange(md5str string, off int64, b []byte) (n int, status int, errmsg string) {
 	glog.V(4).Infoln("read data block", md5str, off, len(b))
@@ -262,10 +629,23 @@ func (f *FileIO) ReadDataBlockRange(md5str string, off int64, b []byte) (n int,
 	return n, StatusOK, StatusOKStr
 }
 
+// partDir returns the dir of the bucket's data parts, so listing the parts
+// of one bucket does not read the parts of all buckets.
+func (f *FileIO) partDir(bkname string) string {
+	return f.rootPartDir + bkname + "/"
+}
+
 // WriteDataPart creates the data part object
 func (f *FileIO) WriteDataPart(bkname string, partName string, b []byte) (status int, errmsg string) {
-	fname := f.rootPartDir + bkname + DefaultSeparator + partName
-	err := ioutil.WriteFile(fname, b, DefaultFileMode)
+	dirpath := f.partDir(bkname)
+	err := os.MkdirAll(dirpath, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create part dir", dirpath, err)
+		return InternalError, "failed to create part dir"
+	}
+
+	fname := dirpath + partName
+	err = ioutil.WriteFile(fname, b, DefaultFileMode)
 	if err != nil {
 		glog.Errorln("failed to create data part file", fname, err)
 		return InternalError, "failed to create data part file"
@@ -275,11 +655,126 @@ func (f *FileIO) WriteDataPart(bkname string, partName string, b []byte) (status
 
 // ReadDataPart reads the data part object
 func (f *FileIO) ReadDataPart(bkname string, partName string) (b []byte, status int, errmsg string) {
-	fname := f.rootPartDir + bkname + DefaultSeparator + partName
+	fname := f.partDir(bkname) + partName
 	b, err := ioutil.ReadFile(fname)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NoSuchKey, "NoSuchKey"
+		}
 		glog.Errorln("failed to read data part file", fname, err)
 		return nil, InternalError, "failed to read data part file"
 	}
 	return b, StatusOK, StatusOKStr
 }
+
+// DeleteDataPart deletes the data part object
+func (f *FileIO) DeleteDataPart(bkname string, partName string) (status int, errmsg string) {
+	fname := f.partDir(bkname) + partName
+	err := os.Remove(fname)
+	if err != nil {
+		glog.Errorln("failed to delete data part file", fname, err)
+		if os.IsNotExist(err) {
+			return NoSuchKey, "NoSuchKey"
+		}
+		return InternalError, "failed to delete data part file"
+	}
+	return StatusOK, StatusOKStr
+}
+
+// ListDataParts lists the data parts that start with prefix
+func (f *FileIO) ListDataParts(bkname string, prefix string) (partNames []string, status int, errmsg string) {
+	dirpath := f.partDir(bkname)
+	fd, err := os.Open(dirpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// no part is written for the bucket yet
+			return nil, StatusOK, StatusOKStr
+		}
+		glog.Errorln("failed to open part dir", dirpath, err)
+		return nil, InternalError, InternalErrorStr
+	}
+
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		glog.Errorln("failed to read part dir", dirpath, err)
+		return nil, InternalError, InternalErrorStr
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			partNames = append(partNames, name)
+		}
+	}
+
+	glog.V(4).Infoln("list data parts", bkname, prefix, len(partNames))
+	return partNames, StatusOK, StatusOKStr
+}
+
+// WriteUploadMD creates the metadata object of the multipart upload
+func (f *FileIO) WriteUploadMD(bkname string, uploadID string, mdbuf []byte) (status int, errmsg string) {
+	dirpath := f.rootUploadDir + bkname
+	err := os.MkdirAll(dirpath, DefaultDirMode)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorln("failed to create upload dir", dirpath, err)
+		return InternalError, "failed to create upload dir"
+	}
+
+	fname := dirpath + "/" + uploadID
+	err = ioutil.WriteFile(fname, mdbuf, DefaultFileMode)
+	if err != nil {
+		glog.Errorln("failed to create upload file", fname, err)
+		return InternalError, "failed to create upload file"
+	}
+	return StatusOK, StatusOKStr
+}
+
+// ReadUploadMD reads the metadata object of the multipart upload
+func (f *FileIO) ReadUploadMD(bkname string, uploadID string) (b []byte, status int, errmsg string) {
+	fname := f.rootUploadDir + bkname + "/" + uploadID
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		glog.Errorln("failed to read upload file", fname, err)
+		if os.IsNotExist(err) {
+			return nil, NoSuchUpload, "NoSuchUpload"
+		}
+		return nil, InternalError, "failed to read upload file"
+	}
+	return b, StatusOK, StatusOKStr
+}
+
+// DeleteUploadMD deletes the metadata object of the multipart upload
+func (f *FileIO) DeleteUploadMD(bkname string, uploadID string) (status int, errmsg string) {
+	fname := f.rootUploadDir + bkname + "/" + uploadID
+	err := os.Remove(fname)
+	if err != nil {
+		glog.Errorln("failed to delete upload file", fname, err)
+		if os.IsNotExist(err) {
+			return NoSuchUpload, "NoSuchUpload"
+		}
+		return InternalError, "failed to delete upload file"
+	}
+	return StatusOK, StatusOKStr
+}
+
+// ListUploads lists the ongoing multipart uploads of the bucket
+func (f *FileIO) ListUploads(bkname string) (uploadIDs []string, status int, errmsg string) {
+	dirpath := f.rootUploadDir + bkname
+	fd, err := os.Open(dirpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// no upload in the bucket
+			return nil, StatusOK, StatusOKStr
+		}
+		glog.Errorln("failed to open upload dir", dirpath, err)
+		return nil, InternalError, InternalErrorStr
+	}
+
+	uploadIDs, err = fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		glog.Errorln("failed to read upload dir", dirpath, err)
+		return nil, InternalError, InternalErrorStr
+	}
+	return uploadIDs, StatusOK, StatusOKStr
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"testing"
+)
+
+func newTestFileIO(t *testing.T) *FileIO {
+	f := newFileIO(t.TempDir() + "/")
+	if f == nil {
+		t.Fatal("failed to create FileIO")
+	}
+	return f
+}
+
+func testWriteObjectMD(t *testing.T, f *FileIO, bkname string, objname string) {
+	b, err := marshalObjectMD(&ObjectMD{Smd: &ObjectSMD{Bucket: bkname, Name: objname}})
+	if err != nil {
+		t.Fatal("marshalObjectMD", err)
+	}
+	if status, errmsg := f.WriteObjectMD(bkname, objname, b); status != StatusOK {
+		t.Fatal("WriteObjectMD", objname, status, errmsg)
+	}
+}
+
+func testListObjectNames(t *testing.T, f *FileIO, bkname string, prefix string, marker string,
+	maxKeys int) (names []string, isTruncated bool) {
+	smds, isTruncated, status, errmsg := f.ListObjects(bkname, prefix, marker, maxKeys)
+	if status != StatusOK {
+		t.Fatal("ListObjects", prefix, marker, status, errmsg)
+	}
+	for _, smd := range smds {
+		names = append(names, smd.Name)
+	}
+	return names, isTruncated
+}
+
+func TestFileIOListObjects(t *testing.T) {
+	f := newTestFileIO(t)
+	if _, _, status, _ := f.ListObjects("bk", "", "", 10); status != NoSuchBucket {
+		t.Fatal("ListObjects of the not existing bucket", status)
+	}
+	if status, errmsg := f.PutBucket("bk", []byte("md")); status != StatusOK {
+		t.Fatal("PutBucket", status, errmsg)
+	}
+	for _, objname := range []string{"/c", "/a", "/b/2", "/b/1", "/.", "/d"} {
+		testWriteObjectMD(t, f, "bk", objname)
+	}
+
+	names, isTruncated := testListObjectNames(t, f, "bk", "", "", 2)
+	if !isTruncated || len(names) != 2 || names[0] != "/." || names[1] != "/a" {
+		t.Fatal("first page", names, isTruncated)
+	}
+
+	// the continued pages see the written and the deleted objects
+	testWriteObjectMD(t, f, "bk", "/b/0")
+	if status, errmsg := f.DeleteObjectMD("bk", "/b/1"); status != StatusOK {
+		t.Fatal("DeleteObjectMD", status, errmsg)
+	}
+	names, isTruncated = testListObjectNames(t, f, "bk", "", "/a", 2)
+	if !isTruncated || len(names) != 2 || names[0] != "/b/0" || names[1] != "/b/2" {
+		t.Fatal("second page", names, isTruncated)
+	}
+	if status, errmsg := f.DeleteObjectMD("bk", "/c"); status != StatusOK {
+		t.Fatal("DeleteObjectMD", status, errmsg)
+	}
+	names, isTruncated = testListObjectNames(t, f, "bk", "", "/b/2", 2)
+	if isTruncated || len(names) != 1 || names[0] != "/d" {
+		t.Fatal("last page", names, isTruncated)
+	}
+
+	// prefix and marker
+	names, isTruncated = testListObjectNames(t, f, "bk", "/b/", "", 10)
+	if isTruncated || len(names) != 2 || names[0] != "/b/0" || names[1] != "/b/2" {
+		t.Fatal("prefix", names, isTruncated)
+	}
+	names, _ = testListObjectNames(t, f, "bk", "/b/", "/b/0", 10)
+	if len(names) != 1 || names[0] != "/b/2" {
+		t.Fatal("prefix after marker", names)
+	}
+	names, _ = testListObjectNames(t, f, "bk", "/b/", "/a", 10)
+	if len(names) != 2 {
+		t.Fatal("prefix after the smaller marker", names)
+	}
+	names, _ = testListObjectNames(t, f, "bk", "/b/", "/c", 10)
+	if len(names) != 0 {
+		t.Fatal("prefix before marker", names)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"net/http"
+	"os"
 	"test"
 
 	"github.com/golang/glog"
@@ -16,6 +17,9 @@ import (
 //	4 - reserve
 //	5 - trace
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "presign" {
+		os.Exit(presign(os.Args[2:]))
+	}
 
 	flag.Parse()
 
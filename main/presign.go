@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"test/util"
+	"time"
+)
+
+// presign mints the presigned url, usage:
+// main presign -method GET -bucket b1 -key k1 -expires 3600
+func presign(args []string) int {
+	fs := flag.NewFlagSet("presign", flag.ContinueOnError)
+	method := fs.String("method", "GET", "the http method of the url, GET, PUT or HEAD")
+	endpoint := fs.String("endpoint", "http://127.0.0.1:8080", "the endpoint of the S3 service")
+	bkname := fs.String("bucket", "", "the bucket name")
+	key := fs.String("key", "", "the object key")
+	expires := fs.Int("expires", 3600, "the seconds the url is valid for, at most 604800")
+	region := fs.String("region", "us-east-1", "the region of the S3 service")
+	accessKey := fs.String("accesskey", os.Getenv("AWS_ACCESS_KEY_ID"), "the access key")
+	secretKey := fs.String("secretkey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "the secret key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	if *bkname == "" || *accessKey == "" || *secretKey == "" {
+		fmt.Fprintln(os.Stderr, "bucket, accesskey and secretkey are required")
+		fs.Usage()
+		return 2
+	}
+	if *method != "GET" && *method != "PUT" && *method != "HEAD" {
+		fmt.Fprintln(os.Stderr, "method should be GET, PUT or HEAD")
+		return 2
+	}
+	if *expires < 1 || *expires > 7*24*3600 {
+		fmt.Fprintln(os.Stderr, "expires should be between 1 and 604800")
+		return 2
+	}
+
+	u, err := util.PresignURL(*method, *endpoint, *bkname, *key, *accessKey, *secretKey, *region,
+		time.Duration(*expires)*time.Second, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to presign url", err)
+		return 1
+	}
+
+	fmt.Println(u)
+	return 0
+}
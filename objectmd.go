@@ -0,0 +1,543 @@
+package test
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"golang.org/x/net/context"
+)
+
+// newObjectMD creates an empty ObjectMD for the put request
+func newObjectMD(requuid string, bkname string, objname string) *ObjectMD {
+	smd := &ObjectSMD{}
+	smd.Bucket = bkname
+	smd.Name = objname
+	smd.Mtime = time.Now().Unix()
+
+	data := &ObjectData{}
+	data.BlockSize = DataBlockSize
+	data.MaxBlocks = MaxDataBlocks
+
+	md := &ObjectMD{}
+	md.Uuid = requuid
+	md.Smd = smd
+	md.Data = data
+	return md
+}
+
+// marshalObjectMD marshals and compresses (if enabled) the ObjectMD
+func marshalObjectMD(md *ObjectMD) (b []byte, err error) {
+	mdbyte, err := proto.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+
+	if *cmp {
+		// looks compression is not useful for ObjectMD.
+		// tried like /usr/local/bin/docker, 9MB, mdbyte is 2519, compress to 2524
+		return snappy.Encode(nil, mdbyte), nil
+	}
+	return mdbyte, nil
+}
+
+// unmarshalObjectMD uncompresses (if enabled) and unmarshals the ObjectMD bytes
+func unmarshalObjectMD(b []byte) (md *ObjectMD, err error) {
+	mdbyte := b
+	if *cmp {
+		mdbyte, err = snappy.Decode(nil, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	md = &ObjectMD{}
+	err = proto.Unmarshal(mdbyte, md)
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// writeObjectMD marshals and writes out the ObjectMD
+func writeObjectMD(ctx context.Context, s3io CloudIO, md *ObjectMD) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, err := marshalObjectMD(md)
+	if err != nil {
+		glog.Errorln("failed to marshal ObjectMD", requuid, md.Smd.Bucket, md.Smd.Name, err)
+		return InternalError, "failed to marshal ObjectMD"
+	}
+
+	status, errmsg = s3io.WriteObjectMD(md.Smd.Bucket, md.Smd.Name, b)
+	if status != StatusOK {
+		glog.Errorln("failed to write ObjectMD", requuid, md.Smd.Bucket, md.Smd.Name, status, errmsg)
+		return status, errmsg
+	}
+	return StatusOK, StatusOKStr
+}
+
+// readObjectMD reads and unmarshals the ObjectMD
+func readObjectMD(ctx context.Context, s3io CloudIO, bkname string,
+	objname string) (md *ObjectMD, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, status, errmsg := s3io.ReadObjectMD(bkname, objname)
+	if status == NoSuchKey {
+		glog.V(2).Infoln("object not exist", requuid, bkname, objname)
+		return nil, status, errmsg
+	}
+	if status != StatusOK {
+		glog.Errorln("failed to ReadObjectMD", requuid, bkname, objname, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	md, err := unmarshalObjectMD(b)
+	if err != nil {
+		glog.Errorln("failed to unmarshal ObjectMD", requuid, bkname, objname, err)
+		return nil, InternalError, InternalErrorStr
+	}
+	return md, StatusOK, StatusOKStr
+}
+
+// readDataPart reads and unmarshals the data part object
+func readDataPart(ctx context.Context, s3io CloudIO, bkname string,
+	partName string) (part *DataPart, status int, errmsg string) {
+	b, status, errmsg := s3io.ReadDataPart(bkname, partName)
+	if status != StatusOK {
+		glog.Errorln("failed to ReadDataPart", util.GetReqIDFromContext(ctx), bkname, partName, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	part = &DataPart{}
+	err := proto.Unmarshal(b, part)
+	if err != nil {
+		glog.Errorln("failed to Unmarshal DataPart", util.GetReqIDFromContext(ctx), bkname, partName, err)
+		return nil, InternalError, "failed to Unmarshal DataPart"
+	}
+	return part, StatusOK, StatusOKStr
+}
+
+// getObjectBlocks returns all data blocks of the object in order.
+// The first and last DataParts are embedded in ObjectMD, the middle parts
+// are read from the data part objects.
+func getObjectBlocks(ctx context.Context, s3io CloudIO, md *ObjectMD) (blocks []string, status int, errmsg string) {
+	totalParts := len(md.Data.DataParts)
+	for i, part := range md.Data.DataParts {
+		if i == 0 || i == totalParts-1 {
+			blocks = append(blocks, part.Blocks...)
+			continue
+		}
+
+		p, status, errmsg := readDataPart(ctx, s3io, md.Smd.Bucket, part.Name)
+		if status != StatusOK {
+			return nil, status, errmsg
+		}
+		blocks = append(blocks, p.Blocks...)
+	}
+	return blocks, StatusOK, StatusOKStr
+}
+
+// setObjectBlocks splits the blocks to DataParts with the same layout as
+// S3PutObject: the first and last parts are embedded in ObjectMD, every
+// middle part is written out as the data part object uuid.partNum. If it
+// fails, the written parts are removed.
+func setObjectBlocks(ctx context.Context, s3io CloudIO, md *ObjectMD, blocks []string) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	maxBlocks := int(md.Data.MaxBlocks)
+	totalParts := (len(blocks) + maxBlocks - 1) / maxBlocks
+
+	md.Data.DataParts = nil
+	for partNum := 0; partNum < totalParts; partNum++ {
+		end := (partNum + 1) * maxBlocks
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+
+		part := &DataPart{}
+		part.Name = util.GenPartName(md.Uuid, partNum)
+		part.Blocks = blocks[partNum*maxBlocks : end]
+
+		if partNum == 0 || partNum == totalParts-1 {
+			md.Data.DataParts = append(md.Data.DataParts, part)
+			continue
+		}
+
+		part.Md = &DataPartMD{BucketName: md.Smd.Bucket, ObjectName: md.Smd.Name}
+		b, err := proto.Marshal(part)
+		if err != nil {
+			glog.Errorln("failed to Marshal DataPart", requuid, part.Name, md.Smd.Bucket, md.Smd.Name, err)
+			return InternalError, "failed to Marshal DataPart"
+		}
+
+		status, errmsg = s3io.WriteDataPart(md.Smd.Bucket, part.Name, b)
+		if status != StatusOK {
+			glog.Errorln("failed to write data part", requuid, part.Name,
+				md.Smd.Bucket, md.Smd.Name, status, errmsg)
+			// remove the written middle parts, DataParts has no last part yet
+			for _, written := range md.Data.DataParts[1:] {
+				st, msg := s3io.DeleteDataPart(md.Smd.Bucket, written.Name)
+				if st != StatusOK && st != NoSuchKey {
+					glog.Errorln("failed to delete data part, the part is leaked",
+						requuid, md.Smd.Bucket, md.Smd.Name, written.Name, st, msg)
+				}
+			}
+			return status, errmsg
+		}
+
+		md.Data.DataParts = append(md.Data.DataParts, &DataPart{Name: part.Name})
+	}
+
+	glog.V(2).Infoln("set object blocks", requuid, md.Smd.Bucket, md.Smd.Name,
+		"blocks", len(blocks), "parts", totalParts)
+	return StatusOK, StatusOKStr
+}
+
+// deleteObjectDataParts removes the middle data parts of the object that is
+// not visible, such as the put fails. The first and last parts are embedded
+// in ObjectMD. The part that fails to be removed is leaked and logged.
+func deleteObjectDataParts(ctx context.Context, s3io CloudIO, md *ObjectMD) {
+	requuid := util.GetReqIDFromContext(ctx)
+	totalParts := len(md.Data.DataParts)
+	for i := 1; i < totalParts-1; i++ {
+		name := md.Data.DataParts[i].Name
+		status, errmsg := s3io.DeleteDataPart(md.Smd.Bucket, name)
+		if status != StatusOK && status != NoSuchKey {
+			glog.Errorln("failed to delete data part, the part is leaked",
+				requuid, md.Smd.Bucket, md.Smd.Name, name, status, errmsg)
+		}
+	}
+}
+
+// objectVersionID returns the version id of the ObjectMD
+func objectVersionID(md *ObjectMD) string {
+	if md.VersionId == "" {
+		return NullVersionID
+	}
+	return md.VersionId
+}
+
+// versionOrder returns the order of the object version, the larger is newer.
+// The objects created before versioning do not have versionTime.
+func versionOrder(md *ObjectMD) int64 {
+	if md.VersionTime != 0 {
+		return md.VersionTime
+	}
+	return md.Smd.Mtime * int64(time.Second)
+}
+
+// writeObjectVersion marshals and writes out the ObjectMD as the object version
+func writeObjectVersion(ctx context.Context, s3io CloudIO, md *ObjectMD) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, err := marshalObjectMD(md)
+	if err != nil {
+		glog.Errorln("failed to marshal ObjectMD", requuid, md.Smd.Bucket, md.Smd.Name, err)
+		return InternalError, "failed to marshal ObjectMD"
+	}
+
+	status, errmsg = s3io.WriteObjectVersion(md.Smd.Bucket, md.Smd.Name, objectVersionID(md), b)
+	if status != StatusOK {
+		glog.Errorln("failed to write object version", requuid, md.Smd.Bucket, md.Smd.Name,
+			objectVersionID(md), status, errmsg)
+		return status, errmsg
+	}
+	return StatusOK, StatusOKStr
+}
+
+// readObjectVersion reads and unmarshals the ObjectMD of the object version
+func readObjectVersion(ctx context.Context, s3io CloudIO, bkname string, objname string,
+	versionID string) (md *ObjectMD, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, status, errmsg := s3io.ReadObjectVersion(bkname, objname, versionID)
+	if status == NoSuchKey {
+		glog.V(2).Infoln("object version not exist", requuid, bkname, objname, versionID)
+		return nil, status, errmsg
+	}
+	if status != StatusOK {
+		glog.Errorln("failed to ReadObjectVersion", requuid, bkname, objname, versionID, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	md, err := unmarshalObjectMD(b)
+	if err != nil {
+		glog.Errorln("failed to unmarshal ObjectMD", requuid, bkname, objname, versionID, err)
+		return nil, InternalError, InternalErrorStr
+	}
+	return md, StatusOK, StatusOKStr
+}
+
+// getNullVersion returns the null version of the object, which is either the
+// current object or the noncurrent version. cur is the current ObjectMD, nil
+// if the object does not exist.
+func getNullVersion(ctx context.Context, s3io CloudIO, journal *DeleteJournal, bkname string,
+	objname string, cur *ObjectMD) (md *ObjectMD, status int, errmsg string) {
+	if cur != nil && cur.VersionId == "" {
+		return cur, StatusOK, StatusOKStr
+	}
+
+	md, status, errmsg = readObjectVersion(ctx, s3io, bkname, objname, NullVersionID)
+	if status == NoSuchKey || (status == StatusOK && journal.IsDeleted(md)) {
+		return nil, StatusOK, StatusOKStr
+	}
+	return md, status, errmsg
+}
+
+// the number of the commit locks, the objects are hashed to the locks
+const commitLockStripes = 256
+
+var commitLocks [commitLockStripes]sync.Mutex
+
+// commitLock returns the lock of the object
+func commitLock(bkname string, objname string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(bkname))
+	h.Write([]byte(objname))
+	return &commitLocks[h.Sum32()%commitLockStripes]
+}
+
+// commitObjectMD references the blocks and writes out the ObjectMD. hdr is the
+// request header for the conditional write, If-Match and If-None-Match.
+//
+// Reading the current object, checking the conditions and writing the new
+// ObjectMD are serialized by the lock of the object. The lock is in the
+// memory of the process, the puts to the different gateways on the same
+// backend are not serialized, and the conditional write is not atomic then.
+//
+// If the bucket is not versioned, the current object is replaced and logged to
+// the delete journal. If versioning is enabled, the new version is written as
+// the object version as well, and the current object is kept as the noncurrent
+// version. If versioning is suspended, the new null version replaces the
+// existing null version. The locked version is never replaced.
+//
+// The middle data parts of md are written for this put. If the commit fails,
+// they are removed, unless the new version could not be removed and may be
+// read.
+func commitObjectMD(ctx context.Context, s3io CloudIO, gc *BlockGC, journal *DeleteJournal,
+	bmd *BucketMD, md *ObjectMD, blocks []string, hdr http.Header) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	bkname := md.Smd.Bucket
+	objname := md.Smd.Name
+
+	now := time.Now()
+	md.VersionTime = now.UnixNano()
+	applyDefaultRetention(bmd, md, now)
+	if bmd.Versioning == VersioningEnabled {
+		md.VersionId = md.Uuid
+	} else {
+		md.VersionId = ""
+	}
+
+	keepParts := false
+	defer func() {
+		if status != StatusOK && !keepParts {
+			deleteObjectDataParts(ctx, s3io, md)
+		}
+	}()
+
+	lock := commitLock(bkname, objname)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// read the current object, the error is not returned, as the put succeeds
+	// if the current object is not reclaimed.
+	oldmd, status, _ := readObjectMD(ctx, s3io, bkname, objname)
+	if status != StatusOK || journal.IsDeleted(oldmd) {
+		oldmd = nil
+	}
+
+	status, errmsg = checkWriteConditions(hdr, oldmd)
+	if status != StatusOK {
+		glog.Errorln("conditional write failed", requuid, bkname, objname, status, errmsg)
+		return status, errmsg
+	}
+
+	// the replaced version, which is reclaimed after the new version is visible
+	var replaced *ObjectMD
+	switch bmd.Versioning {
+	case VersioningEnabled:
+		// keep the current null version, which is not written as version yet
+		if oldmd != nil && oldmd.VersionId == "" {
+			status, errmsg = writeObjectVersion(ctx, s3io, oldmd)
+			if status != StatusOK {
+				return status, errmsg
+			}
+		}
+	case VersioningSuspended:
+		replaced, status, errmsg = getNullVersion(ctx, s3io, journal, bkname, objname, oldmd)
+		if status != StatusOK {
+			return status, errmsg
+		}
+	default:
+		replaced = oldmd
+	}
+	if replaced != nil {
+		status, errmsg = checkObjectLock(replaced, now, false)
+		if status != StatusOK {
+			glog.Errorln("could not replace the locked version", requuid, bkname, objname, replaced.Uuid, errmsg)
+			return status, errmsg
+		}
+	}
+
+	// the blocks should be referenced before the ObjectMD is visible
+	ref := util.GenBlockRef(bkname, objname, md.Uuid)
+	status, errmsg = gc.LogRefs(ctx, ref, true, blocks)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	if bmd.Versioning != "" {
+		status, errmsg = writeObjectVersion(ctx, s3io, md)
+		if status != StatusOK {
+			gc.LogRefs(ctx, ref, false, blocks)
+			return status, errmsg
+		}
+	}
+
+	status, errmsg = writeObjectMD(ctx, s3io, md)
+	if status != StatusOK {
+		if bmd.Versioning != "" {
+			st, msg := s3io.DeleteObjectVersion(bkname, objname, objectVersionID(md))
+			if st != StatusOK {
+				// the version may be read, keep the refs
+				glog.Errorln("failed to remove the version of the failed put, the blocks are leaked",
+					requuid, bkname, objname, md.VersionId, st, msg)
+				keepParts = true
+				return status, errmsg
+			}
+		}
+		// cancel the refs, if fails, the blocks are leaked.
+		gc.LogRefs(ctx, ref, false, blocks)
+		return status, errmsg
+	}
+
+	if replaced != nil {
+		entry := &DeleteEntry{Bucket: bkname, Name: objname, Md: replaced, Overwrite: true,
+			Version: bmd.Versioning != ""}
+		status, errmsg = journal.Log(ctx, []*DeleteEntry{entry})
+		if status != StatusOK {
+			glog.Errorln("failed to log the overwritten object, the old version is leaked",
+				requuid, bkname, objname, replaced.Uuid, status, errmsg)
+		}
+	}
+	return StatusOK, StatusOKStr
+}
+
+// parseUserMetadata collects the x-amz-meta-* headers. The key is stored in
+// lower case without the prefix. The multiple values of one key are joined
+// with ",". The total size of the keys and values could not exceed 2KB.
+func parseUserMetadata(hdr http.Header) (umd *ObjectUMD, status int, errmsg string) {
+	var keys []string
+	for k := range hdr {
+		if strings.HasPrefix(strings.ToLower(k), UserMetadataPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, StatusOK, StatusOKStr
+	}
+	sort.Strings(keys)
+
+	umd = &ObjectUMD{}
+	size := 0
+	for _, k := range keys {
+		item := &UMD{}
+		item.Key = strings.ToLower(k)[len(UserMetadataPrefix):]
+		item.Strval = strings.Join(hdr[k], ",")
+		size += len(item.Key) + len(item.Strval)
+		umd.Umd = append(umd.Umd, item)
+	}
+
+	if size > MaxUserMetadataSize {
+		return nil, MetadataTooLarge, "MetadataTooLarge"
+	}
+	return umd, StatusOK, StatusOKStr
+}
+
+// parseEntityHeaders sets the standard entity headers of the request to smd
+func parseEntityHeaders(hdr http.Header, smd *ObjectSMD) {
+	smd.ContentType = hdr.Get(ContentType)
+	smd.ContentEncoding = hdr.Get(ContentEncoding)
+	smd.ContentLanguage = hdr.Get(ContentLanguage)
+	smd.ContentDisposition = hdr.Get(ContentDisposition)
+	smd.CacheControl = hdr.Get(CacheControl)
+	smd.Expires = hdr.Get(Expires)
+}
+
+// copyEntityHeaders copies the standard entity headers from src to dst
+func copyEntityHeaders(dst *ObjectSMD, src *ObjectSMD) {
+	dst.ContentType = src.ContentType
+	dst.ContentEncoding = src.ContentEncoding
+	dst.ContentLanguage = src.ContentLanguage
+	dst.ContentDisposition = src.ContentDisposition
+	dst.CacheControl = src.CacheControl
+	dst.Expires = src.Expires
+}
+
+// setVersionHeader sets the version id of the new object to the response, if
+// the bucket is versioned.
+func setVersionHeader(w http.ResponseWriter, bmd *BucketMD, md *ObjectMD) {
+	if bmd.Versioning != "" {
+		w.Header().Set(VersionID, objectVersionID(md))
+	}
+}
+
+// setObjectHeaders sets the object system and user metadata to the response headers
+func setObjectHeaders(w http.ResponseWriter, md *ObjectMD) {
+	w.Header().Set(LastModified, time.Unix(md.Smd.Mtime, 0).UTC().Format(time.RFC1123))
+	w.Header().Set(ETag, md.Smd.Etag)
+	if md.VersionId != "" {
+		w.Header().Set(VersionID, md.VersionId)
+	}
+
+	// always set the content type, otherwise http server sniffs it from data
+	if md.Smd.ContentType != "" {
+		w.Header().Set(ContentType, md.Smd.ContentType)
+	} else {
+		w.Header().Set(ContentType, DefaultContentType)
+	}
+	setHeaderIfNotEmpty(w, ContentEncoding, md.Smd.ContentEncoding)
+	setHeaderIfNotEmpty(w, ContentLanguage, md.Smd.ContentLanguage)
+	setHeaderIfNotEmpty(w, ContentDisposition, md.Smd.ContentDisposition)
+	setHeaderIfNotEmpty(w, CacheControl, md.Smd.CacheControl)
+	setHeaderIfNotEmpty(w, Expires, md.Smd.Expires)
+	if len(md.Tags) != 0 {
+		w.Header().Set(TaggingCount, strconv.Itoa(len(md.Tags)))
+	}
+	setSSEHeaders(w, md.Sse)
+	setObjectLockHeaders(w, md)
+
+	if md.Umd != nil {
+		for _, item := range md.Umd.Umd {
+			// set directly, the key is returned in lower case as S3
+			w.Header()[UserMetadataPrefix+item.Key] = []string{item.Strval}
+		}
+	}
+}
+
+func setHeaderIfNotEmpty(w http.ResponseWriter, key string, val string) {
+	if val != "" {
+		w.Header().Set(key, val)
+	}
+}
+
+// setResponseOverrides overrides the response headers with the response-*
+// query parameters of get or head object.
+func setResponseOverrides(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	setHeaderIfNotEmpty(w, ContentType, q.Get(ResponseContentType))
+	setHeaderIfNotEmpty(w, ContentEncoding, q.Get(ResponseContentEncoding))
+	setHeaderIfNotEmpty(w, ContentLanguage, q.Get(ResponseContentLanguage))
+	setHeaderIfNotEmpty(w, ContentDisposition, q.Get(ResponseContentDisposition))
+	setHeaderIfNotEmpty(w, CacheControl, q.Get(ResponseCacheControl))
+	setHeaderIfNotEmpty(w, Expires, q.Get(ResponseExpires))
+}
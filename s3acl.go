@@ -0,0 +1,498 @@
+package test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"test/util"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// Object and bucket ACLs.
+//
+// The acl is stored in the ObjectMD and BucketMD. The object or bucket
+// created before acl is supported has no acl, and keeps accessible by all
+// authenticated requesters, see legacyACL. The owner has the full
+// control implicitly, other requesters are checked by the grants, when the
+// bucket policy does not explicitly allow or deny the request.
+//
+// The anonymous request acts as the default owner if allowanonymous is set,
+// otherwise it only matches the AllUsers group.
+
+type aclGrantee struct {
+	XmlnsXsi string `xml:"xmlns:xsi,attr,omitempty"`
+	XsiType  string `xml:"xsi:type,attr,omitempty"`
+	// the parsed xsi:type of the request
+	Type         string `xml:"type,attr,omitempty"`
+	ID           string `xml:"ID,omitempty"`
+	DisplayName  string `xml:"DisplayName,omitempty"`
+	URI          string `xml:"URI,omitempty"`
+	EmailAddress string `xml:"EmailAddress,omitempty"`
+}
+
+type aclGrant struct {
+	Grantee    aclGrantee `xml:"Grantee"`
+	Permission string     `xml:"Permission"`
+}
+
+type accessControlPolicy struct {
+	XMLName xml.Name   `xml:"AccessControlPolicy"`
+	Xmlns   string     `xml:"xmlns,attr,omitempty"`
+	Owner   *listOwner `xml:"Owner"`
+	Grants  []aclGrant `xml:"AccessControlList>Grant"`
+}
+
+var aclPermissions = map[string]bool{
+	PermissionRead: true, PermissionWrite: true, PermissionReadACP: true,
+	PermissionWriteACP: true, PermissionFullControl: true,
+}
+
+var aclGroups = map[string]bool{AllUsersGroup: true, AuthenticatedUsersGroup: true}
+
+// the grant headers and their permissions
+var aclGrantHeaders = []struct {
+	header     string
+	permission string
+}{
+	{GrantRead, PermissionRead},
+	{GrantWrite, PermissionWrite},
+	{GrantReadACP, PermissionReadACP},
+	{GrantWriteACP, PermissionWriteACP},
+	{GrantFullControl, PermissionFullControl},
+}
+
+// privateACL returns the acl that only grants the owner full control
+func privateACL(ownerID string) *Acl {
+	grant := &Grant{GranteeType: GranteeCanonicalUser, Grantee: ownerID, Permission: PermissionFullControl}
+	return &Acl{OwnerId: ownerID, Grants: []*Grant{grant}}
+}
+
+// legacyACL returns the acl of the bucket or object created before acl is
+// supported. They were accessible by all authenticated requesters, and are
+// kept accessible after upgrade, until the owner puts the acl.
+func legacyACL(ownerID string) *Acl {
+	acl := privateACL(ownerID)
+	acl.Grants = append(acl.Grants, &Grant{GranteeType: GranteeGroup, Grantee: AuthenticatedUsersGroup,
+		Permission: PermissionFullControl})
+	return acl
+}
+
+// cannedACL returns the acl of the canned acl. The bucket owner grants are
+// only added when the bucket owner is not the owner.
+func cannedACL(canned string, ownerID string, bucketOwnerID string) (acl *Acl, status int, errmsg string) {
+	acl = privateACL(ownerID)
+	switch canned {
+	case ACLPrivate:
+	case ACLPublicRead:
+		acl.Grants = append(acl.Grants, &Grant{GranteeType: GranteeGroup, Grantee: AllUsersGroup, Permission: PermissionRead})
+	case ACLPublicReadWrite:
+		acl.Grants = append(acl.Grants,
+			&Grant{GranteeType: GranteeGroup, Grantee: AllUsersGroup, Permission: PermissionRead},
+			&Grant{GranteeType: GranteeGroup, Grantee: AllUsersGroup, Permission: PermissionWrite})
+	case ACLAuthenticatedRead:
+		acl.Grants = append(acl.Grants,
+			&Grant{GranteeType: GranteeGroup, Grantee: AuthenticatedUsersGroup, Permission: PermissionRead})
+	case ACLBucketOwnerRead, ACLBucketOwnerFullControl:
+		if bucketOwnerID != ownerID {
+			perm := PermissionRead
+			if canned == ACLBucketOwnerFullControl {
+				perm = PermissionFullControl
+			}
+			acl.Grants = append(acl.Grants, &Grant{GranteeType: GranteeCanonicalUser, Grantee: bucketOwnerID, Permission: perm})
+		}
+	default:
+		return nil, InvalidArgument, "invalid x-amz-acl " + canned
+	}
+	return acl, StatusOK, StatusOKStr
+}
+
+// parseGrantHeader parses the grantees of the grant header, such as
+// id="id1", uri="http://acs.amazonaws.com/groups/global/AllUsers"
+func parseGrantHeader(val string, permission string) (grants []*Grant, status int, errmsg string) {
+	for _, g := range strings.Split(val, ",") {
+		strs := strings.SplitN(strings.TrimSpace(g), "=", 2)
+		if len(strs) != 2 {
+			return nil, InvalidArgument, "invalid grant " + g
+		}
+		grantee := strings.Trim(strings.TrimSpace(strs[1]), "\"")
+		if grantee == "" {
+			return nil, InvalidArgument, "invalid grant " + g
+		}
+
+		switch strings.TrimSpace(strs[0]) {
+		case "id":
+			grants = append(grants, &Grant{GranteeType: GranteeCanonicalUser, Grantee: grantee, Permission: permission})
+		case "uri":
+			if !aclGroups[grantee] {
+				return nil, InvalidArgument, "unsupported group " + grantee
+			}
+			grants = append(grants, &Grant{GranteeType: GranteeGroup, Grantee: grantee, Permission: permission})
+		default:
+			return nil, NotImplemented, "grantee type is not supported " + strs[0]
+		}
+	}
+	return grants, StatusOK, StatusOKStr
+}
+
+// hasACLHeaders returns whether the request has the canned acl or grant headers
+func hasACLHeaders(hdr http.Header) bool {
+	if hdr.Get(ACL) != "" {
+		return true
+	}
+	for _, g := range aclGrantHeaders {
+		if hdr.Get(g.header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseACLHeaders returns the acl of the x-amz-acl or x-amz-grant-* headers.
+// The private acl is returned if the headers are not set.
+func parseACLHeaders(hdr http.Header, ownerID string, bucketOwnerID string) (acl *Acl, status int, errmsg string) {
+	canned := hdr.Get(ACL)
+
+	var grants []*Grant
+	for _, g := range aclGrantHeaders {
+		val := hdr.Get(g.header)
+		if val == "" {
+			continue
+		}
+		if canned != "" {
+			return nil, InvalidRequest, "InvalidRequest: Specifying both Canned ACLs and Header Grants is not allowed"
+		}
+		gs, status, errmsg := parseGrantHeader(val, g.permission)
+		if status != StatusOK {
+			return nil, status, errmsg
+		}
+		grants = append(grants, gs...)
+	}
+
+	if len(grants) != 0 {
+		return &Acl{OwnerId: ownerID, Grants: grants}, StatusOK, StatusOKStr
+	}
+	if canned == "" {
+		canned = ACLPrivate
+	}
+	return cannedACL(canned, ownerID, bucketOwnerID)
+}
+
+// bucketACL returns the acl of the bucket
+func bucketACL(bmd *BucketMD) *Acl {
+	if bmd.Acl == nil {
+		return legacyACL(bucketOwnerID(bmd))
+	}
+	return bmd.Acl
+}
+
+// objectACL returns the acl of the object, the object put before acl is
+// supported belongs to the bucket owner.
+func objectACL(bmd *BucketMD, md *ObjectMD) *Acl {
+	if md.Acl == nil {
+		return legacyACL(bucketOwnerID(bmd))
+	}
+	return md.Acl
+}
+
+// aclAllowed checks whether the acl grants the permission to the requester.
+// requester is "" for the anonymous request.
+func aclAllowed(acl *Acl, requester string, permission string) bool {
+	if requester != "" && requester == acl.OwnerId {
+		return true
+	}
+	for _, g := range acl.Grants {
+		if g.Permission != permission && g.Permission != PermissionFullControl {
+			continue
+		}
+		if g.GranteeType == GranteeGroup {
+			if g.Grantee == AllUsersGroup || (g.Grantee == AuthenticatedUsersGroup && requester != "") {
+				return true
+			}
+		} else if requester != "" && g.Grantee == requester {
+			return true
+		}
+	}
+	return false
+}
+
+// aclPermission returns the acl permission the action requires, and whether
+// the permission is checked on the object or the bucket.
+func aclPermission(action string) (onObject bool, permission string) {
+	switch action {
+	case "s3:GetObject", "s3:GetObjectVersion", "s3:GetObjectTagging", "s3:GetObjectVersionTagging":
+		return true, PermissionRead
+	case "s3:GetObjectAcl", "s3:GetObjectVersionAcl":
+		return true, PermissionReadACP
+	case "s3:PutObjectAcl", "s3:PutObjectVersionAcl":
+		return true, PermissionWriteACP
+	case "s3:PutObjectTagging", "s3:PutObjectVersionTagging",
+		"s3:DeleteObjectTagging", "s3:DeleteObjectVersionTagging":
+		return true, PermissionFullControl
+	case "s3:ListBucket", "s3:ListBucketVersions", "s3:ListBucketMultipartUploads", "s3:ListMultipartUploadParts":
+		return false, PermissionRead
+	case "s3:PutObject", "s3:DeleteObject", "s3:DeleteObjectVersion", "s3:AbortMultipartUpload":
+		return false, PermissionWrite
+	case "s3:GetBucketAcl":
+		return false, PermissionReadACP
+	case "s3:PutBucketAcl":
+		return false, PermissionWriteACP
+	}
+	// the bucket configurations are only allowed for the owner
+	return false, PermissionFullControl
+}
+
+// aclRequester returns the canonical id of the requester, "" for the
+// anonymous request.
+func (s *S3Server) aclRequester(ctx context.Context) string {
+	info := getAuthInfoFromContext(ctx)
+	if info.AccessKey == "" && !s.auth.AllowAnonymous() {
+		return ""
+	}
+	return getOwnerID(ctx)
+}
+
+// checkACL checks whether the acl of the bucket or object allows the action.
+// If the object does not exist, the requester that could list the bucket is
+// allowed, to get the not found error.
+func (s *S3Server) checkACL(ctx context.Context, bkname string, objname string, versionID string,
+	action string) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	requester := s.aclRequester(ctx)
+
+	if bkname == "" || action == "s3:CreateBucket" {
+		if requester == "" {
+			glog.Errorln("anonymous request is not allowed", requuid, bkname, action)
+			return AccessDenied, "AccessDenied"
+		}
+		return StatusOK, StatusOKStr
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	acl := bucketACL(bmd)
+	onObject, permission := aclPermission(action)
+	if onObject {
+		md, status, errmsg := s.readObjectACLMD(ctx, bkname, objname, versionID)
+		if status == StatusOK {
+			acl = objectACL(bmd, md)
+		} else if status == NoSuchKey || status == NoSuchVersion {
+			permission = PermissionRead
+		} else {
+			return status, errmsg
+		}
+	}
+
+	if aclAllowed(acl, requester, permission) {
+		return StatusOK, StatusOKStr
+	}
+
+	// returns NoSuchBucket rather than AccessDenied for the not existing bucket
+	status, errmsg = s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	glog.Errorln("request is denied by acl", requuid, bkname, objname, versionID, action, requester, permission)
+	return AccessDenied, "AccessDenied"
+}
+
+// readObjectACLMD reads the ObjectMD of the object or version to check the acl
+func (s *S3Server) readObjectACLMD(ctx context.Context, bkname string, objname string,
+	versionID string) (md *ObjectMD, status int, errmsg string) {
+	if versionID != "" {
+		return s.getObjectVersion(ctx, bkname, objname, versionID)
+	}
+
+	md, status, errmsg = readObjectMD(ctx, s.s3io, bkname, objname)
+	if status == StatusOK && s.journal.IsDeleted(md) {
+		return nil, NoSuchKey, "NoSuchKey"
+	}
+	return md, status, errmsg
+}
+
+// aclToXML converts the acl to AccessControlPolicy
+func aclToXML(acl *Acl) *accessControlPolicy {
+	res := &accessControlPolicy{Xmlns: XMLNS, Owner: &listOwner{ID: acl.OwnerId, DisplayName: acl.OwnerId}}
+	res.Grants = []aclGrant{}
+	for _, g := range acl.Grants {
+		grantee := aclGrantee{XmlnsXsi: "http://www.w3.org/2001/XMLSchema-instance", XsiType: g.GranteeType}
+		if g.GranteeType == GranteeGroup {
+			grantee.URI = g.Grantee
+		} else {
+			grantee.ID = g.Grantee
+			grantee.DisplayName = g.Grantee
+		}
+		res.Grants = append(res.Grants, aclGrant{Grantee: grantee, Permission: g.Permission})
+	}
+	return res
+}
+
+// readACLRequest reads the acl of the put acl request, from the
+// AccessControlPolicy body or the acl headers.
+func readACLRequest(ctx context.Context, r *http.Request, cur *Acl,
+	bucketOwnerID string) (acl *Acl, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read acl", requuid, r.URL, err)
+		return nil, InternalError, "failed to read request body"
+	}
+
+	if len(b) == 0 {
+		if !hasACLHeaders(r.Header) {
+			return nil, MissingSecurityHeader, "MissingSecurityHeader"
+		}
+		return parseACLHeaders(r.Header, cur.OwnerId, bucketOwnerID)
+	}
+	if hasACLHeaders(r.Header) {
+		return nil, UnexpectedContent, "UnexpectedContent"
+	}
+
+	req := &accessControlPolicy{}
+	err = xml.Unmarshal(b, req)
+	if err != nil || req.Owner == nil {
+		glog.Errorln("invalid acl", requuid, r.URL, err)
+		return nil, MalformedACLError, "MalformedACLError"
+	}
+	if req.Owner.ID != cur.OwnerId {
+		glog.Errorln("acl owner could not be changed", requuid, r.URL, req.Owner.ID, cur.OwnerId)
+		return nil, AccessDenied, "AccessDenied"
+	}
+
+	acl = &Acl{OwnerId: cur.OwnerId}
+	for _, g := range req.Grants {
+		if !aclPermissions[g.Permission] {
+			return nil, MalformedACLError, "MalformedACLError"
+		}
+		switch g.Grantee.Type {
+		case GranteeCanonicalUser:
+			if g.Grantee.ID == "" {
+				return nil, MalformedACLError, "MalformedACLError"
+			}
+			acl.Grants = append(acl.Grants, &Grant{GranteeType: GranteeCanonicalUser,
+				Grantee: g.Grantee.ID, Permission: g.Permission})
+		case GranteeGroup:
+			if !aclGroups[g.Grantee.URI] {
+				return nil, MalformedACLError, "MalformedACLError"
+			}
+			acl.Grants = append(acl.Grants, &Grant{GranteeType: GranteeGroup,
+				Grantee: g.Grantee.URI, Permission: g.Permission})
+		default:
+			glog.Errorln("unsupported grantee type", requuid, r.URL, g.Grantee.Type)
+			return nil, NotImplemented, "grantee type is not supported " + g.Grantee.Type
+		}
+	}
+	return acl, StatusOK, StatusOKStr
+}
+
+// putBucketAcl handles PUT /bucket?acl
+func (s *S3Server) putBucketAcl(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("put bucket acl failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	acl, status, errmsg := readACLRequest(ctx, r, bucketACL(bmd), bucketOwnerID(bmd))
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd = proto.Clone(bmd).(*BucketMD)
+	bmd.Acl = acl
+	status, errmsg = s.bmds.Put(ctx, bkname, bmd)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	glog.V(1).Infoln("put bucket acl", requuid, bkname, len(acl.Grants))
+	w.WriteHeader(StatusOK)
+}
+
+// getBucketAcl handles GET /bucket?acl
+func (s *S3Server) getBucketAcl(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	writeXMLResponse(ctx, w, aclToXML(bucketACL(bmd)))
+}
+
+// putObjectAcl handles PUT /bucket/key?acl
+func (s *S3Server) putObjectAcl(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg := s.getObjectMD(ctx, r, bkname, objname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	acl, status, errmsg := readACLRequest(ctx, r, objectACL(bmd, md), bucketOwnerID(bmd))
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg = s.updateObjectMD(ctx, r, bmd, bkname, objname, func(md *ObjectMD) (int, string) {
+		md.Acl = acl
+		return StatusOK, StatusOKStr
+	})
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	setVersionHeader(w, bmd, md)
+	w.WriteHeader(StatusOK)
+}
+
+// getObjectAcl handles GET /bucket/key?acl
+func (s *S3Server) getObjectAcl(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg := s.getObjectMD(ctx, r, bkname, objname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	setHeaderIfNotEmpty(w, VersionID, md.VersionId)
+	writeXMLResponse(ctx, w, aclToXML(objectACL(bmd, md)))
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestACLAllowed(t *testing.T) {
+	owner := "owner1"
+	user := "user1"
+	publicRead, _, _ := cannedACL(ACLPublicRead, owner, owner)
+	authRead, _, _ := cannedACL(ACLAuthenticatedRead, owner, owner)
+	bucketOwnerFull, _, _ := cannedACL(ACLBucketOwnerFullControl, user, owner)
+	userWrite := privateACL(owner)
+	userWrite.Grants = append(userWrite.Grants,
+		&Grant{GranteeType: GranteeCanonicalUser, Grantee: user, Permission: PermissionWrite})
+
+	tests := []struct {
+		name       string
+		acl        *Acl
+		requester  string
+		permission string
+		allowed    bool
+	}{
+		{"owner", privateACL(owner), owner, PermissionWriteACP, true},
+		{"private other", privateACL(owner), user, PermissionRead, false},
+		{"private anonymous", privateACL(owner), "", PermissionRead, false},
+		{"public read anonymous", publicRead, "", PermissionRead, true},
+		{"public read no write", publicRead, user, PermissionWrite, false},
+		{"authenticated read", authRead, user, PermissionRead, true},
+		{"authenticated read anonymous", authRead, "", PermissionRead, false},
+		{"bucket owner full control", bucketOwnerFull, owner, PermissionReadACP, true},
+		{"user grant", userWrite, user, PermissionWrite, true},
+		{"user grant other permission", userWrite, user, PermissionRead, false},
+		{"legacy bucket signed", bucketACL(&BucketMD{}), user, PermissionRead, true},
+		{"legacy bucket config signed", bucketACL(&BucketMD{}), user, PermissionFullControl, true},
+		{"legacy bucket anonymous", bucketACL(&BucketMD{}), "", PermissionRead, false},
+		{"legacy bucket default owner", bucketACL(&BucketMD{}), DefaultOwnerID, PermissionWrite, true},
+		{"legacy object signed", objectACL(&BucketMD{OwnerId: owner}, &ObjectMD{}), user, PermissionRead, true},
+		{"legacy object anonymous", objectACL(&BucketMD{OwnerId: owner}, &ObjectMD{}), "", PermissionRead, false},
+		{"bucket acl", bucketACL(&BucketMD{OwnerId: owner, Acl: privateACL(owner)}), user, PermissionRead, false},
+	}
+
+	for _, tt := range tests {
+		if allowed := aclAllowed(tt.acl, tt.requester, tt.permission); allowed != tt.allowed {
+			t.Errorf("%s: aclAllowed(%s, %s) = %v, want %v", tt.name, tt.requester, tt.permission, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestParseACLHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		hdr    map[string]string
+		status int
+		grants int
+	}{
+		{"default private", nil, StatusOK, 1},
+		{"canned public read", map[string]string{ACL: ACLPublicRead}, StatusOK, 2},
+		{"canned bucket owner read", map[string]string{ACL: ACLBucketOwnerRead}, StatusOK, 2},
+		{"invalid canned", map[string]string{ACL: "unknown"}, InvalidArgument, 0},
+		{"grant ids", map[string]string{GrantRead: `id="a", id="b"`}, StatusOK, 2},
+		{"grant group", map[string]string{GrantWrite: "uri=" + AllUsersGroup}, StatusOK, 1},
+		{"unsupported group", map[string]string{GrantWrite: "uri=http://unknown"}, InvalidArgument, 0},
+		{"email grantee", map[string]string{GrantRead: "emailAddress=a@b.com"}, NotImplemented, 0},
+		{"canned and grant", map[string]string{ACL: ACLPrivate, GrantRead: `id="a"`}, InvalidRequest, 0},
+	}
+
+	for _, tt := range tests {
+		hdr := make(http.Header)
+		for k, v := range tt.hdr {
+			hdr.Set(k, v)
+		}
+		acl, status, errmsg := parseACLHeaders(hdr, "user1", "owner1")
+		if status != tt.status {
+			t.Errorf("%s: status %d %s, want %d", tt.name, status, errmsg, tt.status)
+			continue
+		}
+		if status == StatusOK && len(acl.Grants) != tt.grants {
+			t.Errorf("%s: grants %d, want %d", tt.name, len(acl.Grants), tt.grants)
+		}
+	}
+}
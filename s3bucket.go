@@ -0,0 +1,118 @@
+package test
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+type listBucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Owner   *listOwner   `xml:"Owner"`
+	Buckets []listBucket `xml:"Buckets>Bucket"`
+}
+
+// bucketOwnerID returns the owner id of the bucket. The bucket created before
+// the owner is recorded belongs to the default owner, and is accessible by
+// all authenticated requesters, see legacyACL.
+func bucketOwnerID(bmd *BucketMD) string {
+	if bmd.OwnerId == "" {
+		return DefaultOwnerID
+	}
+	return bmd.OwnerId
+}
+
+// putBucket handles PUT /bucket, the bucket is created with the BucketMD
+// that records the creation time, owner, acl and whether object lock is enabled.
+func (s *S3Server) putBucket(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	bmd := &BucketMD{}
+	bmd.CreationTime = time.Now().Unix()
+	bmd.OwnerId = getOwnerID(ctx)
+
+	acl, status, errmsg := parseACLHeaders(r.Header, bmd.OwnerId, bmd.OwnerId)
+	if status != StatusOK {
+		glog.Errorln("invalid bucket acl", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+	bmd.Acl = acl
+
+	// object lock requires versioning, which could not be suspended then
+	if val := r.Header.Get(BucketObjectLockEnabled); val != "" {
+		if !strings.EqualFold(val, "true") {
+			glog.Errorln("invalid object lock enabled header", requuid, bkname, val)
+			writeError(w, r, InvalidArgument, "InvalidArgument: invalid x-amz-bucket-object-lock-enabled "+val)
+			return
+		}
+		bmd.ObjectLockEnabled = true
+		bmd.Versioning = VersioningEnabled
+	}
+
+	b, err := proto.Marshal(bmd)
+	if err != nil {
+		glog.Errorln("failed to marshal BucketMD", requuid, bkname, err)
+		writeError(w, r, InternalError, "failed to marshal BucketMD")
+		return
+	}
+
+	status, errmsg = s.s3io.PutBucket(bkname, b)
+	if status != StatusOK {
+		glog.Errorln("put bucket failed", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// the BucketMD of the deleted bucket with the same name may be cached
+	s.bmds.Remove(bkname)
+
+	glog.Infoln("put bucket success", requuid, bkname, bmd.OwnerId, bmd.ObjectLockEnabled)
+	w.WriteHeader(status)
+}
+
+// listBuckets handles GET /, lists the buckets owned by the requester
+func (s *S3Server) listBuckets(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	bknames, status, errmsg := s.s3io.ListBuckets()
+	if status != StatusOK {
+		glog.Errorln("list buckets failed", requuid, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	ownerID := getOwnerID(ctx)
+	res := &listAllMyBucketsResult{Xmlns: XMLNS}
+	res.Owner = &listOwner{ID: ownerID, DisplayName: ownerID}
+	for _, bkname := range bknames {
+		bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+		if status != StatusOK {
+			glog.Errorln("list buckets failed to get BucketMD", requuid, bkname, status, errmsg)
+			writeError(w, r, status, errmsg)
+			return
+		}
+		// the bucket created before the owner is recorded is listed for all
+		if bmd.OwnerId != "" && bmd.OwnerId != ownerID {
+			continue
+		}
+
+		res.Buckets = append(res.Buckets, listBucket{Name: bkname,
+			CreationDate: time.Unix(bmd.CreationTime, 0).UTC().Format(time.RFC3339)})
+	}
+
+	glog.V(1).Infoln("list buckets", requuid, ownerID, len(res.Buckets))
+	writeXMLResponse(ctx, w, res)
+}
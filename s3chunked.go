@@ -0,0 +1,396 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"test/util"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// aws-chunked streaming upload.
+//
+// The body is a sequence of chunks, the last chunk has 0 size.
+//   hex-size;chunk-signature=signature\r\n
+//   data\r\n
+// The trailer payloads append the trailing headers after the last chunk,
+// such as x-amz-checksum-crc32:value\r\n, and end with an empty line. The
+// signed trailer also has the x-amz-trailer-signature header.
+//
+// The checksum trailer named by x-amz-trailer is verified against the
+// decoded data.
+
+const chunkSignaturePrefix = "chunk-signature="
+const trailerSignature = "x-amz-trailer-signature"
+const checksumTrailerPrefix = "x-amz-checksum-"
+
+// streamingError is the error of the aws-chunked body, which is returned to
+// the client with the status and errmsg.
+type streamingError struct {
+	status int
+	errmsg string
+}
+
+func (e *streamingError) Error() string {
+	return e.errmsg
+}
+
+var errIncompleteChunk = &streamingError{IncompleteBody, "IncompleteBody"}
+var errMalformedChunk = &streamingError{InvalidRequest, "InvalidRequest: malformed aws-chunked body"}
+var errChunkSignature = &streamingError{SignatureDoesNotMatch, "SignatureDoesNotMatch"}
+var errTrailerChecksum = &streamingError{BadDigest, "BadDigest: the checksum trailer does not match the data"}
+
+// newTrailerChecksum returns the hash of the checksum trailer, or nil if
+// the algorithm is not supported.
+func newTrailerChecksum(name string) hash.Hash {
+	switch name {
+	case "x-amz-checksum-crc32":
+		return crc32.NewIEEE()
+	case "x-amz-checksum-crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "x-amz-checksum-sha1":
+		return sha1.New()
+	case "x-amz-checksum-sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// bodyReadError returns the status and errmsg of the request body read error
+func bodyReadError(err error) (status int, errmsg string) {
+	if e, ok := err.(*streamingError); ok {
+		return e.status, e.errmsg
+	}
+	return InternalError, "failed to read data from http"
+}
+
+// chunkedReader decodes the aws-chunked body. The chunk is verified before
+// any of its data is returned, so the unverified data never reaches the
+// data blocks.
+type chunkedReader struct {
+	requuid string
+	rd      *bufio.Reader
+	body    io.ReadCloser
+	// nil if the chunks are not signed
+	info    *AuthInfo
+	trailer bool
+	prevSig string
+	// the checksum trailer and the hash of the decoded data, nil if no
+	// checksum trailer
+	checksumName string
+	checksum     hash.Hash
+	// the data of the current chunk
+	buf []byte
+	off int
+	// the decoded data that is not read from body yet
+	remain int64
+	eof    bool
+	err    error
+}
+
+// decodeStreamingBody replaces the aws-chunked request body with the
+// decoding reader, and sets ContentLength to x-amz-decoded-content-length.
+func decodeStreamingBody(ctx context.Context, r *http.Request) (status int, errmsg string) {
+	payload := r.Header.Get(util.AmzContentSha256)
+	if !strings.HasPrefix(payload, util.StreamingPayloadPrefix) {
+		return StatusOK, StatusOKStr
+	}
+
+	requuid := util.GetReqIDFromContext(ctx)
+
+	var signed, trailer bool
+	switch payload {
+	case util.StreamingPayload:
+		signed = true
+	case util.StreamingPayloadTrailer:
+		signed = true
+		trailer = true
+	case util.StreamingUnsignedPayloadTrailer:
+		trailer = true
+	default:
+		glog.Errorln("unsupported streaming payload", requuid, r.Method, r.URL, payload)
+		return NotImplemented, "NotImplemented: " + payload + " is not supported"
+	}
+
+	val := r.Header.Get(DecodedContentLength)
+	if val == "" {
+		glog.Errorln("no x-amz-decoded-content-length", requuid, r.Method, r.URL)
+		return MissingContentLength, "MissingContentLength"
+	}
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || size < 0 {
+		glog.Errorln("invalid x-amz-decoded-content-length", requuid, r.Method, r.URL, val)
+		return InvalidArgument, "InvalidArgument: invalid x-amz-decoded-content-length"
+	}
+
+	c := &chunkedReader{
+		requuid: requuid,
+		rd:      bufio.NewReaderSize(r.Body, MaxStreamingLineSize),
+		body:    r.Body,
+		trailer: trailer,
+		remain:  size,
+	}
+	if trailer {
+		name := strings.ToLower(strings.TrimSpace(r.Header.Get(AmzTrailer)))
+		if strings.HasPrefix(name, checksumTrailerPrefix) {
+			c.checksum = newTrailerChecksum(name)
+			if c.checksum == nil {
+				glog.Errorln("unsupported checksum trailer", requuid, r.Method, r.URL, name)
+				return NotImplemented, "NotImplemented: " + name + " is not supported"
+			}
+			c.checksumName = name
+		}
+	}
+	if signed {
+		info := getAuthInfoFromContext(ctx)
+		if info.SigningKey == nil {
+			glog.Errorln("signed streaming payload of the unsigned request", requuid, r.Method, r.URL)
+			return AccessDenied, "AccessDenied"
+		}
+		c.info = info
+		c.prevSig = info.Signature
+	}
+
+	r.Body = c
+	r.ContentLength = size
+	r.Header.Set(ContentLength, val)
+
+	// aws-chunked is not the content encoding of the object
+	var encodings []string
+	for _, e := range strings.Split(r.Header.Get(ContentEncoding), ",") {
+		e = strings.TrimSpace(e)
+		if e != "" && e != AwsChunked {
+			encodings = append(encodings, e)
+		}
+	}
+	if len(encodings) == 0 {
+		r.Header.Del(ContentEncoding)
+	} else {
+		r.Header.Set(ContentEncoding, strings.Join(encodings, ","))
+	}
+
+	glog.V(2).Infoln("decode streaming payload", requuid, payload, "size", size)
+	return StatusOK, StatusOKStr
+}
+
+func (c *chunkedReader) Read(p []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	for c.off == len(c.buf) {
+		if c.eof {
+			return 0, io.EOF
+		}
+		c.err = c.readChunk()
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+
+	n = copy(p, c.buf[c.off:])
+	c.off += n
+
+	if c.off == len(c.buf) && c.remain == 0 && !c.eof {
+		// read the last chunk with the last data. The caller stops reading
+		// after ContentLength bytes, the whole body should be verified by then.
+		c.err = c.readChunk()
+		if c.err != nil {
+			return n, c.err
+		}
+	}
+	if c.eof && c.off == len(c.buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// readLine reads one line without the ending \r\n
+func (c *chunkedReader) readLine() (line []byte, err error) {
+	line, err = c.rd.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			glog.Errorln("incomplete aws-chunked body", c.requuid, err)
+			return nil, errIncompleteChunk
+		}
+		if err == bufio.ErrBufferFull {
+			glog.Errorln("aws-chunked line is too long", c.requuid)
+			return nil, errMalformedChunk
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		glog.Errorln("aws-chunked line does not end with CRLF", c.requuid, string(line))
+		return nil, errMalformedChunk
+	}
+	return line[:len(line)-2], nil
+}
+
+// readChunk reads and verifies the next chunk
+func (c *chunkedReader) readChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+
+	sizeStr := string(line)
+	sig := ""
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		sizeStr = string(line[:i])
+		ext := string(line[i+1:])
+		if strings.HasPrefix(ext, chunkSignaturePrefix) {
+			sig = ext[len(chunkSignaturePrefix):]
+		}
+	}
+
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 || size > MaxStreamingChunkSize {
+		glog.Errorln("invalid aws-chunked chunk size", c.requuid, string(line))
+		return errMalformedChunk
+	}
+	if size > c.remain {
+		glog.Errorln("aws-chunked data exceeds x-amz-decoded-content-length", c.requuid, size, c.remain)
+		return errMalformedChunk
+	}
+	if c.info != nil && sig == "" {
+		glog.Errorln("no chunk signature", c.requuid, string(line))
+		return errMalformedChunk
+	}
+
+	if int64(cap(c.buf)) < size {
+		c.buf = make([]byte, size)
+	}
+	c.buf = c.buf[:size]
+	c.off = 0
+
+	if size > 0 {
+		_, err = io.ReadFull(c.rd, c.buf)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				glog.Errorln("incomplete aws-chunked chunk", c.requuid, size, err)
+				return errIncompleteChunk
+			}
+			return err
+		}
+	}
+
+	if c.info != nil {
+		expect := util.ChunkSignature(c.info.SigningKey, c.info.Time, c.info.Scope, c.prevSig, c.buf)
+		if !hmac.Equal([]byte(expect), []byte(sig)) {
+			glog.Errorln("chunk signature does not match", c.requuid, c.info.AccessKey, size)
+			return errChunkSignature
+		}
+		c.prevSig = sig
+	}
+	if c.checksum != nil {
+		c.checksum.Write(c.buf)
+	}
+	c.remain -= size
+
+	if size > 0 {
+		// the data ends with CRLF
+		line, err = c.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) != 0 {
+			glog.Errorln("aws-chunked data does not end with CRLF", c.requuid)
+			return errMalformedChunk
+		}
+		return nil
+	}
+
+	// the last chunk
+	if c.remain != 0 {
+		glog.Errorln("aws-chunked data less than x-amz-decoded-content-length", c.requuid, c.remain)
+		return errIncompleteChunk
+	}
+	if c.trailer {
+		err = c.readTrailer()
+	} else {
+		line, err = c.readLine()
+		if err == nil && len(line) != 0 {
+			glog.Errorln("aws-chunked body does not end with CRLF", c.requuid)
+			err = errMalformedChunk
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.eof = true
+	return nil
+}
+
+// readTrailer reads the trailing headers till the empty line, and verifies
+// the checksum trailer. The headers are not kept.
+func (c *chunkedReader) readTrailer() error {
+	var trailer bytes.Buffer
+	sig := ""
+	checksum := ""
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			glog.Errorln("invalid aws-chunked trailer", c.requuid, string(line))
+			return errMalformedChunk
+		}
+		name := strings.ToLower(strings.TrimSpace(string(line[:i])))
+		value := strings.TrimSpace(string(line[i+1:]))
+		if name == trailerSignature {
+			sig = value
+			continue
+		}
+		if name == c.checksumName {
+			checksum = value
+		}
+		if trailer.Len()+len(line) > MaxStreamingLineSize {
+			glog.Errorln("aws-chunked trailer is too large", c.requuid)
+			return errMalformedChunk
+		}
+		trailer.WriteString(name + ":" + value + "\n")
+		glog.V(5).Infoln("aws-chunked trailer", c.requuid, name, value)
+	}
+
+	if c.info != nil {
+		expect := util.TrailerSignature(c.info.SigningKey, c.info.Time, c.info.Scope, c.prevSig, trailer.Bytes())
+		if !hmac.Equal([]byte(expect), []byte(sig)) {
+			glog.Errorln("trailer signature does not match", c.requuid, c.info.AccessKey)
+			return errChunkSignature
+		}
+	}
+
+	if c.checksum != nil {
+		if checksum == "" {
+			glog.Errorln("no checksum trailer", c.requuid, c.checksumName)
+			return errMalformedChunk
+		}
+		expect := base64.StdEncoding.EncodeToString(c.checksum.Sum(nil))
+		if checksum != expect {
+			glog.Errorln("checksum trailer does not match", c.requuid, c.checksumName, checksum, expect)
+			return errTrailerChecksum
+		}
+	}
+	return nil
+}
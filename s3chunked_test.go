@@ -0,0 +1,229 @@
+package test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"test/util"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// the example of the AWS document, Signature Calculations for the
+// Authorization Header: Transferring Payload in Multiple Chunks.
+var (
+	testChunkedTime = time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC)
+	testChunkedSeed = "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9"
+	testChunkedSigs = []string{
+		"ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648",
+		"0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497",
+		"b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9",
+	}
+)
+
+func newTestChunkedAuthInfo() *AuthInfo {
+	return &AuthInfo{
+		AccessKey:  testAccessKey,
+		SigningKey: util.SigningKey(testSecretKey, testChunkedTime.Format(util.ShortDateFormat), "us-east-1"),
+		Time:       testChunkedTime,
+		Scope:      util.CredentialScope(testChunkedTime, "us-east-1"),
+		Signature:  testChunkedSeed,
+	}
+}
+
+// newTestChunkedBody encodes data as the aws-chunked body. The chunks are
+// signed if info is not nil. The trailer is "name:value" or "".
+func newTestChunkedBody(data []byte, chunkSize int, info *AuthInfo, trailer string) []byte {
+	var b bytes.Buffer
+	prevSig := ""
+	if info != nil {
+		prevSig = info.Signature
+	}
+	for off := 0; ; {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[off:end]
+		off = end
+
+		fmt.Fprintf(&b, "%x", len(chunk))
+		if info != nil {
+			prevSig = util.ChunkSignature(info.SigningKey, info.Time, info.Scope, prevSig, chunk)
+			b.WriteString(";" + chunkSignaturePrefix + prevSig)
+		}
+		b.WriteString("\r\n")
+		if len(chunk) == 0 {
+			break
+		}
+		b.Write(chunk)
+		b.WriteString("\r\n")
+	}
+
+	if trailer != "" {
+		b.WriteString(trailer + "\r\n")
+		if info != nil {
+			sig := util.TrailerSignature(info.SigningKey, info.Time, info.Scope, prevSig, []byte(trailer+"\n"))
+			b.WriteString(trailerSignature + ":" + sig + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func TestChunkSignatureVector(t *testing.T) {
+	info := newTestChunkedAuthInfo()
+	data := bytes.Repeat([]byte("a"), 66560)
+
+	prevSig := testChunkedSeed
+	for i, chunk := range [][]byte{data[:65536], data[65536:], nil} {
+		sig := util.ChunkSignature(info.SigningKey, info.Time, info.Scope, prevSig, chunk)
+		if sig != testChunkedSigs[i] {
+			t.Fatalf("chunk %d signature %s, want %s", i, sig, testChunkedSigs[i])
+		}
+		prevSig = sig
+	}
+
+	body := newTestChunkedBody(data, 65536, info, "")
+	if !bytes.Contains(body, []byte("10000;chunk-signature="+testChunkedSigs[0]+"\r\n")) ||
+		!bytes.HasSuffix(body, []byte("0;chunk-signature="+testChunkedSigs[2]+"\r\n\r\n")) {
+		t.Fatal("unexpected chunked body")
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	crc := func(b []byte) string {
+		h := crc32.NewIEEE()
+		h.Write(b)
+		return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		size    int
+		// the decoded content length, size if 0
+		decodedLength int
+		trailer       string
+		// the x-amz-trailer header
+		amzTrailer string
+		// modify the encoded body
+		modify func(b []byte) []byte
+		// the error code of decodeStreamingBody and reading the body
+		decodeCode string
+		readCode   string
+	}{
+		{"signed", util.StreamingPayload, len(data), 0, "", "", nil, "", ""},
+		{"signed empty", util.StreamingPayload, 0, 0, "", "", nil, "", ""},
+		{"signed one chunk", util.StreamingPayload, 100, 0, "", "", nil, "", ""},
+		{"signed trailer", util.StreamingPayloadTrailer, len(data), 0,
+			"x-amz-checksum-crc32:" + crc(data), "x-amz-checksum-crc32", nil, "", ""},
+		{"unsigned trailer", util.StreamingUnsignedPayloadTrailer, 100, 0,
+			"x-amz-checksum-crc32:" + crc(data[:100]), "x-amz-checksum-crc32", nil, "", ""},
+		{"checksum mismatch", util.StreamingPayloadTrailer, len(data), 0,
+			"x-amz-checksum-crc32:" + crc(data[1:]), "x-amz-checksum-crc32", nil, "", "BadDigest"},
+		{"unsigned checksum mismatch", util.StreamingUnsignedPayloadTrailer, 100, 0,
+			"x-amz-checksum-crc32:AAAAAA==", "x-amz-checksum-crc32", nil, "", "BadDigest"},
+		{"checksum missing", util.StreamingUnsignedPayloadTrailer, 100, 0,
+			"x-amz-checksum-sha256:AAAAAA==", "x-amz-checksum-crc32", nil, "", "InvalidRequest"},
+		{"unsupported checksum", util.StreamingUnsignedPayloadTrailer, 100, 0,
+			"x-amz-checksum-crc64nvme:AAAAAAAAAAA=", "x-amz-checksum-crc64nvme", nil, "NotImplemented", ""},
+		{"unsupported payload", "STREAMING-AWS4-ECDSA-P256-SHA256-PAYLOAD", 100, 0, "", "", nil,
+			"NotImplemented", ""},
+		{"tampered data", util.StreamingPayload, len(data), 0, "", "", func(b []byte) []byte {
+			b[len(b)/2] ^= 1
+			return b
+		}, "", "SignatureDoesNotMatch"},
+		{"tampered trailer", util.StreamingPayloadTrailer, 100, 0,
+			"x-amz-checksum-crc32:" + crc(data[:100]), "x-amz-checksum-crc32", func(b []byte) []byte {
+				return bytes.Replace(b, []byte(crc(data[:100])), []byte("AAAAAA=="), 1)
+			}, "", "SignatureDoesNotMatch"},
+		{"truncated", util.StreamingPayload, len(data), 0, "", "", func(b []byte) []byte {
+			return b[:len(b)-100]
+		}, "", "IncompleteBody"},
+		{"decoded length too small", util.StreamingPayload, 100, 99, "", "", nil, "", "InvalidRequest"},
+		{"decoded length too large", util.StreamingPayload, 100, 101, "", "", nil, "", "IncompleteBody"},
+		{"invalid chunk size", util.StreamingPayload, 100, 0, "", "", func(b []byte) []byte {
+			return append([]byte("xyz"), b[2:]...)
+		}, "", "InvalidRequest"},
+		{"no CRLF", util.StreamingPayload, 100, 0, "", "", func(b []byte) []byte {
+			return bytes.Replace(b, []byte("\r\n"), []byte("\n"), 1)
+		}, "", "InvalidRequest"},
+	}
+
+	info := newTestChunkedAuthInfo()
+	for _, tt := range tests {
+		var signInfo *AuthInfo
+		if tt.payload != util.StreamingUnsignedPayloadTrailer {
+			signInfo = info
+		}
+		body := newTestChunkedBody(data[:tt.size], 65536, signInfo, tt.trailer)
+		if tt.modify != nil {
+			body = tt.modify(body)
+		}
+		decodedLength := tt.decodedLength
+		if decodedLength == 0 {
+			decodedLength = tt.size
+		}
+
+		r := httptest.NewRequest("PUT", "/bk/obj", bytes.NewReader(body))
+		r.Header.Set(util.AmzContentSha256, tt.payload)
+		r.Header.Set(DecodedContentLength, strconv.Itoa(decodedLength))
+		r.Header.Set(ContentEncoding, AwsChunked+",gzip")
+		if tt.amzTrailer != "" {
+			r.Header.Set(AmzTrailer, tt.amzTrailer)
+		}
+		ctx := newAuthContext(context.Background(), info)
+
+		status, errmsg := decodeStreamingBody(ctx, r)
+		if code := testErrorCode(status, errmsg); code != tt.decodeCode {
+			t.Errorf("%s: decodeStreamingBody error %q %s, want %q", tt.name, code, errmsg, tt.decodeCode)
+			continue
+		}
+		if status != StatusOK {
+			continue
+		}
+		if r.ContentLength != int64(decodedLength) || r.Header.Get(ContentEncoding) != "gzip" {
+			t.Errorf("%s: ContentLength %d, Content-Encoding %s", tt.name, r.ContentLength, r.Header.Get(ContentEncoding))
+		}
+
+		b, err := ioutil.ReadAll(r.Body)
+		code := ""
+		if err != nil {
+			code = testErrorCode(bodyReadError(err))
+		}
+		if code != tt.readCode {
+			t.Errorf("%s: read error %q %v, want %q", tt.name, code, err, tt.readCode)
+			continue
+		}
+		if err == nil && !bytes.Equal(b, data[:tt.size]) {
+			t.Errorf("%s: decoded %d bytes, want %d", tt.name, len(b), tt.size)
+		}
+	}
+}
+
+func TestChunkedReaderUnsignedRequest(t *testing.T) {
+	// the signed chunks need the signing key of the request
+	r := httptest.NewRequest("PUT", "/bk/obj", strings.NewReader(""))
+	r.Header.Set(util.AmzContentSha256, util.StreamingPayload)
+	r.Header.Set(DecodedContentLength, "0")
+	status, errmsg := decodeStreamingBody(context.Background(), r)
+	if code := testErrorCode(status, errmsg); code != "AccessDenied" {
+		t.Errorf("unsigned request error %q %s, want AccessDenied", code, errmsg)
+	}
+
+	r = httptest.NewRequest("PUT", "/bk/obj", strings.NewReader(""))
+	r.Header.Set(util.AmzContentSha256, util.StreamingPayload)
+	status, errmsg = decodeStreamingBody(context.Background(), r)
+	if code := testErrorCode(status, errmsg); code != "MissingContentLength" {
+		t.Errorf("no decoded length error %q %s, want MissingContentLength", code, errmsg)
+	}
+}
@@ -0,0 +1,112 @@
+package test
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the header names of the conditional request
+type conditionHeaders struct {
+	ifMatch           string
+	ifNoneMatch       string
+	ifModifiedSince   string
+	ifUnmodifiedSince string
+}
+
+var (
+	// the conditions of get and head object
+	objectConditions = conditionHeaders{ifMatch: IfMatch, ifNoneMatch: IfNoneMatch,
+		ifModifiedSince: IfModifiedSince, ifUnmodifiedSince: IfUnmodifiedSince}
+	// the conditions of the copy source
+	copySourceConditions = conditionHeaders{ifMatch: CopySourceIfMatch,
+		ifNoneMatch: CopySourceIfNoneMatch, ifModifiedSince: CopySourceIfModifiedSince,
+		ifUnmodifiedSince: CopySourceIfUnmodifiedSince}
+)
+
+// checkConditions checks the conditional headers against the object as RFC7232.
+// if-match and if-unmodified-since both present, and if-match is true, the
+// request proceeds. if-none-match and if-modified-since both present, and
+// if-none-match is true, the request proceeds. notModified is the status when
+// if-none-match or if-modified-since fails, 304 for get and head, 412 for copy.
+func checkConditions(hdr http.Header, md *ObjectMD, cond conditionHeaders,
+	notModified int) (status int, errmsg string) {
+	mtime := time.Unix(md.Smd.Mtime, 0)
+
+	ifMatch := hdr.Get(cond.ifMatch)
+	if ifMatch != "" && !matchETag(ifMatch, md.Smd.Etag) {
+		return PreconditionFailed, "PreconditionFailed"
+	}
+
+	if ifMatch == "" {
+		if str := hdr.Get(cond.ifUnmodifiedSince); str != "" {
+			t, err := http.ParseTime(str)
+			if err == nil && mtime.After(t) {
+				return PreconditionFailed, "PreconditionFailed"
+			}
+		}
+	}
+
+	ifNoneMatch := hdr.Get(cond.ifNoneMatch)
+	if ifNoneMatch != "" && matchETag(ifNoneMatch, md.Smd.Etag) {
+		return notModified, "NotModified"
+	}
+
+	if ifNoneMatch == "" {
+		if str := hdr.Get(cond.ifModifiedSince); str != "" {
+			t, err := http.ParseTime(str)
+			if err == nil && !mtime.After(t) {
+				return notModified, "NotModified"
+			}
+		}
+	}
+
+	return StatusOK, StatusOKStr
+}
+
+// checkWriteConditions checks the If-Match and If-None-Match of the put
+// against the current object, oldmd is nil if the object does not exist.
+// If-None-Match only supports "*", which means create only.
+//
+// The caller holds the commit lock of the object, see commitObjectMD. The lock
+// is in the memory of the process, the conditional puts to the different
+// gateways on the same backend could both pass the check.
+func checkWriteConditions(hdr http.Header, oldmd *ObjectMD) (status int, errmsg string) {
+	if hdr == nil {
+		return StatusOK, StatusOKStr
+	}
+
+	ifNoneMatch := hdr.Get(IfNoneMatch)
+	if ifNoneMatch != "" {
+		if strings.TrimSpace(ifNoneMatch) != "*" {
+			return NotImplemented, "If-None-Match only supports *"
+		}
+		if oldmd != nil {
+			return PreconditionFailed, "PreconditionFailed"
+		}
+	}
+
+	ifMatch := hdr.Get(IfMatch)
+	if ifMatch != "" {
+		if oldmd == nil {
+			return NoSuchKey, "NoSuchKey"
+		}
+		if !matchETag(ifMatch, oldmd.Smd.Etag) {
+			return PreconditionFailed, "PreconditionFailed"
+		}
+	}
+
+	return StatusOK, StatusOKStr
+}
+
+// matchETag checks whether the etag matches the If-Match or If-None-Match
+// header value, which is "*" or a list of the quoted or unquoted etags.
+func matchETag(hdr string, etag string) bool {
+	for _, str := range strings.Split(hdr, ",") {
+		str = strings.TrimSpace(str)
+		if str == "*" || strings.Trim(str, "\"") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package test
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+// parse x-amz-copy-source, "/bucket/key" or "bucket/key", the key is url
+// encoded, and the version could be specified as "?versionId=id".
+func parseCopySource(src string) (bkname string, objname string, versionID string, status int, errmsg string) {
+	if i := strings.Index(src, "?"); i >= 0 {
+		q, err := url.ParseQuery(src[i+1:])
+		if err != nil {
+			return "", "", "", InvalidArgument, "invalid x-amz-copy-source"
+		}
+		versionID = q.Get(ObjectVersionID)
+		src = src[:i]
+	}
+
+	src, err := url.PathUnescape(strings.TrimPrefix(src, "/"))
+	if err != nil {
+		return "", "", "", InvalidArgument, "invalid x-amz-copy-source"
+	}
+
+	strs := strings.SplitN(src, "/", 2)
+	if len(strs) != 2 || strs[0] == "" || strs[1] == "" {
+		return "", "", "", InvalidArgument, "invalid x-amz-copy-source"
+	}
+	return strs[0], "/" + strs[1], versionID, StatusOK, StatusOKStr
+}
+
+// copyObject handles CopyObject, PUT /bucket/key with x-amz-copy-source.
+//
+// The object data is the list of the data blocks, so the copy does not read
+// or write any data block. It creates the new ObjectMD and DataParts that
+// reference the same blocks. Only if the source and target are encrypted with
+// the different keys, the blocks are re-encrypted.
+func (s *S3Server) copyObject(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	srcbk, srcobj, srcVersionID, status, errmsg := parseCopySource(r.Header.Get(CopySource))
+	if status != StatusOK {
+		glog.Errorln("invalid copy source", requuid, bkname, objname, r.Header.Get(CopySource))
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// the source object should be readable by the requester
+	action := "s3:GetObject"
+	if srcVersionID != "" {
+		action = "s3:GetObjectVersion"
+	}
+	status, errmsg = s.authorizeAction(ctx, r, srcbk, srcobj, srcVersionID, action)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	directive := r.Header.Get(MetadataDirective)
+	if directive == "" {
+		directive = MetadataDirectiveCopy
+	}
+	if directive != MetadataDirectiveCopy && directive != MetadataDirectiveReplace {
+		glog.Errorln("invalid metadata directive", requuid, bkname, objname, directive)
+		writeError(w, r, InvalidArgument, "invalid x-amz-metadata-directive")
+		return
+	}
+
+	umd, status, errmsg := parseUserMetadata(r.Header)
+	if status != StatusOK {
+		glog.Errorln("invalid user metadata", requuid, bkname, objname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	tagDirective := r.Header.Get(TaggingDirective)
+	if tagDirective == "" {
+		tagDirective = TaggingDirectiveCopy
+	}
+	if tagDirective != TaggingDirectiveCopy && tagDirective != TaggingDirectiveReplace {
+		glog.Errorln("invalid tagging directive", requuid, bkname, objname, tagDirective)
+		writeError(w, r, InvalidArgument, "invalid x-amz-tagging-directive")
+		return
+	}
+
+	tags, status, errmsg := parseTaggingHeader(r.Header)
+	if status != StatusOK {
+		glog.Errorln("invalid tagging", requuid, bkname, objname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// copy to itself is only allowed to change the metadata or encryption
+	if srcbk == bkname && srcobj == objname && directive == MetadataDirectiveCopy &&
+		tagDirective == TaggingDirectiveCopy && !hasSSEHeaders(r.Header) {
+		glog.Errorln("copy object to itself without changing metadata", requuid, bkname, objname)
+		writeError(w, r, InvalidRequest, "InvalidRequest: copy to itself without changing metadata")
+		return
+	}
+
+	var srcmd *ObjectMD
+	if srcVersionID != "" {
+		srcmd, status, errmsg = s.getObjectVersion(ctx, srcbk, srcobj, srcVersionID)
+		if status == StatusOK && srcmd.DeleteMarker {
+			// S3 does not allow the delete marker as the copy source
+			status, errmsg = InvalidRequest, "InvalidRequest: the copy source is a delete marker"
+		}
+	} else {
+		srcmd, status, errmsg = s.getObjectMD(ctx, r, srcbk, srcobj)
+	}
+	if status != StatusOK {
+		glog.Errorln("failed to get the copy source", requuid, srcbk, srcobj, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = checkConditions(r.Header, srcmd, copySourceConditions, PreconditionFailed)
+	if status != StatusOK {
+		glog.Errorln("copy source condition failed", requuid, srcbk, srcobj, srcmd.Smd.Etag, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// the SSE-C source requires the x-amz-copy-source-* customer key
+	srcCipher, status, errmsg := s.sse.objectCipher(ctx, r.Header, srcmd.Sse, true)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// the acl is not copied, the new object gets the acl of the request
+	acl, status, errmsg := parseACLHeaders(r.Header, getOwnerID(ctx), bucketOwnerID(bmd))
+	if status != StatusOK {
+		glog.Errorln("invalid acl", requuid, bkname, objname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// the encryption is not copied, the new object gets the encryption of the request
+	sse, cipher, status, errmsg := s.sse.parseSSEHeaders(ctx, r.Header, bucketOwnerID(bmd))
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// the object lock is not copied, the new object gets the lock of the request
+	lockmd := &ObjectMD{}
+	status, errmsg = parseLockHeaders(r.Header, bmd, lockmd)
+	if status != StatusOK {
+		glog.Errorln("invalid object lock", requuid, bkname, objname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	blocks, status, errmsg := getObjectBlocks(ctx, s.s3io, srcmd)
+	if status != StatusOK {
+		glog.Errorln("failed to get the copy source blocks", requuid, srcbk, srcobj, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	ddBlocks := int64(len(blocks))
+	if !sameCipher(srcCipher, cipher) {
+		blocks, ddBlocks, status, errmsg = recryptBlocks(ctx, s.s3io, s.gc, blocks, srcmd.Data.BlockSize,
+			srcCipher, cipher)
+		if status != StatusOK {
+			glog.Errorln("failed to re-encrypt the copy source blocks", requuid, srcbk, srcobj, status, errmsg)
+			writeError(w, r, status, errmsg)
+			return
+		}
+	}
+
+	md := newObjectMD(requuid, bkname, objname)
+	md.Smd.Size = srcmd.Smd.Size
+	md.Smd.Etag = srcmd.Smd.Etag
+	md.Data.DdBlocks = ddBlocks
+	md.Sse = sse
+	if directive == MetadataDirectiveCopy {
+		md.Umd = srcmd.Umd
+		copyEntityHeaders(md.Smd, srcmd.Smd)
+	} else {
+		md.Umd = umd
+		parseEntityHeaders(r.Header, md.Smd)
+	}
+	if tagDirective == TaggingDirectiveCopy {
+		md.Tags = srcmd.Tags
+	} else {
+		md.Tags = tags
+	}
+	md.Acl = acl
+	md.LockMode = lockmd.LockMode
+	md.LockRetainUntil = lockmd.LockRetainUntil
+	md.LegalHold = lockmd.LegalHold
+
+	status, errmsg = setObjectBlocks(ctx, s.s3io, md, blocks)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = commitObjectMD(ctx, s.s3io, s.gc, s.journal, bmd, md, blocks, nil)
+	if status != StatusOK {
+		glog.Errorln("failed to commit the copied object", requuid, bkname, objname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	glog.V(0).Infoln("copy object success", requuid, srcbk, srcobj, "to", bkname, objname,
+		"blocks", len(blocks), md.Smd.Etag)
+
+	res := &copyObjectResult{Xmlns: XMLNS, ETag: md.Smd.Etag,
+		LastModified: time.Unix(md.Smd.Mtime, 0).UTC().Format(time.RFC3339)}
+	setVersionHeader(w, bmd, md)
+	setSSEHeaders(w, md.Sse)
+	if srcmd.VersionId != "" {
+		w.Header().Set(CopySourceVersionID, srcmd.VersionId)
+	}
+	writeXMLResponse(ctx, w, res)
+}
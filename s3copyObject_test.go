@@ -0,0 +1,122 @@
+package test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testWriteCountIO counts the data block writes
+type testWriteCountIO struct {
+	CloudIO
+
+	mu          sync.Mutex
+	blockWrites int
+}
+
+func (c *testWriteCountIO) WriteDataBlock(buf []byte, md5str string) (status int, errmsg string) {
+	c.mu.Lock()
+	c.blockWrites++
+	c.mu.Unlock()
+	return c.CloudIO.WriteDataBlock(buf, md5str)
+}
+
+func (c *testWriteCountIO) reset() (blockWrites int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blockWrites, c.blockWrites = c.blockWrites, 0
+	return blockWrites
+}
+
+// testUserMetadata returns the user metadata of the response, the header key
+// is not canonicalized.
+func testUserMetadata(w *httptest.ResponseRecorder, key string) string {
+	if v := w.Header()[UserMetadataPrefix+key]; len(v) != 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func TestCopyObject(t *testing.T) {
+	s := newTestS3Server(t)
+	wio := &testWriteCountIO{CloudIO: s.s3io}
+	s.s3io = wio
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+	testS3OK(t, s, "PUT", "/bk2", nil, nil)
+
+	// 3 DataParts, the middle part is the data part object
+	data := testObjectData(2*MaxDataBlocks*DataBlockSize + 1000)
+	testS3OK(t, s, "PUT", "/bk/src%201", map[string]string{ContentType: "text/plain", "x-amz-meta-k": "v"}, data)
+	srcmd := testReadObjectMD(t, s, "bk", "/src 1")
+	blocks := testObjectBlocks(t, s, srcmd)
+	wio.reset()
+
+	// copy to the other bucket only references the source blocks
+	w := testS3OK(t, s, "PUT", "/bk2/dst", map[string]string{CopySource: "/bk/src%201"}, nil)
+	res := &copyObjectResult{}
+	if err := xml.Unmarshal(w.Body.Bytes(), res); err != nil || res.ETag != srcmd.Smd.Etag {
+		t.Fatal("CopyObjectResult", err, w.Body.String())
+	}
+	if n := wio.reset(); n != 0 {
+		t.Fatal("copy writes the data blocks", n)
+	}
+	dstmd := testReadObjectMD(t, s, "bk2", "/dst")
+	if !reflect.DeepEqual(testObjectBlocks(t, s, dstmd), blocks) || !testHasBlockRef(t, s, dstmd, blocks) {
+		t.Fatal("the copied object does not reference the source blocks")
+	}
+
+	// the metadata is copied by default, and replaced with REPLACE
+	w = testS3OK(t, s, "GET", "/bk2/dst", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), data) || w.Header().Get(ETag) != srcmd.Smd.Etag {
+		t.Fatal("copied object data mismatch", w.Body.Len(), w.Header().Get(ETag))
+	}
+	if w.Header().Get(ContentType) != "text/plain" || testUserMetadata(w, "k") != "v" {
+		t.Fatal("the metadata is not copied", w.Header())
+	}
+	testS3OK(t, s, "PUT", "/bk2/dst", map[string]string{CopySource: "bk2/dst",
+		MetadataDirective: MetadataDirectiveReplace, "x-amz-meta-k2": "v2"}, nil)
+	w = testS3OK(t, s, "HEAD", "/bk2/dst", nil, nil)
+	if w.Header().Get(ContentType) != DefaultContentType || testUserMetadata(w, "k") != "" ||
+		testUserMetadata(w, "k2") != "v2" {
+		t.Fatal("the metadata is not replaced", w.Header())
+	}
+
+	tests := []struct {
+		name string
+		hdr  map[string]string
+		code string
+	}{
+		{"invalid source", map[string]string{CopySource: "bk"}, "InvalidArgument"},
+		{"invalid directive", map[string]string{CopySource: "bk/src%201", MetadataDirective: "MOVE"}, "InvalidArgument"},
+		{"to itself", map[string]string{CopySource: "bk2/dst"}, "InvalidRequest"},
+		{"no source key", map[string]string{CopySource: "bk/nokey"}, "NoSuchKey"},
+		{"if match", map[string]string{CopySource: "bk/src%201", CopySourceIfMatch: "nomatch"}, "PreconditionFailed"},
+		{"if none match", map[string]string{CopySource: "bk/src%201", CopySourceIfNoneMatch: srcmd.Smd.Etag},
+			"PreconditionFailed"},
+	}
+	for _, tt := range tests {
+		if code := testS3ErrorCode(testS3Request(s, "PUT", "/bk2/dst", tt.hdr, nil)); code != tt.code {
+			t.Errorf("%s: error %q, want %q", tt.name, code, tt.code)
+		}
+	}
+
+	// the copied blocks are kept after the source is deleted
+	testS3OK(t, s, "DELETE", "/bk/src%201", nil, nil)
+	s.journal.ApplyBucket("bk")
+	s.journal.ApplyBucket("bk2")
+	s.gc.Collect()
+	testBackdateBlocks(s.gc, true, true, int64(*gcGraceSecs))
+	s.gc.Collect()
+	for _, md5str := range blocks {
+		if !s.s3io.IsDataBlockExist(md5str) {
+			t.Fatal("the copied block is deleted", md5str)
+		}
+	}
+	w = testS3OK(t, s, "GET", "/bk2/dst", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatal("copied object data mismatch after the source is deleted", w.Body.Len())
+	}
+}
@@ -0,0 +1,302 @@
+package test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"test/util"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// Bucket CORS.
+//
+// The CORS rules are stored in the BucketMD. The preflight OPTIONS request
+// is not signed, it is answered by the rules without authentication. The
+// actual request with the Origin header gets the Access-Control-* headers of
+// the first matched rule.
+
+type corsRule struct {
+	ID             string   `xml:"ID,omitempty"`
+	AllowedOrigins []string `xml:"AllowedOrigin"`
+	AllowedMethods []string `xml:"AllowedMethod"`
+	AllowedHeaders []string `xml:"AllowedHeader,omitempty"`
+	ExposeHeaders  []string `xml:"ExposeHeader,omitempty"`
+	MaxAgeSeconds  int32    `xml:"MaxAgeSeconds,omitempty"`
+}
+
+type corsConfiguration struct {
+	XMLName xml.Name   `xml:"CORSConfiguration"`
+	Xmlns   string     `xml:"xmlns,attr,omitempty"`
+	Rules   []corsRule `xml:"CORSRule"`
+}
+
+var corsMethods = map[string]bool{"GET": true, "PUT": true, "POST": true, "DELETE": true, "HEAD": true}
+
+// wildcardMatch matches s with the pattern that has at most one "*"
+func wildcardMatch(pattern string, s string) bool {
+	i := strings.Index(pattern, "*")
+	if i == -1 {
+		return pattern == s
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(s) >= len(prefix)+len(suffix) && strings.HasPrefix(s, prefix) && strings.HasSuffix(s, suffix)
+}
+
+// checkCorsRule checks the origins and headers have at most one "*", and
+// the methods are supported.
+func checkCorsRule(rule *corsRule) (status int, errmsg string) {
+	if len(rule.AllowedOrigins) == 0 || len(rule.AllowedMethods) == 0 {
+		return MalformedXML, "MalformedXML"
+	}
+	for _, m := range rule.AllowedMethods {
+		if !corsMethods[m] {
+			return InvalidRequest, "InvalidRequest: unsupported CORS method " + m
+		}
+	}
+	for _, o := range rule.AllowedOrigins {
+		if strings.Count(o, "*") > 1 {
+			return InvalidRequest, "InvalidRequest: AllowedOrigin can have at most one * wildcard"
+		}
+	}
+	for _, h := range rule.AllowedHeaders {
+		if strings.Count(h, "*") > 1 {
+			return InvalidRequest, "InvalidRequest: AllowedHeader can have at most one * wildcard"
+		}
+	}
+	return StatusOK, StatusOKStr
+}
+
+// matchCorsRule returns the first rule that allows the origin, method and
+// headers, and the matched origin pattern.
+func matchCorsRule(rules []*CorsRule, origin string, method string,
+	headers []string) (rule *CorsRule, originPattern string) {
+	for _, rule := range rules {
+		originPattern = ""
+		for _, o := range rule.AllowedOrigins {
+			if wildcardMatch(o, origin) {
+				originPattern = o
+				break
+			}
+		}
+		if originPattern == "" {
+			continue
+		}
+
+		methodOK := false
+		for _, m := range rule.AllowedMethods {
+			if m == method {
+				methodOK = true
+				break
+			}
+		}
+		if !methodOK {
+			continue
+		}
+
+		headersOK := true
+		for _, h := range headers {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if h == "" {
+				continue
+			}
+			allowed := false
+			for _, ah := range rule.AllowedHeaders {
+				if wildcardMatch(strings.ToLower(ah), h) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				headersOK = false
+				break
+			}
+		}
+		if headersOK {
+			return rule, originPattern
+		}
+	}
+	return nil, ""
+}
+
+// setCorsHeaders sets the Access-Control-* headers of the matched rule
+func setCorsHeaders(w http.ResponseWriter, rule *CorsRule, origin string, originPattern string) {
+	if originPattern == "*" {
+		w.Header().Set(AccessControlAllowOrigin, "*")
+	} else {
+		w.Header().Set(AccessControlAllowOrigin, origin)
+		w.Header().Set(AccessControlAllowCredentials, "true")
+	}
+	w.Header().Set(AccessControlAllowMethods, strings.Join(rule.AllowedMethods, ", "))
+	if len(rule.ExposeHeaders) != 0 {
+		w.Header().Set(AccessControlExposeHeaders, strings.Join(rule.ExposeHeaders, ", "))
+	}
+	if rule.MaxAgeSeconds > 0 {
+		w.Header().Set(AccessControlMaxAge, strconv.Itoa(int(rule.MaxAgeSeconds)))
+	}
+	w.Header().Add(Vary, Origin)
+}
+
+// setCorsResponseHeaders sets the Access-Control-* headers for the actual
+// request, if the request has the Origin header and matches the bucket rule.
+func (s *S3Server) setCorsResponseHeaders(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	origin := r.Header.Get(Origin)
+	if origin == "" {
+		return
+	}
+
+	bmd, status, _ := s.bmds.Get(ctx, bkname)
+	if status != StatusOK || len(bmd.CorsRules) == 0 {
+		return
+	}
+
+	rule, originPattern := matchCorsRule(bmd.CorsRules, origin, r.Method, nil)
+	if rule != nil {
+		setCorsHeaders(w, rule, origin, originPattern)
+	}
+}
+
+// preflight handles the CORS preflight request, OPTIONS /bucket/key
+func (s *S3Server) preflight(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	origin := r.Header.Get(Origin)
+	method := r.Header.Get(AccessControlRequestMethod)
+	if origin == "" || method == "" {
+		glog.Errorln("preflight without origin or method", requuid, bkname, origin, method)
+		writeError(w, r, InvalidRequest, "InvalidRequest: Insufficient information. Origin and method request headers needed.")
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	var headers []string
+	if h := r.Header.Get(AccessControlRequestHeaders); h != "" {
+		headers = strings.Split(h, ",")
+	}
+
+	rule, originPattern := matchCorsRule(bmd.CorsRules, origin, method, headers)
+	if rule == nil {
+		glog.Errorln("CORS request is not allowed", requuid, bkname, origin, method, headers)
+		writeError(w, r, AccessForbidden, "AccessForbidden: CORSResponse: This CORS request is not allowed.")
+		return
+	}
+
+	setCorsHeaders(w, rule, origin, originPattern)
+	setHeaderIfNotEmpty(w, AccessControlAllowHeaders, r.Header.Get(AccessControlRequestHeaders))
+	w.Header().Add(Vary, AccessControlRequestMethod)
+	w.Header().Add(Vary, AccessControlRequestHeaders)
+
+	glog.V(1).Infoln("preflight allowed", requuid, bkname, origin, method, rule.Id)
+	w.WriteHeader(StatusOK)
+}
+
+// putBucketCors handles PUT /bucket?cors
+func (s *S3Server) putBucketCors(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("put bucket cors failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read cors configuration", requuid, bkname, err)
+		writeError(w, r, InternalError, "failed to read request body")
+		return
+	}
+
+	conf := &corsConfiguration{}
+	err = xml.Unmarshal(b, conf)
+	if err != nil || len(conf.Rules) == 0 || len(conf.Rules) > MaxCorsRules {
+		glog.Errorln("invalid cors configuration", requuid, bkname, len(conf.Rules), err)
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+
+	var rules []*CorsRule
+	for i := range conf.Rules {
+		rule := &conf.Rules[i]
+		status, errmsg = checkCorsRule(rule)
+		if status != StatusOK {
+			glog.Errorln("invalid cors rule", requuid, bkname, rule, status, errmsg)
+			writeError(w, r, status, errmsg)
+			return
+		}
+		rules = append(rules, &CorsRule{Id: rule.ID, AllowedOrigins: rule.AllowedOrigins,
+			AllowedMethods: rule.AllowedMethods, AllowedHeaders: rule.AllowedHeaders,
+			ExposeHeaders: rule.ExposeHeaders, MaxAgeSeconds: rule.MaxAgeSeconds})
+	}
+
+	status, errmsg = s.setBucketCors(ctx, bkname, rules)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(StatusOK)
+}
+
+func (s *S3Server) setBucketCors(ctx context.Context, bkname string, rules []*CorsRule) (status int, errmsg string) {
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	bmd = proto.Clone(bmd).(*BucketMD)
+	bmd.CorsRules = rules
+	return s.bmds.Put(ctx, bkname, bmd)
+}
+
+// getBucketCors handles GET /bucket?cors
+func (s *S3Server) getBucketCors(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if len(bmd.CorsRules) == 0 {
+		writeError(w, r, NoSuchCORSConfiguration, "NoSuchCORSConfiguration")
+		return
+	}
+
+	res := &corsConfiguration{Xmlns: XMLNS}
+	for _, rule := range bmd.CorsRules {
+		res.Rules = append(res.Rules, corsRule{ID: rule.Id, AllowedOrigins: rule.AllowedOrigins,
+			AllowedMethods: rule.AllowedMethods, AllowedHeaders: rule.AllowedHeaders,
+			ExposeHeaders: rule.ExposeHeaders, MaxAgeSeconds: rule.MaxAgeSeconds})
+	}
+	writeXMLResponse(ctx, w, res)
+}
+
+// deleteBucketCors handles DELETE /bucket?cors
+func (s *S3Server) deleteBucketCors(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = s.setBucketCors(ctx, bkname, nil)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"test/util"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Multi-object delete.
+//
+// The objects are deleted one by one with the same path of the single object
+// delete. For the unversioned bucket, the DeleteEntries of all objects are
+// logged as one journal record, so the whole request costs one fsync.
+
+type deleteObjectsRequest struct {
+	XMLName xml.Name             `xml:"Delete"`
+	Quiet   bool                 `xml:"Quiet"`
+	Objects []deleteObjectsEntry `xml:"Object"`
+}
+
+type deleteObjectsEntry struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId,omitempty"`
+}
+
+type deletedObject struct {
+	Key                   string `xml:"Key"`
+	VersionID             string `xml:"VersionId,omitempty"`
+	DeleteMarker          bool   `xml:"DeleteMarker,omitempty"`
+	DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId,omitempty"`
+}
+
+type deleteError struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId,omitempty"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+}
+
+type deleteObjectsResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+func newDeleteError(obj deleteObjectsEntry, status int, errmsg string) deleteError {
+	code, message := getS3Error(status, errmsg)
+	return deleteError{Key: obj.Key, VersionID: obj.VersionID, Code: code, Message: message}
+}
+
+// deleteObjects handles POST /bucket?delete
+func (s *S3Server) deleteObjects(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("delete objects failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read delete objects request", requuid, bkname, err)
+		writeError(w, r, InternalError, "failed to read request body")
+		return
+	}
+
+	req := &deleteObjectsRequest{}
+	err = xml.Unmarshal(b, req)
+	if err != nil {
+		glog.Errorln("invalid delete objects request", requuid, bkname, err)
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > MaxDeleteObjects {
+		glog.Errorln("invalid delete objects number", requuid, bkname, len(req.Objects))
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	res := &deleteObjectsResult{Xmlns: XMLNS}
+
+	// the deleted objects of the unversioned bucket, added to the result
+	// after the entries are logged
+	var entries []*DeleteEntry
+	var batched []deleteObjectsEntry
+	logged := make(map[string]bool)
+
+	for _, obj := range req.Objects {
+		objname := "/" + obj.Key
+
+		action := "s3:DeleteObject"
+		if obj.VersionID != "" {
+			action = "s3:DeleteObjectVersion"
+		}
+		status, errmsg := s.authorizeAction(ctx, r, bkname, objname, obj.VersionID, action)
+		if status != StatusOK {
+			res.Errors = append(res.Errors, newDeleteError(obj, status, errmsg))
+			continue
+		}
+
+		if obj.VersionID != "" {
+			bypass := s.bypassGovernance(ctx, r, bkname, objname, obj.VersionID)
+			md, status, errmsg := s.deleteObjectVersion(ctx, bkname, objname, obj.VersionID, bypass)
+			if status != StatusOK {
+				res.Errors = append(res.Errors, newDeleteError(obj, status, errmsg))
+				continue
+			}
+			deleted := deletedObject{Key: obj.Key, VersionID: obj.VersionID}
+			if md != nil && md.DeleteMarker {
+				deleted.DeleteMarker = true
+				deleted.DeleteMarkerVersionID = obj.VersionID
+			}
+			res.Deleted = append(res.Deleted, deleted)
+			continue
+		}
+
+		if bmd.Versioning != "" {
+			marker, status, errmsg := s.createDeleteMarker(ctx, bmd, bkname, objname, "")
+			if status != StatusOK {
+				res.Errors = append(res.Errors, newDeleteError(obj, status, errmsg))
+				continue
+			}
+			res.Deleted = append(res.Deleted, deletedObject{Key: obj.Key, DeleteMarker: true,
+				DeleteMarkerVersionID: objectVersionID(marker)})
+			continue
+		}
+
+		if !logged[objname] {
+			entry, status, errmsg := s.getDeleteEntry(ctx, bkname, objname)
+			if status != StatusOK {
+				res.Errors = append(res.Errors, newDeleteError(obj, status, errmsg))
+				continue
+			}
+			if entry != nil {
+				entries = append(entries, entry)
+			}
+			logged[objname] = true
+		}
+		batched = append(batched, obj)
+	}
+
+	if len(entries) != 0 {
+		status, errmsg = s.journal.Log(ctx, entries)
+		if status != StatusOK {
+			glog.Errorln("failed to log deletes", requuid, bkname, len(entries), status, errmsg)
+			for _, obj := range batched {
+				res.Errors = append(res.Errors, newDeleteError(obj, status, errmsg))
+			}
+			batched = nil
+		}
+	}
+	for _, obj := range batched {
+		res.Deleted = append(res.Deleted, deletedObject{Key: obj.Key})
+	}
+
+	glog.V(0).Infoln("delete objects", requuid, bkname, "deleted", len(res.Deleted), "errors", len(res.Errors))
+
+	if req.Quiet {
+		res.Deleted = nil
+	}
+	writeXMLResponse(ctx, w, res)
+}
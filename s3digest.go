@@ -0,0 +1,79 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"test/util"
+
+	"github.com/golang/glog"
+)
+
+// payloadDigest verifies the request body against the Content-MD5 and
+// x-amz-content-sha256 headers. The md5 of the body is already computed as
+// the etag, only sha256 is computed while the body is read.
+type payloadDigest struct {
+	requuid string
+	// the declared md5 and sha256, nil if not declared
+	md5    []byte
+	sha256 []byte
+	// the sha256 of the read body
+	sha hash.Hash
+}
+
+type hashReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newPayloadDigest parses the digest headers, and wraps the request body to
+// compute sha256 if the payload is signed.
+func newPayloadDigest(requuid string, r *http.Request) (d *payloadDigest, status int, errmsg string) {
+	d = &payloadDigest{requuid: requuid}
+
+	if val := r.Header.Get(ContentMD5); val != "" {
+		b, err := base64.StdEncoding.DecodeString(val)
+		if err != nil || len(b) != 16 {
+			glog.Errorln("invalid Content-MD5", requuid, r.URL, val)
+			return nil, InvalidDigest, "InvalidDigest"
+		}
+		d.md5 = b
+	}
+
+	val := r.Header.Get(util.AmzContentSha256)
+	if val != "" && val != util.UnsignedPayload && !strings.HasPrefix(val, util.StreamingPayloadPrefix) {
+		b, err := hex.DecodeString(val)
+		if err != nil || len(b) != sha256.Size {
+			glog.Errorln("invalid x-amz-content-sha256", requuid, r.URL, val)
+			return nil, InvalidArgument, "InvalidArgument: x-amz-content-sha256 must be UNSIGNED-PAYLOAD, " +
+				"STREAMING-AWS4-HMAC-SHA256-PAYLOAD or a valid sha256 value."
+		}
+		d.sha256 = b
+		d.sha = sha256.New()
+		r.Body = hashReadCloser{io.TeeReader(r.Body, d.sha), r.Body}
+	}
+	return d, StatusOK, StatusOKStr
+}
+
+// verify checks the md5 and sha256 of the whole body. md5sum is the md5 of
+// the body, which is computed as the etag.
+func (d *payloadDigest) verify(md5sum []byte) (status int, errmsg string) {
+	if d.md5 != nil && !bytes.Equal(d.md5, md5sum) {
+		glog.Errorln("Content-MD5 mismatch", d.requuid, hex.EncodeToString(d.md5), hex.EncodeToString(md5sum))
+		return BadDigest, "BadDigest"
+	}
+
+	if d.sha != nil {
+		sum := d.sha.Sum(nil)
+		if !bytes.Equal(d.sha256, sum) {
+			glog.Errorln("x-amz-content-sha256 mismatch", d.requuid, hex.EncodeToString(d.sha256), hex.EncodeToString(sum))
+			return XAmzContentSHA256Mismatch, "XAmzContentSHA256Mismatch"
+		}
+	}
+	return StatusOK, StatusOKStr
+}
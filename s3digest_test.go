@@ -0,0 +1,73 @@
+package test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"test/util"
+	"testing"
+)
+
+func TestPayloadDigest(t *testing.T) {
+	body := []byte("Welcome to Amazon S3.")
+	md5sum := md5.Sum(body)
+	goodMD5 := base64.StdEncoding.EncodeToString(md5sum[:])
+	otherMD5 := md5.Sum([]byte("other"))
+	badMD5 := base64.StdEncoding.EncodeToString(otherMD5[:])
+	goodSHA := util.SHA256Hex(body)
+	badSHA := util.SHA256Hex([]byte("other"))
+
+	tests := []struct {
+		name       string
+		contentMD5 string
+		sha256     string
+		// the error code of newPayloadDigest and verify
+		parseCode  string
+		verifyCode string
+	}{
+		{"no digest", "", "", "", ""},
+		{"content md5", goodMD5, "", "", ""},
+		{"content md5 mismatch", badMD5, "", "", "BadDigest"},
+		{"invalid content md5", "not-base64", "", "InvalidDigest", ""},
+		{"short content md5", base64.StdEncoding.EncodeToString([]byte("short")), "", "InvalidDigest", ""},
+		{"sha256", "", goodSHA, "", ""},
+		{"sha256 mismatch", "", badSHA, "", "XAmzContentSHA256Mismatch"},
+		{"invalid sha256", "", "xyz", "InvalidArgument", ""},
+		{"unsigned payload", "", util.UnsignedPayload, "", ""},
+		{"streaming payload", "", util.StreamingPayload, "", ""},
+		{"both", goodMD5, goodSHA, "", ""},
+		{"both md5 mismatch", badMD5, goodSHA, "", "BadDigest"},
+		{"both sha256 mismatch", goodMD5, badSHA, "", "XAmzContentSHA256Mismatch"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/bk/obj", bytes.NewReader(body))
+		if tt.contentMD5 != "" {
+			r.Header.Set(ContentMD5, tt.contentMD5)
+		}
+		if tt.sha256 != "" {
+			r.Header.Set(util.AmzContentSha256, tt.sha256)
+		}
+
+		d, status, errmsg := newPayloadDigest("requuid", r)
+		if code := testErrorCode(status, errmsg); code != tt.parseCode {
+			t.Errorf("%s: newPayloadDigest error %q %s, want %q", tt.name, code, errmsg, tt.parseCode)
+			continue
+		}
+		if status != StatusOK {
+			continue
+		}
+
+		// the body is read by put, and md5 is computed as the etag
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil || !bytes.Equal(b, body) {
+			t.Fatal(tt.name, "failed to read body", err)
+		}
+		status, errmsg = d.verify(md5sum[:])
+		if code := testErrorCode(status, errmsg); code != tt.verifyCode {
+			t.Errorf("%s: verify error %q %s, want %q", tt.name, code, errmsg, tt.verifyCode)
+		}
+	}
+}
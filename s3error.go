@@ -0,0 +1,159 @@
+package test
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// S3 error response.
+//
+// The functions return the error code and errmsg. The error code is one of
+// the S3 error code constants, such as NoSuchKey, see sysconst.go. The errmsg
+// is the message of the error. The errmsg could be the S3 error code string,
+// such as "NoSuchKey", or "Code: message", the default message is returned
+// for the error code string and the code prefix is removed.
+
+// S3Error is the S3 error code string, the error code and the default message
+type S3Error struct {
+	Code    string
+	ErrCode int
+	Message string
+}
+
+// the S3 errors by the error code string and by the error code
+var s3Errors = map[string]*S3Error{}
+var s3ErrorCodes = map[int]*S3Error{}
+
+var s3ErrorList = []S3Error{
+	{"AccessDenied", AccessDenied, "Access Denied"},
+	{"AccessForbidden", AccessForbidden, "Access Forbidden"},
+	{"AuthorizationHeaderMalformed", AuthorizationHeaderMalformed, "The authorization header is malformed."},
+	{"AuthorizationQueryParametersError", AuthorizationQueryParametersError,
+		"Error parsing the X-Amz-Credential parameter."},
+	{"BadDigest", BadDigest, "The Content-MD5 you specified did not match what we received."},
+	{"BucketAlreadyExists", BucketAlreadyExists, "The requested bucket name is not available."},
+	{"BucketAlreadyOwnedByYou", BucketAlreadyOwnedByYou, "Your previous request to create the named bucket succeeded and you already own it."},
+	{"BucketNotEmpty", BucketNotEmpty, "The bucket you tried to delete is not empty."},
+	{"EntityTooSmall", EntityTooSmall, "Your proposed upload is smaller than the minimum allowed object size."},
+	{"IllegalVersioningConfigurationException", IllegalVersioningConfiguration,
+		"The versioning configuration specified in the request is invalid."},
+	{"IncompleteBody", IncompleteBody, "You did not provide the number of bytes specified by the Content-Length HTTP header."},
+	{"InternalError", InternalError, "We encountered an internal error. Please try again."},
+	{"InvalidAccessKeyId", InvalidAccessKeyID, "The AWS access key Id you provided does not exist in our records."},
+	{"InvalidArgument", InvalidArgument, "Invalid Argument"},
+	{"InvalidBucketName", InvalidBucketName, "The specified bucket is not valid."},
+	{"InvalidBucketState", InvalidBucketState, "The request is not valid with the current state of the bucket."},
+	{"InvalidDigest", InvalidDigest, "The Content-MD5 you specified is not valid."},
+	{"InvalidLocationConstraint", InvalidLocationConstraint, "The specified location constraint is not valid."},
+	{"InvalidPart", InvalidPart, "One or more of the specified parts could not be found."},
+	{"InvalidPartOrder", InvalidPartOrder, "The list of parts was not in ascending order."},
+	{"InvalidRange", InvalidRange, "The requested range is not satisfiable"},
+	{"InvalidRequest", InvalidRequest, "Invalid Request"},
+	{"InvalidTag", InvalidTag, "The tag provided was not a valid tag."},
+	{"InvalidURI", InvalidURI, "Couldn't parse the specified URI."},
+	{"KeyTooLong", KeyTooLong, "Your key is too long."},
+	{"MalformedACLError", MalformedACLError, "The XML you provided was not well-formed or did not validate against our published schema."},
+	{"MalformedPolicy", MalformedPolicy, "Policies must be valid JSON and the first byte must be '{'"},
+	{"MalformedPOSTRequest", MalformedPOSTRequest, "The body of your POST request is not well-formed multipart/form-data."},
+	{"MalformedXML", MalformedXML, "The XML you provided was not well-formed or did not validate against our published schema."},
+	{"MaxMessageLengthExceeded", MaxMessageLengthExceeded, "Your request was too big."},
+	{"MetadataTooLarge", MetadataTooLarge, "Your metadata headers exceed the maximum allowed metadata size."},
+	{"MethodNotAllowed", MethodNotAllowed, "The specified method is not allowed against this resource."},
+	{"MissingContentLength", MissingContentLength, "You must provide the Content-Length HTTP header."},
+	{"MissingRequestBodyError", MissingRequestBodyError, "Request Body is empty"},
+	{"MissingSecurityHeader", MissingSecurityHeader, "Your request is missing a required header."},
+	{"NoSuchBucket", NoSuchBucket, "The specified bucket does not exist"},
+	{"NoSuchBucketPolicy", NoSuchBucketPolicy, "The bucket policy does not exist"},
+	{"NoSuchCORSConfiguration", NoSuchCORSConfiguration, "The CORS configuration does not exist"},
+	{"NoSuchKey", NoSuchKey, "The specified key does not exist."},
+	{"NoSuchLifecycleConfiguration", NoSuchLifecycleConfiguration, "The lifecycle configuration does not exist"},
+	{"NoSuchObjectLockConfiguration", NoSuchObjectLockConfiguration, "The specified object does not have a ObjectLock configuration"},
+	{"NoSuchTagSet", NoSuchTagSet, "The TagSet does not exist"},
+	{"NoSuchUpload", NoSuchUpload, "The specified multipart upload does not exist."},
+	{"NoSuchVersion", NoSuchVersion, "The specified version does not exist."},
+	{"NotImplemented", NotImplemented, "A header you provided implies functionality that is not implemented"},
+	{"ObjectLockConfigurationNotFoundError", ObjectLockConfigurationNotFound,
+		"Object Lock configuration does not exist for this bucket"},
+	{"OperationAborted", OperationAborted, "A conflicting conditional operation is currently in progress against this resource."},
+	{"PreconditionFailed", PreconditionFailed, "At least one of the preconditions you specified did not hold."},
+	{"RequestTimeout", RequestTimeout, "Your socket connection to the server was not read from or written to within the timeout period."},
+	{"RequestTimeTooSkewed", RequestTimeTooSkewed, "The difference between the request time and the current time is too large."},
+	{"SignatureDoesNotMatch", SignatureDoesNotMatch,
+		"The request signature we calculated does not match the signature you provided."},
+	{"ServiceUnavailable", ServiceUnavailable, "Service is unable to handle request."},
+	{"SlowDown", SlowDown, "Please reduce your request rate."},
+	{"TokenRefreshRequired", TokenRefreshRequired, "The provided token must be refreshed."},
+	{"UnexpectedContent", UnexpectedContent, "This request does not support content"},
+	{"XAmzContentSHA256Mismatch", XAmzContentSHA256Mismatch,
+		"The provided 'x-amz-content-sha256' header does not match what was computed."},
+}
+
+func init() {
+	for i := range s3ErrorList {
+		s3Errors[s3ErrorList[i].Code] = &s3ErrorList[i]
+		s3ErrorCodes[s3ErrorList[i].ErrCode] = &s3ErrorList[i]
+	}
+}
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// httpStatus returns the http status of the error code
+func httpStatus(status int) int {
+	return status % 1000
+}
+
+// getS3Error returns the S3 error code string and message of the error code
+// and errmsg
+func getS3Error(status int, errmsg string) (code string, message string) {
+	e, ok := s3ErrorCodes[status]
+	if !ok {
+		if httpStatus(status) >= 500 {
+			e = s3Errors[InternalErrorStr]
+		} else {
+			e = s3Errors["InvalidRequest"]
+		}
+	}
+
+	if errmsg == "" || errmsg == e.Code {
+		return e.Code, e.Message
+	}
+	if i := strings.Index(errmsg, ": "); i > 0 && s3Errors[errmsg[:i]] != nil {
+		return e.Code, errmsg[i+2:]
+	}
+	return e.Code, errmsg
+}
+
+// writeError writes the S3 xml error response. r could be nil if the
+// resource is unknown.
+func writeError(w http.ResponseWriter, r *http.Request, status int, errmsg string) {
+	code, message := getS3Error(status, errmsg)
+
+	res := &errorResponse{Code: code, Message: message, RequestID: w.Header().Get(RequestID)}
+	if r != nil {
+		res.Resource = r.URL.Path
+	}
+
+	b, err := xml.Marshal(res)
+	if err != nil {
+		glog.Errorln("failed to marshal error response", res.RequestID, status, errmsg, err)
+		http.Error(w, errmsg, httpStatus(status))
+		return
+	}
+
+	w.Header().Set(ContentType, "application/xml")
+	w.Header().Set(ContentLength, strconv.Itoa(len(xml.Header)+len(b)))
+	w.WriteHeader(httpStatus(status))
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
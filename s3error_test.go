@@ -0,0 +1,57 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestS3ErrorCodes(t *testing.T) {
+	codes := make(map[int]string)
+	for _, e := range s3ErrorList {
+		if code, ok := codes[e.ErrCode]; ok {
+			t.Errorf("%s has the same error code %d as %s", e.Code, e.ErrCode, code)
+		}
+		codes[e.ErrCode] = e.Code
+		if http.StatusText(httpStatus(e.ErrCode)) == "" {
+			t.Errorf("%s has the invalid http status %d", e.Code, httpStatus(e.ErrCode))
+		}
+	}
+
+	// every http status has the default error
+	for _, e := range s3ErrorList {
+		if _, ok := codes[httpStatus(e.ErrCode)]; !ok {
+			t.Errorf("http status %d has no default error", httpStatus(e.ErrCode))
+		}
+	}
+}
+
+func TestGetS3Error(t *testing.T) {
+	tests := []struct {
+		status  int
+		errmsg  string
+		code    string
+		message string
+	}{
+		{NoSuchKey, "NoSuchKey", "NoSuchKey", "The specified key does not exist."},
+		{NoSuchBucket, "", "NoSuchBucket", "The specified bucket does not exist"},
+		{NoSuchVersion, "NoSuchVersion", "NoSuchVersion", "The specified version does not exist."},
+		{BucketNotEmpty, "BucketNotEmpty: the bucket has versions", "BucketNotEmpty", "the bucket has versions"},
+		{InvalidTag, "duplicate tag key", "InvalidTag", "duplicate tag key"},
+		{InvalidBucketName, "InvalidBucketName: the bucket name is reserved", "InvalidBucketName",
+			"the bucket name is reserved"},
+		{BucketAlreadyOwnedByYou, "BucketAlreadyOwnedByYou", "BucketAlreadyOwnedByYou",
+			"Your previous request to create the named bucket succeeded and you already own it."},
+		// the upstream errors that are not known
+		{http.StatusBadRequest, "ExpiredToken", "InvalidArgument", "ExpiredToken"},
+		{http.StatusBadGateway, "Bad Gateway", "InternalError", "Bad Gateway"},
+		{http.StatusGone, "Gone", "InvalidRequest", "Gone"},
+	}
+
+	for _, tt := range tests {
+		code, message := getS3Error(tt.status, tt.errmsg)
+		if code != tt.code || message != tt.message {
+			t.Errorf("getS3Error(%d, %q) = %q %q, want %q %q", tt.status, tt.errmsg, code, message,
+				tt.code, tt.message)
+		}
+	}
+}
@@ -23,9 +23,13 @@ type S3GetObject struct {
 	requuid string
 
 	objmd *ObjectMD
+	// the cipher of the data blocks, nil if not encrypted
+	cipher *blockCipher
 
 	// the read offset
 	off int64
+	// the end offset of the read range, exclusive
+	end int64
 	// data part of the currBlock
 	currPart dataPartReadResult
 	// the current cached data block
@@ -62,13 +66,14 @@ type dataPartReadResult struct {
 
 // NewS3GetObject creates a S3GetObject instance
 func NewS3GetObject(ctx context.Context, r *http.Request, s3io CloudIO,
-	md *ObjectMD, bkname string, objname string) *S3GetObject {
+	md *ObjectMD, cipher *blockCipher, bkname string, objname string) *S3GetObject {
 	s := new(S3GetObject)
 	s.ctx = ctx
-	s.requuid = s.requuid
+	s.requuid = util.GetReqIDFromContext(ctx)
 	s.r = r
 	s.s3io = s3io
 	s.objmd = md
+	s.cipher = cipher
 	s.bkname = bkname
 	s.objname = objname
 	return s
@@ -93,6 +98,13 @@ func (d *S3GetObject) isLastBlock(partNum int, blkIdx int) bool {
 	return false
 }
 
+// check whether the block is the last block to read in the read range
+func (d *S3GetObject) isLastReadBlock(partNum int, blkIdx int) bool {
+	blockNum := int64(partNum)*int64(d.objmd.Data.MaxBlocks) + int64(blkIdx)
+	lastBlockNum := (d.end - 1) / int64(d.objmd.Data.BlockSize)
+	return blockNum >= lastBlockNum || d.isLastBlock(partNum, blkIdx)
+}
+
 // check to make sure the read block is in currPart
 func (d *S3GetObject) isValidReadBlock(partNum int, blkIdx int) bool {
 	// sanity check
@@ -139,6 +151,9 @@ func (d *S3GetObject) readBlock(partNum int, blkIdx int, b []byte) dataBlockRead
 		res.errmsg = "read less data for a full block"
 	}
 
+	if res.status == StatusOK && d.cipher != nil {
+		d.cipher.decrypt(res.blkmd5, res.buf[:res.n])
+	}
 	return res
 }
 
@@ -221,7 +236,7 @@ func (d *S3GetObject) waitPrefetchBlock(partNum int, blkInPart int) error {
 		d.currBlock = nextBlock
 
 		// prefetch the next block if necessary
-		if d.currBlock.status == StatusOK && !d.isLastBlock(partNum, blkInPart) {
+		if d.currBlock.status == StatusOK && !d.isLastReadBlock(partNum, blkInPart) {
 			if blkInPart == int(d.objmd.Data.MaxBlocks-1) {
 				// read the last block in the currPart, wait prefetch part
 				err := d.waitPrefetchPart()
@@ -288,8 +303,9 @@ func (d *S3GetObject) waitPrefetchPart() error {
 		// the next block is back, switch the current block to the next block
 		d.currPart = nextPart
 
-		// if not last-1 part, prefetch the next part
-		if d.currPart.partNum < totalParts-2 {
+		// if not last-1 part and the read range is not finished, prefetch the next part
+		if d.currPart.partNum < totalParts-2 &&
+			!d.isLastReadBlock(d.currPart.partNum, int(d.objmd.Data.MaxBlocks-1)) {
 			d.waitPart = true
 			go d.prefetchPart(d.currPart.partNum + 1)
 		}
@@ -304,7 +320,7 @@ func (d *S3GetObject) waitPrefetchPart() error {
 }
 
 func (d *S3GetObject) Read(p []byte) (n int, err error) {
-	if d.off >= d.objmd.Smd.Size {
+	if d.off >= d.end {
 		glog.V(1).Infoln("finish read object data", d.requuid, d.bkname, d.objname)
 		return 0, io.EOF
 	}
@@ -350,6 +366,11 @@ func (d *S3GetObject) Read(p []byte) (n int, err error) {
 	glog.V(2).Infoln("fill data from currBlock", d.requuid, "part", partNum,
 		"block", blkIdx, blockOff, "block len", d.currBlock.n, "read offset", d.off, d.bkname, d.objname)
 
+	// do not read beyond the read range
+	if int64(len(p)) > d.end-d.off {
+		p = p[:d.end-d.off]
+	}
+
 	endOff := blockOff + len(p)
 	if endOff <= d.currBlock.n {
 		// currBlock has more data than p
@@ -370,7 +391,7 @@ func (d *S3GetObject) Read(p []byte) (n int, err error) {
 
 	d.off += int64(n)
 
-	if d.off == d.objmd.Smd.Size {
+	if d.off == d.end {
 		return n, io.EOF
 	}
 
@@ -379,33 +400,73 @@ func (d *S3GetObject) Read(p []byte) (n int, err error) {
 
 // GetObject prepares the object read
 func (d *S3GetObject) GetObject() (status int, errmsg string) {
+	return d.GetObjectRange(0, d.objmd.Smd.Size)
+}
+
+// GetObjectRange prepares the read of the object range [start, end).
+// The read starts from the DataPart and block of the start offset directly,
+// the blocks before the range are not read.
+func (d *S3GetObject) GetObjectRange(start int64, end int64) (status int, errmsg string) {
+	d.off = start
+	d.end = end
+
+	data := d.objmd.Data
+	totalParts := len(data.DataParts)
+	blockNum := int(start / int64(data.BlockSize))
+	partNum := blockNum / int(data.MaxBlocks)
+	blkIdx := blockNum % int(data.MaxBlocks)
+
+	// the first and last parts are in ObjectMD, the middle parts need to be read
+	part := data.DataParts[partNum]
+	if partNum != 0 && partNum != totalParts-1 {
+		part, status, errmsg = readDataPart(d.ctx, d.s3io, d.objmd.Smd.Bucket, part.Name)
+		if status != StatusOK {
+			glog.Errorln("read the first data part failed", d.requuid, partNum, status, errmsg, d.bkname, d.objname)
+			return status, errmsg
+		}
+	}
+
 	// synchronously read the first block
-	b := make([]byte, d.objmd.Data.BlockSize)
-	d.currPart = dataPartReadResult{partName: util.GenPartName(d.objmd.Uuid, 0), partNum: 0,
-		part: d.objmd.Data.DataParts[0], status: StatusOK, errmsg: StatusOKStr}
-	d.currBlock = d.readBlock(0, 0, b)
+	b := make([]byte, data.BlockSize)
+	d.currPart = dataPartReadResult{partName: util.GenPartName(d.objmd.Uuid, partNum), partNum: partNum,
+		part: part, status: StatusOK, errmsg: StatusOKStr}
+	d.currBlock = d.readBlock(partNum, blkIdx, b)
 
 	// check the first block read status
 	if d.currBlock.status != StatusOK {
-		glog.Errorln("read first data block failed",
-			d.requuid, d.objmd.Data.DataParts[0].Blocks[0],
+		glog.Errorln("read first data block failed", d.requuid, "part", partNum, "block", blkIdx,
 			d.currBlock.status, d.currBlock.errmsg, d.bkname, d.objname)
 		return d.currBlock.status, d.currBlock.errmsg
 	}
 
-	// if there are more data to read, start the prefetch task
-	if d.objmd.Smd.Size > int64(d.objmd.Data.BlockSize) {
-		d.blockChan = make(chan dataBlockReadResult)
-		nextbuf := make([]byte, d.objmd.Data.BlockSize)
-		d.waitBlock = true
-		go d.prefetchBlock(0, 1, nextbuf)
-	}
+	glog.V(2).Infoln("read range", d.requuid, start, end, "first part", partNum, "block", blkIdx, d.bkname, d.objname)
 
-	// if there are more than 2 parts, start the prefetch task
-	if len(d.objmd.Data.DataParts) > 2 {
+	// if the range goes beyond the current part and the next part is a middle
+	// part, start the prefetch task for the next part
+	if partNum < totalParts-2 && !d.isLastReadBlock(partNum, int(data.MaxBlocks-1)) {
 		d.partChan = make(chan dataPartReadResult)
 		d.waitPart = true
-		go d.prefetchPart(1)
+		go d.prefetchPart(partNum + 1)
+	}
+
+	// if there are more data to read, start the prefetch task
+	if !d.isLastReadBlock(partNum, blkIdx) {
+		d.blockChan = make(chan dataBlockReadResult)
+		nextbuf := make([]byte, data.BlockSize)
+
+		if blkIdx == int(data.MaxBlocks-1) {
+			// the first block is the last block of the part, switch to the next part
+			err := d.waitPrefetchPart()
+			if err != nil {
+				return InternalError, err.Error()
+			}
+
+			d.waitBlock = true
+			go d.prefetchBlock(d.currPart.partNum, 0, nextbuf)
+		} else {
+			d.waitBlock = true
+			go d.prefetchBlock(partNum, blkIdx+1, nextbuf)
+		}
 	}
 
 	return StatusOK, StatusOKStr
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testCountIO counts the data block and data part reads
+type testCountIO struct {
+	CloudIO
+
+	mu         sync.Mutex
+	blockReads int
+	partReads  int
+}
+
+func (c *testCountIO) ReadDataBlockRange(md5str string, off int64, b []byte) (n int, status int, errmsg string) {
+	c.mu.Lock()
+	c.blockReads++
+	c.mu.Unlock()
+	return c.CloudIO.ReadDataBlockRange(md5str, off, b)
+}
+
+func (c *testCountIO) ReadDataPart(bkname string, partName string) (b []byte, status int, errmsg string) {
+	c.mu.Lock()
+	c.partReads++
+	c.mu.Unlock()
+	return c.CloudIO.ReadDataPart(bkname, partName)
+}
+
+func (c *testCountIO) reset() (blockReads int, partReads int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blockReads, partReads = c.blockReads, c.partReads
+	c.blockReads, c.partReads = 0, 0
+	return blockReads, partReads
+}
+
+func TestGetObjectRange(t *testing.T) {
+	s := newTestS3Server(t)
+	cio := &testCountIO{CloudIO: s.s3io}
+	s.s3io = cio
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	// 4 DataParts, the first and last parts are in ObjectMD
+	partSize := int64(MaxDataBlocks * DataBlockSize)
+	size := 3*partSize + 1000
+	data := testObjectData(int(size))
+	testS3OK(t, s, "PUT", "/bk/obj", nil, data)
+	cio.reset()
+
+	tests := []struct {
+		name string
+		rg   string
+		// the expected range [start, end)
+		start int64
+		end   int64
+		// the blocks and the middle data parts to read
+		blockReads int
+		partReads  int
+	}{
+		{"first byte", "bytes=0-0", 0, 1, 1, 0},
+		{"in block", "bytes=100-199", 100, 200, 1, 0},
+		{"cross blocks", "bytes=131000-131100", 131000, 131101, 2, 0},
+		{"cross data parts", "bytes=" + strconv.FormatInt(partSize-10, 10) + "-" + strconv.FormatInt(partSize+9, 10),
+			partSize - 10, partSize + 10, 2, 1},
+		{"middle data part", "bytes=" + strconv.FormatInt(2*partSize+1, 10) + "-" + strconv.FormatInt(2*partSize+2, 10),
+			2*partSize + 1, 2*partSize + 3, 1, 1},
+		{"last data part", "bytes=" + strconv.FormatInt(3*partSize+10, 10) + "-", 3*partSize + 10, size, 1, 0},
+		{"suffix", "bytes=-500", size - 500, size, 1, 0},
+		{"suffix larger than size", "bytes=-" + strconv.FormatInt(size+1, 10), 0, size, 13, 2},
+		{"end beyond size", "bytes=" + strconv.FormatInt(size-1, 10) + "-" + strconv.FormatInt(size+100, 10),
+			size - 1, size, 1, 0},
+	}
+
+	for _, tt := range tests {
+		w := testS3Request(s, "GET", "/bk/obj", map[string]string{Range: tt.rg}, nil)
+		if w.Code != 206 {
+			t.Errorf("%s: status %d, want 206", tt.name, w.Code)
+			continue
+		}
+		if !bytes.Equal(w.Body.Bytes(), data[tt.start:tt.end]) {
+			t.Errorf("%s: data mismatch, len %d, want %d", tt.name, w.Body.Len(), tt.end-tt.start)
+		}
+		contentRange := "bytes " + strconv.FormatInt(tt.start, 10) + "-" + strconv.FormatInt(tt.end-1, 10) +
+			"/" + strconv.FormatInt(size, 10)
+		if w.Header().Get(ContentRange) != contentRange {
+			t.Errorf("%s: Content-Range %s, want %s", tt.name, w.Header().Get(ContentRange), contentRange)
+		}
+		blockReads, partReads := cio.reset()
+		if blockReads != tt.blockReads || partReads != tt.partReads {
+			t.Errorf("%s: read blocks %d parts %d, want %d %d", tt.name, blockReads, partReads,
+				tt.blockReads, tt.partReads)
+		}
+	}
+
+	// the invalid range is ignored
+	for _, rg := range []string{"bytes=10", "bytes=5-1", "bytes=0-1,5-6", "items=0-1"} {
+		w := testS3Request(s, "GET", "/bk/obj", map[string]string{Range: rg}, nil)
+		if w.Code != 200 || w.Body.Len() != len(data) {
+			t.Errorf("%s: status %d len %d, want the whole object", rg, w.Code, w.Body.Len())
+		}
+	}
+
+	// the unsatisfiable range
+	for _, rg := range []string{"bytes=" + strconv.FormatInt(size, 10) + "-", "bytes=-0"} {
+		w := testS3Request(s, "GET", "/bk/obj", map[string]string{Range: rg}, nil)
+		if code := testS3ErrorCode(w); w.Code != 416 || code != "InvalidRange" {
+			t.Errorf("%s: status %d %s, want InvalidRange", rg, w.Code, code)
+		}
+	}
+}
@@ -0,0 +1,723 @@
+package test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var s3Endpoint = flag.String("s3endpoint", "http://127.0.0.1:9000", "the endpoint of the upstream S3 for the cloudio ioengine")
+var s3Region = flag.String("s3region", "us-east-1", "the region of the upstream S3")
+var s3AccessKey = flag.String("s3accesskey", "", "the access key of the upstream S3, default is env AWS_ACCESS_KEY_ID")
+var s3SecretKey = flag.String("s3secretkey", "", "the secret key of the upstream S3, default is env AWS_SECRET_ACCESS_KEY")
+var s3DataBucket = flag.String("s3databucket", "clouddd-data", "the upstream bucket of the data blocks")
+var s3PartBucket = flag.String("s3partbucket", "clouddd-part", "the upstream bucket of the data parts, uploads and block refs")
+
+// Misc const definition for S3IO
+const (
+	// the user metadata of the ObjectMD object, for bucket list
+	s3MetaSize  = "X-Amz-Meta-Dd-Size"
+	s3MetaEtag  = "X-Amz-Meta-Dd-Etag"
+	s3MetaMtime = "X-Amz-Meta-Dd-Mtime"
+
+	// the key prefixes in the part bucket
+	s3UploadPrefix   = "upload/"
+	s3RefPrefix      = "refs/"
+	s3BucketMDPrefix = "bucketmd/"
+	s3VersionPrefix  = "version/"
+	s3VIndexPrefix   = "vindex/"
+
+	// the concurrent heads to get the list metadata
+	s3ListHeadConcurrency = 16
+)
+
+// S3IO is the CloudIO engine that stores everything in an upstream S3
+// compatible object store.
+//
+// Every bucket is created as the same name bucket in the upstream S3, and the
+// ObjectMD is stored as the object with the same key. The data blocks are
+// stored in the data bucket with md5 as key. The data parts are stored in the
+// part bucket as bucket.partName, the multipart uploads as upload/bucket/uploadID,
+// the BlockRefs as refs/md5, the BucketMD as bucketmd/bucket, and the ObjectMD
+// versions as version/bucket/key/versionID. The object that has versions is
+// indexed by the empty object vindex/bucket/key, as the version keys are not
+// sorted in the order of the object names. The names of the data and part
+// buckets are reserved, they could not be used as the user buckets.
+//
+// The list metadata, size, etag and mtime, is stored as the user metadata of
+// the ObjectMD object. The bucket list asks for the user metadata with
+// metadata=true, which some S3 compatible stores support. If the user metadata
+// is not returned, every listed object is HEAD, but its content is not fetched.
+type S3IO struct {
+	endpoint   string
+	region     string
+	accessKey  string
+	secretKey  string
+	dataBucket string
+	partBucket string
+	client     *http.Client
+
+	// serialize the bucket create and delete in the process
+	bucketLock sync.Mutex
+}
+
+type s3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type s3ListUserMetadata struct {
+	Items []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+type s3ListContent struct {
+	Key          string              `xml:"Key"`
+	LastModified string              `xml:"LastModified"`
+	ETag         string              `xml:"ETag"`
+	Size         int64               `xml:"Size"`
+	UserMetadata *s3ListUserMetadata `xml:"UserMetadata"`
+}
+
+type s3ListResult struct {
+	XMLName     xml.Name        `xml:"ListBucketResult"`
+	IsTruncated bool            `xml:"IsTruncated"`
+	Contents    []s3ListContent `xml:"Contents"`
+}
+
+// NewS3IO creates the S3IO instance, and creates the data and part buckets
+// if they do not exist.
+func NewS3IO(endpoint string, region string, accessKey string, secretKey string,
+	dataBucket string, partBucket string) *S3IO {
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	c := new(S3IO)
+	c.endpoint = strings.TrimSuffix(endpoint, "/")
+	c.region = region
+	c.accessKey = accessKey
+	c.secretKey = secretKey
+	c.dataBucket = dataBucket
+	c.partBucket = partBucket
+	c.client = &http.Client{Timeout: RWTimeOutSecs * time.Second}
+
+	for _, bkname := range []string{dataBucket, partBucket} {
+		status, errmsg := c.HeadBucket(bkname)
+		if status == StatusOK {
+			continue
+		}
+		status, errmsg = c.createBucket(bkname)
+		if status != StatusOK {
+			glog.Errorln("failed to create the upstream bucket", c.endpoint, bkname, status, errmsg)
+			return nil
+		}
+	}
+
+	glog.Infoln("created S3IO", c.endpoint, c.region, dataBucket, partBucket)
+	return c
+}
+
+// do sends the signed request to the upstream S3, and returns the response
+// body and headers. If the request fails, status is the error code of the
+// upstream S3 error, or the http status if the error is unknown, and errmsg
+// is the S3 error code string.
+func (c *S3IO) do(method string, bkname string, key string, query url.Values, hdr http.Header,
+	body []byte) (b []byte, resphdr http.Header, status int, errmsg string) {
+	path := "/" + bkname
+	if key != "" {
+		path += "/" + key
+	}
+	u := c.endpoint + util.URIEncode(path, false)
+	if len(query) != 0 {
+		u += "?" + util.CanonicalQueryString(query, "")
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		glog.Errorln("failed to create upstream request", method, u, err)
+		return nil, nil, InternalError, InternalErrorStr
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+
+	if c.accessKey != "" {
+		payloadHash := util.EmptyPayloadHash
+		if len(body) != 0 {
+			payloadHash = util.SHA256Hex(body)
+		}
+		util.SignRequest(req, c.accessKey, c.secretKey, c.region, payloadHash, time.Now())
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		glog.Errorln("failed to send upstream request", method, u, err)
+		return nil, nil, ServiceUnavailable, "failed to send upstream request"
+	}
+	defer resp.Body.Close()
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		glog.Errorln("failed to read upstream response", method, u, resp.StatusCode, err)
+		return nil, nil, InternalError, "failed to read upstream response"
+	}
+
+	if resp.StatusCode >= 300 {
+		// return the error code of the upstream S3 error, the http status
+		// is the default error code of the status
+		status, errmsg = resp.StatusCode, http.StatusText(resp.StatusCode)
+		res := &s3ErrorResponse{}
+		if xml.Unmarshal(b, res) == nil && res.Code != "" {
+			errmsg = res.Code
+			if e, ok := s3Errors[res.Code]; ok && httpStatus(e.ErrCode) == resp.StatusCode {
+				status = e.ErrCode
+			}
+		}
+		glog.V(2).Infoln("upstream request failed", method, u, resp.StatusCode, errmsg)
+		return nil, resp.Header, status, errmsg
+	}
+
+	return b, resp.Header, StatusOK, StatusOKStr
+}
+
+// list the keys with prefix after marker
+func (c *S3IO) list(bkname string, prefix string, marker string, maxKeys int,
+	withMetadata bool) (res *s3ListResult, status int, errmsg string) {
+	q := url.Values{}
+	q.Set(BucketListOp, "2")
+	q.Set("max-keys", strconv.Itoa(maxKeys))
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if marker != "" {
+		q.Set("start-after", marker)
+	}
+	if withMetadata {
+		q.Set("metadata", "true")
+	}
+
+	b, _, status, errmsg := c.do("GET", bkname, "", q, nil, nil)
+	if status != StatusOK {
+		glog.Errorln("failed to list upstream bucket", bkname, prefix, marker, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	res = &s3ListResult{}
+	err := xml.Unmarshal(b, res)
+	if err != nil {
+		glog.Errorln("failed to unmarshal upstream list result", bkname, prefix, marker, err)
+		return nil, InternalError, "failed to unmarshal upstream list result"
+	}
+	return res, StatusOK, StatusOKStr
+}
+
+// list all keys with prefix, the prefix is removed from the returned keys
+func (c *S3IO) listAll(bkname string, prefix string) (keys []string, status int, errmsg string) {
+	marker := ""
+	for {
+		res, status, errmsg := c.list(bkname, prefix, marker, BucketListMaxKeys, false)
+		if status != StatusOK {
+			return nil, status, errmsg
+		}
+
+		for _, content := range res.Contents {
+			keys = append(keys, strings.TrimPrefix(content.Key, prefix))
+			marker = content.Key
+		}
+
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			return keys, StatusOK, StatusOKStr
+		}
+	}
+}
+
+func (c *S3IO) readObject(bkname string, key string) (b []byte, status int, errmsg string) {
+	b, _, status, errmsg = c.do("GET", bkname, key, nil, nil, nil)
+	if httpStatus(status) == http.StatusNotFound && status != NoSuchBucket {
+		return nil, NoSuchKey, "NoSuchKey"
+	}
+	return b, status, errmsg
+}
+
+func (c *S3IO) writeObject(bkname string, key string, hdr http.Header, b []byte) (status int, errmsg string) {
+	_, _, status, errmsg = c.do("PUT", bkname, key, nil, hdr, b)
+	return status, errmsg
+}
+
+func (c *S3IO) deleteObject(bkname string, key string) (status int, errmsg string) {
+	_, _, status, errmsg = c.do("DELETE", bkname, key, nil, nil, nil)
+	return status, errmsg
+}
+
+func (c *S3IO) createBucket(bkname string) (status int, errmsg string) {
+	_, _, status, errmsg = c.do("PUT", bkname, "", nil, nil, nil)
+	if status != StatusOK {
+		glog.Errorln("failed to create upstream bucket", bkname, status, errmsg)
+	}
+	return status, errmsg
+}
+
+// PutBucket creates the bucket in the upstream S3, and writes the BucketMD.
+// The upstream S3 may succeed to create the bucket that is already owned,
+// such as AWS us-east-1, so the bucket exists if it has the BucketMD. The
+// BucketMD left by the failed DeleteBucket is overwritten.
+func (c *S3IO) PutBucket(bkname string, mdbuf []byte) (status int, errmsg string) {
+	c.bucketLock.Lock()
+	defer c.bucketLock.Unlock()
+
+	_, status, errmsg = c.ReadBucketMD(bkname)
+	if status == StatusOK {
+		status, errmsg = c.HeadBucket(bkname)
+		if status == StatusOK {
+			glog.Errorln("upstream bucket exists", bkname)
+			return BucketAlreadyExists, "BucketAlreadyExists"
+		}
+		if status != NoSuchBucket {
+			glog.Errorln("failed to head upstream bucket", bkname, status, errmsg)
+			return status, errmsg
+		}
+	} else if status != NoSuchKey {
+		glog.Errorln("failed to read upstream BucketMD", bkname, status, errmsg)
+		return status, errmsg
+	}
+
+	status, errmsg = c.createBucket(bkname)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	status, errmsg = c.WriteBucketMD(bkname, mdbuf)
+	if status != StatusOK {
+		glog.Errorln("failed to write upstream BucketMD", bkname, status, errmsg)
+		c.deleteObject(bkname, "")
+		return status, errmsg
+	}
+	return StatusOK, StatusOKStr
+}
+
+// DeleteBucket deletes the bucket in the upstream S3
+func (c *S3IO) DeleteBucket(bkname string) (status int, errmsg string) {
+	c.bucketLock.Lock()
+	defer c.bucketLock.Unlock()
+
+	res, status, errmsg := c.list(c.partBucket, s3VersionPrefix+bkname+"/", "", 1, false)
+	if status != StatusOK {
+		return status, errmsg
+	}
+	if len(res.Contents) != 0 {
+		glog.Errorln("bucket has object versions", bkname, res.Contents[0].Key)
+		return BucketNotEmpty, "BucketNotEmpty"
+	}
+
+	status, errmsg = c.deleteObject(bkname, "")
+	if status != StatusOK {
+		glog.Errorln("failed to delete upstream bucket", bkname, status, errmsg)
+		return status, errmsg
+	}
+
+	status, errmsg = c.deleteObject(c.partBucket, s3BucketMDPrefix+bkname)
+	if status != StatusOK && status != NoSuchKey {
+		glog.Errorln("failed to delete upstream BucketMD", bkname, status, errmsg)
+	}
+
+	// remove the index left by the concurrent write and delete of the versions
+	keys, status, errmsg := c.listAll(c.partBucket, s3VIndexPrefix+bkname+"/")
+	if status != StatusOK {
+		glog.Errorln("failed to list upstream version index", bkname, status, errmsg)
+		return StatusOK, StatusOKStr
+	}
+	for _, key := range keys {
+		status, errmsg = c.deleteObject(c.partBucket, s3VIndexPrefix+bkname+"/"+key)
+		if status != StatusOK && status != NoSuchKey {
+			glog.Errorln("failed to delete upstream version index", bkname, key, status, errmsg)
+		}
+	}
+	return StatusOK, StatusOKStr
+}
+
+// IsReservedBucket returns true for the data and part buckets
+func (c *S3IO) IsReservedBucket(bkname string) bool {
+	return bkname == c.dataBucket || bkname == c.partBucket
+}
+
+// HeadBucket checks whether the bucket exists
+func (c *S3IO) HeadBucket(bkname string) (status int, errmsg string) {
+	_, _, status, errmsg = c.do("HEAD", bkname, "", nil, nil, nil)
+	if httpStatus(status) == http.StatusNotFound {
+		return NoSuchBucket, "NoSuchBucket"
+	}
+	return status, errmsg
+}
+
+// ListBuckets lists the BucketMD objects. The upstream S3 may have other
+// buckets, every bucket created by the gateway has the BucketMD.
+func (c *S3IO) ListBuckets() (bknames []string, status int, errmsg string) {
+	return c.listAll(c.partBucket, s3BucketMDPrefix)
+}
+
+// WriteBucketMD writes the BucketMD of the bucket
+func (c *S3IO) WriteBucketMD(bkname string, b []byte) (status int, errmsg string) {
+	return c.writeObject(c.partBucket, s3BucketMDPrefix+bkname, nil, b)
+}
+
+// ReadBucketMD reads the BucketMD of the bucket
+func (c *S3IO) ReadBucketMD(bkname string) (b []byte, status int, errmsg string) {
+	return c.readObject(c.partBucket, s3BucketMDPrefix+bkname)
+}
+
+// ListObjects lists the ObjectMD objects, and returns the list metadata from
+// the user metadata.
+func (c *S3IO) ListObjects(bkname string, prefix string, marker string,
+	maxKeys int) (smds []*ObjectSMD, isTruncated bool, status int, errmsg string) {
+	// the names have the leading "/", the upstream keys do not
+	res, status, errmsg := c.list(bkname, strings.TrimPrefix(prefix, "/"),
+		strings.TrimPrefix(marker, "/"), maxKeys, true)
+	if status != StatusOK {
+		return nil, false, status, errmsg
+	}
+
+	smds = make([]*ObjectSMD, len(res.Contents))
+	var wg sync.WaitGroup
+	sem := make(chan bool, s3ListHeadConcurrency)
+	// the first head failure, except the object is deleted after list
+	var headMu sync.Mutex
+	headStatus, headErrmsg := StatusOK, StatusOKStr
+	for i, content := range res.Contents {
+		smd := &ObjectSMD{Bucket: bkname, Name: "/" + content.Key}
+		smds[i] = smd
+
+		if content.UserMetadata != nil {
+			hdr := http.Header{}
+			for _, item := range content.UserMetadata.Items {
+				hdr.Set(item.XMLName.Local, item.Value)
+			}
+			if c.parseListMetadata(hdr, smd) {
+				continue
+			}
+		}
+
+		// the user metadata is not returned, head the object
+		wg.Add(1)
+		sem <- true
+		go func(key string, smd *ObjectSMD) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			_, hdr, status, errmsg := c.do("HEAD", bkname, key, nil, nil, nil)
+			if httpStatus(status) == http.StatusNotFound {
+				glog.V(1).Infoln("the listed object is deleted", bkname, key)
+				return
+			}
+			if status != StatusOK {
+				glog.Errorln("failed to head the listed object", bkname, key, status, errmsg)
+				headMu.Lock()
+				if headStatus == StatusOK {
+					headStatus, headErrmsg = status, errmsg
+				}
+				headMu.Unlock()
+				return
+			}
+			c.parseListMetadata(hdr, smd)
+		}(content.Key, smd)
+	}
+	wg.Wait()
+
+	if headStatus != StatusOK {
+		return nil, false, headStatus, headErrmsg
+	}
+
+	// skip the objects deleted after list
+	n := 0
+	for _, smd := range smds {
+		if smd.Mtime != 0 {
+			smds[n] = smd
+			n++
+		}
+	}
+
+	return smds[:n], res.IsTruncated, StatusOK, StatusOKStr
+}
+
+func (c *S3IO) parseListMetadata(hdr http.Header, smd *ObjectSMD) bool {
+	size, err1 := strconv.ParseInt(hdr.Get(s3MetaSize), 10, 64)
+	mtime, err2 := strconv.ParseInt(hdr.Get(s3MetaMtime), 10, 64)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	smd.Size = size
+	smd.Mtime = mtime
+	smd.Etag = hdr.Get(s3MetaEtag)
+	return true
+}
+
+// IsDataBlockExist checks if the data block exists
+func (c *S3IO) IsDataBlockExist(md5str string) bool {
+	_, _, status, _ := c.do("HEAD", c.dataBucket, md5str, nil, nil, nil)
+	return status == StatusOK
+}
+
+// WriteDataBlock creates the data block under the data bucket
+func (c *S3IO) WriteDataBlock(buf []byte, md5str string) (status int, errmsg string) {
+	status, errmsg = c.writeObject(c.dataBucket, md5str, nil, buf)
+	if status != StatusOK {
+		glog.Errorln("failed to write upstream data block", md5str, status, errmsg)
+	}
+	return status, errmsg
+}
+
+// ReadDataBlockRange reads the data block
+func (c *S3IO) ReadDataBlockRange(md5str string, off int64, b []byte) (n int, status int, errmsg string) {
+	hdr := http.Header{}
+	hdr.Set(Range, "bytes="+strconv.FormatInt(off, 10)+"-"+strconv.FormatInt(off+int64(len(b))-1, 10))
+
+	data, _, status, errmsg := c.do("GET", c.dataBucket, md5str, nil, hdr, nil)
+	if status == InvalidRange {
+		// read beyond the end of the block
+		return 0, StatusOK, StatusOKStr
+	}
+	if status != StatusOK {
+		glog.Errorln("failed to read upstream data block", md5str, off, len(b), status, errmsg)
+		return 0, status, errmsg
+	}
+	return copy(b, data), StatusOK, StatusOKStr
+}
+
+// DeleteDataBlock deletes the data block
+func (c *S3IO) DeleteDataBlock(md5str string) (status int, errmsg string) {
+	return c.deleteObject(c.dataBucket, md5str)
+}
+
+// ListDataBlocks lists the data blocks after marker
+func (c *S3IO) ListDataBlocks(marker string, maxKeys int) (md5strs []string, isTruncated bool, status int, errmsg string) {
+	res, status, errmsg := c.list(c.dataBucket, "", marker, maxKeys, false)
+	if status != StatusOK {
+		return nil, false, status, errmsg
+	}
+
+	for _, content := range res.Contents {
+		md5strs = append(md5strs, content.Key)
+	}
+	return md5strs, res.IsTruncated, StatusOK, StatusOKStr
+}
+
+// WriteBlockRefs writes the BlockRefs of the data block
+func (c *S3IO) WriteBlockRefs(md5str string, b []byte) (status int, errmsg string) {
+	return c.writeObject(c.partBucket, s3RefPrefix+md5str, nil, b)
+}
+
+// ReadBlockRefs reads the BlockRefs of the data block
+func (c *S3IO) ReadBlockRefs(md5str string) (b []byte, status int, errmsg string) {
+	return c.readObject(c.partBucket, s3RefPrefix+md5str)
+}
+
+// DeleteBlockRefs deletes the BlockRefs of the data block
+func (c *S3IO) DeleteBlockRefs(md5str string) (status int, errmsg string) {
+	return c.deleteObject(c.partBucket, s3RefPrefix+md5str)
+}
+
+// WriteObjectMD creates the metadata object, with the list metadata as the
+// user metadata.
+func (c *S3IO) WriteObjectMD(bkname string, objname string, mdbuf []byte) (status int, errmsg string) {
+	md, err := unmarshalObjectMD(mdbuf)
+	if err != nil {
+		glog.Errorln("failed to unmarshal ObjectMD", bkname, objname, err)
+		return InternalError, "failed to unmarshal ObjectMD"
+	}
+
+	hdr := http.Header{}
+	hdr.Set(s3MetaSize, strconv.FormatInt(md.Smd.Size, 10))
+	hdr.Set(s3MetaEtag, md.Smd.Etag)
+	hdr.Set(s3MetaMtime, strconv.FormatInt(md.Smd.Mtime, 10))
+
+	status, errmsg = c.writeObject(bkname, objectKey(objname), hdr, mdbuf)
+	if status != StatusOK {
+		glog.Errorln("failed to write upstream ObjectMD", bkname, objname, status, errmsg)
+	}
+	return status, errmsg
+}
+
+// ReadObjectMD reads the metadata object
+func (c *S3IO) ReadObjectMD(bkname string, objname string) (b []byte, status int, errmsg string) {
+	return c.readObject(bkname, objectKey(objname))
+}
+
+// DeleteObjectMD deletes the metadata object
+func (c *S3IO) DeleteObjectMD(bkname string, objname string) (status int, errmsg string) {
+	return c.deleteObject(bkname, objectKey(objname))
+}
+
+// the key of the object version, the version id does not have "/"
+func (c *S3IO) versionKey(bkname string, objname string, versionID string) string {
+	return s3VersionPrefix + bkname + "/" + objectKey(objname) + "/" + versionID
+}
+
+// the key of the version index of the object
+func (c *S3IO) vindexKey(bkname string, objname string) string {
+	return s3VIndexPrefix + bkname + "/" + objectKey(objname)
+}
+
+// WriteObjectVersion writes the metadata object of the object version, and
+// then the version index of the object.
+func (c *S3IO) WriteObjectVersion(bkname string, objname string, versionID string,
+	mdbuf []byte) (status int, errmsg string) {
+	key := c.versionKey(bkname, objname, versionID)
+	status, errmsg = c.writeObject(c.partBucket, key, nil, mdbuf)
+	if status != StatusOK {
+		glog.Errorln("failed to write upstream object version", bkname, objname, versionID, status, errmsg)
+		return status, errmsg
+	}
+
+	status, errmsg = c.writeObject(c.partBucket, c.vindexKey(bkname, objname), nil, nil)
+	if status != StatusOK {
+		glog.Errorln("failed to write upstream version index", bkname, objname, versionID, status, errmsg)
+		c.deleteObject(c.partBucket, key)
+		return status, errmsg
+	}
+	return StatusOK, StatusOKStr
+}
+
+// ReadObjectVersion reads the metadata object of the object version
+func (c *S3IO) ReadObjectVersion(bkname string, objname string, versionID string) (b []byte, status int, errmsg string) {
+	return c.readObject(c.partBucket, c.versionKey(bkname, objname, versionID))
+}
+
+// DeleteObjectVersion deletes the metadata object of the object version. The
+// version index is deleted with the last version. If a version is written
+// concurrently, and its index is deleted, the index is written again.
+func (c *S3IO) DeleteObjectVersion(bkname string, objname string, versionID string) (status int, errmsg string) {
+	status, errmsg = c.deleteObject(c.partBucket, c.versionKey(bkname, objname, versionID))
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	versionIDs, status, errmsg := c.ListObjectVersionIDs(bkname, objname)
+	if status != StatusOK || len(versionIDs) != 0 {
+		// the stale index only lists the name without versions
+		return StatusOK, StatusOKStr
+	}
+
+	status, errmsg = c.deleteObject(c.partBucket, c.vindexKey(bkname, objname))
+	if status != StatusOK && status != NoSuchKey {
+		glog.Errorln("failed to delete upstream version index", bkname, objname, status, errmsg)
+		return StatusOK, StatusOKStr
+	}
+
+	versionIDs, status, errmsg = c.ListObjectVersionIDs(bkname, objname)
+	if status == StatusOK && len(versionIDs) != 0 {
+		status, errmsg = c.writeObject(c.partBucket, c.vindexKey(bkname, objname), nil, nil)
+		if status != StatusOK {
+			glog.Errorln("failed to rewrite upstream version index, the versions are not listed",
+				bkname, objname, versionIDs, status, errmsg)
+		}
+	}
+	return StatusOK, StatusOKStr
+}
+
+// ListVersionedObjects lists the names of the objects that have versions from
+// the version index, whose keys are sorted in the order of the object names.
+func (c *S3IO) ListVersionedObjects(bkname string, prefix string, marker string,
+	maxKeys int) (objnames []string, isTruncated bool, status int, errmsg string) {
+	keyPrefix := s3VIndexPrefix + bkname + "/"
+	keyMarker := ""
+	if marker != "" {
+		keyMarker = keyPrefix + objectKey(marker)
+	}
+	res, status, errmsg := c.list(c.partBucket, keyPrefix+objectKey(prefix), keyMarker, maxKeys, false)
+	if status != StatusOK {
+		return nil, false, status, errmsg
+	}
+
+	for _, content := range res.Contents {
+		objnames = append(objnames, "/"+strings.TrimPrefix(content.Key, keyPrefix))
+	}
+	return objnames, res.IsTruncated, StatusOK, StatusOKStr
+}
+
+// ListObjectVersionIDs lists the version ids of the object
+func (c *S3IO) ListObjectVersionIDs(bkname string, objname string) (versionIDs []string, status int, errmsg string) {
+	keys, status, errmsg := c.listAll(c.partBucket, c.versionKey(bkname, objname, ""))
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+
+	// skip the versions of the other objects, whose names start with objname/
+	for _, key := range keys {
+		if !strings.Contains(key, "/") {
+			versionIDs = append(versionIDs, key)
+		}
+	}
+	return versionIDs, StatusOK, StatusOKStr
+}
+
+// WriteDataPart creates the data part object
+func (c *S3IO) WriteDataPart(bkname string, partName string, b []byte) (status int, errmsg string) {
+	status, errmsg = c.writeObject(c.partBucket, bkname+DefaultSeparator+partName, nil, b)
+	if status != StatusOK {
+		glog.Errorln("failed to write upstream data part", bkname, partName, status, errmsg)
+	}
+	return status, errmsg
+}
+
+// ReadDataPart reads the data part object
+func (c *S3IO) ReadDataPart(bkname string, partName string) (b []byte, status int, errmsg string) {
+	return c.readObject(c.partBucket, bkname+DefaultSeparator+partName)
+}
+
+// DeleteDataPart deletes the data part object
+func (c *S3IO) DeleteDataPart(bkname string, partName string) (status int, errmsg string) {
+	return c.deleteObject(c.partBucket, bkname+DefaultSeparator+partName)
+}
+
+// ListDataParts lists the names of the data parts that start with prefix
+func (c *S3IO) ListDataParts(bkname string, prefix string) (partNames []string, status int, errmsg string) {
+	return c.listAll(c.partBucket, bkname+DefaultSeparator+prefix)
+}
+
+func (c *S3IO) uploadKey(bkname string, uploadID string) string {
+	return s3UploadPrefix + bkname + "/" + uploadID
+}
+
+// WriteUploadMD writes the metadata of the multipart upload
+func (c *S3IO) WriteUploadMD(bkname string, uploadID string, mdbuf []byte) (status int, errmsg string) {
+	return c.writeObject(c.partBucket, c.uploadKey(bkname, uploadID), nil, mdbuf)
+}
+
+// ReadUploadMD reads the metadata of the multipart upload
+func (c *S3IO) ReadUploadMD(bkname string, uploadID string) (b []byte, status int, errmsg string) {
+	b, status, errmsg = c.readObject(c.partBucket, c.uploadKey(bkname, uploadID))
+	if status == NoSuchKey {
+		return nil, NoSuchUpload, "NoSuchUpload"
+	}
+	return b, status, errmsg
+}
+
+// DeleteUploadMD deletes the metadata of the multipart upload
+func (c *S3IO) DeleteUploadMD(bkname string, uploadID string) (status int, errmsg string) {
+	return c.deleteObject(c.partBucket, c.uploadKey(bkname, uploadID))
+}
+
+// ListUploads lists the ids of the ongoing multipart uploads of the bucket
+func (c *S3IO) ListUploads(bkname string) (uploadIDs []string, status int, errmsg string) {
+	return c.listAll(c.partBucket, c.uploadKey(bkname, ""))
+}
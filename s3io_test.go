@@ -0,0 +1,496 @@
+package test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is the in-memory S3 for the S3IO tests. It supports the bucket
+// and object PUT, GET, HEAD and DELETE, ListObjectsV2 and the Range read.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeS3Object
+	// whether ListObjectsV2 returns the user metadata for metadata=true
+	listMetadata bool
+	// the number of the object HEAD requests
+	heads int
+	// whether the create of the existing bucket succeeds, as AWS us-east-1
+	createOwnedBucket bool
+	// the http status of the object HEAD, by key
+	headErrors map[string]int
+}
+
+type fakeS3Object struct {
+	data []byte
+	hdr  http.Header
+}
+
+func newFakeS3(listMetadata bool) *fakeS3 {
+	return &fakeS3{buckets: make(map[string]map[string]*fakeS3Object), listMetadata: listMetadata}
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=fakeak/") {
+		f.writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	strs := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bkname := strs[0]
+	objs, ok := f.buckets[bkname]
+	if len(strs) == 1 {
+		f.serveBucket(w, r, bkname, objs, ok)
+		return
+	}
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	key := strs[1]
+	switch r.Method {
+	case "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		objs[key] = &fakeS3Object{data: b, hdr: r.Header}
+	case "GET", "HEAD":
+		if r.Method == "HEAD" {
+			f.heads++
+			if status, ok := f.headErrors[key]; ok {
+				w.WriteHeader(status)
+				return
+			}
+		}
+		obj, ok := objs[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range obj.hdr {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				w.Header()[k] = v
+			}
+		}
+		data := obj.data
+		if rg := r.Header.Get(Range); rg != "" {
+			var start, end int
+			fmt.Sscanf(rg, "bytes=%d-%d", &start, &end)
+			if start >= len(data) {
+				f.writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			data = data[start : end+1]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "DELETE":
+		delete(objs, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bkname string,
+	objs map[string]*fakeS3Object, ok bool) {
+	if r.Method == "PUT" {
+		if ok {
+			if !f.createOwnedBucket {
+				f.writeError(w, http.StatusConflict, "BucketAlreadyOwnedByYou")
+			}
+			return
+		}
+		f.buckets[bkname] = make(map[string]*fakeS3Object)
+		return
+	}
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+	case "DELETE":
+		if len(objs) != 0 {
+			f.writeError(w, http.StatusConflict, "BucketNotEmpty")
+			return
+		}
+		delete(f.buckets, bkname)
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		q := r.URL.Query()
+		prefix := q.Get("prefix")
+		after := q.Get("start-after")
+		maxKeys, _ := strconv.Atoi(q.Get("max-keys"))
+
+		var keys []string
+		for key := range objs {
+			if strings.HasPrefix(key, prefix) && key > after {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		truncated := len(keys) > maxKeys
+		if truncated {
+			keys = keys[:maxKeys]
+		}
+
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "<ListBucketResult><IsTruncated>%v</IsTruncated>", truncated)
+		for _, key := range keys {
+			b.WriteString("<Contents><Key>")
+			xml.EscapeText(&b, []byte(key))
+			fmt.Fprintf(&b, "</Key><Size>%d</Size>", len(objs[key].data))
+			if f.listMetadata && q.Get("metadata") == "true" {
+				b.WriteString("<UserMetadata>")
+				for k, v := range objs[key].hdr {
+					if strings.HasPrefix(k, "X-Amz-Meta-") {
+						fmt.Fprintf(&b, "<%s>%s</%s>", k, v[0], k)
+					}
+				}
+				b.WriteString("</UserMetadata>")
+			}
+			b.WriteString("</Contents>")
+		}
+		b.WriteString("</ListBucketResult>")
+		w.Write(b.Bytes())
+	}
+}
+
+func newTestS3IO(t *testing.T, listMetadata bool) (c *S3IO, fake *fakeS3, srv *httptest.Server) {
+	fake = newFakeS3(listMetadata)
+	srv = httptest.NewServer(fake)
+	c = NewS3IO(srv.URL, "us-east-1", "fakeak", "fakesk", "data", "part")
+	if c == nil {
+		srv.Close()
+		t.Fatal("failed to create S3IO")
+	}
+	return c, fake, srv
+}
+
+func TestS3IOBucket(t *testing.T) {
+	c, fake, srv := newTestS3IO(t, true)
+	defer srv.Close()
+
+	if fake.buckets["data"] == nil || fake.buckets["part"] == nil {
+		t.Fatal("data or part bucket is not created")
+	}
+
+	status, errmsg := c.PutBucket("bk", []byte("bucketmd"))
+	if status != StatusOK {
+		t.Fatal("PutBucket", status, errmsg)
+	}
+	if status, _ = c.HeadBucket("bk"); status != StatusOK {
+		t.Fatal("HeadBucket", status)
+	}
+	b, status, _ := c.ReadBucketMD("bk")
+	if status != StatusOK || string(b) != "bucketmd" {
+		t.Fatal("ReadBucketMD", status, string(b))
+	}
+	bknames, status, _ := c.ListBuckets()
+	if status != StatusOK || !reflect.DeepEqual(bknames, []string{"bk"}) {
+		t.Fatal("ListBuckets", status, bknames)
+	}
+
+	// the bucket with the object versions could not be deleted
+	if status, _ = c.WriteObjectVersion("bk", "/obj", "v1", []byte("md")); status != StatusOK {
+		t.Fatal("WriteObjectVersion", status)
+	}
+	if status, _ = c.DeleteBucket("bk"); status != BucketNotEmpty {
+		t.Fatal("DeleteBucket with versions", status)
+	}
+	if status, _ = c.DeleteObjectVersion("bk", "/obj", "v1"); status != StatusOK {
+		t.Fatal("DeleteObjectVersion", status)
+	}
+
+	if status, errmsg = c.DeleteBucket("bk"); status != StatusOK {
+		t.Fatal("DeleteBucket", status, errmsg)
+	}
+	if status, _ = c.HeadBucket("bk"); status != NoSuchBucket {
+		t.Fatal("HeadBucket after delete", status)
+	}
+	if _, status, _ = c.ReadBucketMD("bk"); status != NoSuchKey {
+		t.Fatal("ReadBucketMD after delete", status)
+	}
+	if len(fake.buckets["part"]) != 0 {
+		t.Fatal("part bucket is not empty", fake.buckets["part"])
+	}
+}
+
+func TestS3IOPutExistingBucket(t *testing.T) {
+	c, fake, srv := newTestS3IO(t, true)
+	defer srv.Close()
+	fake.createOwnedBucket = true
+
+	if !c.IsReservedBucket("data") || !c.IsReservedBucket("part") || c.IsReservedBucket("bk") {
+		t.Fatal("IsReservedBucket")
+	}
+
+	if status, errmsg := c.PutBucket("bk", []byte("md1")); status != StatusOK {
+		t.Fatal("PutBucket", status, errmsg)
+	}
+	// the upstream create succeeds, but the BucketMD is not overwritten
+	if status, _ := c.PutBucket("bk", []byte("md2")); status != BucketAlreadyExists {
+		t.Fatal("PutBucket of the existing bucket", status)
+	}
+	if b, _, _ := c.ReadBucketMD("bk"); string(b) != "md1" {
+		t.Fatal("BucketMD is overwritten", string(b))
+	}
+
+	// the BucketMD left by the failed delete
+	c.WriteBucketMD("bk2", []byte("stale"))
+	if status, errmsg := c.PutBucket("bk2", []byte("md2")); status != StatusOK {
+		t.Fatal("PutBucket with the stale BucketMD", status, errmsg)
+	}
+	if b, _, _ := c.ReadBucketMD("bk2"); string(b) != "md2" {
+		t.Fatal("stale BucketMD is not overwritten", string(b))
+	}
+}
+
+func TestS3IOErrorCodes(t *testing.T) {
+	c, _, srv := newTestS3IO(t, true)
+	defer srv.Close()
+
+	if _, status, _ := c.ReadObjectMD("bk", "obj"); status != NoSuchBucket {
+		t.Fatal("ReadObjectMD of the not existing bucket", status)
+	}
+	if status, errmsg := c.PutBucket("bk", []byte("md")); status != StatusOK {
+		t.Fatal("PutBucket", status, errmsg)
+	}
+	if _, status, _ := c.ReadObjectMD("bk", "obj"); status != NoSuchKey {
+		t.Fatal("ReadObjectMD of the not existing object", status)
+	}
+	if _, status, _ := c.ReadUploadMD("bk", "upload1"); status != NoSuchUpload {
+		t.Fatal("ReadUploadMD of the not existing upload", status)
+	}
+	if status, _ := c.createBucket("bk"); status != BucketAlreadyOwnedByYou {
+		t.Fatal("create the existing bucket", status)
+	}
+	if status, _ := c.writeObject("bk", "obj", nil, []byte("md")); status != StatusOK {
+		t.Fatal("writeObject", status)
+	}
+	if status, _ := c.DeleteBucket("bk"); status != BucketNotEmpty {
+		t.Fatal("DeleteBucket of the not empty bucket", status)
+	}
+}
+
+func TestS3IOListObjects(t *testing.T) {
+	for _, listMetadata := range []bool{true, false} {
+		c, fake, srv := newTestS3IO(t, listMetadata)
+
+		c.PutBucket("bk", nil)
+		names := []string{"/a", "/b/c", "/d"}
+		for i, name := range names {
+			md := newObjectMD("uuid", "bk", name)
+			md.Smd.Size = int64(i + 10)
+			md.Smd.Etag = "etag" + name
+			mdbuf, err := marshalObjectMD(md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, errmsg := c.WriteObjectMD("bk", name, mdbuf); status != StatusOK {
+				t.Fatal("WriteObjectMD", name, status, errmsg)
+			}
+		}
+
+		fake.heads = 0
+		smds, isTruncated, status, _ := c.ListObjects("bk", "", "", 2)
+		if status != StatusOK || !isTruncated || len(smds) != 2 {
+			t.Fatal("ListObjects", listMetadata, status, isTruncated, len(smds))
+		}
+		for i, smd := range smds {
+			if smd.Name != names[i] || smd.Size != int64(i+10) || smd.Etag != "etag"+names[i] || smd.Mtime == 0 {
+				t.Error("ListObjects", listMetadata, i, smd)
+			}
+		}
+		if listMetadata && fake.heads != 0 {
+			t.Error("objects are HEAD with the list metadata", fake.heads)
+		}
+		if !listMetadata && fake.heads != 2 {
+			t.Error("objects are not HEAD without the list metadata", fake.heads)
+		}
+
+		smds, isTruncated, status, _ = c.ListObjects("bk", "", smds[1].Name, 2)
+		if status != StatusOK || isTruncated || len(smds) != 1 || smds[0].Name != "/d" {
+			t.Fatal("ListObjects after marker", listMetadata, status, isTruncated, smds)
+		}
+		smds, _, status, _ = c.ListObjects("bk", "/b/", "", 10)
+		if status != StatusOK || len(smds) != 1 || smds[0].Name != "/b/c" {
+			t.Fatal("ListObjects with prefix", listMetadata, status, smds)
+		}
+
+		b, status, _ := c.ReadObjectMD("bk", "/b/c")
+		md, err := unmarshalObjectMD(b)
+		if status != StatusOK || err != nil || md.Smd.Name != "/b/c" {
+			t.Fatal("ReadObjectMD", status, err)
+		}
+		if status, _ = c.DeleteObjectMD("bk", "/b/c"); status != StatusOK {
+			t.Fatal("DeleteObjectMD", status)
+		}
+		if _, status, _ = c.ReadObjectMD("bk", "/b/c"); status != NoSuchKey {
+			t.Fatal("ReadObjectMD after delete", status)
+		}
+		srv.Close()
+	}
+}
+
+func TestS3IOListObjectsHeadError(t *testing.T) {
+	c, fake, srv := newTestS3IO(t, false)
+	defer srv.Close()
+
+	c.PutBucket("bk", nil)
+	for _, name := range []string{"/a", "/b", "/c"} {
+		mdbuf, _ := marshalObjectMD(newObjectMD("uuid", "bk", name))
+		c.WriteObjectMD("bk", name, mdbuf)
+	}
+
+	tests := []struct {
+		headErrors map[string]int
+		status     int
+		names      []string
+	}{
+		{nil, StatusOK, []string{"/a", "/b", "/c"}},
+		// the object deleted after list is skipped
+		{map[string]int{"b": http.StatusNotFound}, StatusOK, []string{"/a", "/c"}},
+		{map[string]int{"b": http.StatusServiceUnavailable}, http.StatusServiceUnavailable, nil},
+		{map[string]int{"a": http.StatusNotFound, "c": http.StatusInternalServerError},
+			http.StatusInternalServerError, nil},
+	}
+	for _, tt := range tests {
+		fake.headErrors = tt.headErrors
+		smds, _, status, errmsg := c.ListObjects("bk", "", "", 10)
+		var names []string
+		for _, smd := range smds {
+			names = append(names, smd.Name)
+		}
+		if status != tt.status || !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("ListObjects with head errors %v = %v %d %s, want %v %d",
+				tt.headErrors, names, status, errmsg, tt.names, tt.status)
+		}
+	}
+}
+
+func TestS3IOReadDataBlockRange(t *testing.T) {
+	c, _, srv := newTestS3IO(t, true)
+	defer srv.Close()
+
+	data := []byte("0123456789")
+	if status, _ := c.WriteDataBlock(data, "md5"); status != StatusOK {
+		t.Fatal("WriteDataBlock", status)
+	}
+	if !c.IsDataBlockExist("md5") || c.IsDataBlockExist("nomd5") {
+		t.Fatal("IsDataBlockExist")
+	}
+
+	tests := []struct {
+		off  int64
+		size int
+		want string
+	}{
+		{0, 4, "0123"},
+		{4, 4, "4567"},
+		{8, 4, "89"},
+		{0, 20, "0123456789"},
+		{10, 4, ""},
+		{20, 4, ""},
+	}
+	for _, tt := range tests {
+		b := make([]byte, tt.size)
+		n, status, errmsg := c.ReadDataBlockRange("md5", tt.off, b)
+		if status != StatusOK || string(b[:n]) != tt.want {
+			t.Errorf("ReadDataBlockRange(%d, %d) = %q %d %s, want %q",
+				tt.off, tt.size, b[:n], status, errmsg, tt.want)
+		}
+	}
+
+	if _, status, _ := c.ReadDataBlockRange("nomd5", 0, make([]byte, 4)); status == StatusOK {
+		t.Error("ReadDataBlockRange of the not existing block")
+	}
+}
+
+func TestS3IOVersions(t *testing.T) {
+	c, fake, srv := newTestS3IO(t, true)
+	defer srv.Close()
+
+	c.PutBucket("bk", nil)
+	// the version keys of "/a-b" and "/a/c" sort before the keys of "/a"
+	versions := map[string][]string{
+		"/a":   {"v1", "v2"},
+		"/a-b": {"v1"},
+		"/a/c": {"v1", "v2", "v3"},
+		"/b":   {"v1"},
+	}
+	for name, versionIDs := range versions {
+		for _, versionID := range versionIDs {
+			if status, _ := c.WriteObjectVersion("bk", name, versionID, []byte(name+versionID)); status != StatusOK {
+				t.Fatal("WriteObjectVersion", name, versionID, status)
+			}
+		}
+	}
+
+	tests := []struct {
+		prefix    string
+		marker    string
+		maxKeys   int
+		objnames  []string
+		truncated bool
+	}{
+		{"", "", 10, []string{"/a", "/a-b", "/a/c", "/b"}, false},
+		{"", "", 2, []string{"/a", "/a-b"}, true},
+		{"", "/a-b", 2, []string{"/a/c", "/b"}, false},
+		{"/a", "", 10, []string{"/a", "/a-b", "/a/c"}, false},
+		{"/a/", "", 10, []string{"/a/c"}, false},
+		{"/c", "", 10, nil, false},
+	}
+	for _, tt := range tests {
+		objnames, truncated, status, _ := c.ListVersionedObjects("bk", tt.prefix, tt.marker, tt.maxKeys)
+		if status != StatusOK || !reflect.DeepEqual(objnames, tt.objnames) || truncated != tt.truncated {
+			t.Errorf("ListVersionedObjects(%q, %q, %d) = %v %v %d, want %v %v",
+				tt.prefix, tt.marker, tt.maxKeys, objnames, truncated, status, tt.objnames, tt.truncated)
+		}
+	}
+
+	versionIDs, status, _ := c.ListObjectVersionIDs("bk", "/a")
+	if status != StatusOK || !reflect.DeepEqual(versionIDs, []string{"v1", "v2"}) {
+		t.Fatal("ListObjectVersionIDs", status, versionIDs)
+	}
+	b, status, _ := c.ReadObjectVersion("bk", "/a/c", "v2")
+	if status != StatusOK || string(b) != "/a/cv2" {
+		t.Fatal("ReadObjectVersion", status, string(b))
+	}
+
+	// the name is not listed after the last version is deleted
+	c.DeleteObjectVersion("bk", "/a", "v1")
+	objnames, _, _, _ := c.ListVersionedObjects("bk", "", "", 10)
+	if !reflect.DeepEqual(objnames, []string{"/a", "/a-b", "/a/c", "/b"}) {
+		t.Fatal("ListVersionedObjects after deleting one version", objnames)
+	}
+	c.DeleteObjectVersion("bk", "/a", "v2")
+	objnames, _, _, _ = c.ListVersionedObjects("bk", "", "", 10)
+	if !reflect.DeepEqual(objnames, []string{"/a-b", "/a/c", "/b"}) {
+		t.Fatal("ListVersionedObjects after deleting all versions", objnames)
+	}
+	if _, ok := fake.buckets["part"][c.vindexKey("bk", "/a")]; ok {
+		t.Fatal("version index is not deleted")
+	}
+}
@@ -0,0 +1,601 @@
+package test
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+var lifecycleIntervalSecs = flag.Int("lifecycleinterval", 3600, "the interval seconds to apply the bucket lifecycle rules")
+
+// Bucket lifecycle.
+//
+// The lifecycle rules are stored in the BucketMD. The background worker
+// periodically scans the buckets, and expires the objects, the noncurrent
+// versions and the incomplete multipart uploads through the normal delete
+// paths. The expired object of the unversioned bucket is logged to the delete
+// journal, the versioned bucket gets the delete marker.
+//
+// As S3, the expiration time is rounded up to the next midnight UTC.
+
+type lifecycleAnd struct {
+	Prefix string   `xml:"Prefix,omitempty"`
+	Tags   []xmlTag `xml:"Tag"`
+}
+
+type lifecycleFilter struct {
+	Prefix *string       `xml:"Prefix"`
+	Tag    *xmlTag       `xml:"Tag"`
+	And    *lifecycleAnd `xml:"And"`
+}
+
+type lifecycleExpiration struct {
+	Days int32  `xml:"Days,omitempty"`
+	Date string `xml:"Date,omitempty"`
+}
+
+type noncurrentVersionExpiration struct {
+	NoncurrentDays int32 `xml:"NoncurrentDays"`
+}
+
+type abortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int32 `xml:"DaysAfterInitiation"`
+}
+
+type lifecycleRule struct {
+	ID     string           `xml:"ID,omitempty"`
+	Filter *lifecycleFilter `xml:"Filter"`
+	// the prefix of the old rule format, without Filter
+	Prefix                         *string                         `xml:"Prefix"`
+	Status                         string                          `xml:"Status"`
+	Expiration                     *lifecycleExpiration            `xml:"Expiration"`
+	NoncurrentVersionExpiration    *noncurrentVersionExpiration    `xml:"NoncurrentVersionExpiration"`
+	AbortIncompleteMultipartUpload *abortIncompleteMultipartUpload `xml:"AbortIncompleteMultipartUpload"`
+}
+
+type lifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Xmlns   string          `xml:"xmlns,attr,omitempty"`
+	Rules   []lifecycleRule `xml:"Rule"`
+}
+
+// parseLifecycleRule checks and converts the xml rule to LifecycleRule
+func parseLifecycleRule(r *lifecycleRule) (rule *LifecycleRule, status int, errmsg string) {
+	rule = &LifecycleRule{Id: r.ID}
+
+	if r.Status == LifecycleEnabled {
+		rule.Enabled = true
+	} else if r.Status != LifecycleDisabled {
+		return nil, MalformedXML, "MalformedXML"
+	}
+
+	if r.Filter != nil && r.Prefix != nil {
+		return nil, MalformedXML, "MalformedXML"
+	}
+	if r.Prefix != nil {
+		rule.Prefix = *r.Prefix
+	}
+	if r.Filter != nil {
+		n := 0
+		if r.Filter.Prefix != nil {
+			rule.Prefix = *r.Filter.Prefix
+			n++
+		}
+		if r.Filter.Tag != nil {
+			rule.Tags = append(rule.Tags, &Tag{Key: r.Filter.Tag.Key, Value: r.Filter.Tag.Value})
+			n++
+		}
+		if r.Filter.And != nil {
+			rule.Prefix = r.Filter.And.Prefix
+			for _, t := range r.Filter.And.Tags {
+				rule.Tags = append(rule.Tags, &Tag{Key: t.Key, Value: t.Value})
+			}
+			n++
+		}
+		// Filter could have only one of Prefix, Tag and And
+		if n > 1 {
+			return nil, MalformedXML, "MalformedXML"
+		}
+	}
+	status, errmsg = checkTags(rule.Tags, MaxObjectTags)
+	if status != StatusOK {
+		return nil, InvalidArgument, "invalid lifecycle filter tags"
+	}
+
+	if r.Expiration != nil {
+		if (r.Expiration.Days == 0) == (r.Expiration.Date == "") || r.Expiration.Days < 0 {
+			return nil, InvalidArgument, "Expiration should have either positive Days or Date"
+		}
+		rule.ExpirationDays = r.Expiration.Days
+		if r.Expiration.Date != "" {
+			t, err := time.Parse(time.RFC3339, r.Expiration.Date)
+			if err != nil || !t.Equal(t.Truncate(24*time.Hour)) {
+				return nil, InvalidArgument, "Expiration Date should be midnight UTC in ISO 8601 format"
+			}
+			rule.ExpirationDate = t.Unix()
+		}
+	}
+	if r.NoncurrentVersionExpiration != nil {
+		if r.NoncurrentVersionExpiration.NoncurrentDays <= 0 {
+			return nil, InvalidArgument, "NoncurrentDays should be positive"
+		}
+		rule.NoncurrentDays = r.NoncurrentVersionExpiration.NoncurrentDays
+	}
+	if r.AbortIncompleteMultipartUpload != nil {
+		if r.AbortIncompleteMultipartUpload.DaysAfterInitiation <= 0 {
+			return nil, InvalidArgument, "DaysAfterInitiation should be positive"
+		}
+		// the upload does not have tags yet
+		if len(rule.Tags) != 0 {
+			return nil, InvalidRequest, "InvalidRequest: AbortIncompleteMultipartUpload cannot be specified with tags"
+		}
+		rule.AbortUploadDays = r.AbortIncompleteMultipartUpload.DaysAfterInitiation
+	}
+
+	if rule.ExpirationDays == 0 && rule.ExpirationDate == 0 && rule.NoncurrentDays == 0 && rule.AbortUploadDays == 0 {
+		return nil, MalformedXML, "MalformedXML"
+	}
+	return rule, StatusOK, StatusOKStr
+}
+
+// formatLifecycleRule converts LifecycleRule to the xml rule
+func formatLifecycleRule(rule *LifecycleRule) lifecycleRule {
+	r := lifecycleRule{ID: rule.Id, Filter: &lifecycleFilter{}, Status: LifecycleDisabled}
+	if rule.Enabled {
+		r.Status = LifecycleEnabled
+	}
+
+	if len(rule.Tags) == 0 {
+		prefix := rule.Prefix
+		r.Filter.Prefix = &prefix
+	} else if len(rule.Tags) == 1 && rule.Prefix == "" {
+		r.Filter.Tag = &xmlTag{Key: rule.Tags[0].Key, Value: rule.Tags[0].Value}
+	} else {
+		r.Filter.And = &lifecycleAnd{Prefix: rule.Prefix}
+		for _, t := range rule.Tags {
+			r.Filter.And.Tags = append(r.Filter.And.Tags, xmlTag{Key: t.Key, Value: t.Value})
+		}
+	}
+
+	if rule.ExpirationDays != 0 {
+		r.Expiration = &lifecycleExpiration{Days: rule.ExpirationDays}
+	} else if rule.ExpirationDate != 0 {
+		r.Expiration = &lifecycleExpiration{Date: time.Unix(rule.ExpirationDate, 0).UTC().Format(time.RFC3339)}
+	}
+	if rule.NoncurrentDays != 0 {
+		r.NoncurrentVersionExpiration = &noncurrentVersionExpiration{NoncurrentDays: rule.NoncurrentDays}
+	}
+	if rule.AbortUploadDays != 0 {
+		r.AbortIncompleteMultipartUpload = &abortIncompleteMultipartUpload{DaysAfterInitiation: rule.AbortUploadDays}
+	}
+	return r
+}
+
+// expiryTime returns the time after days, rounded up to the next midnight UTC
+func expiryTime(t time.Time, days int32) time.Time {
+	return t.Add(time.Duration(days) * 24 * time.Hour).Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// matchLifecycleRule checks whether the object name and tags match the rule
+func matchLifecycleRule(rule *LifecycleRule, objname string, tags []*Tag) bool {
+	if !rule.Enabled || !strings.HasPrefix(objectKey(objname), rule.Prefix) {
+		return false
+	}
+	for _, rt := range rule.Tags {
+		found := false
+		for _, t := range tags {
+			if t.Key == rt.Key && t.Value == rt.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// objectExpiration returns the rule that expires the current object first,
+// and the expiry time. nil is returned if no rule expires the object.
+func objectExpiration(rules []*LifecycleRule, md *ObjectMD) (rule *LifecycleRule, expiry time.Time) {
+	for _, r := range rules {
+		if (r.ExpirationDays == 0 && r.ExpirationDate == 0) || !matchLifecycleRule(r, md.Smd.Name, md.Tags) {
+			continue
+		}
+
+		var t time.Time
+		if r.ExpirationDays != 0 {
+			t = expiryTime(time.Unix(md.Smd.Mtime, 0), r.ExpirationDays)
+		} else {
+			t = time.Unix(r.ExpirationDate, 0)
+		}
+		if rule == nil || t.Before(expiry) {
+			rule, expiry = r, t
+		}
+	}
+	return rule, expiry
+}
+
+// setExpirationHeader sets the x-amz-expiration header if the current object
+// will be expired by the lifecycle rule.
+func (s *S3Server) setExpirationHeader(ctx context.Context, w http.ResponseWriter, r *http.Request, md *ObjectMD) {
+	if hasQuery(r, ObjectVersionID) {
+		return
+	}
+
+	bmd, status, _ := s.bmds.Get(ctx, md.Smd.Bucket)
+	if status != StatusOK || len(bmd.LifecycleRules) == 0 {
+		return
+	}
+
+	rule, expiry := objectExpiration(bmd.LifecycleRules, md)
+	if rule != nil {
+		w.Header().Set(Expiration, fmt.Sprintf("expiry-date=\"%s\", rule-id=\"%s\"",
+			expiry.UTC().Format(http.TimeFormat), rule.Id))
+	}
+}
+
+// putBucketLifecycle handles PUT /bucket?lifecycle
+func (s *S3Server) putBucketLifecycle(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("put bucket lifecycle failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read lifecycle configuration", requuid, bkname, err)
+		writeError(w, r, InternalError, "failed to read request body")
+		return
+	}
+
+	conf := &lifecycleConfiguration{}
+	err = xml.Unmarshal(b, conf)
+	if err != nil || len(conf.Rules) == 0 || len(conf.Rules) > MaxLifecycleRules {
+		glog.Errorln("invalid lifecycle configuration", requuid, bkname, len(conf.Rules), err)
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+
+	var rules []*LifecycleRule
+	ids := make(map[string]bool)
+	for i := range conf.Rules {
+		rule, status, errmsg := parseLifecycleRule(&conf.Rules[i])
+		if status != StatusOK {
+			glog.Errorln("invalid lifecycle rule", requuid, bkname, conf.Rules[i], status, errmsg)
+			writeError(w, r, status, errmsg)
+			return
+		}
+		if rule.Id != "" && ids[rule.Id] {
+			glog.Errorln("duplicate lifecycle rule id", requuid, bkname, rule.Id)
+			writeError(w, r, InvalidArgument, "duplicate lifecycle rule id")
+			return
+		}
+		ids[rule.Id] = true
+		rules = append(rules, rule)
+	}
+
+	status, errmsg = s.setBucketLifecycle(ctx, bkname, rules)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(StatusOK)
+}
+
+func (s *S3Server) setBucketLifecycle(ctx context.Context, bkname string, rules []*LifecycleRule) (status int, errmsg string) {
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	bmd = proto.Clone(bmd).(*BucketMD)
+	bmd.LifecycleRules = rules
+	return s.bmds.Put(ctx, bkname, bmd)
+}
+
+// getBucketLifecycle handles GET /bucket?lifecycle
+func (s *S3Server) getBucketLifecycle(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if len(bmd.LifecycleRules) == 0 {
+		writeError(w, r, NoSuchLifecycleConfiguration, "NoSuchLifecycleConfiguration")
+		return
+	}
+
+	res := &lifecycleConfiguration{Xmlns: XMLNS}
+	for _, rule := range bmd.LifecycleRules {
+		res.Rules = append(res.Rules, formatLifecycleRule(rule))
+	}
+	writeXMLResponse(ctx, w, res)
+}
+
+// deleteBucketLifecycle handles DELETE /bucket?lifecycle
+func (s *S3Server) deleteBucketLifecycle(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = s.setBucketLifecycle(ctx, bkname, nil)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startLifecycle starts the background lifecycle worker
+func (s *S3Server) startLifecycle() {
+	go s.runLifecycle()
+}
+
+func (s *S3Server) runLifecycle() {
+	for {
+		time.Sleep(time.Duration(*lifecycleIntervalSecs) * time.Second)
+		s.applyLifecycle(time.Now())
+	}
+}
+
+// newLifecycleContext creates the context with a new request id. Every
+// delete marker needs its own uuid.
+func newLifecycleContext() (ctx context.Context, ok bool) {
+	requuid, err := util.GenRequestID()
+	if err != nil {
+		glog.Errorln("failed to generate uuid for lifecycle", err)
+		return nil, false
+	}
+	return util.NewRequestContext(context.Background(), requuid), true
+}
+
+// applyLifecycle applies the lifecycle rules of all buckets as of now
+func (s *S3Server) applyLifecycle(now time.Time) {
+	bknames, status, errmsg := s.s3io.ListBuckets()
+	if status != StatusOK {
+		glog.Errorln("lifecycle failed to list buckets", status, errmsg)
+		return
+	}
+
+	for _, bkname := range bknames {
+		ctx, ok := newLifecycleContext()
+		if !ok {
+			return
+		}
+
+		bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+		if status != StatusOK {
+			glog.Errorln("lifecycle failed to get BucketMD", bkname, status, errmsg)
+			continue
+		}
+
+		var expire, noncurrent, abort bool
+		for _, rule := range bmd.LifecycleRules {
+			if rule.Enabled {
+				expire = expire || rule.ExpirationDays != 0 || rule.ExpirationDate != 0
+				noncurrent = noncurrent || rule.NoncurrentDays != 0
+				abort = abort || rule.AbortUploadDays != 0
+			}
+		}
+
+		if expire {
+			s.expireObjects(ctx, bmd, bkname, now)
+		}
+		if noncurrent && bmd.Versioning != "" {
+			s.expireNoncurrentVersions(ctx, bmd, bkname, now)
+		}
+		if abort {
+			s.abortIncompleteUploads(ctx, bmd, bkname, now)
+		}
+	}
+}
+
+// matchLifecyclePrefix checks whether any rule could apply to the object,
+// to avoid reading the ObjectMD.
+func matchLifecyclePrefix(rules []*LifecycleRule, objname string) bool {
+	for _, rule := range rules {
+		if rule.Enabled && strings.HasPrefix(objectKey(objname), rule.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireObjects expires the current objects of the bucket
+func (s *S3Server) expireObjects(ctx context.Context, bmd *BucketMD, bkname string, now time.Time) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	marker := ""
+	for {
+		smds, isTruncated, status, errmsg := s.s3io.ListObjects(bkname, "", marker, BucketListMaxKeys)
+		if status != StatusOK {
+			glog.Errorln("lifecycle failed to list objects", requuid, bkname, marker, status, errmsg)
+			return
+		}
+
+		var entries []*DeleteEntry
+		for _, smd := range smds {
+			marker = smd.Name
+			if !matchLifecyclePrefix(bmd.LifecycleRules, smd.Name) || s.journal.IsListDeleted(smd) {
+				continue
+			}
+
+			md, status, errmsg := readObjectMD(ctx, s.s3io, bkname, smd.Name)
+			if status != StatusOK || s.journal.IsDeleted(md) {
+				if status != StatusOK && status != NoSuchKey {
+					glog.Errorln("lifecycle failed to read ObjectMD", requuid, bkname, smd.Name, status, errmsg)
+				}
+				continue
+			}
+
+			rule, expiry := objectExpiration(bmd.LifecycleRules, md)
+			if rule == nil || now.Before(expiry) {
+				continue
+			}
+
+			if bmd.Versioning == "" {
+				if st, _ := checkObjectLock(md, now, false); st != StatusOK {
+					glog.V(1).Infoln("lifecycle skips the locked object", requuid, bkname, smd.Name, md.Uuid)
+					continue
+				}
+				// the journal does not delete the ObjectMD if it is overwritten
+				entries = append(entries, &DeleteEntry{Bucket: bkname, Name: smd.Name, Md: md})
+				glog.V(1).Infoln("lifecycle expires object", requuid, bkname, smd.Name, md.Uuid, rule.Id)
+				continue
+			}
+
+			// the object put after the read does not get the delete marker
+			mctx, ok := newLifecycleContext()
+			if !ok {
+				return
+			}
+			_, status, errmsg = s.createDeleteMarker(mctx, bmd, bkname, smd.Name, md.Uuid)
+			if status == PreconditionFailed {
+				continue
+			}
+			if status != StatusOK {
+				glog.Errorln("lifecycle failed to create delete marker", requuid, bkname, smd.Name, status, errmsg)
+				continue
+			}
+			glog.V(1).Infoln("lifecycle expires versioned object", requuid, bkname, smd.Name, md.Uuid, rule.Id)
+		}
+
+		if len(entries) != 0 {
+			status, errmsg = s.journal.Log(ctx, entries)
+			if status != StatusOK {
+				glog.Errorln("lifecycle failed to log deletes", requuid, bkname, len(entries), status, errmsg)
+				return
+			}
+		}
+
+		if !isTruncated || len(smds) == 0 {
+			return
+		}
+	}
+}
+
+// expireNoncurrentVersions deletes the versions that have been noncurrent for
+// the NoncurrentDays. A version becomes noncurrent when the newer version is
+// created.
+func (s *S3Server) expireNoncurrentVersions(ctx context.Context, bmd *BucketMD, bkname string, now time.Time) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	marker := ""
+	for {
+		objnames, isTruncated, status, errmsg := s.s3io.ListVersionedObjects(bkname, "", marker, BucketListMaxKeys)
+		if status != StatusOK {
+			glog.Errorln("lifecycle failed to list versioned objects", requuid, bkname, marker, status, errmsg)
+			return
+		}
+
+		for _, objname := range objnames {
+			marker = objname
+			if !matchLifecyclePrefix(bmd.LifecycleRules, objname) {
+				continue
+			}
+
+			mds, status, errmsg := s.getObjectVersions(ctx, bkname, objname)
+			if status != StatusOK {
+				glog.Errorln("lifecycle failed to get object versions", requuid, bkname, objname, status, errmsg)
+				continue
+			}
+
+			for i := 1; i < len(mds); i++ {
+				noncurrentSince := time.Unix(0, versionOrder(mds[i-1]))
+				if !isNoncurrentExpired(bmd.LifecycleRules, mds[i], noncurrentSince, now) {
+					continue
+				}
+
+				versionID := objectVersionID(mds[i])
+				if st, _ := checkObjectLock(mds[i], now, false); st != StatusOK {
+					// expired by the scan after the lock expires
+					glog.V(1).Infoln("lifecycle skips the locked version", requuid, bkname, objname, versionID)
+					continue
+				}
+				_, status, errmsg = s.deleteObjectVersion(ctx, bkname, objname, versionID, false)
+				if status != StatusOK {
+					glog.Errorln("lifecycle failed to delete version", requuid, bkname, objname, versionID, status, errmsg)
+					continue
+				}
+				glog.V(1).Infoln("lifecycle expires noncurrent version", requuid, bkname, objname, versionID)
+			}
+		}
+
+		if !isTruncated || len(objnames) == 0 {
+			return
+		}
+	}
+}
+
+func isNoncurrentExpired(rules []*LifecycleRule, md *ObjectMD, noncurrentSince time.Time,
+	now time.Time) bool {
+	for _, rule := range rules {
+		if rule.NoncurrentDays != 0 && matchLifecycleRule(rule, md.Smd.Name, md.Tags) &&
+			!now.Before(expiryTime(noncurrentSince, rule.NoncurrentDays)) {
+			return true
+		}
+	}
+	return false
+}
+
+// abortIncompleteUploads aborts the multipart uploads initiated for the
+// DaysAfterInitiation.
+func (s *S3Server) abortIncompleteUploads(ctx context.Context, bmd *BucketMD, bkname string, now time.Time) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	uploadIDs, status, errmsg := s.s3io.ListUploads(bkname)
+	if status != StatusOK {
+		glog.Errorln("lifecycle failed to list uploads", requuid, bkname, status, errmsg)
+		return
+	}
+
+	m := NewS3Multipart(ctx, nil, s.s3io, s.gc, s.journal, s.sse, bkname, "")
+	for _, uploadID := range uploadIDs {
+		upload, status, _ := m.readUpload(uploadID)
+		if status != StatusOK {
+			continue
+		}
+
+		expired := false
+		for _, rule := range bmd.LifecycleRules {
+			if rule.AbortUploadDays != 0 && matchLifecycleRule(rule, upload.Md.Smd.Name, nil) &&
+				!now.Before(expiryTime(time.Unix(upload.Initiated, 0), rule.AbortUploadDays)) {
+				expired = true
+				break
+			}
+		}
+		if !expired {
+			continue
+		}
+
+		status, errmsg = m.deleteUpload(uploadID)
+		if status != StatusOK {
+			glog.Errorln("lifecycle failed to abort upload", requuid, bkname, upload.Md.Smd.Name, uploadID, status, errmsg)
+			continue
+		}
+		glog.V(1).Infoln("lifecycle aborts upload", requuid, bkname, upload.Md.Smd.Name, uploadID)
+	}
+}
@@ -0,0 +1,209 @@
+package test
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"test/util"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+type listOwner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type listContent struct {
+	Key          string     `xml:"Key"`
+	LastModified string     `xml:"LastModified"`
+	ETag         string     `xml:"ETag"`
+	Size         int64      `xml:"Size"`
+	Owner        *listOwner `xml:"Owner,omitempty"`
+	StorageClass string     `xml:"StorageClass"`
+}
+
+type listCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// ListBucketResult of both ListObjects (v1) and ListObjectsV2
+type listBucketResult struct {
+	XMLName               xml.Name           `xml:"ListBucketResult"`
+	Xmlns                 string             `xml:"xmlns,attr"`
+	Name                  string             `xml:"Name"`
+	Prefix                string             `xml:"Prefix"`
+	Marker                *string            `xml:"Marker"`
+	NextMarker            string             `xml:"NextMarker,omitempty"`
+	StartAfter            string             `xml:"StartAfter,omitempty"`
+	ContinuationToken     string             `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string             `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int               `xml:"KeyCount"`
+	MaxKeys               int                `xml:"MaxKeys"`
+	Delimiter             string             `xml:"Delimiter,omitempty"`
+	EncodingType          string             `xml:"EncodingType,omitempty"`
+	IsTruncated           bool               `xml:"IsTruncated"`
+	Contents              []listContent      `xml:"Contents"`
+	CommonPrefixes        []listCommonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObjects handles ListObjectsV2, GET /bucket?list-type=2, and the old
+// ListObjects, GET /bucket.
+//
+// The objects are listed from CloudIO in the sorted key order. With delimiter,
+// the keys that contain the delimiter after prefix are rolled up to a common
+// prefix, and the scan jumps over all keys of the common prefix.
+// The continuation token is the last returned key or common prefix.
+func (s *S3Server) listObjects(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	q := r.URL.Query()
+
+	v2 := q.Get(BucketListOp) == "2"
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	encodingType := q.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		glog.Errorln("invalid encoding-type", requuid, bkname, encodingType)
+		writeError(w, r, InvalidArgument, "invalid encoding-type")
+		return
+	}
+
+	maxKeys := BucketListMaxKeys
+	if str := q.Get("max-keys"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			glog.Errorln("invalid max-keys", requuid, bkname, str)
+			writeError(w, r, InvalidArgument, "invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	encode := func(str string) string {
+		if encodingType == "url" {
+			return url.QueryEscape(str)
+		}
+		return str
+	}
+
+	res := &listBucketResult{Xmlns: XMLNS, Name: bkname, Prefix: encode(prefix), MaxKeys: maxKeys,
+		Delimiter: encode(delimiter), EncodingType: encodingType}
+
+	// the key to list after
+	var marker string
+	fetchOwner := true
+	if v2 {
+		fetchOwner = q.Get("fetch-owner") == "true"
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.URLEncoding.DecodeString(token)
+			if err != nil {
+				glog.Errorln("invalid continuation-token", requuid, bkname, token, err)
+				writeError(w, r, InvalidArgument, "invalid continuation-token")
+				return
+			}
+			marker = string(b)
+			res.ContinuationToken = token
+		} else {
+			marker = q.Get("start-after")
+			res.StartAfter = encode(marker)
+		}
+	} else {
+		marker = q.Get("marker")
+		m := encode(marker)
+		res.Marker = &m
+	}
+
+	// the names in CloudIO have the leading "/"
+	scanPrefix := "/" + prefix
+	scanMarker := "/" + marker
+	// the last returned key or common prefix
+	last := ""
+	count := 0
+
+	for {
+		if count == maxKeys {
+			// check whether there are more objects
+			smds, _, status, errmsg := s.s3io.ListObjects(bkname, scanPrefix, scanMarker, 1)
+			if status != StatusOK {
+				glog.Errorln("failed to list objects", requuid, bkname, prefix, scanMarker, status, errmsg)
+				writeError(w, r, status, errmsg)
+				return
+			}
+			res.IsTruncated = len(smds) != 0
+			break
+		}
+
+		smds, isTruncated, status, errmsg := s.s3io.ListObjects(bkname, scanPrefix, scanMarker, maxKeys-count)
+		if status != StatusOK {
+			glog.Errorln("failed to list objects", requuid, bkname, prefix, scanMarker, status, errmsg)
+			writeError(w, r, status, errmsg)
+			return
+		}
+
+		jumped := false
+		for _, smd := range smds {
+			key := objectKey(smd.Name)
+			scanMarker = smd.Name
+
+			// the object is deleted, but the delete is not applied yet
+			if s.journal.IsListDeleted(smd) {
+				continue
+			}
+
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					commonPrefix := key[:len(prefix)+i+len(delimiter)]
+					if commonPrefix > marker {
+						res.CommonPrefixes = append(res.CommonPrefixes,
+							listCommonPrefix{Prefix: encode(commonPrefix)})
+						count++
+						last = commonPrefix
+					}
+
+					// jump over all keys of the common prefix, the max rune is
+					// greater than any other character of the utf-8 key
+					scanMarker = "/" + commonPrefix + string(utf8.MaxRune)
+					jumped = true
+					break
+				}
+			}
+
+			c := listContent{Key: encode(key), LastModified: time.Unix(smd.Mtime, 0).UTC().Format(time.RFC3339),
+				ETag: smd.Etag, Size: smd.Size, StorageClass: "STANDARD"}
+			if fetchOwner {
+				c.Owner = &listOwner{ID: DefaultOwnerID, DisplayName: DefaultOwnerDisplayName}
+			}
+			res.Contents = append(res.Contents, c)
+			count++
+			last = key
+		}
+
+		if !jumped && !isTruncated {
+			break
+		}
+	}
+
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+		} else if delimiter != "" {
+			res.NextMarker = encode(last)
+		}
+	}
+	if v2 {
+		res.KeyCount = &count
+	}
+
+	glog.V(1).Infoln("list objects success", requuid, bkname, prefix, delimiter, marker,
+		"keys", len(res.Contents), "common prefixes", len(res.CommonPrefixes), res.IsTruncated)
+
+	writeXMLResponse(ctx, w, res)
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// testListAll lists the bucket page by page, and returns the keys and the
+// common prefixes in the listed order.
+func testListAll(t *testing.T, s *S3Server, bkname string, query string, v2 bool) (names []string, pages int) {
+	token := ""
+	for {
+		target := "/" + bkname + "?" + query
+		if v2 {
+			target += "&list-type=2"
+			if token != "" {
+				target += "&continuation-token=" + url.QueryEscape(token)
+			}
+		} else if token != "" {
+			target += "&marker=" + url.QueryEscape(token)
+		}
+
+		res := &listBucketResult{}
+		testS3XML(t, s, "GET", target, nil, res)
+		pages++
+		for _, c := range res.Contents {
+			names = append(names, c.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			names = append(names, p.Prefix)
+		}
+		if v2 && (res.KeyCount == nil || *res.KeyCount != len(res.Contents)+len(res.CommonPrefixes)) {
+			t.Fatal("KeyCount", res.KeyCount, len(res.Contents), len(res.CommonPrefixes))
+		}
+
+		if !res.IsTruncated {
+			return names, pages
+		}
+		token = res.NextContinuationToken
+		if !v2 {
+			// NextMarker is only returned with delimiter, otherwise the
+			// last key is the marker
+			token = res.NextMarker
+			if token == "" && len(res.Contents) != 0 {
+				token = res.Contents[len(res.Contents)-1].Key
+			}
+		}
+		if token == "" {
+			t.Fatal("truncated list without the next marker", target)
+		}
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+	for _, key := range []string{"a", "b/1", "b/2", "b/3/x", "c d", "e/f/g", "z"} {
+		testS3OK(t, s, "PUT", "/bk/"+url.PathEscape(key), nil, []byte(key))
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		names []string
+		pages int
+	}{
+		{"all", "max-keys=3", []string{"a", "b/1", "b/2", "b/3/x", "c d", "e/f/g", "z"}, 3},
+		{"delimiter", "delimiter=/&max-keys=2", []string{"a", "b/", "c d", "e/", "z"}, 3},
+		{"prefix", "prefix=b/&delimiter=/", []string{"b/1", "b/2", "b/3/"}, 1},
+		{"prefix pages", "prefix=b/&delimiter=/&max-keys=1", []string{"b/1", "b/2", "b/3/"}, 3},
+		{"start after", "start-after=b/2", []string{"b/3/x", "c d", "e/f/g", "z"}, 1},
+		{"no match", "prefix=x", nil, 1},
+	}
+
+	for _, tt := range tests {
+		for _, v2 := range []bool{true, false} {
+			if !v2 && tt.name == "start after" {
+				continue
+			}
+			names, pages := testListAll(t, s, "bk", tt.query, v2)
+			if !reflect.DeepEqual(names, tt.names) || pages != tt.pages {
+				t.Errorf("%s v2 %v: %v pages %d, want %v pages %d", tt.name, v2, names, pages, tt.names, tt.pages)
+			}
+		}
+	}
+
+	// the deleted object is not listed before the delete is applied
+	testS3OK(t, s, "DELETE", "/bk/b/2", nil, nil)
+	names, _ := testListAll(t, s, "bk", "prefix=b/", true)
+	if !reflect.DeepEqual(names, []string{"b/1", "b/3/x"}) {
+		t.Fatal("list after delete", names)
+	}
+	s.journal.ApplyBucket("bk")
+	names, _ = testListAll(t, s, "bk", "prefix=b/", true)
+	if !reflect.DeepEqual(names, []string{"b/1", "b/3/x"}) {
+		t.Fatal("list after the delete is applied", names)
+	}
+
+	if code := testS3ErrorCode(testS3Request(s, "GET", "/bk2?list-type=2", nil, nil)); code != "NoSuchBucket" {
+		t.Fatal("list the not existing bucket", code)
+	}
+	if code := testS3ErrorCode(testS3Request(s, "GET", "/bk?list-type=2&max-keys=-1", nil, nil)); code != "InvalidArgument" {
+		t.Fatal("list with the invalid max-keys", code)
+	}
+}
@@ -0,0 +1,741 @@
+package test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// S3Multipart is the class to handle the multipart upload operations.
+//
+// Every uploaded part is chunked to data blocks, and the block list is stored
+// as the data part object uploadId.partNum. CompleteMultipartUpload stitches
+// the blocks of all parts to a single ObjectMD. The ObjectMD layout requires
+// all blocks except the last one are full blocks, so if one part size is not
+// aligned with DataBlockSize, the blocks after it are re-chunked.
+//
+// Every uploaded part references its blocks with its own uuid, so the blocks
+// are not collected by gc before the upload is completed or aborted.
+type S3Multipart struct {
+	ctx     context.Context
+	requuid string
+	r       *http.Request
+	s3io    CloudIO
+	gc      *BlockGC
+	journal *DeleteJournal
+	sse     *S3SSE
+	bkname  string
+	objname string
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type listPart struct {
+	PartNumber   int32  `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type listPartsResult struct {
+	XMLName              xml.Name   `xml:"ListPartsResult"`
+	Xmlns                string     `xml:"xmlns,attr"`
+	Bucket               string     `xml:"Bucket"`
+	Key                  string     `xml:"Key"`
+	UploadID             string     `xml:"UploadId"`
+	StorageClass         string     `xml:"StorageClass"`
+	PartNumberMarker     int        `xml:"PartNumberMarker"`
+	NextPartNumberMarker int        `xml:"NextPartNumberMarker"`
+	MaxParts             int        `xml:"MaxParts"`
+	IsTruncated          bool       `xml:"IsTruncated"`
+	Parts                []listPart `xml:"Part"`
+}
+
+type listUpload struct {
+	Key          string `xml:"Key"`
+	UploadID     string `xml:"UploadId"`
+	Initiated    string `xml:"Initiated"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name     `xml:"ListMultipartUploadsResult"`
+	Xmlns              string       `xml:"xmlns,attr"`
+	Bucket             string       `xml:"Bucket"`
+	KeyMarker          string       `xml:"KeyMarker"`
+	UploadIDMarker     string       `xml:"UploadIdMarker"`
+	NextKeyMarker      string       `xml:"NextKeyMarker"`
+	NextUploadIDMarker string       `xml:"NextUploadIdMarker"`
+	Prefix             string       `xml:"Prefix"`
+	MaxUploads         int          `xml:"MaxUploads"`
+	IsTruncated        bool         `xml:"IsTruncated"`
+	Uploads            []listUpload `xml:"Upload"`
+}
+
+// NewS3Multipart creates a new S3Multipart instance
+func NewS3Multipart(ctx context.Context, r *http.Request, s3io CloudIO, gc *BlockGC, journal *DeleteJournal,
+	sse *S3SSE, bkname string, objname string) *S3Multipart {
+	m := new(S3Multipart)
+	m.ctx = ctx
+	m.requuid = util.GetReqIDFromContext(ctx)
+	m.r = r
+	m.s3io = s3io
+	m.gc = gc
+	m.journal = journal
+	m.sse = sse
+	m.bkname = bkname
+	m.objname = objname
+	return m
+}
+
+func (m *S3Multipart) readUpload(uploadID string) (upload *MultipartUpload, status int, errmsg string) {
+	b, status, errmsg := m.s3io.ReadUploadMD(m.bkname, uploadID)
+	if status != StatusOK {
+		glog.Errorln("failed to read upload", m.requuid, m.bkname, m.objname, uploadID, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	upload = &MultipartUpload{}
+	err := proto.Unmarshal(b, upload)
+	if err != nil {
+		glog.Errorln("failed to Unmarshal MultipartUpload", m.requuid, m.bkname, m.objname, uploadID, err)
+		return nil, InternalError, "failed to Unmarshal MultipartUpload"
+	}
+
+	// the upload id is for another object
+	if m.objname != "" && upload.Md.Smd.Name != m.objname {
+		glog.Errorln("upload is not for the object", m.requuid, m.bkname, m.objname,
+			uploadID, upload.Md.Smd.Name)
+		return nil, NoSuchUpload, "NoSuchUpload"
+	}
+	return upload, StatusOK, StatusOKStr
+}
+
+func (m *S3Multipart) readUploadPart(uploadID string, partNum int) (part *UploadPart, status int, errmsg string) {
+	b, status, errmsg := m.s3io.ReadDataPart(m.bkname, util.GenPartName(uploadID, partNum))
+	if status == NoSuchKey {
+		glog.V(2).Infoln("upload part not exist", m.requuid, m.bkname, m.objname, uploadID, partNum)
+		return nil, status, errmsg
+	}
+	if status != StatusOK {
+		glog.Errorln("failed to read upload part", m.requuid, m.bkname, m.objname,
+			uploadID, partNum, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	part = &UploadPart{}
+	err := proto.Unmarshal(b, part)
+	if err != nil {
+		glog.Errorln("failed to Unmarshal UploadPart", m.requuid, m.bkname, m.objname, uploadID, partNum, err)
+		return nil, InternalError, "failed to Unmarshal UploadPart"
+	}
+	return part, StatusOK, StatusOKStr
+}
+
+// list the part numbers of the upload in order
+func (m *S3Multipart) listUploadPartNums(uploadID string) (partNums []int, status int, errmsg string) {
+	prefix := uploadID + util.DefaultSeparator
+	names, status, errmsg := m.s3io.ListDataParts(m.bkname, prefix)
+	if status != StatusOK {
+		glog.Errorln("failed to list upload parts", m.requuid, m.bkname, m.objname, uploadID, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	for _, name := range names {
+		partNum, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			glog.Errorln("invalid upload part name", m.requuid, m.bkname, name, err)
+			continue
+		}
+		partNums = append(partNums, partNum)
+	}
+	sort.Ints(partNums)
+	return partNums, StatusOK, StatusOKStr
+}
+
+// the ref of the upload part blocks
+func (m *S3Multipart) partRef(part *UploadPart) string {
+	return util.GenBlockRef(m.bkname, m.objname, part.Uuid)
+}
+
+// delete all uploaded parts and the upload metadata.
+// the blocks of the parts are dereferenced, and collected by gc.
+func (m *S3Multipart) deleteUpload(uploadID string) (status int, errmsg string) {
+	partNums, status, errmsg := m.listUploadPartNums(uploadID)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	for _, partNum := range partNums {
+		part, status, errmsg := m.readUploadPart(uploadID, partNum)
+		if status == NoSuchKey {
+			continue
+		}
+		if status != StatusOK {
+			return status, errmsg
+		}
+
+		status, errmsg = m.gc.LogRefs(m.ctx, m.partRef(part), false, part.Blocks)
+		if status != StatusOK {
+			return status, errmsg
+		}
+
+		status, errmsg = m.s3io.DeleteDataPart(m.bkname, util.GenPartName(uploadID, partNum))
+		if status != StatusOK && status != NoSuchKey {
+			glog.Errorln("failed to delete upload part", m.requuid, m.bkname, m.objname,
+				uploadID, partNum, status, errmsg)
+			return status, errmsg
+		}
+	}
+
+	return m.s3io.DeleteUploadMD(m.bkname, uploadID)
+}
+
+// CreateUpload handles CreateMultipartUpload, POST /bucket/key?uploads
+func (m *S3Multipart) CreateUpload(w http.ResponseWriter, bmd *BucketMD) {
+	status, errmsg := m.s3io.HeadBucket(m.bkname)
+	if status != StatusOK {
+		glog.Errorln("create upload failed to head bucket", m.requuid, m.bkname, m.objname, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	// the request id is used as the upload id
+	upload := &MultipartUpload{}
+	upload.UploadId = m.requuid
+	upload.Initiated = time.Now().Unix()
+	upload.Md = newObjectMD("", m.bkname, m.objname)
+	parseEntityHeaders(m.r.Header, upload.Md.Smd)
+
+	upload.Md.Umd, status, errmsg = parseUserMetadata(m.r.Header)
+	if status != StatusOK {
+		glog.Errorln("invalid user metadata", m.requuid, m.bkname, m.objname, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	upload.Md.Tags, status, errmsg = parseTaggingHeader(m.r.Header)
+	if status != StatusOK {
+		glog.Errorln("invalid tagging", m.requuid, m.bkname, m.objname, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	upload.Md.Acl, status, errmsg = parseACLHeaders(m.r.Header, getOwnerID(m.ctx), bucketOwnerID(bmd))
+	if status != StatusOK {
+		glog.Errorln("invalid acl", m.requuid, m.bkname, m.objname, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	// every part is encrypted with the encryption of the upload
+	upload.Md.Sse, _, status, errmsg = m.sse.parseSSEHeaders(m.ctx, m.r.Header, bucketOwnerID(bmd))
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	// the default retention is applied at complete
+	status, errmsg = parseLockHeaders(m.r.Header, bmd, upload.Md)
+	if status != StatusOK {
+		glog.Errorln("invalid object lock", m.requuid, m.bkname, m.objname, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	b, err := proto.Marshal(upload)
+	if err != nil {
+		glog.Errorln("failed to Marshal MultipartUpload", m.requuid, m.bkname, m.objname, err)
+		writeError(w, m.r, InternalError, "failed to Marshal MultipartUpload")
+		return
+	}
+
+	status, errmsg = m.s3io.WriteUploadMD(m.bkname, upload.UploadId, b)
+	if status != StatusOK {
+		glog.Errorln("failed to write upload", m.requuid, m.bkname, m.objname, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	glog.V(1).Infoln("create upload success", m.requuid, m.bkname, m.objname)
+
+	res := &initiateMultipartUploadResult{Xmlns: XMLNS, Bucket: m.bkname,
+		Key: objectKey(m.objname), UploadID: upload.UploadId}
+	setSSEHeaders(w, upload.Md.Sse)
+	writeXMLResponse(m.ctx, w, res)
+}
+
+// UploadPart handles UploadPart, PUT /bucket/key?partNumber=n&uploadId=id
+func (m *S3Multipart) UploadPart(w http.ResponseWriter) {
+	uploadID := m.r.URL.Query().Get(ObjectUploadID)
+	partNum, err := strconv.Atoi(m.r.URL.Query().Get(ObjectPartNumber))
+	if err != nil || partNum < 1 || partNum > MaxPartNumber {
+		glog.Errorln("invalid part number", m.requuid, m.bkname, m.objname, uploadID, m.r.URL.RawQuery)
+		writeError(w, m.r, InvalidArgument, "invalid part number")
+		return
+	}
+
+	upload, status, errmsg := m.readUpload(uploadID)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	// the SSE-C part requires the same customer key with the upload
+	cipher, status, errmsg := m.sse.objectCipher(m.ctx, m.r.Header, upload.Md.Sse, false)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	digest, status, errmsg := newPayloadDigest(m.requuid, m.r)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	// chunk the part data to blocks
+	p := NewS3PutObject(m.ctx, m.r, m.s3io, m.gc, m.journal, m.sse, nil, m.bkname, m.objname)
+	p.cipher = cipher
+	blocks, size, etag, status, errmsg := p.putDataBlocks()
+	if status != StatusOK {
+		glog.Errorln("failed to put part data", m.requuid, m.bkname, m.objname, uploadID, partNum, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	status, errmsg = digest.verify(etag)
+	if status != StatusOK {
+		glog.Errorln("part digest mismatch", m.requuid, m.bkname, m.objname, uploadID, partNum, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	part := &UploadPart{}
+	part.PartNum = int32(partNum)
+	part.Size = size
+	part.Etag = hex.EncodeToString(etag)
+	part.Mtime = time.Now().Unix()
+	part.Blocks = blocks
+	part.Uuid = m.requuid
+
+	b, err := proto.Marshal(part)
+	if err != nil {
+		glog.Errorln("failed to Marshal UploadPart", m.requuid, m.bkname, m.objname, uploadID, partNum, err)
+		writeError(w, m.r, InternalError, "failed to Marshal UploadPart")
+		return
+	}
+
+	// the part could be uploaded again, the old part is dereferenced
+	oldpart, status, _ := m.readUploadPart(uploadID, partNum)
+	if status != StatusOK {
+		oldpart = nil
+	}
+
+	status, errmsg = m.gc.LogRefs(m.ctx, m.partRef(part), true, part.Blocks)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	status, errmsg = m.s3io.WriteDataPart(m.bkname, util.GenPartName(uploadID, partNum), b)
+	if status != StatusOK {
+		glog.Errorln("failed to write upload part", m.requuid, m.bkname, m.objname, uploadID, partNum, status, errmsg)
+		m.gc.LogRefs(m.ctx, m.partRef(part), false, part.Blocks)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	if oldpart != nil {
+		status, errmsg = m.gc.LogRefs(m.ctx, m.partRef(oldpart), false, oldpart.Blocks)
+		if status != StatusOK {
+			glog.Errorln("failed to dereference the old part, the blocks are leaked", m.requuid,
+				m.bkname, m.objname, uploadID, partNum, oldpart.Uuid, status, errmsg)
+		}
+	}
+
+	glog.V(1).Infoln("upload part success", m.requuid, m.bkname, m.objname, uploadID, partNum, size, part.Etag)
+
+	w.Header().Set(ETag, part.Etag)
+	setSSEHeaders(w, upload.Md.Sse)
+	w.WriteHeader(StatusOK)
+}
+
+// merge the blocks of all parts. If the part size is not aligned with
+// DataBlockSize, the last block of the part is partial, the blocks after it
+// are read back and re-chunked.
+func (m *S3Multipart) mergePartBlocks(parts []*UploadPart, cipher *blockCipher) (blocks []string, ddBlocks int64, status int, errmsg string) {
+	var carry []byte
+	for i, part := range parts {
+		for j, blk := range part.Blocks {
+			blkSize := int64(DataBlockSize)
+			if j == len(part.Blocks)-1 {
+				blkSize = part.Size - int64(j)*DataBlockSize
+			}
+
+			lastBlock := i == len(parts)-1 && j == len(part.Blocks)-1
+			if len(carry) == 0 && (blkSize == DataBlockSize || lastBlock) {
+				// aligned, reuse the block
+				blocks = append(blocks, blk)
+				continue
+			}
+
+			buf := make([]byte, blkSize)
+			n, status, errmsg := m.s3io.ReadDataBlockRange(blk, 0, buf)
+			if status != StatusOK {
+				glog.Errorln("failed to read part block", m.requuid, m.bkname, m.objname, blk, status, errmsg)
+				return nil, 0, status, errmsg
+			}
+			if int64(n) != blkSize {
+				glog.Errorln("read less data for part block", m.requuid, m.bkname, m.objname, blk, n, blkSize)
+				return nil, 0, InternalError, "read less data for part block"
+			}
+			if cipher != nil {
+				cipher.decrypt(blk, buf)
+			}
+
+			carry = append(carry, buf...)
+			for len(carry) >= DataBlockSize {
+				md5str, exist, status, errmsg := writeBlock(m.s3io, m.gc, cipher, carry[:DataBlockSize])
+				if status != StatusOK {
+					glog.Errorln("failed to write merged block", m.requuid, m.bkname, m.objname, status, errmsg)
+					return nil, 0, status, errmsg
+				}
+				if exist {
+					ddBlocks++
+				}
+				blocks = append(blocks, md5str)
+				carry = carry[DataBlockSize:]
+			}
+		}
+	}
+
+	if len(carry) != 0 {
+		md5str, exist, status, errmsg := writeBlock(m.s3io, m.gc, cipher, carry)
+		if status != StatusOK {
+			glog.Errorln("failed to write the last merged block", m.requuid, m.bkname, m.objname, status, errmsg)
+			return nil, 0, status, errmsg
+		}
+		if exist {
+			ddBlocks++
+		}
+		blocks = append(blocks, md5str)
+	}
+
+	return blocks, ddBlocks, StatusOK, StatusOKStr
+}
+
+// CompleteUpload handles CompleteMultipartUpload, POST /bucket/key?uploadId=id
+func (m *S3Multipart) CompleteUpload(w http.ResponseWriter, bmd *BucketMD) {
+	uploadID := m.r.URL.Query().Get(ObjectUploadID)
+
+	upload, status, errmsg := m.readUpload(uploadID)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	body, err := ioutil.ReadAll(m.r.Body)
+	if err != nil {
+		glog.Errorln("failed to read complete request", m.requuid, m.bkname, m.objname, uploadID, err)
+		writeError(w, m.r, InternalError, "failed to read request body")
+		return
+	}
+
+	req := &completeMultipartUpload{}
+	err = xml.Unmarshal(body, req)
+	if err != nil || len(req.Parts) == 0 {
+		glog.Errorln("invalid complete request", m.requuid, m.bkname, m.objname, uploadID, err)
+		writeError(w, m.r, MalformedXML, "MalformedXML")
+		return
+	}
+
+	// load and check all parts
+	parts := make([]*UploadPart, len(req.Parts))
+	etag := md5.New()
+	var size int64
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			glog.Errorln("invalid part order", m.requuid, m.bkname, m.objname, uploadID, req.Parts)
+			writeError(w, m.r, InvalidPartOrder, "InvalidPartOrder")
+			return
+		}
+
+		part, status, _ := m.readUploadPart(uploadID, p.PartNumber)
+		if status != StatusOK || part.Etag != strings.Trim(p.ETag, "\"") {
+			glog.Errorln("invalid part", m.requuid, m.bkname, m.objname, uploadID, p, status)
+			writeError(w, m.r, InvalidPart, "InvalidPart")
+			return
+		}
+
+		if i != len(req.Parts)-1 && part.Size < MinPartSize {
+			glog.Errorln("part is too small", m.requuid, m.bkname, m.objname, uploadID, p, part.Size)
+			writeError(w, m.r, EntityTooSmall, "EntityTooSmall")
+			return
+		}
+
+		md5byte, _ := hex.DecodeString(part.Etag)
+		etag.Write(md5byte)
+		size += part.Size
+		parts[i] = part
+	}
+
+	// the unaligned part blocks are re-chunked, the SSE-C upload requires the
+	// customer key to complete.
+	cipher, status, errmsg := m.sse.objectCipher(m.ctx, m.r.Header, upload.Md.Sse, false)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	blocks, ddBlocks, status, errmsg := m.mergePartBlocks(parts, cipher)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	// create the ObjectMD
+	md := upload.Md
+	md.Uuid = m.requuid
+	md.Smd.Mtime = time.Now().Unix()
+	md.Smd.Size = size
+	md.Smd.Etag = hex.EncodeToString(etag.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+	md.Data.DdBlocks = ddBlocks
+
+	status, errmsg = setObjectBlocks(m.ctx, m.s3io, md, blocks)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	status, errmsg = commitObjectMD(m.ctx, m.s3io, m.gc, m.journal, bmd, md, blocks, m.r.Header)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	glog.V(0).Infoln("complete upload success", m.requuid, m.bkname, m.objname,
+		uploadID, "parts", len(parts), "blocks", len(blocks), md.Smd.Etag)
+
+	// the object is created, the failure of cleaning up the upload is not
+	// returned to the client.
+	status, errmsg = m.deleteUpload(uploadID)
+	if status != StatusOK {
+		glog.Errorln("failed to clean up the completed upload", m.requuid, m.bkname, m.objname,
+			uploadID, status, errmsg)
+	}
+
+	res := &completeMultipartUploadResult{Xmlns: XMLNS, Location: m.bkname + m.objname,
+		Bucket: m.bkname, Key: objectKey(m.objname), ETag: md.Smd.Etag}
+	setVersionHeader(w, bmd, md)
+	setSSEHeaders(w, md.Sse)
+	writeXMLResponse(m.ctx, w, res)
+}
+
+// AbortUpload handles AbortMultipartUpload, DELETE /bucket/key?uploadId=id
+func (m *S3Multipart) AbortUpload(w http.ResponseWriter) {
+	uploadID := m.r.URL.Query().Get(ObjectUploadID)
+
+	_, status, errmsg := m.readUpload(uploadID)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	status, errmsg = m.deleteUpload(uploadID)
+	if status != StatusOK {
+		glog.Errorln("failed to abort upload", m.requuid, m.bkname, m.objname, uploadID, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	glog.V(1).Infoln("abort upload success", m.requuid, m.bkname, m.objname, uploadID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListParts handles ListParts, GET /bucket/key?uploadId=id
+func (m *S3Multipart) ListParts(w http.ResponseWriter) {
+	q := m.r.URL.Query()
+	uploadID := q.Get(ObjectUploadID)
+
+	maxParts := MaxPartsList
+	if str := q.Get("max-parts"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			writeError(w, m.r, InvalidArgument, "invalid max-parts")
+			return
+		}
+		if n < maxParts {
+			maxParts = n
+		}
+	}
+
+	marker := 0
+	if str := q.Get("part-number-marker"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			writeError(w, m.r, InvalidArgument, "invalid part-number-marker")
+			return
+		}
+		marker = n
+	}
+
+	_, status, errmsg := m.readUpload(uploadID)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	partNums, status, errmsg := m.listUploadPartNums(uploadID)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	res := &listPartsResult{Xmlns: XMLNS, Bucket: m.bkname, Key: objectKey(m.objname),
+		UploadID: uploadID, StorageClass: "STANDARD", PartNumberMarker: marker, MaxParts: maxParts}
+
+	for _, partNum := range partNums {
+		if partNum <= marker {
+			continue
+		}
+		if len(res.Parts) == maxParts {
+			res.IsTruncated = true
+			break
+		}
+
+		part, status, errmsg := m.readUploadPart(uploadID, partNum)
+		if status != StatusOK {
+			writeError(w, m.r, status, errmsg)
+			return
+		}
+
+		res.Parts = append(res.Parts, listPart{PartNumber: part.PartNum,
+			LastModified: time.Unix(part.Mtime, 0).UTC().Format(time.RFC3339),
+			ETag:         part.Etag, Size: part.Size})
+		res.NextPartNumberMarker = partNum
+	}
+
+	glog.V(2).Infoln("list parts success", m.requuid, m.bkname, m.objname, uploadID, len(res.Parts))
+	writeXMLResponse(m.ctx, w, res)
+}
+
+// ListUploads handles ListMultipartUploads, GET /bucket?uploads
+func (m *S3Multipart) ListUploads(w http.ResponseWriter) {
+	q := m.r.URL.Query()
+	prefix := q.Get("prefix")
+	keyMarker := q.Get("key-marker")
+	uploadIDMarker := q.Get("upload-id-marker")
+
+	maxUploads := MaxUploadsList
+	if str := q.Get("max-uploads"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			writeError(w, m.r, InvalidArgument, "invalid max-uploads")
+			return
+		}
+		if n < maxUploads {
+			maxUploads = n
+		}
+	}
+
+	status, errmsg := m.s3io.HeadBucket(m.bkname)
+	if status != StatusOK {
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	uploadIDs, status, errmsg := m.s3io.ListUploads(m.bkname)
+	if status != StatusOK {
+		glog.Errorln("failed to list uploads", m.requuid, m.bkname, status, errmsg)
+		writeError(w, m.r, status, errmsg)
+		return
+	}
+
+	var uploads []*MultipartUpload
+	for _, uploadID := range uploadIDs {
+		upload, status, errmsg := m.readUpload(uploadID)
+		if status != StatusOK {
+			if status == NoSuchUpload {
+				// completed or aborted after list
+				continue
+			}
+			writeError(w, m.r, status, errmsg)
+			return
+		}
+
+		key := objectKey(upload.Md.Smd.Name)
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if keyMarker != "" && (key < keyMarker ||
+			(key == keyMarker && (uploadIDMarker == "" || upload.UploadId <= uploadIDMarker))) {
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+
+	// sort by key, then by upload id, the same order with the markers
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Md.Smd.Name != uploads[j].Md.Smd.Name {
+			return uploads[i].Md.Smd.Name < uploads[j].Md.Smd.Name
+		}
+		return uploads[i].UploadId < uploads[j].UploadId
+	})
+
+	res := &listMultipartUploadsResult{Xmlns: XMLNS, Bucket: m.bkname, KeyMarker: keyMarker,
+		UploadIDMarker: uploadIDMarker, Prefix: prefix, MaxUploads: maxUploads}
+
+	for _, upload := range uploads {
+		if len(res.Uploads) == maxUploads {
+			res.IsTruncated = true
+			break
+		}
+
+		res.Uploads = append(res.Uploads, listUpload{Key: objectKey(upload.Md.Smd.Name),
+			UploadID:     upload.UploadId,
+			Initiated:    time.Unix(upload.Initiated, 0).UTC().Format(time.RFC3339),
+			StorageClass: "STANDARD"})
+		res.NextKeyMarker = objectKey(upload.Md.Smd.Name)
+		res.NextUploadIDMarker = upload.UploadId
+	}
+
+	glog.V(2).Infoln("list uploads success", m.requuid, m.bkname, len(res.Uploads))
+	writeXMLResponse(m.ctx, w, res)
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func testCreateUpload(t *testing.T, s *S3Server, target string) string {
+	res := &initiateMultipartUploadResult{}
+	testS3XML(t, s, "POST", target+"?uploads", nil, res)
+	if res.UploadID == "" {
+		t.Fatal("no upload id", target)
+	}
+	return res.UploadID
+}
+
+func testUploadPart(t *testing.T, s *S3Server, target string, uploadID string, partNum int,
+	data []byte) completePart {
+	w := testS3OK(t, s, "PUT", target+"?partNumber="+strconv.Itoa(partNum)+"&uploadId="+uploadID, nil, data)
+	return completePart{PartNumber: partNum, ETag: w.Header().Get(ETag)}
+}
+
+func testCompleteUpload(s *S3Server, target string, uploadID string, parts []completePart) (code string) {
+	b, _ := xml.Marshal(&completeMultipartUpload{Parts: parts})
+	return testS3ErrorCode(testS3Request(s, "POST", target+"?uploadId="+uploadID, nil, b))
+}
+
+// the multipart ETag, the md5 of the part md5s and the number of parts
+func testMultipartETag(datas ...[]byte) string {
+	h := md5.New()
+	for _, data := range datas {
+		sum := md5.Sum(data)
+		h.Write(sum[:])
+	}
+	return hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(datas))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	// the first part is not aligned with DataBlockSize, the blocks after it
+	// are re-chunked.
+	data1 := testObjectData(MinPartSize + 1000)
+	data2 := testObjectData(MinPartSize)
+	data3 := testObjectData(1000)
+	uploadID := testCreateUpload(t, s, "/bk/obj")
+	parts := []completePart{
+		testUploadPart(t, s, "/bk/obj", uploadID, 1, data1),
+		testUploadPart(t, s, "/bk/obj", uploadID, 2, data2),
+		testUploadPart(t, s, "/bk/obj", uploadID, 3, data3),
+	}
+	// upload the part again
+	parts[1] = testUploadPart(t, s, "/bk/obj", uploadID, 2, data2)
+
+	listParts := &listPartsResult{}
+	testS3XML(t, s, "GET", "/bk/obj?uploadId="+uploadID, nil, listParts)
+	if len(listParts.Parts) != 3 {
+		t.Fatal("ListParts", len(listParts.Parts))
+	}
+	listUploads := &listMultipartUploadsResult{}
+	testS3XML(t, s, "GET", "/bk?uploads", nil, listUploads)
+	if len(listUploads.Uploads) != 1 || listUploads.Uploads[0].UploadID != uploadID {
+		t.Fatal("ListMultipartUploads", listUploads.Uploads)
+	}
+
+	if code := testCompleteUpload(s, "/bk/obj", uploadID, parts); code != "" {
+		t.Fatal("CompleteMultipartUpload", code)
+	}
+
+	data := append(append(append([]byte{}, data1...), data2...), data3...)
+	w := testS3OK(t, s, "GET", "/bk/obj", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatal("object data mismatch", w.Body.Len(), len(data))
+	}
+	etag := testMultipartETag(data1, data2, data3)
+	if w.Header().Get(ETag) != etag {
+		t.Fatal("ETag", w.Header().Get(ETag), etag)
+	}
+
+	// all blocks except the last one are full blocks
+	md, status, errmsg := readObjectMD(context.Background(), s.s3io, "bk", "/obj")
+	if status != StatusOK {
+		t.Fatal("readObjectMD", status, errmsg)
+	}
+	blocks, status, errmsg := getObjectBlocks(context.Background(), s.s3io, md)
+	if status != StatusOK {
+		t.Fatal("getObjectBlocks", status, errmsg)
+	}
+	if len(blocks) != (len(data)+DataBlockSize-1)/DataBlockSize {
+		t.Fatal("blocks", len(blocks), "size", len(data))
+	}
+
+	// the upload is removed
+	if code := testS3ErrorCode(testS3Request(s, "GET", "/bk/obj?uploadId="+uploadID, nil, nil)); code != "NoSuchUpload" {
+		t.Fatal("ListParts of the completed upload", code)
+	}
+	listUploads = &listMultipartUploadsResult{}
+	testS3XML(t, s, "GET", "/bk?uploads", nil, listUploads)
+	if len(listUploads.Uploads) != 0 {
+		t.Fatal("the completed upload is listed", listUploads.Uploads)
+	}
+}
+
+func TestMultipartUploadErrors(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	data1 := testObjectData(MinPartSize)
+	data2 := testObjectData(1000)
+	uploadID := testCreateUpload(t, s, "/bk/obj")
+	part1 := testUploadPart(t, s, "/bk/obj", uploadID, 1, data1)
+	part2 := testUploadPart(t, s, "/bk/obj", uploadID, 2, data2)
+	part3 := testUploadPart(t, s, "/bk/obj", uploadID, 3, data2)
+
+	tests := []struct {
+		name  string
+		parts []completePart
+		code  string
+	}{
+		{"no part", nil, "MalformedXML"},
+		{"part order", []completePart{part1, part1}, "InvalidPartOrder"},
+		{"part etag", []completePart{{1, part1.ETag + "0"}}, "InvalidPart"},
+		{"not uploaded part", []completePart{part1, {4, part2.ETag}}, "InvalidPart"},
+		{"small part", []completePart{part2, part3}, "EntityTooSmall"},
+		{"last small part", []completePart{part1, part3}, ""},
+	}
+	for _, tt := range tests {
+		if code := testCompleteUpload(s, "/bk/obj", uploadID, tt.parts); code != tt.code {
+			t.Errorf("%s: error %q, want %q", tt.name, code, tt.code)
+		}
+	}
+
+	w := testS3OK(t, s, "GET", "/bk/obj", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), append(append([]byte{}, data1...), data2...)) {
+		t.Fatal("object data mismatch", w.Body.Len())
+	}
+	if code := testCompleteUpload(s, "/bk/obj", uploadID, []completePart{part3}); code != "NoSuchUpload" {
+		t.Fatal("complete the completed upload", code)
+	}
+
+	// abort
+	uploadID = testCreateUpload(t, s, "/bk/obj2")
+	testUploadPart(t, s, "/bk/obj2", uploadID, 1, data1)
+	testS3OK(t, s, "DELETE", "/bk/obj2?uploadId="+uploadID, nil, nil)
+	if code := testS3ErrorCode(testS3Request(s, "GET", "/bk/obj2?uploadId="+uploadID, nil, nil)); code != "NoSuchUpload" {
+		t.Fatal("ListParts of the aborted upload", code)
+	}
+	if names, _, _ := s.s3io.ListDataParts("bk", uploadID); len(names) != 0 {
+		t.Fatal("the parts of the aborted upload are left", names)
+	}
+}
@@ -0,0 +1,459 @@
+package test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"test/util"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// S3 Object Lock.
+//
+// Object lock is enabled at the bucket creation, or later on the versioning
+// enabled bucket, and could not be disabled. Versioning could not be
+// suspended then, so the put never replaces the existing version.
+//
+// The retention and legal hold are stored in the ObjectMD of the version. The
+// locked version could not be removed, the delete of the version, the
+// replace of the null version, the lifecycle expiration and the delete
+// journal all check the lock. The data blocks are referenced by the version,
+// so gc does not reclaim them while the version is kept. The delete without
+// version id only creates the delete marker, which is allowed.
+//
+// The GOVERNANCE retention could be shortened or removed by the request with
+// x-amz-bypass-governance-retention and the s3:BypassGovernanceRetention
+// permission. The COMPLIANCE retention could only be extended.
+
+type xmlDefaultRetention struct {
+	Mode  string `xml:"Mode"`
+	Days  int32  `xml:"Days,omitempty"`
+	Years int32  `xml:"Years,omitempty"`
+}
+
+type objectLockRule struct {
+	DefaultRetention *xmlDefaultRetention `xml:"DefaultRetention"`
+}
+
+type objectLockConfiguration struct {
+	XMLName           xml.Name        `xml:"ObjectLockConfiguration"`
+	Xmlns             string          `xml:"xmlns,attr,omitempty"`
+	ObjectLockEnabled string          `xml:"ObjectLockEnabled,omitempty"`
+	Rule              *objectLockRule `xml:"Rule,omitempty"`
+}
+
+type objectRetention struct {
+	XMLName         xml.Name `xml:"Retention"`
+	Xmlns           string   `xml:"xmlns,attr,omitempty"`
+	Mode            string   `xml:"Mode,omitempty"`
+	RetainUntilDate string   `xml:"RetainUntilDate,omitempty"`
+}
+
+type objectLegalHold struct {
+	XMLName xml.Name `xml:"LegalHold"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Status  string   `xml:"Status"`
+}
+
+func isLockMode(mode string) bool {
+	return mode == LockModeGovernance || mode == LockModeCompliance
+}
+
+// parseRetainUntilDate parses the ISO 8601 retain until date to seconds
+func parseRetainUntilDate(val string) (until int64, status int, errmsg string) {
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return 0, InvalidArgument, "InvalidArgument: invalid retain until date " + val
+	}
+	return t.Unix(), StatusOK, StatusOKStr
+}
+
+func formatRetainUntilDate(until int64) string {
+	return time.Unix(until, 0).UTC().Format(time.RFC3339)
+}
+
+// checkObjectLock returns AccessDenied if the object version is under the
+// legal hold or the retention. The GOVERNANCE retention is bypassed if
+// bypassGovernance is true.
+func checkObjectLock(md *ObjectMD, now time.Time, bypassGovernance bool) (status int, errmsg string) {
+	if md.LegalHold {
+		return AccessDenied, "AccessDenied: the object version is under legal hold"
+	}
+	if md.LockMode == "" || now.Unix() >= md.LockRetainUntil {
+		return StatusOK, StatusOKStr
+	}
+	if md.LockMode == LockModeGovernance && bypassGovernance {
+		return StatusOK, StatusOKStr
+	}
+	return AccessDenied, "AccessDenied: the object version is WORM protected until " +
+		formatRetainUntilDate(md.LockRetainUntil)
+}
+
+// parseLockHeaders parses the object lock headers of the put request to md.
+// The bucket default retention is applied when the object is committed.
+func parseLockHeaders(hdr http.Header, bmd *BucketMD, md *ObjectMD) (status int, errmsg string) {
+	mode := hdr.Get(ObjectLockMode)
+	until := hdr.Get(ObjectLockRetainUntilDate)
+	hold := hdr.Get(ObjectLockLegalHold)
+	if mode == "" && until == "" && hold == "" {
+		return StatusOK, StatusOKStr
+	}
+
+	if !bmd.ObjectLockEnabled {
+		return InvalidRequest, "InvalidRequest: Bucket is missing Object Lock Configuration"
+	}
+
+	if mode != "" || until != "" {
+		if !isLockMode(mode) || until == "" {
+			return InvalidArgument, "InvalidArgument: x-amz-object-lock-mode and " +
+				"x-amz-object-lock-retain-until-date must both be supplied"
+		}
+		md.LockRetainUntil, status, errmsg = parseRetainUntilDate(until)
+		if status != StatusOK {
+			return status, errmsg
+		}
+		if md.LockRetainUntil <= time.Now().Unix() {
+			return InvalidArgument, "InvalidArgument: the retain until date must be in the future"
+		}
+		md.LockMode = mode
+	}
+
+	switch hold {
+	case "", LegalHoldOff:
+	case LegalHoldOn:
+		md.LegalHold = true
+	default:
+		return InvalidArgument, "InvalidArgument: invalid x-amz-object-lock-legal-hold " + hold
+	}
+	return StatusOK, StatusOKStr
+}
+
+// applyDefaultRetention sets the bucket default retention to the new object
+// that does not have the retention.
+func applyDefaultRetention(bmd *BucketMD, md *ObjectMD, now time.Time) {
+	r := bmd.DefaultRetention
+	if !bmd.ObjectLockEnabled || r == nil || md.LockMode != "" || md.DeleteMarker {
+		return
+	}
+	md.LockMode = r.Mode
+	md.LockRetainUntil = now.AddDate(int(r.Years), 0, int(r.Days)).Unix()
+}
+
+// objectLockActions returns the extra actions of the object put that sets
+// the object lock.
+func objectLockActions(hdr http.Header) (actions []string) {
+	if hdr.Get(ObjectLockMode) != "" || hdr.Get(ObjectLockRetainUntilDate) != "" {
+		actions = append(actions, "s3:PutObjectRetention")
+	}
+	if hdr.Get(ObjectLockLegalHold) != "" {
+		actions = append(actions, "s3:PutObjectLegalHold")
+	}
+	return actions
+}
+
+// bypassGovernance returns whether the request asks to bypass the GOVERNANCE
+// retention and has the permission.
+func (s *S3Server) bypassGovernance(ctx context.Context, r *http.Request, bkname string,
+	objname string, versionID string) bool {
+	if !strings.EqualFold(r.Header.Get(BypassGovernanceRetention), "true") {
+		return false
+	}
+	status, _ := s.authorizeAction(ctx, r, bkname, objname, versionID, "s3:BypassGovernanceRetention")
+	return status == StatusOK
+}
+
+// putBucketObjectLockConfiguration handles PUT /bucket?object-lock
+func (s *S3Server) putBucketObjectLockConfiguration(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("put object lock configuration failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read object lock configuration", requuid, bkname, err)
+		writeError(w, r, InternalError, "failed to read request body")
+		return
+	}
+
+	conf := &objectLockConfiguration{}
+	err = xml.Unmarshal(b, conf)
+	if err != nil || conf.ObjectLockEnabled != ObjectLockEnabled {
+		glog.Errorln("invalid object lock configuration", requuid, bkname, conf.ObjectLockEnabled, err)
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+
+	var retention *DefaultRetention
+	if conf.Rule != nil {
+		d := conf.Rule.DefaultRetention
+		if d == nil || !isLockMode(d.Mode) || (d.Days == 0) == (d.Years == 0) || d.Days < 0 || d.Years < 0 {
+			glog.Errorln("invalid default retention", requuid, bkname, d)
+			writeError(w, r, MalformedXML, "MalformedXML")
+			return
+		}
+		if d.Days > MaxRetentionDays || d.Years > MaxRetentionYears {
+			glog.Errorln("default retention is too long", requuid, bkname, d.Days, d.Years)
+			writeError(w, r, InvalidArgument, "InvalidArgument: the default retention could not exceed 100 years")
+			return
+		}
+		retention = &DefaultRetention{Mode: d.Mode, Days: d.Days, Years: d.Years}
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	if !bmd.ObjectLockEnabled && bmd.Versioning != VersioningEnabled {
+		glog.Errorln("enable object lock on the unversioned bucket", requuid, bkname, bmd.Versioning)
+		writeError(w, r, InvalidBucketState, "InvalidBucketState: Versioning must be 'Enabled' on the bucket "+
+			"to apply a Object Lock configuration")
+		return
+	}
+
+	bmd = proto.Clone(bmd).(*BucketMD)
+	bmd.ObjectLockEnabled = true
+	bmd.DefaultRetention = retention
+	status, errmsg = s.bmds.Put(ctx, bkname, bmd)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	glog.Infoln("put object lock configuration success", requuid, bkname, retention)
+	w.WriteHeader(StatusOK)
+}
+
+// getBucketObjectLockConfiguration handles GET /bucket?object-lock
+func (s *S3Server) getBucketObjectLockConfiguration(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if !bmd.ObjectLockEnabled {
+		writeError(w, r, ObjectLockConfigurationNotFound, "ObjectLockConfigurationNotFoundError")
+		return
+	}
+
+	res := &objectLockConfiguration{Xmlns: XMLNS, ObjectLockEnabled: ObjectLockEnabled}
+	if d := bmd.DefaultRetention; d != nil {
+		res.Rule = &objectLockRule{DefaultRetention: &xmlDefaultRetention{Mode: d.Mode, Days: d.Days, Years: d.Years}}
+	}
+	writeXMLResponse(ctx, w, res)
+}
+
+// getLockedBucketMD returns the BucketMD of the bucket that has object lock enabled
+func (s *S3Server) getLockedBucketMD(ctx context.Context, bkname string) (bmd *BucketMD, status int, errmsg string) {
+	bmd, status, errmsg = s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+	if !bmd.ObjectLockEnabled {
+		glog.Errorln("object lock is not enabled", util.GetReqIDFromContext(ctx), bkname)
+		return nil, InvalidRequest, "InvalidRequest: Bucket is missing Object Lock Configuration"
+	}
+	return bmd, StatusOK, StatusOKStr
+}
+
+// checkRetentionChange checks whether the retention of the object version
+// could be changed to mode and until. The COMPLIANCE retention could only be
+// extended, the GOVERNANCE retention could be shortened or removed with bypass.
+func checkRetentionChange(md *ObjectMD, mode string, until int64, now time.Time,
+	bypassGovernance bool) (status int, errmsg string) {
+	if md.LockMode == "" || now.Unix() >= md.LockRetainUntil {
+		return StatusOK, StatusOKStr
+	}
+	if mode != "" && until >= md.LockRetainUntil &&
+		(md.LockMode == LockModeGovernance || mode == LockModeCompliance) {
+		return StatusOK, StatusOKStr
+	}
+	if md.LockMode == LockModeGovernance && bypassGovernance {
+		return StatusOK, StatusOKStr
+	}
+	return AccessDenied, "AccessDenied: the retention of the object version could not be shortened"
+}
+
+// putObjectRetention handles PUT /bucket/key?retention. The empty Retention
+// removes the retention.
+func (s *S3Server) putObjectRetention(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read retention", requuid, bkname, objname, err)
+		writeError(w, r, InternalError, "failed to read request body")
+		return
+	}
+
+	req := &objectRetention{}
+	err = xml.Unmarshal(b, req)
+	if err != nil || (req.Mode == "") != (req.RetainUntilDate == "") || (req.Mode != "" && !isLockMode(req.Mode)) {
+		glog.Errorln("invalid retention", requuid, bkname, objname, req.Mode, req.RetainUntilDate, err)
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+
+	now := time.Now()
+	var until int64
+	if req.RetainUntilDate != "" {
+		var status int
+		var errmsg string
+		until, status, errmsg = parseRetainUntilDate(req.RetainUntilDate)
+		if status != StatusOK {
+			writeError(w, r, status, errmsg)
+			return
+		}
+		if until <= now.Unix() {
+			writeError(w, r, InvalidArgument, "InvalidArgument: the retain until date must be in the future")
+			return
+		}
+	}
+
+	bmd, status, errmsg := s.getLockedBucketMD(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// the retention is checked under the commit lock, so the concurrent
+	// change could not be bypassed.
+	md, status, errmsg := s.updateObjectMD(ctx, r, bmd, bkname, objname, func(md *ObjectMD) (int, string) {
+		bypass := s.bypassGovernance(ctx, r, bkname, objname, md.VersionId)
+		status, errmsg := checkRetentionChange(md, req.Mode, until, now, bypass)
+		if status != StatusOK {
+			glog.Errorln("could not change the retention", requuid, bkname, objname, objectVersionID(md),
+				md.LockMode, md.LockRetainUntil, req.Mode, until, bypass)
+			return status, errmsg
+		}
+		md.LockMode = req.Mode
+		md.LockRetainUntil = until
+		return StatusOK, StatusOKStr
+	})
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	glog.V(0).Infoln("put object retention", requuid, bkname, objname, objectVersionID(md), req.Mode, until)
+	setVersionHeader(w, bmd, md)
+	w.WriteHeader(StatusOK)
+}
+
+// getObjectRetention handles GET /bucket/key?retention
+func (s *S3Server) getObjectRetention(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	_, status, errmsg := s.getLockedBucketMD(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg := s.getObjectMD(ctx, r, bkname, objname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if md.LockMode == "" {
+		writeError(w, r, NoSuchObjectLockConfiguration, "NoSuchObjectLockConfiguration")
+		return
+	}
+
+	setHeaderIfNotEmpty(w, VersionID, md.VersionId)
+	writeXMLResponse(ctx, w, &objectRetention{Xmlns: XMLNS, Mode: md.LockMode,
+		RetainUntilDate: formatRetainUntilDate(md.LockRetainUntil)})
+}
+
+// putObjectLegalHold handles PUT /bucket/key?legal-hold
+func (s *S3Server) putObjectLegalHold(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read legal hold", requuid, bkname, objname, err)
+		writeError(w, r, InternalError, "failed to read request body")
+		return
+	}
+
+	req := &objectLegalHold{}
+	err = xml.Unmarshal(b, req)
+	if err != nil || (req.Status != LegalHoldOn && req.Status != LegalHoldOff) {
+		glog.Errorln("invalid legal hold", requuid, bkname, objname, req.Status, err)
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+
+	bmd, status, errmsg := s.getLockedBucketMD(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg := s.updateObjectMD(ctx, r, bmd, bkname, objname, func(md *ObjectMD) (int, string) {
+		md.LegalHold = req.Status == LegalHoldOn
+		return StatusOK, StatusOKStr
+	})
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	glog.V(0).Infoln("put object legal hold", requuid, bkname, objname, objectVersionID(md), req.Status)
+	setVersionHeader(w, bmd, md)
+	w.WriteHeader(StatusOK)
+}
+
+// getObjectLegalHold handles GET /bucket/key?legal-hold
+func (s *S3Server) getObjectLegalHold(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	_, status, errmsg := s.getLockedBucketMD(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg := s.getObjectMD(ctx, r, bkname, objname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	res := &objectLegalHold{Xmlns: XMLNS, Status: LegalHoldOff}
+	if md.LegalHold {
+		res.Status = LegalHoldOn
+	}
+	setHeaderIfNotEmpty(w, VersionID, md.VersionId)
+	writeXMLResponse(ctx, w, res)
+}
+
+// setObjectLockHeaders sets the object lock of the version to the response headers
+func setObjectLockHeaders(w http.ResponseWriter, md *ObjectMD) {
+	if md.LockMode != "" {
+		w.Header().Set(ObjectLockMode, md.LockMode)
+		w.Header().Set(ObjectLockRetainUntilDate, formatRetainUntilDate(md.LockRetainUntil))
+	}
+	if md.LegalHold {
+		w.Header().Set(ObjectLockLegalHold, LegalHoldOn)
+	}
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestObjectLock(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", map[string]string{BucketObjectLockEnabled: "true"}, nil)
+
+	until := formatRetainUntilDate(time.Now().Add(time.Hour).Unix())
+	gv := testS3OK(t, s, "PUT", "/bk/g", map[string]string{ObjectLockMode: LockModeGovernance,
+		ObjectLockRetainUntilDate: until}, []byte("g")).Header().Get(VersionID)
+	cv := testS3OK(t, s, "PUT", "/bk/c", map[string]string{ObjectLockMode: LockModeCompliance,
+		ObjectLockRetainUntilDate: until}, []byte("c")).Header().Get(VersionID)
+	hv := testS3OK(t, s, "PUT", "/bk/h", map[string]string{ObjectLockLegalHold: LegalHoldOn},
+		[]byte("h")).Header().Get(VersionID)
+
+	// the overwrite creates the new version, the locked version and its
+	// blocks are kept
+	testS3OK(t, s, "PUT", "/bk/g", nil, []byte("g2"))
+	testGetCurrent(t, s, "/bk/g", "g2")
+	s.journal.ApplyBucket("bk")
+	s.gc.Collect()
+	testBackdateBlocks(s.gc, true, true, int64(*gcGraceSecs))
+	s.gc.Collect()
+	testGetCurrent(t, s, "/bk/g?versionId="+gv, "g")
+
+	// the delete without version id only creates the delete marker
+	w := testS3OK(t, s, "DELETE", "/bk/c", nil, nil)
+	if w.Header().Get(DeleteMarker) != "true" {
+		t.Fatal("delete the locked object", w.Header())
+	}
+	s.journal.ApplyBucket("bk")
+	testGetCurrent(t, s, "/bk/c", "")
+	testGetCurrent(t, s, "/bk/c?versionId="+cv, "c")
+
+	bypass := map[string]string{BypassGovernanceRetention: "true"}
+	tests := []struct {
+		name   string
+		target string
+		hdr    map[string]string
+		code   string
+	}{
+		{"governance", "/bk/g?versionId=" + gv, nil, "AccessDenied"},
+		{"compliance", "/bk/c?versionId=" + cv, nil, "AccessDenied"},
+		{"compliance with bypass", "/bk/c?versionId=" + cv, bypass, "AccessDenied"},
+		{"legal hold", "/bk/h?versionId=" + hv, nil, "AccessDenied"},
+		{"legal hold with bypass", "/bk/h?versionId=" + hv, bypass, "AccessDenied"},
+	}
+	for _, tt := range tests {
+		if code := testS3ErrorCode(testS3Request(s, "DELETE", tt.target, tt.hdr, nil)); code != tt.code {
+			t.Errorf("delete %s: error %q, want %q", tt.name, code, tt.code)
+		}
+	}
+
+	b, _ := xml.Marshal(&deleteObjectsRequest{Objects: []deleteObjectsEntry{{Key: "g", VersionID: gv},
+		{Key: "c", VersionID: cv}}})
+	res := &deleteObjectsResult{}
+	testS3XML(t, s, "POST", "/bk?delete", b, res)
+	if len(res.Deleted) != 0 || len(res.Errors) != 2 || res.Errors[0].Code != "AccessDenied" ||
+		res.Errors[1].Code != "AccessDenied" {
+		t.Fatal("multi delete the locked versions", res.Deleted, res.Errors)
+	}
+
+	// the delete journal never removes the locked version, such as the record
+	// logged before the lock check
+	md, status, errmsg := s.getObjectVersion(context.Background(), "bk", "/c", cv)
+	if status != StatusOK {
+		t.Fatal("getObjectVersion", status, errmsg)
+	}
+	entry := &DeleteEntry{Bucket: "bk", Name: "/c", Md: md, Version: true}
+	if status, errmsg = s.journal.Log(context.Background(), []*DeleteEntry{entry}); status != StatusOK {
+		t.Fatal("log the delete", status, errmsg)
+	}
+	s.journal.ApplyBucket("bk")
+	testGetCurrent(t, s, "/bk/c?versionId="+cv, "c")
+
+	// the governance retention is bypassed, and the legal hold is removed
+	testS3OK(t, s, "DELETE", "/bk/g?versionId="+gv, bypass, nil)
+	hold, _ := xml.Marshal(&objectLegalHold{Status: LegalHoldOff})
+	testS3OK(t, s, "PUT", "/bk/h?legal-hold&versionId="+hv, nil, hold)
+	testS3OK(t, s, "DELETE", "/bk/h?versionId="+hv, nil, nil)
+	s.journal.ApplyBucket("bk")
+	for _, target := range []string{"/bk/g?versionId=" + gv, "/bk/h?versionId=" + hv} {
+		if code := testS3ErrorCode(testS3Request(s, "GET", target, nil, nil)); code != "NoSuchVersion" {
+			t.Fatal("get the deleted version", target, code)
+		}
+	}
+	testGetCurrent(t, s, "/bk/g", "g2")
+}
@@ -0,0 +1,628 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"test/util"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// Bucket policy.
+//
+// The policy is stored as the json text in the BucketMD, and evaluated for
+// every request after authentication. The explicit Deny rejects the request,
+// the explicit Allow accepts it, even for the anonymous request. If no
+// statement applies, the request is checked by the acls.
+//
+// The principal is the access key, "*" or the user arn that ends with the
+// access key. The supported condition keys are aws:SourceIp,
+// aws:SecureTransport and s3:prefix.
+
+const (
+	policyAllow = "Allow"
+	policyDeny  = "Deny"
+
+	policyARNPrefix = "arn:aws:s3:::"
+
+	policyKeySourceIP        = "aws:sourceip"
+	policyKeySecureTransport = "aws:securetransport"
+	policyKeyPrefix          = "s3:prefix"
+)
+
+// the policy decision of the request
+const (
+	policyNotApplicable = iota
+	policyAllowed
+	policyDenied
+)
+
+// stringOrSlice is the policy element that could be a string or an array
+type stringOrSlice []string
+
+func (v *stringOrSlice) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = []string{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*v = ss
+	return nil
+}
+
+// policyPrincipal is "*" or {"AWS": principals}
+type policyPrincipal struct {
+	AWS stringOrSlice
+}
+
+func (p *policyPrincipal) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s != "*" {
+			return fmt.Errorf("invalid principal %s", s)
+		}
+		p.AWS = []string{s}
+		return nil
+	}
+	var m map[string]stringOrSlice
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for k, v := range m {
+		if k != "AWS" {
+			return fmt.Errorf("unsupported principal type %s", k)
+		}
+		p.AWS = v
+	}
+	return nil
+}
+
+type policyStatement struct {
+	Sid       string                              `json:"Sid"`
+	Effect    string                              `json:"Effect"`
+	Principal *policyPrincipal                    `json:"Principal"`
+	Action    stringOrSlice                       `json:"Action"`
+	NotAction stringOrSlice                       `json:"NotAction"`
+	Resource  stringOrSlice                       `json:"Resource"`
+	Condition map[string]map[string]stringOrSlice `json:"Condition"`
+}
+
+type bucketPolicy struct {
+	Version   string            `json:"Version"`
+	ID        string            `json:"Id"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+// the request properties that the policy is evaluated on
+type policyRequest struct {
+	accessKey string
+	action    string
+	resource  string
+	// the condition key values, the key is in lower case
+	keys map[string]string
+}
+
+var policyConditionOps = map[string]bool{
+	"StringEquals": true, "StringNotEquals": true, "StringLike": true, "StringNotLike": true,
+	"IpAddress": true, "NotIpAddress": true, "Bool": true,
+}
+
+var policyConditionKeys = map[string]bool{
+	policyKeySourceIP: true, policyKeySecureTransport: true, policyKeyPrefix: true,
+}
+
+// globMatch matches s with the pattern, "*" matches any sequence and "?"
+// matches any single character.
+func globMatch(pattern string, s string) bool {
+	p, i := 0, 0
+	star, match := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]) {
+			p++
+			i++
+		} else if p < len(pattern) && pattern[p] == '*' {
+			star, match = p, i
+			p++
+		} else if star != -1 {
+			p = star + 1
+			match++
+			i = match
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// parseBucketPolicy parses and checks the policy of the bucket
+func parseBucketPolicy(b []byte, bkname string) (policy *bucketPolicy, status int, errmsg string) {
+	policy = &bucketPolicy{}
+	err := json.Unmarshal(b, policy)
+	if err != nil {
+		// Statement could be a single statement
+		var single struct {
+			Version   string          `json:"Version"`
+			ID        string          `json:"Id"`
+			Statement policyStatement `json:"Statement"`
+		}
+		if json.Unmarshal(b, &single) != nil {
+			return nil, MalformedPolicy, "MalformedPolicy: " + err.Error()
+		}
+		policy = &bucketPolicy{Version: single.Version, ID: single.ID, Statement: []policyStatement{single.Statement}}
+	}
+
+	if len(policy.Statement) == 0 {
+		return nil, MalformedPolicy, "MalformedPolicy: missing Statement"
+	}
+	for _, st := range policy.Statement {
+		if st.Effect != policyAllow && st.Effect != policyDeny {
+			return nil, MalformedPolicy, "MalformedPolicy: invalid Effect " + st.Effect
+		}
+		if st.Principal == nil || len(st.Principal.AWS) == 0 {
+			return nil, MalformedPolicy, "MalformedPolicy: missing Principal"
+		}
+		if (len(st.Action) == 0) == (len(st.NotAction) == 0) {
+			return nil, MalformedPolicy, "MalformedPolicy: should have either Action or NotAction"
+		}
+		if len(st.Resource) == 0 {
+			return nil, MalformedPolicy, "MalformedPolicy: missing Resource"
+		}
+		for _, res := range st.Resource {
+			// the resource should be the bucket or its objects
+			if res != policyARNPrefix+bkname && !strings.HasPrefix(res, policyARNPrefix+bkname+"/") {
+				return nil, MalformedPolicy, "MalformedPolicy: Policy has invalid resource " + res
+			}
+		}
+		for op, kv := range st.Condition {
+			if !policyConditionOps[op] {
+				return nil, MalformedPolicy, "MalformedPolicy: unsupported condition " + op
+			}
+			for k, vals := range kv {
+				if !policyConditionKeys[strings.ToLower(k)] {
+					return nil, MalformedPolicy, "MalformedPolicy: unsupported condition key " + k
+				}
+				if op == "IpAddress" || op == "NotIpAddress" {
+					for _, v := range vals {
+						if parseIPNet(v) == nil {
+							return nil, MalformedPolicy, "MalformedPolicy: invalid ip " + v
+						}
+					}
+				}
+			}
+		}
+	}
+	return policy, StatusOK, StatusOKStr
+}
+
+// parseIPNet parses the CIDR or the single ip
+func parseIPNet(s string) *net.IPNet {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil
+	}
+	return ipnet
+}
+
+func (st *policyStatement) matchPrincipal(accessKey string) bool {
+	for _, p := range st.Principal.AWS {
+		if p == "*" || (accessKey != "" && (p == accessKey || strings.HasSuffix(p, ":user/"+accessKey))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *policyStatement) matchAction(action string) bool {
+	actions, negate := st.Action, false
+	if len(st.NotAction) != 0 {
+		actions, negate = st.NotAction, true
+	}
+	for _, a := range actions {
+		if globMatch(strings.ToLower(a), strings.ToLower(action)) {
+			return !negate
+		}
+	}
+	return negate
+}
+
+func (st *policyStatement) matchResource(resource string) bool {
+	for _, res := range st.Resource {
+		if globMatch(res, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCondition evaluates one condition operator on one key. The negated
+// operator matches if the key is not in the request.
+func matchCondition(op string, val string, exist bool, vals []string) bool {
+	negate := strings.Contains(op, "Not")
+	if !exist {
+		return negate
+	}
+
+	matched := false
+	for _, v := range vals {
+		switch op {
+		case "StringEquals", "StringNotEquals":
+			matched = v == val
+		case "StringLike", "StringNotLike":
+			matched = globMatch(v, val)
+		case "IpAddress", "NotIpAddress":
+			ipnet := parseIPNet(v)
+			ip := net.ParseIP(val)
+			matched = ipnet != nil && ip != nil && ipnet.Contains(ip)
+		case "Bool":
+			matched = strings.EqualFold(v, val)
+		}
+		if matched {
+			break
+		}
+	}
+	return matched != negate
+}
+
+func (st *policyStatement) matchConditions(keys map[string]string) bool {
+	for op, kv := range st.Condition {
+		for k, vals := range kv {
+			val, exist := keys[strings.ToLower(k)]
+			if !matchCondition(op, val, exist, vals) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// evaluate returns the policy decision of the request
+func (p *bucketPolicy) evaluate(req *policyRequest) int {
+	decision := policyNotApplicable
+	for i := range p.Statement {
+		st := &p.Statement[i]
+		if !st.matchPrincipal(req.accessKey) || !st.matchAction(req.action) ||
+			!st.matchResource(req.resource) || !st.matchConditions(req.keys) {
+			continue
+		}
+		if st.Effect == policyDeny {
+			return policyDenied
+		}
+		decision = policyAllowed
+	}
+	return decision
+}
+
+// requestAction returns the S3 action of the request. "" is returned for the
+// multi-object delete, which is authorized for every object.
+func (s *S3Server) requestAction(r *http.Request, objname string) string {
+	q := r.URL.Query()
+	_, hasVersion := q[ObjectVersionID]
+
+	if s.isBucketOp(objname) {
+		subres := s.getBucketSubResource(r)
+		switch r.Method {
+		case "GET", "HEAD":
+			switch subres {
+			case "":
+				return "s3:ListBucket"
+			case BucketVersions:
+				return "s3:ListBucketVersions"
+			case BucketUploads:
+				return "s3:ListBucketMultipartUploads"
+			case BucketVersioning:
+				return "s3:GetBucketVersioning"
+			case BucketTag:
+				return "s3:GetBucketTagging"
+			case BucketCors:
+				return "s3:GetBucketCORS"
+			case BucketLifecycle:
+				return "s3:GetLifecycleConfiguration"
+			case BucketPolicy:
+				return "s3:GetBucketPolicy"
+			case BucketACL:
+				return "s3:GetBucketAcl"
+			case BucketObjectLock:
+				return "s3:GetBucketObjectLockConfiguration"
+			}
+		case "PUT":
+			switch subres {
+			case "":
+				return "s3:CreateBucket"
+			case BucketVersioning:
+				return "s3:PutBucketVersioning"
+			case BucketTag:
+				return "s3:PutBucketTagging"
+			case BucketCors:
+				return "s3:PutBucketCORS"
+			case BucketLifecycle:
+				return "s3:PutLifecycleConfiguration"
+			case BucketPolicy:
+				return "s3:PutBucketPolicy"
+			case BucketACL:
+				return "s3:PutBucketAcl"
+			case BucketObjectLock:
+				return "s3:PutBucketObjectLockConfiguration"
+			}
+		case "DELETE":
+			switch subres {
+			case "":
+				return "s3:DeleteBucket"
+			case BucketTag:
+				return "s3:PutBucketTagging"
+			case BucketCors:
+				return "s3:PutBucketCORS"
+			case BucketLifecycle:
+				return "s3:PutLifecycleConfiguration"
+			case BucketPolicy:
+				return "s3:DeleteBucketPolicy"
+			}
+		case "POST":
+			if subres == BucketDelete {
+				return ""
+			}
+		}
+		// the unsupported operation, which will be rejected later
+		return "s3:" + r.Method + "Bucket"
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if hasQuery(r, ObjectACL) {
+			if hasVersion {
+				return "s3:GetObjectVersionAcl"
+			}
+			return "s3:GetObjectAcl"
+		}
+		if hasQuery(r, ObjectTagging) {
+			if hasVersion {
+				return "s3:GetObjectVersionTagging"
+			}
+			return "s3:GetObjectTagging"
+		}
+		if hasQuery(r, ObjectRetention) {
+			return "s3:GetObjectRetention"
+		}
+		if hasQuery(r, ObjectLegalHold) {
+			return "s3:GetObjectLegalHold"
+		}
+		if hasQuery(r, ObjectUploadID) {
+			return "s3:ListMultipartUploadParts"
+		}
+		if hasVersion {
+			return "s3:GetObjectVersion"
+		}
+		return "s3:GetObject"
+	case "PUT":
+		if hasQuery(r, ObjectACL) {
+			if hasVersion {
+				return "s3:PutObjectVersionAcl"
+			}
+			return "s3:PutObjectAcl"
+		}
+		if hasQuery(r, ObjectTagging) {
+			if hasVersion {
+				return "s3:PutObjectVersionTagging"
+			}
+			return "s3:PutObjectTagging"
+		}
+		if hasQuery(r, ObjectRetention) {
+			return "s3:PutObjectRetention"
+		}
+		if hasQuery(r, ObjectLegalHold) {
+			return "s3:PutObjectLegalHold"
+		}
+		return "s3:PutObject"
+	case "POST":
+		return "s3:PutObject"
+	case "DELETE":
+		if hasQuery(r, ObjectTagging) {
+			if hasVersion {
+				return "s3:DeleteObjectVersionTagging"
+			}
+			return "s3:DeleteObjectTagging"
+		}
+		if hasQuery(r, ObjectUploadID) {
+			return "s3:AbortMultipartUpload"
+		}
+		if hasVersion {
+			return "s3:DeleteObjectVersion"
+		}
+		return "s3:DeleteObject"
+	}
+	return "s3:" + r.Method + "Object"
+}
+
+// authorize checks whether the request is allowed by the bucket policy and acl
+func (s *S3Server) authorize(ctx context.Context, r *http.Request, bkname string, objname string) (status int, errmsg string) {
+	if bkname != "" {
+		action := s.requestAction(r, objname)
+		if action == "" {
+			// authorized later for every object
+			return StatusOK, StatusOKStr
+		}
+		versionID := r.URL.Query().Get(ObjectVersionID)
+		status, errmsg = s.authorizeAction(ctx, r, bkname, objname, versionID, action)
+		if status != StatusOK || action != "s3:PutObject" {
+			return status, errmsg
+		}
+		// setting the object lock at put requires the lock permissions as well
+		for _, action := range objectLockActions(r.Header) {
+			status, errmsg = s.authorizeAction(ctx, r, bkname, objname, versionID, action)
+			if status != StatusOK {
+				return status, errmsg
+			}
+		}
+		return StatusOK, StatusOKStr
+	}
+	return s.authorizeAction(ctx, r, "", "", "", "s3:ListAllMyBuckets")
+}
+
+// authorizeAction checks whether the action on the bucket or object is
+// allowed by the bucket policy and acl. bkname is "" for the service operation.
+func (s *S3Server) authorizeAction(ctx context.Context, r *http.Request, bkname string, objname string,
+	versionID string, action string) (status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	info := getAuthInfoFromContext(ctx)
+
+	decision := policyNotApplicable
+	if bkname != "" {
+		policy, status, errmsg := s.readBucketPolicy(ctx, bkname)
+		if status != StatusOK {
+			return status, errmsg
+		}
+
+		if policy != nil {
+			req := &policyRequest{accessKey: info.AccessKey, action: action, keys: make(map[string]string)}
+			req.resource = policyARNPrefix + bkname
+			if !s.isBucketOp(objname) {
+				req.resource += objname
+			}
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				req.keys[policyKeySourceIP] = host
+			}
+			req.keys[policyKeySecureTransport] = fmt.Sprint(r.TLS != nil)
+			if prefix, ok := r.URL.Query()["prefix"]; ok && s.isBucketOp(objname) {
+				req.keys[policyKeyPrefix] = prefix[0]
+			}
+
+			decision = policy.evaluate(req)
+		}
+	}
+
+	switch decision {
+	case policyDenied:
+		glog.Errorln("request is denied by bucket policy", requuid, bkname, objname, action, info.AccessKey)
+		return AccessDenied, "AccessDenied"
+	case policyAllowed:
+		glog.V(2).Infoln("request is allowed by bucket policy", requuid, bkname, objname, action, info.AccessKey)
+		return StatusOK, StatusOKStr
+	}
+
+	return s.checkACL(ctx, bkname, objname, versionID, action)
+}
+
+// readBucketPolicy returns the parsed policy of the bucket, nil if the bucket
+// does not have the policy.
+func (s *S3Server) readBucketPolicy(ctx context.Context, bkname string) (policy *bucketPolicy, status int, errmsg string) {
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+	if bmd.Policy == "" {
+		return nil, StatusOK, StatusOKStr
+	}
+
+	policy, status, errmsg = parseBucketPolicy([]byte(bmd.Policy), bkname)
+	if status != StatusOK {
+		// should not happen, the policy is checked at put
+		glog.Errorln("SanityError - invalid stored bucket policy", util.GetReqIDFromContext(ctx), bkname, errmsg)
+		return nil, InternalError, InternalErrorStr
+	}
+	return policy, StatusOK, StatusOKStr
+}
+
+// putBucketPolicy handles PUT /bucket?policy
+func (s *S3Server) putBucketPolicy(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("put bucket policy failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBucketPolicySize+1))
+	if err != nil || len(b) > MaxBucketPolicySize {
+		glog.Errorln("failed to read bucket policy", requuid, bkname, len(b), err)
+		writeError(w, r, InvalidArgument, "Policies must be no larger than 20 KB")
+		return
+	}
+
+	_, status, errmsg = parseBucketPolicy(b, bkname)
+	if status != StatusOK {
+		glog.Errorln("invalid bucket policy", requuid, bkname, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = s.setBucketPolicy(ctx, bkname, string(b))
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *S3Server) setBucketPolicy(ctx context.Context, bkname string, policy string) (status int, errmsg string) {
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	bmd = proto.Clone(bmd).(*BucketMD)
+	bmd.Policy = policy
+	return s.bmds.Put(ctx, bkname, bmd)
+}
+
+// getBucketPolicy handles GET /bucket?policy
+func (s *S3Server) getBucketPolicy(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if bmd.Policy == "" {
+		writeError(w, r, NoSuchBucketPolicy, "NoSuchBucketPolicy")
+		return
+	}
+
+	w.Header().Set(ContentType, "application/json")
+	w.WriteHeader(StatusOK)
+	w.Write([]byte(bmd.Policy))
+}
+
+// deleteBucketPolicy handles DELETE /bucket?policy
+func (s *S3Server) deleteBucketPolicy(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = s.setBucketPolicy(ctx, bkname, "")
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		matched bool
+	}{
+		{"", "", true},
+		{"*", "", true},
+		{"*", "abc", true},
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"s3:Get*", "s3:GetObject", true},
+		{"s3:*Object", "s3:PutObject", true},
+		{"arn:aws:s3:::bk/*", "arn:aws:s3:::bk/dir/obj", true},
+		{"arn:aws:s3:::bk/*", "arn:aws:s3:::bk", false},
+		{"*a*b", "xaybzb", true},
+	}
+
+	for _, tt := range tests {
+		if matched := globMatch(tt.pattern, tt.s); matched != tt.matched {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, matched, tt.matched)
+		}
+	}
+}
+
+func TestParseBucketPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		code   string
+	}{
+		{"allow", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:GetObject",
+			"Resource":"arn:aws:s3:::bk/*"}]}`, ""},
+		{"single statement", `{"Statement":{"Effect":"Deny","Principal":{"AWS":["ak1","ak2"]},
+			"NotAction":["s3:Get*"],"Resource":["arn:aws:s3:::bk","arn:aws:s3:::bk/*"]}}`, ""},
+		{"condition", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:ListBucket",
+			"Resource":"arn:aws:s3:::bk","Condition":{"IpAddress":{"aws:SourceIp":"10.0.0.0/8"},
+			"StringLike":{"s3:prefix":"home/*"}}}]}`, ""},
+		{"not json", `{"Statement":`, "MalformedPolicy"},
+		{"no statement", `{"Version":"2012-10-17"}`, "MalformedPolicy"},
+		{"invalid effect", `{"Statement":[{"Effect":"Maybe","Principal":"*","Action":"s3:*",
+			"Resource":"arn:aws:s3:::bk"}]}`, "MalformedPolicy"},
+		{"no principal", `{"Statement":[{"Effect":"Allow","Action":"s3:*",
+			"Resource":"arn:aws:s3:::bk"}]}`, "MalformedPolicy"},
+		{"invalid principal", `{"Statement":[{"Effect":"Allow","Principal":"ak1","Action":"s3:*",
+			"Resource":"arn:aws:s3:::bk"}]}`, "MalformedPolicy"},
+		{"action and not action", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:*",
+			"NotAction":"s3:GetObject","Resource":"arn:aws:s3:::bk"}]}`, "MalformedPolicy"},
+		{"no action", `{"Statement":[{"Effect":"Allow","Principal":"*",
+			"Resource":"arn:aws:s3:::bk"}]}`, "MalformedPolicy"},
+		{"no resource", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:*"}]}`, "MalformedPolicy"},
+		{"other bucket", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:*",
+			"Resource":"arn:aws:s3:::bk2/*"}]}`, "MalformedPolicy"},
+		{"unsupported condition", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:*",
+			"Resource":"arn:aws:s3:::bk","Condition":{"DateGreaterThan":{"aws:CurrentTime":"2020-01-01"}}}]}`,
+			"MalformedPolicy"},
+		{"unsupported condition key", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:*",
+			"Resource":"arn:aws:s3:::bk","Condition":{"StringEquals":{"aws:UserAgent":"x"}}}]}`, "MalformedPolicy"},
+		{"invalid ip", `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:*",
+			"Resource":"arn:aws:s3:::bk","Condition":{"IpAddress":{"aws:SourceIp":"10.0.0/8"}}}]}`,
+			"MalformedPolicy"},
+	}
+
+	for _, tt := range tests {
+		_, status, errmsg := parseBucketPolicy([]byte(tt.policy), "bk")
+		if code := testErrorCode(status, errmsg); code != tt.code {
+			t.Errorf("%s: error %q %s, want %q", tt.name, code, errmsg, tt.code)
+		}
+	}
+}
+
+func TestMatchCondition(t *testing.T) {
+	tests := []struct {
+		op      string
+		val     string
+		exist   bool
+		vals    []string
+		matched bool
+	}{
+		{"StringEquals", "a", true, []string{"b", "a"}, true},
+		{"StringEquals", "a", true, []string{"b"}, false},
+		{"StringEquals", "", false, []string{"a"}, false},
+		{"StringNotEquals", "a", true, []string{"b"}, true},
+		{"StringNotEquals", "a", true, []string{"a"}, false},
+		{"StringNotEquals", "", false, []string{"a"}, true},
+		{"StringLike", "home/u1/", true, []string{"home/*"}, true},
+		{"StringNotLike", "home/u1/", true, []string{"home/*"}, false},
+		{"IpAddress", "10.1.2.3", true, []string{"10.0.0.0/8"}, true},
+		{"IpAddress", "11.1.2.3", true, []string{"10.0.0.0/8", "12.1.2.3"}, false},
+		{"IpAddress", "12.1.2.3", true, []string{"10.0.0.0/8", "12.1.2.3"}, true},
+		{"IpAddress", "::1", true, []string{"::1/128"}, true},
+		{"NotIpAddress", "10.1.2.3", true, []string{"10.0.0.0/8"}, false},
+		{"NotIpAddress", "11.1.2.3", true, []string{"10.0.0.0/8"}, true},
+		{"Bool", "true", true, []string{"TRUE"}, true},
+		{"Bool", "false", true, []string{"true"}, false},
+	}
+
+	for _, tt := range tests {
+		if matched := matchCondition(tt.op, tt.val, tt.exist, tt.vals); matched != tt.matched {
+			t.Errorf("matchCondition(%s, %q, %v, %v) = %v, want %v", tt.op, tt.val, tt.exist, tt.vals, matched, tt.matched)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, status, errmsg := parseBucketPolicy([]byte(`{
+		"Version": "2012-10-17",
+		"Statement": [
+			{"Sid": "public read", "Effect": "Allow", "Principal": "*",
+				"Action": "s3:GetObject", "Resource": "arn:aws:s3:::bk/public/*"},
+			{"Sid": "user write", "Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::123456789012:user/ak1"},
+				"Action": ["s3:PutObject", "s3:DeleteObject"], "Resource": "arn:aws:s3:::bk/*"},
+			{"Sid": "list home", "Effect": "Allow", "Principal": {"AWS": ["ak1", "ak2"]},
+				"Action": "s3:ListBucket", "Resource": "arn:aws:s3:::bk",
+				"Condition": {"StringLike": {"s3:prefix": "home/*"}}},
+			{"Sid": "deny insecure", "Effect": "Deny", "Principal": "*",
+				"Action": "s3:*", "Resource": "arn:aws:s3:::bk/secret/*",
+				"Condition": {"Bool": {"aws:SecureTransport": "false"}}},
+			{"Sid": "deny other ips", "Effect": "Deny", "Principal": {"AWS": "ak2"},
+				"NotAction": "s3:Get*", "Resource": "arn:aws:s3:::bk/*",
+				"Condition": {"NotIpAddress": {"aws:SourceIp": "10.0.0.0/8"}}}
+		]
+	}`), "bk")
+	if status != StatusOK {
+		t.Fatalf("parseBucketPolicy error %d %s", status, errmsg)
+	}
+
+	secure := map[string]string{policyKeySecureTransport: "true", policyKeySourceIP: "10.1.1.1"}
+	insecure := map[string]string{policyKeySecureTransport: "false", policyKeySourceIP: "10.1.1.1"}
+	outside := map[string]string{policyKeySecureTransport: "true", policyKeySourceIP: "192.168.1.1"}
+	tests := []struct {
+		name     string
+		req      policyRequest
+		decision int
+	}{
+		{"anonymous public read", policyRequest{"", "s3:GetObject", "arn:aws:s3:::bk/public/a", secure}, policyAllowed},
+		{"anonymous public write", policyRequest{"", "s3:PutObject", "arn:aws:s3:::bk/public/a", secure}, policyNotApplicable},
+		{"anonymous other read", policyRequest{"", "s3:GetObject", "arn:aws:s3:::bk/a", secure}, policyNotApplicable},
+		{"user arn write", policyRequest{"ak1", "s3:PutObject", "arn:aws:s3:::bk/a", secure}, policyAllowed},
+		{"action case", policyRequest{"ak1", "s3:deleteobject", "arn:aws:s3:::bk/a", secure}, policyAllowed},
+		{"other user write", policyRequest{"ak3", "s3:PutObject", "arn:aws:s3:::bk/a", secure}, policyNotApplicable},
+		{"list prefix", policyRequest{"ak2", "s3:ListBucket", "arn:aws:s3:::bk",
+			map[string]string{policyKeyPrefix: "home/ak2/", policyKeySourceIP: "10.1.1.1"}}, policyAllowed},
+		{"list other prefix", policyRequest{"ak2", "s3:ListBucket", "arn:aws:s3:::bk",
+			map[string]string{policyKeyPrefix: "tmp/", policyKeySourceIP: "10.1.1.1"}}, policyNotApplicable},
+		{"list no prefix", policyRequest{"ak1", "s3:ListBucket", "arn:aws:s3:::bk", secure}, policyNotApplicable},
+		{"deny insecure", policyRequest{"ak1", "s3:PutObject", "arn:aws:s3:::bk/secret/a", insecure}, policyDenied},
+		{"allow secure", policyRequest{"ak1", "s3:PutObject", "arn:aws:s3:::bk/secret/a", secure}, policyAllowed},
+		{"deny outside ip", policyRequest{"ak2", "s3:ListBucket", "arn:aws:s3:::bk/a", outside}, policyDenied},
+		{"not action outside ip", policyRequest{"ak2", "s3:GetObject", "arn:aws:s3:::bk/public/a", outside}, policyAllowed},
+		{"insecure public read", policyRequest{"ak1", "s3:GetObject", "arn:aws:s3:::bk/public/a", insecure}, policyAllowed},
+		{"deny public secret", policyRequest{"", "s3:GetObject", "arn:aws:s3:::bk/secret/a", insecure}, policyDenied},
+	}
+
+	for _, tt := range tests {
+		if decision := policy.evaluate(&tt.req); decision != tt.decision {
+			t.Errorf("%s: decision %d, want %d", tt.name, decision, tt.decision)
+		}
+	}
+}
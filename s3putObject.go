@@ -12,7 +12,6 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
 	"golang.org/x/net/context"
 )
 
@@ -22,6 +21,10 @@ type S3PutObject struct {
 	requuid string
 	r       *http.Request
 	s3io    CloudIO
+	gc      *BlockGC
+	journal *DeleteJournal
+	sse     *S3SSE
+	bmd     *BucketMD
 	bkname  string
 	objname string
 
@@ -29,6 +32,10 @@ type S3PutObject struct {
 
 	// ObjectMD
 	md *ObjectMD
+	// the cipher of the data blocks, nil if not encrypted
+	cipher *blockCipher
+	// all data blocks of the object, to reference them
+	blocks []string
 	// statistics
 	totalBlocks int64
 	ddBlocks    int64
@@ -40,12 +47,17 @@ type S3PutObject struct {
 }
 
 // NewS3PutObject creates a new S3PutObject instance
-func NewS3PutObject(ctx context.Context, r *http.Request, s3io CloudIO, bkname string, objname string) *S3PutObject {
+func NewS3PutObject(ctx context.Context, r *http.Request, s3io CloudIO, gc *BlockGC, journal *DeleteJournal,
+	sse *S3SSE, bmd *BucketMD, bkname string, objname string) *S3PutObject {
 	s := new(S3PutObject)
 	s.ctx = ctx
 	s.requuid = util.GetReqIDFromContext(ctx)
 	s.r = r
 	s.s3io = s3io
+	s.gc = gc
+	s.journal = journal
+	s.sse = sse
+	s.bmd = bmd
 	s.bkname = bkname
 	s.objname = objname
 	return s
@@ -90,14 +102,14 @@ func (s *S3PutObject) putSmallObjectData() (status int, errmsg string) {
 		if err != io.EOF {
 			glog.Errorln("failed to read data from http", s.requuid, err, "ContentLength",
 				r.ContentLength, s.bkname, s.objname)
-			return InternalError, "failed to read data from http"
+			return bodyReadError(err)
 		}
 
 		// EOF, check if all contents are readed
 		if int64(n) != r.ContentLength {
 			glog.Errorln(s.requuid, "read", n, "less than ContentLength",
 				r.ContentLength, s.bkname, s.objname)
-			return InvalidRequest, "data less than ContentLength"
+			return IncompleteBody, "IncompleteBody"
 		}
 	}
 
@@ -108,23 +120,32 @@ func (s *S3PutObject) putSmallObjectData() (status int, errmsg string) {
 	md5str := hex.EncodeToString(md5byte)
 	m.Reset()
 
+	// the encrypted block is named by the keyed hash
+	blkname := md5str
+	data := readBuf
+	if s.cipher != nil {
+		blkname = s.cipher.blockName(readBuf)
+		data = s.cipher.encrypt(blkname, readBuf)
+	}
+
 	// write data block
-	if !s.s3io.IsDataBlockExist(md5str) {
-		status, errmsg = s.s3io.WriteDataBlock(readBuf, md5str)
+	if s.gc.UseBlock(blkname) || !s.s3io.IsDataBlockExist(blkname) {
+		status, errmsg = s.s3io.WriteDataBlock(data, blkname)
 		if status != StatusOK {
 			glog.Errorln("failed to create data block",
-				s.requuid, md5str, status, errmsg, s.bkname, s.objname)
+				s.requuid, blkname, status, errmsg, s.bkname, s.objname)
 			return status, errmsg
 		}
-		glog.V(2).Infoln("create data block", s.requuid, md5str, r.ContentLength)
+		glog.V(2).Infoln("create data block", s.requuid, blkname, r.ContentLength)
 	} else {
 		s.md.Data.DdBlocks = 1
-		glog.V(2).Infoln("data block exists", s.requuid, md5str, r.ContentLength)
+		glog.V(2).Infoln("data block exists", s.requuid, blkname, r.ContentLength)
 	}
 
 	part := &DataPart{}
 	part.Name = util.GenPartName(s.md.Uuid, 0)
-	part.Blocks = append(part.Blocks, md5str)
+	part.Blocks = append(part.Blocks, blkname)
+	s.blocks = append(s.blocks, blkname)
 
 	s.md.Data.DataParts = append(s.md.Data.DataParts, part)
 
@@ -142,12 +163,17 @@ type writeDataBlockResult struct {
 }
 
 func (s *S3PutObject) writeOneDataBlock(buf []byte, md5ck hash.Hash, etag hash.Hash) {
-	// compute checksum
-	md5ck.Write(buf)
-	md5byte := md5ck.Sum(nil)
-	md5str := hex.EncodeToString(md5byte)
-	// reset md5 for the next block
-	md5ck.Reset()
+	// compute checksum, the encrypted block is named by the keyed hash
+	var md5str string
+	if s.cipher != nil {
+		md5str = s.cipher.blockName(buf)
+	} else {
+		md5ck.Write(buf)
+		md5byte := md5ck.Sum(nil)
+		md5str = hex.EncodeToString(md5byte)
+		// reset md5 for the next block
+		md5ck.Reset()
+	}
 
 	// update etag
 	etag.Write(buf)
@@ -155,9 +181,13 @@ func (s *S3PutObject) writeOneDataBlock(buf []byte, md5ck hash.Hash, etag hash.H
 	res := writeDataBlockResult{md5str, true, StatusOK, StatusOKStr}
 
 	// write data block
-	if !s.s3io.IsDataBlockExist(md5str) {
+	if s.gc.UseBlock(md5str) || !s.s3io.IsDataBlockExist(md5str) {
 		res.exist = false
-		res.status, res.errmsg = s.s3io.WriteDataBlock(buf, md5str)
+		data := buf
+		if s.cipher != nil {
+			data = s.cipher.encrypt(md5str, buf)
+		}
+		res.status, res.errmsg = s.s3io.WriteDataBlock(data, md5str)
 		glog.V(2).Infoln("create data block", md5str, res.status, len(buf), s.bkname, s.objname)
 	} else {
 		glog.V(2).Infoln("data block exists", md5str, len(buf), s.bkname, s.objname)
@@ -266,6 +296,7 @@ func (s *S3PutObject) waitLastWrite(waitWrite bool, part *DataPart, waitPart boo
 		s.totalBlocks++
 		// add to data block
 		part.Blocks = append(part.Blocks, res.md5str)
+		s.blocks = append(s.blocks, res.md5str)
 	}
 
 	// wait the last part
@@ -352,14 +383,14 @@ func (s *S3PutObject) putObjectData() (status int, errmsg string) {
 			if err != io.EOF {
 				glog.Errorln("failed to read data from http", s.requuid, err, "readed len",
 					rlen, "ContentLength", r.ContentLength, s.bkname, s.objname)
-				return InternalError, "failed to read data from http"
+				return bodyReadError(err)
 			}
 
 			// EOF, check if all contents are readed
 			if rlen != r.ContentLength && r.ContentLength != -1 {
 				glog.Errorln(s.requuid, "read", rlen, "less than ContentLength",
 					r.ContentLength, s.bkname, s.objname)
-				return InvalidRequest, "data less than ContentLength"
+				return IncompleteBody, "IncompleteBody"
 			}
 
 			// EOF, check if the last data block is 0
@@ -388,6 +419,7 @@ func (s *S3PutObject) putObjectData() (status int, errmsg string) {
 
 			// add to data block
 			part.Blocks = append(part.Blocks, res.md5str)
+			s.blocks = append(s.blocks, res.md5str)
 		}
 
 		// write data block
@@ -451,64 +483,180 @@ func (s *S3PutObject) putObjectData() (status int, errmsg string) {
 	return StatusOK, StatusOKStr
 }
 
+// read data and create data blocks, without splitting the blocks to parts.
+// this is used by the multipart upload, every upload part keeps all blocks.
+func (s *S3PutObject) putDataBlocks() (blocks []string, size int64, etag []byte, status int, errmsg string) {
+	r := s.r
+
+	readBuf := make([]byte, DataBlockSize)
+	writeBuf := make([]byte, DataBlockSize)
+
+	md5ck := md5.New()
+	etagck := md5.New()
+
+	// chan to wait till the previous write completes
+	waitWrite := false
+	s.blockChan = make(chan writeDataBlockResult)
+
+	for size < r.ContentLength || r.ContentLength == -1 {
+		// read one block
+		n, err := s.readFullBuf(readBuf)
+		size += int64(n)
+		glog.V(4).Infoln(s.requuid, "read", n, err, "total readed len", size,
+			"specified read len", r.ContentLength, s.bkname, s.objname)
+
+		if err != nil {
+			if err != io.EOF {
+				glog.Errorln("failed to read data from http", s.requuid, err, "readed len",
+					size, "ContentLength", r.ContentLength, s.bkname, s.objname)
+				status, errmsg = bodyReadError(err)
+				return nil, 0, nil, status, errmsg
+			}
+
+			// EOF, check if all contents are readed
+			if size != r.ContentLength && r.ContentLength != -1 {
+				glog.Errorln(s.requuid, "read", size, "less than ContentLength",
+					r.ContentLength, s.bkname, s.objname)
+				return nil, 0, nil, IncompleteBody, "IncompleteBody"
+			}
+
+			// EOF, check if the last data block is 0
+			if n == 0 {
+				break // break the for loop
+			}
+		}
+
+		if waitWrite {
+			// wait data block write done
+			res := <-s.blockChan
+			if res.status != StatusOK {
+				glog.Errorln("failed to create data block", s.requuid, res.md5str,
+					res.status, res.errmsg, s.bkname, s.objname)
+				return nil, 0, nil, res.status, res.errmsg
+			}
+
+			if res.exist {
+				s.ddBlocks++
+			}
+			s.totalBlocks++
+			blocks = append(blocks, res.md5str)
+		}
+
+		// switch buffer, readBuf will be used to read the next data block
+		tmpbuf := readBuf
+		readBuf = writeBuf
+		writeBuf = tmpbuf
+
+		waitWrite = true
+		go s.writeOneDataBlock(writeBuf[:n], md5ck, etagck)
+	}
+
+	if waitWrite {
+		res := <-s.blockChan
+		if res.status != StatusOK {
+			glog.Errorln("failed to write the last block", s.requuid, res.md5str,
+				res.status, res.errmsg, s.bkname, s.objname)
+			return nil, 0, nil, res.status, res.errmsg
+		}
+
+		if res.exist {
+			s.ddBlocks++
+		}
+		s.totalBlocks++
+		blocks = append(blocks, res.md5str)
+	}
+
+	glog.V(1).Infoln(s.requuid, s.bkname, s.objname, r.ContentLength, size,
+		"totalBlocks", s.totalBlocks, "ddBlocks", s.ddBlocks)
+
+	return blocks, size, etagck.Sum(nil), StatusOK, StatusOKStr
+}
+
 // PutObject creates the object's data and metadata objects in s3
 func (s *S3PutObject) PutObject(w http.ResponseWriter, bkname string, objname string) {
 	// Performance is one critical factor for this dedup layer. Not doing the
 	// additional operations here, such as bucket permission check, etc.
 	// When creating the metadata object, S3 will do all the checks. If S3
-	// rejects the request, no positive refs will be added for the data blocks.
+	// rejects the request, the positive refs of the data blocks are cancelled.
 	// gc will clean up them in the background.
 
 	// create the metadata object
-	smd := &ObjectSMD{}
-	smd.Bucket = bkname
-	smd.Name = objname
-	smd.Mtime = time.Now().Unix()
+	s.md = newObjectMD(s.requuid, bkname, objname)
 
-	data := &ObjectData{}
-	data.BlockSize = DataBlockSize
-	data.MaxBlocks = MaxDataBlocks
+	umd, status, errmsg := parseUserMetadata(s.r.Header)
+	if status != StatusOK {
+		glog.Errorln("invalid user metadata", s.requuid, bkname, objname, status, errmsg)
+		writeError(w, s.r, status, errmsg)
+		return
+	}
+	s.md.Umd = umd
+	parseEntityHeaders(s.r.Header, s.md.Smd)
 
-	s.md = &ObjectMD{}
-	s.md.Uuid = s.requuid
-	s.md.Smd = smd
-	s.md.Data = data
+	s.md.Tags, status, errmsg = parseTaggingHeader(s.r.Header)
+	if status != StatusOK {
+		glog.Errorln("invalid tagging", s.requuid, bkname, objname, status, errmsg)
+		writeError(w, s.r, status, errmsg)
+		return
+	}
 
-	// read object data and create data blocks
-	status, errmsg := s.putObjectData()
+	s.md.Acl, status, errmsg = parseACLHeaders(s.r.Header, getOwnerID(s.ctx), bucketOwnerID(s.bmd))
 	if status != StatusOK {
-		glog.Errorln("put object failed", s.requuid, bkname, objname, status, errmsg)
-		http.Error(w, errmsg, status)
+		glog.Errorln("invalid acl", s.requuid, bkname, objname, status, errmsg)
+		writeError(w, s.r, status, errmsg)
 		return
 	}
 
-	// Marshal ObjectMD to []byte
-	mdbyte, err := proto.Marshal(s.md)
-	if err != nil {
-		glog.Errorln("failed to marshal ObjectMD", s.requuid, bkname, objname, s.md, err)
-		http.Error(w, "failed to marshal ObjectMD", InternalError)
+	s.md.Sse, s.cipher, status, errmsg = s.sse.parseSSEHeaders(s.ctx, s.r.Header, bucketOwnerID(s.bmd))
+	if status != StatusOK {
+		writeError(w, s.r, status, errmsg)
+		return
+	}
+
+	status, errmsg = parseLockHeaders(s.r.Header, s.bmd, s.md)
+	if status != StatusOK {
+		glog.Errorln("invalid object lock", s.requuid, bkname, objname, status, errmsg)
+		writeError(w, s.r, status, errmsg)
 		return
 	}
 
-	// compress ObjectMD bytes
-	b := mdbyte
-	if *cmp {
-		// looks compression is not useful for ObjectMD.
-		// tried like /usr/local/bin/docker, 9MB, mdbyte is 2519, compress to 2524
-		b = snappy.Encode(nil, mdbyte)
-		glog.V(5).Infoln(s.requuid, "compressed md", b, len(mdbyte), bkname, objname)
+	digest, status, errmsg := newPayloadDigest(s.requuid, s.r)
+	if status != StatusOK {
+		writeError(w, s.r, status, errmsg)
+		return
+	}
+
+	// read object data and create data blocks
+	status, errmsg = s.putObjectData()
+	if status != StatusOK {
+		glog.Errorln("put object failed", s.requuid, bkname, objname, status, errmsg)
+		writeError(w, s.r, status, errmsg)
+		return
+	}
+
+	// verify the data before the object becomes visible. the written data
+	// blocks are not referenced, gc will clean up them. the data parts are
+	// not tracked by gc, remove them here.
+	md5sum, _ := hex.DecodeString(s.md.Smd.Etag)
+	status, errmsg = digest.verify(md5sum)
+	if status != StatusOK {
+		glog.Errorln("put object digest mismatch", s.requuid, bkname, objname, status, errmsg)
+		deleteObjectDataParts(s.ctx, s.s3io, s.md)
+		writeError(w, s.r, status, errmsg)
+		return
 	}
 
-	// write out ObjectMD
-	status, errmsg = s.s3io.WriteObjectMD(bkname, objname, b)
+	// reference the data blocks and write out ObjectMD
+	status, errmsg = commitObjectMD(s.ctx, s.s3io, s.gc, s.journal, s.bmd, s.md, s.blocks, s.r.Header)
 	if status != StatusOK {
 		glog.Errorln("failed to write ObjectMD", s.requuid, bkname, objname, status, errmsg)
-		http.Error(w, errmsg, status)
+		writeError(w, s.r, status, errmsg)
 		return
 	}
 
 	glog.V(0).Infoln("create object success", s.requuid, bkname, objname, s.md.Smd.Etag)
 
 	w.Header().Set(ETag, s.md.Smd.Etag)
+	setVersionHeader(w, s.bmd, s.md)
+	setSSEHeaders(w, s.md.Sse)
 	w.WriteHeader(status)
 }
@@ -1,6 +1,8 @@
 package test
 
 import (
+	"bufio"
+	"encoding/xml"
 	"flag"
 	"io"
 	"net/http"
@@ -11,7 +13,6 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
 	"golang.org/x/net/context"
 )
 
@@ -20,7 +21,12 @@ var cmp = flag.Bool("cmp", false, "whether enable compression")
 
 // S3Server handles the coming S3 requests
 type S3Server struct {
-	s3io CloudIO
+	s3io    CloudIO
+	auth    *S3Auth
+	gc      *BlockGC
+	journal *DeleteJournal
+	bmds    *BucketMDCache
+	sse     *S3SSE
 }
 
 // NewS3Server allocates a new S3Server instance
@@ -33,8 +39,49 @@ func NewS3Server() *S3Server {
 			return nil
 		}
 		s.s3io = fio
+	} else if *ioengine == "cloudio" {
+		cio := NewS3IO(*s3Endpoint, *s3Region, *s3AccessKey, *s3SecretKey, *s3DataBucket, *s3PartBucket)
+		if cio == nil {
+			glog.Errorln("failed to create CloudIO instance, type", *ioengine)
+			return nil
+		}
+		s.s3io = cio
+	} else {
+		glog.Errorln("unknown ioengine", *ioengine)
+		return nil
 	}
 
+	creds := NewCredentialStore(*credFile)
+	if creds == nil {
+		glog.Errorln("failed to load the credentials", *credFile)
+		return nil
+	}
+	s.auth = NewS3Auth(creds, *region, *allowAnonymous)
+
+	s.sse = NewS3SSE(*sseKeyFile, *sseDefault)
+	if s.sse == nil {
+		glog.Errorln("failed to load the SSE master key", *sseKeyFile)
+		return nil
+	}
+
+	s.gc = NewBlockGC(*gcDir, s.s3io)
+	if s.gc == nil {
+		glog.Errorln("failed to create the block gc", *gcDir)
+		return nil
+	}
+	s.gc.Start()
+
+	s.journal = NewDeleteJournal(*journalDir, s.s3io, s.gc)
+	if s.journal == nil {
+		glog.Errorln("failed to create the delete journal", *journalDir)
+		return nil
+	}
+	s.journal.Start()
+
+	s.bmds = NewBucketMDCache(s.s3io, time.Duration(*bucketMDCacheSecs)*time.Second)
+
+	s.startLifecycle()
+
 	glog.Infoln("created S3Server, type", *ioengine)
 	return s
 }
@@ -46,17 +93,11 @@ func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set(Server, ServerName)
 
-	if bkname == "" {
-		glog.Errorln("InvalidRequest, no bucketname", r.Method, r.URL, r.Host)
-		http.Error(w, "InvalidRequest, no bucketname", InvalidRequest)
-		return
-	}
-
 	// generate uuid as request id
 	requuid, err := util.GenRequestID()
 	if err != nil {
 		glog.Errorln("failed to generate uuid for", r.Method, bkname, objname)
-		http.Error(w, "failed to generate uuid", InternalError)
+		writeError(w, r, InternalError, "failed to generate uuid")
 		return
 	}
 
@@ -66,11 +107,58 @@ func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set(RequestID, requuid)
 
+	if bkname == "" && r.Method != "GET" {
+		glog.Errorln("InvalidRequest, no bucketname", requuid, r.Method, r.URL, r.Host)
+		writeError(w, r, InvalidRequest, "InvalidRequest: no bucketname")
+		return
+	}
+
+	// the data blocks and parts are stored in the reserved buckets
+	if bkname != "" && s.s3io.IsReservedBucket(bkname) {
+		glog.Errorln("InvalidBucketName, reserved bucket", requuid, r.Method, bkname)
+		writeError(w, r, InvalidBucketName, "InvalidBucketName: the bucket name is reserved")
+		return
+	}
+
 	glog.V(2).Infoln(requuid, r.Method, r.URL, r.Host, bkname, objname)
 
+	// the preflight request is not signed
+	if r.Method == "OPTIONS" {
+		s.preflight(ctx, w, r, bkname)
+		return
+	}
+	if bkname != "" {
+		s.setCorsResponseHeaders(ctx, w, r, bkname)
+	}
+
+	info, status, errmsg := s.auth.Authenticate(ctx, r)
+	if status != StatusOK {
+		glog.Errorln("failed to authenticate request", requuid, r.Method, bkname, objname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+	ctx = newAuthContext(ctx, info)
+
+	status, errmsg = s.authorize(ctx, r, bkname, objname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = decodeStreamingBody(ctx, r)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	if bkname == "" {
+		s.listBuckets(ctx, w, r)
+		return
+	}
+
 	switch r.Method {
 	case "POST":
-		http.Error(w, NotImplementedStr, NotImplemented)
+		s.postOp(ctx, w, r, bkname, objname)
 	case "PUT":
 		s.putOp(ctx, w, r, bkname, objname)
 	case "GET":
@@ -79,11 +167,9 @@ func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.headOp(ctx, w, r, bkname, objname)
 	case "DELETE":
 		s.delOp(ctx, w, r, bkname, objname)
-	case "OPTIONS":
-		http.Error(w, NotImplementedStr, NotImplemented)
 	default:
 		glog.Errorln("unsupported request", r.Method, r.URL)
-		http.Error(w, "Invalid method", InvalidRequest)
+		writeError(w, r, InvalidRequest, "InvalidRequest: Invalid method")
 	}
 }
 
@@ -121,7 +207,7 @@ func (s *S3Server) getBucketAndObjectName(r *http.Request) (bkname string, objna
 		// url like /b1/k1 will be split to 3 elements, [ b1 k1].
 		// /b1/ also 3 elements [ b1 ].
 		// /b1 2 elements [ b1].
-		strs := strings.SplitN(r.URL.String(), "/", 3)
+		strs := strings.SplitN(r.URL.Path, "/", 3)
 		l := len(strs)
 		if l == 3 {
 			return strs[1], "/" + strs[2]
@@ -131,66 +217,181 @@ func (s *S3Server) getBucketAndObjectName(r *http.Request) (bkname string, objna
 			return "", ""
 		}
 	} else {
-		// bucket is in r.Host, the whole URL is object name
-		return bkname, r.URL.String()
+		// bucket is in r.Host, the whole URL path is object name
+		return bkname, r.URL.Path
 	}
 }
 
 func (s *S3Server) isBucketOp(objname string) bool {
-	if objname == "" || objname == "/" ||
-		strings.HasPrefix(objname, "/?") || strings.HasPrefix(objname, "?") {
-		return true
+	return objname == "" || objname == "/"
+}
+
+// the bucket sub-resources, such as /b1?cors
+var bucketSubResources = []string{BucketACL, BucketAccelerate, BucketCors, BucketDelete, BucketLifecycle,
+	BucketPolicy, BucketLogging, BucketNotification, BucketReplication, BucketTag,
+	BucketRequestPayment, BucketVersioning, BucketVersions, BucketWebsite, BucketUploads, BucketObjectLock}
+
+// returns the bucket sub-resource of the request, "" if none.
+func (s *S3Server) getBucketSubResource(r *http.Request) string {
+	q := r.URL.Query()
+	for _, res := range bucketSubResources {
+		if _, ok := q[res]; ok {
+			return res
+		}
 	}
-	return false
+	return ""
 }
 
-func (s *S3Server) putOp(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
+func hasQuery(r *http.Request, key string) bool {
+	_, ok := r.URL.Query()[key]
+	return ok
+}
+
+// objectKey returns the S3 key of the object name, objname has the leading "/"
+func objectKey(objname string) string {
+	return strings.TrimPrefix(objname, "/")
+}
+
+// writeXMLResponse marshals v and writes it as the response body
+func writeXMLResponse(ctx context.Context, w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		glog.Errorln("failed to marshal xml response", util.GetReqIDFromContext(ctx), v, err)
+		writeError(w, nil, InternalError, "failed to marshal xml response")
+		return
+	}
+
+	w.Header().Set(ContentType, "application/xml")
+	w.Header().Set(ContentLength, strconv.Itoa(len(xml.Header)+len(b)))
+	w.WriteHeader(StatusOK)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+func (s *S3Server) postOp(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
 	if s.isBucketOp(objname) {
-		if objname == "" || objname == "/" {
-			status, errmsg := s.s3io.PutBucket(bkname)
+		if hasQuery(r, BucketDelete) {
+			s.deleteObjects(ctx, w, r, bkname)
+			return
+		}
+	} else {
+		if hasQuery(r, ObjectUploads) {
+			bmd, status, errmsg := s.bmds.Get(ctx, bkname)
 			if status != StatusOK {
-				glog.Errorln("put bucket failed", bkname, status, errmsg)
-				http.Error(w, errmsg, status)
+				writeError(w, r, status, errmsg)
 				return
 			}
-			glog.Infoln("put bucket success", bkname)
-			w.WriteHeader(status)
+			m := NewS3Multipart(ctx, r, s.s3io, s.gc, s.journal, s.sse, bkname, objname)
+			m.CreateUpload(w, bmd)
+			return
+		}
+		if hasQuery(r, ObjectUploadID) {
+			bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+			if status != StatusOK {
+				writeError(w, r, status, errmsg)
+				return
+			}
+			m := NewS3Multipart(ctx, r, s.s3io, s.gc, s.journal, s.sse, bkname, objname)
+			m.CompleteUpload(w, bmd)
+			return
+		}
+	}
+
+	glog.Errorln("NotImplemented post operation", util.GetReqIDFromContext(ctx), bkname, objname, r.URL.RawQuery)
+	writeError(w, r, NotImplemented, NotImplementedStr)
+}
+
+func (s *S3Server) putOp(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
+	if s.isBucketOp(objname) {
+		subres := s.getBucketSubResource(r)
+		if subres == BucketVersioning {
+			s.putBucketVersioning(ctx, w, r, bkname)
+		} else if subres == BucketTag {
+			s.putBucketTagging(ctx, w, r, bkname)
+		} else if subres == BucketCors {
+			s.putBucketCors(ctx, w, r, bkname)
+		} else if subres == BucketLifecycle {
+			s.putBucketLifecycle(ctx, w, r, bkname)
+		} else if subres == BucketPolicy {
+			s.putBucketPolicy(ctx, w, r, bkname)
+		} else if subres == BucketACL {
+			s.putBucketAcl(ctx, w, r, bkname)
+		} else if subres == BucketObjectLock {
+			s.putBucketObjectLockConfiguration(ctx, w, r, bkname)
+		} else if subres == "" {
+			s.putBucket(ctx, w, r, bkname)
 		} else {
 			glog.Errorln("NotImplemented put bucket operation", bkname, objname)
-			http.Error(w, NotImplementedStr, NotImplemented)
+			writeError(w, r, NotImplemented, NotImplementedStr)
+		}
+	} else if hasQuery(r, ObjectACL) {
+		s.putObjectAcl(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectTagging) {
+		s.putObjectTagging(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectRetention) {
+		s.putObjectRetention(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectLegalHold) {
+		s.putObjectLegalHold(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectUploadID) {
+		if r.Header.Get(CopySource) != "" {
+			glog.Errorln("NotImplemented upload part copy", util.GetReqIDFromContext(ctx), bkname, objname)
+			writeError(w, r, NotImplemented, NotImplementedStr)
+			return
 		}
+		m := NewS3Multipart(ctx, r, s.s3io, s.gc, s.journal, s.sse, bkname, objname)
+		m.UploadPart(w)
+	} else if r.Header.Get(CopySource) != "" {
+		s.copyObject(ctx, w, r, bkname, objname)
 	} else {
-		p := NewS3PutObject(ctx, r, s.s3io, bkname, objname)
+		bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+		if status != StatusOK {
+			writeError(w, r, status, errmsg)
+			return
+		}
+		p := NewS3PutObject(ctx, r, s.s3io, s.gc, s.journal, s.sse, bmd, bkname, objname)
 		p.PutObject(w, bkname, objname)
 	}
 }
 
 func (s *S3Server) getOp(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
 	if s.isBucketOp(objname) {
-		if objname == "" || objname == "/" || objname == BucketListOp {
-			body, status, errmsg := s.s3io.GetBucket(bkname)
-			if status != StatusOK {
-				glog.Errorln("get bucket failed", util.GetReqIDFromContext(ctx), bkname, objname, status, errmsg)
-				http.Error(w, errmsg, status)
-				return
-			}
-
-			// GetBucket success, copy result to w
-			n, err := io.Copy(w, body)
-			if err != nil || n == 0 {
-				glog.Errorln("get bucket failed", util.GetReqIDFromContext(ctx), bkname, objname, n, err)
-				if n == 0 {
-					// n == 0 is not valid, the list would at least have some xml string
-					// read and write 0 data, w.Write may not be called in io.Copy
-					w.WriteHeader(InternalError)
-				}
-			} else {
-				glog.V(1).Infoln("get bucket success", util.GetReqIDFromContext(ctx), bkname, objname, n)
-			}
+		subres := s.getBucketSubResource(r)
+		if subres == BucketUploads {
+			m := NewS3Multipart(ctx, r, s.s3io, s.gc, s.journal, s.sse, bkname, "")
+			m.ListUploads(w)
+		} else if subres == BucketVersioning {
+			s.getBucketVersioning(ctx, w, r, bkname)
+		} else if subres == BucketVersions {
+			s.listObjectVersions(ctx, w, r, bkname)
+		} else if subres == BucketTag {
+			s.getBucketTagging(ctx, w, r, bkname)
+		} else if subres == BucketCors {
+			s.getBucketCors(ctx, w, r, bkname)
+		} else if subres == BucketLifecycle {
+			s.getBucketLifecycle(ctx, w, r, bkname)
+		} else if subres == BucketPolicy {
+			s.getBucketPolicy(ctx, w, r, bkname)
+		} else if subres == BucketACL {
+			s.getBucketAcl(ctx, w, r, bkname)
+		} else if subres == BucketObjectLock {
+			s.getBucketObjectLockConfiguration(ctx, w, r, bkname)
+		} else if subres == "" {
+			s.listObjects(ctx, w, r, bkname)
 		} else {
 			glog.Errorln("not support get bucket operation", util.GetReqIDFromContext(ctx), bkname, objname)
-			http.Error(w, NotImplementedStr, NotImplemented)
+			writeError(w, r, NotImplemented, NotImplementedStr)
 		}
+	} else if hasQuery(r, ObjectACL) {
+		s.getObjectAcl(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectTagging) {
+		s.getObjectTagging(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectRetention) {
+		s.getObjectRetention(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectLegalHold) {
+		s.getObjectLegalHold(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectUploadID) {
+		m := NewS3Multipart(ctx, r, s.s3io, s.gc, s.journal, s.sse, bkname, objname)
+		m.ListParts(w)
 	} else {
 		s.getObjectOp(ctx, w, r, bkname, objname)
 	}
@@ -198,36 +399,103 @@ func (s *S3Server) getOp(ctx context.Context, w http.ResponseWriter, r *http.Req
 
 func (s *S3Server) getObjectMD(ctx context.Context, r *http.Request, bkname string,
 	objname string) (objmd *ObjectMD, status int, errmsg string) {
+	// get the object version
+	if versionIDs, ok := r.URL.Query()[ObjectVersionID]; ok {
+		objmd, status, errmsg = s.getObjectVersion(ctx, bkname, objname, versionIDs[0])
+		if status != StatusOK {
+			return nil, status, errmsg
+		}
+		if objmd.DeleteMarker {
+			return nil, MethodNotAllowed, "MethodNotAllowed"
+		}
+		return objmd, StatusOK, StatusOKStr
+	}
+
 	// object get, read metadata object first
-	b, status, errmsg := s.s3io.ReadObjectMD(bkname, objname)
+	objmd, status, errmsg = readObjectMD(ctx, s.s3io, bkname, objname)
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+
+	// the object is deleted, but the delete is not applied yet
+	if s.journal.IsDeleted(objmd) {
+		glog.V(2).Infoln("object is deleted", util.GetReqIDFromContext(ctx), bkname, objname, objmd.Uuid)
+		return nil, NoSuchKey, "NoSuchKey"
+	}
+
+	glog.V(2).Infoln("successfully read object md", util.GetReqIDFromContext(ctx), bkname, objname,
+		objmd.Smd, "totalParts", len(objmd.Data.DataParts))
+	return objmd, StatusOK, StatusOKStr
+}
+
+// updateObjectMD updates the metadata of the object, or the object version if
+// versionId is in the request. The ObjectMD, and the version record if the
+// object is a version, are rewritten with the same uuid. The read, update and
+// write are serialized with the puts by the commit lock of the object. The
+// update could reject the change by returning the error.
+func (s *S3Server) updateObjectMD(ctx context.Context, r *http.Request, bmd *BucketMD, bkname string,
+	objname string, update func(md *ObjectMD) (status int, errmsg string)) (md *ObjectMD, status int, errmsg string) {
+	lock := commitLock(bkname, objname)
+	lock.Lock()
+	defer lock.Unlock()
+
+	md, status, errmsg = s.getObjectMD(ctx, r, bkname, objname)
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+
+	md = proto.Clone(md).(*ObjectMD)
+	status, errmsg = update(md)
 	if status != StatusOK {
-		glog.Errorln("failed to ReadObjectMD", util.GetReqIDFromContext(ctx), bkname, objname, status, errmsg)
 		return nil, status, errmsg
 	}
 
-	// uncompress ObjectMD bytes
-	mdbyte := b
-	var err error
-	if *cmp {
-		mdbyte, err = snappy.Decode(nil, b)
-		if err != nil {
-			glog.Errorln("failed to uncompress ObjectMD", util.GetReqIDFromContext(ctx), bkname, objname, err)
-			return nil, InternalError, "failed to uncompress ObjectMD"
+	if bmd.Versioning != "" {
+		ver, status, errmsg := readObjectVersion(ctx, s.s3io, bkname, objname, objectVersionID(md))
+		if status == StatusOK && ver.Uuid == md.Uuid {
+			status, errmsg = writeObjectVersion(ctx, s.s3io, md)
+			if status != StatusOK {
+				return nil, status, errmsg
+			}
+		} else if status != StatusOK && status != NoSuchKey {
+			return nil, status, errmsg
 		}
+	}
 
-		glog.V(5).Infoln(util.GetReqIDFromContext(ctx), "compressed size", len(b), "original size", len(mdbyte), bkname, objname)
+	cur, status, errmsg := readObjectMD(ctx, s.s3io, bkname, objname)
+	if status == StatusOK && cur.Uuid == md.Uuid {
+		status, errmsg = writeObjectMD(ctx, s.s3io, md)
+		if status != StatusOK {
+			return nil, status, errmsg
+		}
+	} else if status != StatusOK && status != NoSuchKey {
+		return nil, status, errmsg
 	}
+	return md, StatusOK, StatusOKStr
+}
 
-	objmd = &ObjectMD{}
-	err = proto.Unmarshal(mdbyte, objmd)
-	if err != nil {
-		glog.Errorln("failed to Unmarshal ObjectMD", util.GetReqIDFromContext(ctx), bkname, objname, err)
-		return nil, InternalError, InternalErrorStr
+// checkObjectConditions checks the conditional headers of get and head object,
+// returns false if the response is written.
+func (s *S3Server) checkObjectConditions(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	objmd *ObjectMD) bool {
+	status, errmsg := checkConditions(r.Header, objmd, objectConditions, NotModified)
+	if status == StatusOK {
+		return true
 	}
 
-	glog.V(2).Infoln("successfully read object md", util.GetReqIDFromContext(ctx), bkname, objname,
-		objmd.Smd, "totalParts", len(objmd.Data.DataParts))
-	return objmd, StatusOK, StatusOKStr
+	glog.V(1).Infoln("object condition failed", util.GetReqIDFromContext(ctx),
+		objmd.Smd.Bucket, objmd.Smd.Name, objmd.Smd.Etag, status, errmsg)
+
+	if status == NotModified {
+		// 304 has no body, but still returns the validators
+		w.Header().Set(LastModified, time.Unix(objmd.Smd.Mtime, 0).UTC().Format(time.RFC1123))
+		w.Header().Set(ETag, objmd.Smd.Etag)
+		w.WriteHeader(status)
+		return false
+	}
+
+	writeError(w, r, status, errmsg)
+	return false
 }
 
 func (s *S3Server) getObjectOp(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
@@ -236,13 +504,60 @@ func (s *S3Server) getObjectOp(ctx context.Context, w http.ResponseWriter, r *ht
 	if status != StatusOK {
 		glog.Errorln("getObjecct failed to get ObjectMD",
 			util.GetReqIDFromContext(ctx), bkname, objname, status, errmsg)
-		http.Error(w, errmsg, status)
+		if status == MethodNotAllowed {
+			// the version is the delete marker
+			w.Header().Set(DeleteMarker, "true")
+		}
+		writeError(w, r, status, errmsg)
 		return
 	}
 
-	w.Header().Set(LastModified, time.Unix(objmd.Smd.Mtime, 0).UTC().Format(time.RFC1123))
-	w.Header().Set(ETag, objmd.Smd.Etag)
-	w.Header().Set(ContentLength, strconv.FormatInt(objmd.Smd.Size, 10))
+	if !s.checkObjectConditions(ctx, w, r, objmd) {
+		return
+	}
+
+	cipher, status, errmsg := s.sse.objectCipher(ctx, r.Header, objmd.Sse, false)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	start, end, isRange, status, errmsg := parseRange(r.Header.Get(Range), objmd.Smd.Size)
+	if status != StatusOK {
+		glog.Errorln("invalid range", util.GetReqIDFromContext(ctx), bkname, objname,
+			r.Header.Get(Range), objmd.Smd.Size)
+		w.Header().Set(ContentRange, "bytes */"+strconv.FormatInt(objmd.Smd.Size, 10))
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	// construct Body reader to read the corresponding data blocks
+	var body io.Reader
+	if objmd.Smd.Size != 0 {
+		rd := NewS3GetObject(ctx, r, s.s3io, objmd, cipher, bkname, objname)
+		status, errmsg = rd.GetObjectRange(start, end)
+		if status != StatusOK {
+			writeError(w, r, status, errmsg)
+			return
+		}
+
+		// read the first data before the response header is written, so the
+		// read failure could still be returned as the error response
+		br := bufio.NewReaderSize(rd, int(objmd.Data.BlockSize))
+		_, err := br.Peek(1)
+		if err != nil && err != io.EOF {
+			glog.Errorln("get object failed to read the first data", util.GetReqIDFromContext(ctx), bkname, objname, err)
+			writeError(w, r, InternalError, "failed to read object data, "+err.Error())
+			return
+		}
+		body = br
+	}
+
+	setObjectHeaders(w, objmd)
+	s.setExpirationHeader(ctx, w, r, objmd)
+	setResponseOverrides(w, r)
+	w.Header().Set(AcceptRanges, "bytes")
+	w.Header().Set(ContentLength, strconv.FormatInt(end-start, 10))
 
 	if objmd.Smd.Size == 0 {
 		glog.V(1).Infoln("get object success, size 0", util.GetReqIDFromContext(ctx), bkname, objname)
@@ -250,63 +565,207 @@ func (s *S3Server) getObjectOp(ctx context.Context, w http.ResponseWriter, r *ht
 		return
 	}
 
-	// construct Body reader to read the corresponding data blocks
-	rd := NewS3GetObject(ctx, r, s.s3io, objmd, bkname, objname)
-	status, errmsg = rd.GetObject()
-	if status != StatusOK {
-		http.Error(w, errmsg, status)
-		return
+	if isRange {
+		w.Header().Set(ContentRange, "bytes "+strconv.FormatInt(start, 10)+"-"+
+			strconv.FormatInt(end-1, 10)+"/"+strconv.FormatInt(objmd.Smd.Size, 10))
+		w.WriteHeader(http.StatusPartialContent)
 	}
 
-	n, err := io.Copy(w, rd)
-	if err != nil || n == 0 {
-		// n == 0 is also an error,
+	n, err := io.Copy(w, body)
+	if err != nil {
+		// the response header and some data are already sent, the error
+		// response could not be sent. The client will get less data than
+		// Content-Length, and the connection is closed.
 		glog.Errorln("get object failed", util.GetReqIDFromContext(ctx), bkname, objname, n, err)
-		if n == 0 {
-			// n == 0 is also an error. if object size is not 0, will not reach here.
-			// read and write 0 data, w.Write may not be called in io.Copy
-			w.WriteHeader(InternalError)
-		}
 	} else {
 		glog.V(1).Infoln("get object success", util.GetReqIDFromContext(ctx), bkname, objname, n, objmd.Smd)
 	}
 }
 
+// parseRange parses the Range header and returns the read range [start, end).
+// Only the single byte range is supported, such as "bytes=0-99", "bytes=100-"
+// and "bytes=-500". As RFC7233, the header is ignored and the whole object is
+// returned if the header is not a valid single byte range.
+func parseRange(hdr string, size int64) (start int64, end int64, isRange bool, status int, errmsg string) {
+	if hdr == "" || !strings.HasPrefix(hdr, "bytes=") || strings.Contains(hdr, ",") {
+		return 0, size, false, StatusOK, StatusOKStr
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(hdr, "bytes="))
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, size, false, StatusOK, StatusOKStr
+	}
+
+	startStr := strings.TrimSpace(spec[:i])
+	endStr := strings.TrimSpace(spec[i+1:])
+
+	if startStr == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, false, StatusOK, StatusOKStr
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, InvalidRange, "InvalidRange"
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, true, StatusOK, StatusOKStr
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, StatusOK, StatusOKStr
+	}
+
+	end = size
+	if endStr != "" {
+		last, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || last < start {
+			return 0, size, false, StatusOK, StatusOKStr
+		}
+		if last+1 < size {
+			end = last + 1
+		}
+	}
+
+	if start >= size {
+		return 0, 0, true, InvalidRange, "InvalidRange"
+	}
+	return start, end, true, StatusOK, StatusOKStr
+}
+
 func (s *S3Server) delOp(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
 	if s.isBucketOp(objname) {
-		if objname == "" || objname == "/" {
+		subres := s.getBucketSubResource(r)
+		if subres == BucketTag {
+			s.deleteBucketTagging(ctx, w, r, bkname)
+		} else if subres == BucketCors {
+			s.deleteBucketCors(ctx, w, r, bkname)
+		} else if subres == BucketLifecycle {
+			s.deleteBucketLifecycle(ctx, w, r, bkname)
+		} else if subres == BucketPolicy {
+			s.deleteBucketPolicy(ctx, w, r, bkname)
+		} else if subres == "" {
+			// apply the pending object deletes of the bucket first
+			s.journal.ApplyBucket(bkname)
+
 			status, errmsg := s.s3io.DeleteBucket(bkname)
 			if status != StatusOK {
 				glog.Errorln("delete bucket failed", util.GetReqIDFromContext(ctx), bkname, status, errmsg)
-				http.Error(w, errmsg, status)
+				writeError(w, r, status, errmsg)
 				return
 			}
+			s.bmds.Remove(bkname)
 			glog.Infoln("del bucket success", util.GetReqIDFromContext(ctx), bkname)
 			w.WriteHeader(status)
 		} else {
 			glog.Errorln("NotImplemented delete bucket operation", util.GetReqIDFromContext(ctx), bkname, objname)
-			http.Error(w, NotImplementedStr, NotImplemented)
+			writeError(w, r, NotImplemented, NotImplementedStr)
 		}
+	} else if hasQuery(r, ObjectTagging) {
+		s.deleteObjectTagging(ctx, w, r, bkname, objname)
+	} else if hasQuery(r, ObjectUploadID) {
+		m := NewS3Multipart(ctx, r, s.s3io, s.gc, s.journal, s.sse, bkname, objname)
+		m.AbortUpload(w)
 	} else {
 		s.delObject(ctx, w, r, bkname, objname)
 	}
 }
 
 func (s *S3Server) delObject(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
-	// read object md
+	requuid := util.GetReqIDFromContext(ctx)
+
+	if versionIDs, ok := r.URL.Query()[ObjectVersionID]; ok {
+		bypass := s.bypassGovernance(ctx, r, bkname, objname, versionIDs[0])
+		md, status, errmsg := s.deleteObjectVersion(ctx, bkname, objname, versionIDs[0], bypass)
+		if status != StatusOK {
+			writeError(w, r, status, errmsg)
+			return
+		}
+		w.Header().Set(VersionID, versionIDs[0])
+		if md != nil && md.DeleteMarker {
+			w.Header().Set(DeleteMarker, "true")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if bmd.Versioning != "" {
+		marker, status, errmsg := s.createDeleteMarker(ctx, bmd, bkname, objname, "")
+		if status != StatusOK {
+			writeError(w, r, status, errmsg)
+			return
+		}
+		w.Header().Set(VersionID, objectVersionID(marker))
+		w.Header().Set(DeleteMarker, "true")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	entry, status, errmsg := s.getDeleteEntry(ctx, bkname, objname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if entry == nil {
+		// S3 returns success for the unexist key
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
 	// log it to the local fs (protected by EBS or the underline storage of VMWare)
+	status, errmsg = s.journal.Log(ctx, []*DeleteEntry{entry})
+	if status != StatusOK {
+		glog.Errorln("failed to log delete", requuid, bkname, objname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
 
 	// return success, the background scanner will pick up from log
+	glog.V(0).Infoln("delete object success", requuid, bkname, objname, entry.Md.Uuid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDeleteEntry reads the ObjectMD and returns the DeleteEntry of the
+// unversioned object. nil is returned if the object does not exist.
+func (s *S3Server) getDeleteEntry(ctx context.Context, bkname string,
+	objname string) (entry *DeleteEntry, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	objmd, status, errmsg := readObjectMD(ctx, s.s3io, bkname, objname)
+	if status == NoSuchKey || (status == StatusOK && s.journal.IsDeleted(objmd)) {
+		glog.V(1).Infoln("delete object, key not exist", requuid, bkname, objname)
+		return nil, StatusOK, StatusOKStr
+	}
+	if status != StatusOK {
+		glog.Errorln("delete object failed to get ObjectMD", requuid, bkname, objname, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	status, errmsg = checkObjectLock(objmd, time.Now(), false)
+	if status != StatusOK {
+		glog.Errorln("delete object is locked", requuid, bkname, objname, objmd.Uuid, errmsg)
+		return nil, status, errmsg
+	}
+
+	return &DeleteEntry{Bucket: bkname, Name: objname, Md: objmd}, StatusOK, StatusOKStr
 }
 
 func (s *S3Server) headOp(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string, objname string) {
 	if s.isBucketOp(objname) {
-		if objname == "" || objname == "/" {
+		if s.getBucketSubResource(r) == "" {
 			status, errmsg := s.s3io.HeadBucket(bkname)
 			if status != StatusOK {
 				glog.Errorln("failed to head bucket", util.GetReqIDFromContext(ctx), bkname, status, errmsg)
-				http.Error(w, errmsg, status)
+				writeError(w, r, status, errmsg)
 				return
 			}
 
@@ -314,7 +773,7 @@ func (s *S3Server) headOp(ctx context.Context, w http.ResponseWriter, r *http.Re
 			w.WriteHeader(status)
 		} else {
 			glog.Errorln("Invalid head bucket operation", util.GetReqIDFromContext(ctx), bkname, objname)
-			http.Error(w, "Invalid head bucket operation", InvalidRequest)
+			writeError(w, r, InvalidRequest, "InvalidRequest: Invalid head bucket operation")
 		}
 	} else {
 		s.headObject(ctx, w, r, bkname, objname)
@@ -327,13 +786,31 @@ func (s *S3Server) headObject(ctx context.Context, w http.ResponseWriter, r *htt
 	if status != StatusOK {
 		glog.Errorln("headObjecct failed to get ObjectMD",
 			util.GetReqIDFromContext(ctx), bkname, objname, status, errmsg)
-		http.Error(w, errmsg, status)
+		if status == MethodNotAllowed {
+			// the version is the delete marker
+			w.Header().Set(DeleteMarker, "true")
+		}
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	if !s.checkObjectConditions(ctx, w, r, objmd) {
+		return
+	}
+
+	// the SSE-C object requires the customer key to head
+	_, status, errmsg = s.sse.objectCipher(ctx, r.Header, objmd.Sse, false)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
 		return
 	}
 
 	glog.V(2).Infoln("head object success", util.GetReqIDFromContext(ctx), objmd.Smd)
 
-	w.Header().Set(LastModified, time.Unix(objmd.Smd.Mtime, 0).UTC().Format(time.RFC1123))
-	w.Header().Set(ETag, objmd.Smd.Etag)
+	setObjectHeaders(w, objmd)
+	s.setExpirationHeader(ctx, w, r, objmd)
+	setResponseOverrides(w, r)
+	w.Header().Set(AcceptRanges, "bytes")
+	w.Header().Set(ContentLength, strconv.FormatInt(objmd.Smd.Size, 10))
 	w.WriteHeader(StatusOK)
 }
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestS3Server creates the S3Server on the FileIO under the test temp dir.
+// The anonymous requests are allowed. The gc, the delete journal and the
+// lifecycle workers are not started, the tests apply the journal and collect
+// the blocks explicitly.
+func newTestS3Server(t *testing.T) *S3Server {
+	dir := t.TempDir() + "/"
+
+	s := new(S3Server)
+	fio := newFileIO(dir + "io/")
+	if fio == nil {
+		t.Fatal("failed to create FileIO")
+	}
+	s.s3io = fio
+	s.auth = NewS3Auth(&CredentialStore{keys: map[string]string{}}, "us-east-1", true)
+	s.sse = NewS3SSE("", false)
+	s.gc = NewBlockGC(dir+"gc", s.s3io)
+	if s.gc == nil {
+		t.Fatal("failed to create BlockGC")
+	}
+	s.journal = NewDeleteJournal(dir+"journal", s.s3io, s.gc)
+	if s.journal == nil {
+		t.Fatal("failed to create DeleteJournal")
+	}
+	s.bmds = NewBucketMDCache(s.s3io, 0)
+	return s
+}
+
+// testS3Request serves the request and returns the response
+func testS3Request(s *S3Server, method string, target string, hdr map[string]string,
+	body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for k, v := range hdr {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// testS3OK serves the request and fails the test if the request fails
+func testS3OK(t *testing.T, s *S3Server, method string, target string, hdr map[string]string,
+	body []byte) *httptest.ResponseRecorder {
+	w := testS3Request(s, method, target, hdr, body)
+	if w.Code >= 300 {
+		t.Fatal(method, target, w.Code, w.Body.String())
+	}
+	return w
+}
+
+// testS3ErrorCode returns the S3 error code of the response, "" if the
+// request succeeds.
+func testS3ErrorCode(w *httptest.ResponseRecorder) string {
+	if w.Code < 300 {
+		return ""
+	}
+	res := &errorResponse{}
+	if xml.Unmarshal(w.Body.Bytes(), res) != nil {
+		return w.Body.String()
+	}
+	return res.Code
+}
+
+// testS3XML serves the request and unmarshals the xml response to res
+func testS3XML(t *testing.T, s *S3Server, method string, target string, body []byte, res interface{}) {
+	w := testS3OK(t, s, method, target, nil, body)
+	err := xml.Unmarshal(w.Body.Bytes(), res)
+	if err != nil {
+		t.Fatal(method, target, "invalid xml response", err, w.Body.String())
+	}
+}
+
+// testObjectData returns the test data of the size
+func testObjectData(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i*7 + i/DataBlockSize)
+	}
+	return b
+}
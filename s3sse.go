@@ -0,0 +1,322 @@
+package test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"test/util"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+var sseKeyFile = flag.String("ssekeyfile", "",
+	"the file of the hex encoded 32 bytes master key of SSE-S3, SSE-S3 is not supported if not set")
+var sseDefault = flag.Bool("ssedefault", false,
+	"whether encrypt the object with SSE-S3 if the request does not specify the encryption")
+
+// Server side encryption.
+//
+// The data block is named by its md5, so the same data is stored once. An
+// encrypted block could not be named by the md5 of the data, which leaks the
+// data and mixes the blocks of different keys. The encrypted block is named
+// by the keyed hash of the data, and encrypted with the key derived from the
+// name. So the same data with the same secret still has the same block.
+//
+// SSE-S3 uses the tenant secret derived from the master key and the bucket
+// owner, the blocks are deduplicated within the tenant. SSE-C uses the
+// customer key as the secret, the blocks are deduplicated only with the
+// objects of the same customer key, and the key is never stored.
+
+// S3SSE keeps the master key of SSE-S3
+type S3SSE struct {
+	// nil if SSE-S3 is not configured
+	masterKey []byte
+	// whether encrypt the object by default
+	encryptDefault bool
+}
+
+// blockCipher encrypts and decrypts the data blocks. nil for the unencrypted
+// object.
+type blockCipher struct {
+	secret []byte
+}
+
+// NewS3SSE loads the master key from the file. The file has the hex encoded
+// 32 bytes key. If the path is empty, only SSE-C is supported.
+func NewS3SSE(path string, encryptDefault bool) *S3SSE {
+	e := new(S3SSE)
+	if path == "" {
+		if encryptDefault {
+			glog.Errorln("no master key to encrypt the objects by default")
+			return nil
+		}
+		glog.Infoln("no master key, SSE-S3 is not supported")
+		return e
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.Errorln("failed to read the master key file", path, err)
+		return nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		glog.Errorln("invalid master key, should be hex encoded 32 bytes", path, len(key), err)
+		return nil
+	}
+
+	e.masterKey = key
+	e.encryptDefault = encryptDefault
+	glog.Infoln("loaded the master key", path, "encrypt by default", encryptDefault)
+	return e
+}
+
+func hmacSum(key []byte, label string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// tenantCipher returns the cipher of the tenant secret
+func (e *S3SSE) tenantCipher(tenant string) *blockCipher {
+	return &blockCipher{secret: hmacSum(e.masterKey, "tenant:", []byte(tenant))}
+}
+
+// blockName returns the name of the data block. It has the same format as
+// the md5 name of the unencrypted block.
+func (c *blockCipher) blockName(data []byte) string {
+	return hex.EncodeToString(hmacSum(c.secret, "block:", data)[:md5.Size])
+}
+
+// the key is unique for every block data, so the zero iv is never reused
+// with the same key for the different data.
+func (c *blockCipher) stream(name string) cipher.Stream {
+	block, err := aes.NewCipher(hmacSum(c.secret, "key:", []byte(name)))
+	if err != nil {
+		// the key size is always 32
+		glog.Fatalln("failed to create aes cipher", err)
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize))
+}
+
+// encrypt returns the encrypted data in the new buffer
+func (c *blockCipher) encrypt(name string, data []byte) []byte {
+	b := make([]byte, len(data))
+	c.stream(name).XORKeyStream(b, data)
+	return b
+}
+
+// decrypt decrypts the whole block in place
+func (c *blockCipher) decrypt(name string, b []byte) {
+	c.stream(name).XORKeyStream(b, b)
+}
+
+// sameCipher checks whether the blocks of the 2 ciphers are the same
+func sameCipher(c1 *blockCipher, c2 *blockCipher) bool {
+	if c1 == nil || c2 == nil {
+		return c1 == c2
+	}
+	return hmac.Equal(c1.secret, c2.secret)
+}
+
+// parse the SSE-C headers, or the copy source SSE-C headers. key is nil if
+// none of the headers is set.
+func parseCustomerKey(hdr http.Header, copySource bool) (key []byte, keyMD5 string, status int, errmsg string) {
+	algHdr, keyHdr, md5Hdr := SSECustomerAlgorithm, SSECustomerKey, SSECustomerKeyMD5
+	if copySource {
+		algHdr, keyHdr, md5Hdr = CopySourceSSECustomerAlgorithm, CopySourceSSECustomerKey, CopySourceSSECustomerKeyMD5
+	}
+
+	alg := hdr.Get(algHdr)
+	keyStr := hdr.Get(keyHdr)
+	keyMD5 = hdr.Get(md5Hdr)
+	if alg == "" && keyStr == "" && keyMD5 == "" {
+		return nil, "", StatusOK, StatusOKStr
+	}
+
+	if alg != SSEAlgorithmAES256 {
+		return nil, "", InvalidArgument, "InvalidArgument: The encryption algorithm must be AES256."
+	}
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil || len(key) != 32 {
+		return nil, "", InvalidArgument, "InvalidArgument: The secret key was invalid for the specified algorithm."
+	}
+	sum := md5.Sum(key)
+	if keyMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, "", InvalidArgument,
+			"InvalidArgument: The calculated MD5 hash of the key did not match the hash that was provided."
+	}
+	return key, keyMD5, StatusOK, StatusOKStr
+}
+
+// parseSSEHeaders parses the encryption of the object write. tenant is the
+// bucket owner. sse and cipher are nil if the object is not encrypted.
+func (e *S3SSE) parseSSEHeaders(ctx context.Context, hdr http.Header,
+	tenant string) (sse *ObjectSSE, c *blockCipher, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	key, keyMD5, status, errmsg := parseCustomerKey(hdr, false)
+	if status != StatusOK {
+		glog.Errorln("invalid SSE-C headers", requuid, errmsg)
+		return nil, nil, status, errmsg
+	}
+
+	alg := hdr.Get(SSE)
+	if key != nil {
+		if alg != "" {
+			glog.Errorln("both SSE-C and SSE are specified", requuid, alg)
+			return nil, nil, InvalidArgument, "InvalidArgument: Server Side Encryption with Customer " +
+				"provided key is incompatible with the encryption method specified"
+		}
+		sse = &ObjectSSE{Algorithm: SSEAlgorithmAES256, CustomerKeyMd5: keyMD5}
+		return sse, &blockCipher{secret: key}, StatusOK, StatusOKStr
+	}
+
+	if alg == "" {
+		if !e.encryptDefault {
+			return nil, nil, StatusOK, StatusOKStr
+		}
+		alg = SSEAlgorithmAES256
+	}
+
+	if strings.HasPrefix(alg, SSEAlgorithmKMSPrefix) {
+		glog.Errorln("SSE-KMS is not supported", requuid, alg)
+		return nil, nil, NotImplemented, "NotImplemented: SSE-KMS is not supported"
+	}
+	if alg != SSEAlgorithmAES256 {
+		glog.Errorln("invalid SSE algorithm", requuid, alg)
+		return nil, nil, InvalidArgument, "InvalidArgument: The encryption method specified is not supported"
+	}
+	if e.masterKey == nil {
+		glog.Errorln("SSE-S3 is not configured", requuid)
+		return nil, nil, NotImplemented, "NotImplemented: SSE-S3 is not configured"
+	}
+
+	sse = &ObjectSSE{Algorithm: SSEAlgorithmAES256, Tenant: tenant}
+	return sse, e.tenantCipher(tenant), StatusOK, StatusOKStr
+}
+
+// objectCipher returns the cipher to read the object, or to add the part to
+// the multipart upload. The SSE-C object requires the same customer key.
+func (e *S3SSE) objectCipher(ctx context.Context, hdr http.Header, sse *ObjectSSE,
+	copySource bool) (c *blockCipher, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	key, keyMD5, status, errmsg := parseCustomerKey(hdr, copySource)
+	if status != StatusOK {
+		glog.Errorln("invalid SSE-C headers", requuid, errmsg)
+		return nil, status, errmsg
+	}
+
+	if sse == nil || sse.CustomerKeyMd5 == "" {
+		if key != nil {
+			glog.Errorln("SSE-C key for the object not encrypted by SSE-C", requuid)
+			return nil, InvalidRequest, "InvalidRequest: The encryption parameters are not applicable to this object."
+		}
+		if sse == nil {
+			return nil, StatusOK, StatusOKStr
+		}
+		if e.masterKey == nil {
+			glog.Errorln("no master key to decrypt the SSE-S3 object", requuid, sse.Tenant)
+			return nil, InternalError, "SSE-S3 is not configured"
+		}
+		return e.tenantCipher(sse.Tenant), StatusOK, StatusOKStr
+	}
+
+	if key == nil {
+		glog.Errorln("no SSE-C key for the SSE-C object", requuid)
+		return nil, InvalidRequest, "InvalidRequest: The object was stored using a form of Server Side " +
+			"Encryption. The correct parameters must be provided to retrieve the object."
+	}
+	if keyMD5 != sse.CustomerKeyMd5 {
+		glog.Errorln("SSE-C key does not match", requuid)
+		return nil, AccessDenied, "AccessDenied"
+	}
+	return &blockCipher{secret: key}, StatusOK, StatusOKStr
+}
+
+// setSSEHeaders sets the encryption response headers
+func setSSEHeaders(w http.ResponseWriter, sse *ObjectSSE) {
+	if sse == nil {
+		return
+	}
+	if sse.CustomerKeyMd5 != "" {
+		w.Header().Set(SSECustomerAlgorithm, sse.Algorithm)
+		w.Header().Set(SSECustomerKeyMD5, sse.CustomerKeyMd5)
+		return
+	}
+	w.Header().Set(SSE, sse.Algorithm)
+}
+
+// hasSSEHeaders checks whether the request specifies the encryption
+func hasSSEHeaders(hdr http.Header) bool {
+	return hdr.Get(SSE) != "" || hdr.Get(SSECustomerAlgorithm) != ""
+}
+
+// writeBlock writes the data block if it does not exist
+func writeBlock(s3io CloudIO, gc *BlockGC, c *blockCipher, buf []byte) (name string, exist bool, status int, errmsg string) {
+	if c != nil {
+		name = c.blockName(buf)
+	} else {
+		md5byte := md5.Sum(buf)
+		name = hex.EncodeToString(md5byte[:])
+	}
+
+	if !gc.UseBlock(name) && s3io.IsDataBlockExist(name) {
+		return name, true, StatusOK, StatusOKStr
+	}
+
+	if c != nil {
+		buf = c.encrypt(name, buf)
+	}
+	status, errmsg = s3io.WriteDataBlock(buf, name)
+	return name, false, status, errmsg
+}
+
+// recryptBlocks reads the blocks with the src cipher, and writes them with
+// the dst cipher. All blocks are full blocks except the last one, so the
+// new blocks have the same layout.
+func recryptBlocks(ctx context.Context, s3io CloudIO, gc *BlockGC, blocks []string, blockSize int32,
+	src *blockCipher, dst *blockCipher) (newBlocks []string, ddBlocks int64, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	buf := make([]byte, blockSize)
+	for i, blk := range blocks {
+		n, status, errmsg := s3io.ReadDataBlockRange(blk, 0, buf)
+		if status != StatusOK {
+			glog.Errorln("failed to read block", requuid, blk, status, errmsg)
+			return nil, 0, status, errmsg
+		}
+		if n != len(buf) && i != len(blocks)-1 {
+			glog.Errorln("read less data for a full block", requuid, blk, n)
+			return nil, 0, InternalError, "read less data for a full block"
+		}
+
+		if src != nil {
+			src.decrypt(blk, buf[:n])
+		}
+
+		name, exist, status, errmsg := writeBlock(s3io, gc, dst, buf[:n])
+		if status != StatusOK {
+			glog.Errorln("failed to write block", requuid, name, status, errmsg)
+			return nil, 0, status, errmsg
+		}
+		if exist {
+			ddBlocks++
+		}
+		newBlocks = append(newBlocks, name)
+	}
+
+	glog.V(1).Infoln("recrypt blocks done", requuid, len(newBlocks), "ddBlocks", ddBlocks)
+	return newBlocks, ddBlocks, StatusOK, StatusOKStr
+}
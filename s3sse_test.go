@@ -0,0 +1,165 @@
+package test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSSECHeaders adds the SSE-C headers of the customer key filled with b,
+// or the copy source SSE-C headers, to hdr.
+func testSSECHeaders(hdr map[string]string, b byte, copySource bool) map[string]string {
+	key := bytes.Repeat([]byte{b}, 32)
+	sum := md5.Sum(key)
+	algHdr, keyHdr, md5Hdr := SSECustomerAlgorithm, SSECustomerKey, SSECustomerKeyMD5
+	if copySource {
+		algHdr, keyHdr, md5Hdr = CopySourceSSECustomerAlgorithm, CopySourceSSECustomerKey, CopySourceSSECustomerKeyMD5
+	}
+	hdr[algHdr] = SSEAlgorithmAES256
+	hdr[keyHdr] = base64.StdEncoding.EncodeToString(key)
+	hdr[md5Hdr] = base64.StdEncoding.EncodeToString(sum[:])
+	return hdr
+}
+
+func TestSSECopy(t *testing.T) {
+	s := newTestS3Server(t)
+	keyFile := t.TempDir() + "/ssekey"
+	err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	if err != nil {
+		t.Fatal("write the master key", err)
+	}
+	s.sse = NewS3SSE(keyFile, false)
+	if s.sse == nil {
+		t.Fatal("failed to load the master key")
+	}
+	wio := &testWriteCountIO{CloudIO: s.s3io}
+	s.s3io = wio
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	data := testObjectData(2*DataBlockSize + 100)
+	testS3OK(t, s, "PUT", "/bk/plain", nil, data)
+	plainBlocks := testObjectBlocks(t, s, testReadObjectMD(t, s, "bk", "/plain"))
+	wio.reset()
+
+	// plain to SSE-S3, every block is re-encrypted
+	w := testS3OK(t, s, "PUT", "/bk/s3", map[string]string{CopySource: "bk/plain", SSE: SSEAlgorithmAES256}, nil)
+	if w.Header().Get(SSE) != SSEAlgorithmAES256 {
+		t.Fatal("SSE header of the copy", w.Header())
+	}
+	s3md := testReadObjectMD(t, s, "bk", "/s3")
+	s3Blocks := testObjectBlocks(t, s, s3md)
+	if n := wio.reset(); n != len(plainBlocks) || s3md.Data.DdBlocks != 0 {
+		t.Fatal("re-encrypt writes", n, "ddBlocks", s3md.Data.DdBlocks)
+	}
+	buf := make([]byte, DataBlockSize)
+	for i, blk := range s3Blocks {
+		if blk == plainBlocks[i] {
+			t.Fatal("the encrypted block has the plaintext name", blk)
+		}
+		n, status, errmsg := s.s3io.ReadDataBlockRange(blk, 0, buf)
+		if status != StatusOK || bytes.Equal(buf[:n], data[i*DataBlockSize:i*DataBlockSize+n]) {
+			t.Fatal("the block is not encrypted", blk, status, errmsg)
+		}
+	}
+	w = testS3OK(t, s, "GET", "/bk/s3", nil, nil)
+	if !bytes.Equal(w.Body.Bytes(), data) || w.Header().Get(SSE) != SSEAlgorithmAES256 ||
+		w.Header().Get(ETag) != s3md.Smd.Etag {
+		t.Fatal("get the SSE-S3 copy", w.Body.Len(), w.Header())
+	}
+	w = testS3OK(t, s, "GET", "/bk/s3", map[string]string{Range: "bytes=131000-131100"}, nil)
+	if !bytes.Equal(w.Body.Bytes(), data[131000:131101]) {
+		t.Fatal("range get the SSE-S3 copy", w.Code, w.Body.Len())
+	}
+
+	// SSE-S3 to SSE-S3 of the same tenant only references the blocks
+	testS3OK(t, s, "PUT", "/bk/s3b", map[string]string{CopySource: "bk/s3", SSE: SSEAlgorithmAES256}, nil)
+	if n := wio.reset(); n != 0 {
+		t.Fatal("copy with the same key writes the blocks", n)
+	}
+	if blocks := testObjectBlocks(t, s, testReadObjectMD(t, s, "bk", "/s3b")); !reflect.DeepEqual(blocks, s3Blocks) {
+		t.Fatal("copy with the same key has the new blocks")
+	}
+
+	// SSE-S3 to SSE-C
+	testS3OK(t, s, "PUT", "/bk/c", testSSECHeaders(map[string]string{CopySource: "bk/s3"}, 1, false), nil)
+	if n := wio.reset(); n != len(plainBlocks) {
+		t.Fatal("re-encrypt writes", n)
+	}
+	getTests := []struct {
+		name string
+		hdr  map[string]string
+		code string
+	}{
+		{"no key", nil, "InvalidRequest"},
+		{"wrong key", testSSECHeaders(map[string]string{}, 2, false), "AccessDenied"},
+		{"key", testSSECHeaders(map[string]string{}, 1, false), ""},
+	}
+	for _, tt := range getTests {
+		w = testS3Request(s, "GET", "/bk/c", tt.hdr, nil)
+		if code := testS3ErrorCode(w); code != tt.code {
+			t.Errorf("get SSE-C %s: error %q, want %q", tt.name, code, tt.code)
+		} else if code == "" && !bytes.Equal(w.Body.Bytes(), data) {
+			t.Errorf("get SSE-C %s: data mismatch %d", tt.name, w.Body.Len())
+		}
+	}
+
+	// the SSE-C source requires the copy source key
+	wio.reset()
+	copyTests := []struct {
+		name string
+		hdr  map[string]string
+		code string
+	}{
+		{"no source key", map[string]string{}, "InvalidRequest"},
+		{"wrong source key", testSSECHeaders(map[string]string{}, 2, true), "AccessDenied"},
+		{"source key", testSSECHeaders(map[string]string{}, 1, true), ""},
+	}
+	for _, tt := range copyTests {
+		tt.hdr[CopySource] = "bk/c"
+		if code := testS3ErrorCode(testS3Request(s, "PUT", "/bk/plain2", tt.hdr, nil)); code != tt.code {
+			t.Errorf("copy SSE-C %s: error %q, want %q", tt.name, code, tt.code)
+		}
+	}
+
+	// SSE-C to plain is decrypted to the original blocks
+	md := testReadObjectMD(t, s, "bk", "/plain2")
+	if n := wio.reset(); n != 0 {
+		t.Fatal("decrypted copy writes the existing blocks", n)
+	}
+	if blocks := testObjectBlocks(t, s, md); !reflect.DeepEqual(blocks, plainBlocks) ||
+		md.Data.DdBlocks != int64(len(plainBlocks)) || md.Sse != nil {
+		t.Fatal("decrypted copy blocks", blocks, "ddBlocks", md.Data.DdBlocks, md.Sse)
+	}
+
+	// rotate the customer key of the object in place
+	hdr := testSSECHeaders(testSSECHeaders(map[string]string{CopySource: "bk/c"}, 1, true), 3, false)
+	testS3OK(t, s, "PUT", "/bk/c", hdr, nil)
+	w = testS3Request(s, "GET", "/bk/c", testSSECHeaders(map[string]string{}, 1, false), nil)
+	if code := testS3ErrorCode(w); code != "AccessDenied" {
+		t.Fatal("get with the old key", code)
+	}
+	w = testS3OK(t, s, "GET", "/bk/c", testSSECHeaders(map[string]string{}, 3, false), nil)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatal("get with the new key", w.Body.Len())
+	}
+
+	// the re-encrypted blocks are kept after the source is deleted
+	for _, obj := range []string{"plain", "s3"} {
+		testS3OK(t, s, "DELETE", "/bk/"+obj, nil, nil)
+	}
+	s.journal.ApplyBucket("bk")
+	s.gc.Collect()
+	testBackdateBlocks(s.gc, true, true, int64(*gcGraceSecs))
+	s.gc.Collect()
+	for obj, hdr := range map[string]map[string]string{"plain2": nil, "s3b": nil,
+		"c": testSSECHeaders(map[string]string{}, 3, false)} {
+		w = testS3OK(t, s, "GET", "/bk/"+obj, hdr, nil)
+		if !bytes.Equal(w.Body.Bytes(), data) {
+			t.Fatal("get after the source is deleted", obj, w.Body.Len())
+		}
+	}
+}
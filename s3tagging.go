@@ -0,0 +1,252 @@
+package test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"test/util"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// Object and bucket tagging.
+//
+// The object tags are stored in the ObjectMD. The tag change rewrites the
+// ObjectMD by updateObjectMD, the data blocks and their refs are not changed.
+
+type xmlTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	TagSet  []xmlTag `xml:"TagSet>Tag"`
+}
+
+// checkTags checks the number of tags, the key and value length, and the
+// duplicate keys.
+func checkTags(tags []*Tag, maxTags int) (status int, errmsg string) {
+	if len(tags) > maxTags {
+		return InvalidTag, "InvalidTag"
+	}
+	keys := make(map[string]bool)
+	for _, t := range tags {
+		if t.Key == "" || len(t.Key) > MaxTagKeyLength || len(t.Value) > MaxTagValueLength || keys[t.Key] {
+			return InvalidTag, "InvalidTag"
+		}
+		keys[t.Key] = true
+	}
+	return StatusOK, StatusOKStr
+}
+
+// parseTaggingHeader parses the x-amz-tagging header, the url encoded
+// "key1=value1&key2=value2". nil is returned if the header is not set.
+func parseTaggingHeader(hdr http.Header) (tags []*Tag, status int, errmsg string) {
+	val := hdr.Get(Tagging)
+	if val == "" {
+		return nil, StatusOK, StatusOKStr
+	}
+
+	q, err := url.ParseQuery(val)
+	if err != nil {
+		return nil, InvalidArgument, "invalid x-amz-tagging"
+	}
+
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if len(q[k]) != 1 {
+			return nil, InvalidTag, "InvalidTag"
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		tags = append(tags, &Tag{Key: k, Value: q[k][0]})
+	}
+
+	status, errmsg = checkTags(tags, MaxObjectTags)
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+	return tags, StatusOK, StatusOKStr
+}
+
+// readTagging reads and checks the Tagging of the request body
+func readTagging(ctx context.Context, r *http.Request, maxTags int) (tags []*Tag, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read tagging", requuid, r.URL, err)
+		return nil, InternalError, "failed to read request body"
+	}
+
+	req := &tagging{}
+	err = xml.Unmarshal(b, req)
+	if err != nil {
+		glog.Errorln("invalid tagging", requuid, r.URL, err)
+		return nil, MalformedXML, "MalformedXML"
+	}
+
+	for _, t := range req.TagSet {
+		tags = append(tags, &Tag{Key: t.Key, Value: t.Value})
+	}
+
+	status, errmsg = checkTags(tags, maxTags)
+	if status != StatusOK {
+		glog.Errorln("invalid tags", requuid, r.URL, len(tags))
+		return nil, status, errmsg
+	}
+	return tags, StatusOK, StatusOKStr
+}
+
+func writeTaggingResponse(ctx context.Context, w http.ResponseWriter, tags []*Tag) {
+	res := &tagging{Xmlns: XMLNS, TagSet: []xmlTag{}}
+	for _, t := range tags {
+		res.TagSet = append(res.TagSet, xmlTag{Key: t.Key, Value: t.Value})
+	}
+	writeXMLResponse(ctx, w, res)
+}
+
+// setObjectTags replaces the tags of the object, or the object version if
+// versionId is in the request.
+func (s *S3Server) setObjectTags(ctx context.Context, r *http.Request, bmd *BucketMD, bkname string,
+	objname string, tags []*Tag) (md *ObjectMD, status int, errmsg string) {
+	md, status, errmsg = s.updateObjectMD(ctx, r, bmd, bkname, objname, func(md *ObjectMD) (int, string) {
+		md.Tags = tags
+		return StatusOK, StatusOKStr
+	})
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+	glog.V(1).Infoln("set object tags", util.GetReqIDFromContext(ctx), bkname, objname, md.Uuid, len(tags))
+	return md, StatusOK, StatusOKStr
+}
+
+// putObjectTagging handles PUT /bucket/key?tagging
+func (s *S3Server) putObjectTagging(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	tags, status, errmsg := readTagging(ctx, r, MaxObjectTags)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg := s.setObjectTags(ctx, r, bmd, bkname, objname, tags)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	setVersionHeader(w, bmd, md)
+	w.WriteHeader(StatusOK)
+}
+
+// getObjectTagging handles GET /bucket/key?tagging
+func (s *S3Server) getObjectTagging(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	md, status, errmsg := s.getObjectMD(ctx, r, bkname, objname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	setHeaderIfNotEmpty(w, VersionID, md.VersionId)
+	writeTaggingResponse(ctx, w, md.Tags)
+}
+
+// deleteObjectTagging handles DELETE /bucket/key?tagging
+func (s *S3Server) deleteObjectTagging(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	bkname string, objname string) {
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	md, status, errmsg := s.setObjectTags(ctx, r, bmd, bkname, objname, nil)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	setVersionHeader(w, bmd, md)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setBucketTags replaces the tags of the bucket
+func (s *S3Server) setBucketTags(ctx context.Context, bkname string, tags []*Tag) (status int, errmsg string) {
+	status, errmsg = s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("set bucket tags failed to head bucket", util.GetReqIDFromContext(ctx), bkname, status, errmsg)
+		return status, errmsg
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		return status, errmsg
+	}
+
+	bmd = proto.Clone(bmd).(*BucketMD)
+	bmd.Tags = tags
+	return s.bmds.Put(ctx, bkname, bmd)
+}
+
+// putBucketTagging handles PUT /bucket?tagging
+func (s *S3Server) putBucketTagging(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	tags, status, errmsg := readTagging(ctx, r, MaxBucketTags)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	status, errmsg = s.setBucketTags(ctx, bkname, tags)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getBucketTagging handles GET /bucket?tagging
+func (s *S3Server) getBucketTagging(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	if len(bmd.Tags) == 0 {
+		writeError(w, r, NoSuchTagSet, "NoSuchTagSet")
+		return
+	}
+	writeTaggingResponse(ctx, w, bmd.Tags)
+}
+
+// deleteBucketTagging handles DELETE /bucket?tagging
+func (s *S3Server) deleteBucketTagging(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	status, errmsg := s.setBucketTags(ctx, bkname, nil)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseTaggingHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		val    string
+		status int
+		// the sorted "key=value" tags
+		tags []string
+	}{
+		{"not set", "", StatusOK, nil},
+		{"one tag", "k1=v1", StatusOK, []string{"k1=v1"}},
+		{"sorted", "k2=v2&k1=v1&k3=", StatusOK, []string{"k1=v1", "k2=v2", "k3="}},
+		{"escaped", "a%20b=c%26d&e+f=g%3Dh", StatusOK, []string{"a b=c&d", "e f=g=h"}},
+		{"invalid escape", "k1=%zz", InvalidArgument, nil},
+		{"duplicate key", "k1=v1&k1=v2", InvalidTag, nil},
+		{"empty key", "=v1", InvalidTag, nil},
+		{"key too long", strings.Repeat("k", MaxTagKeyLength+1) + "=v", InvalidTag, nil},
+		{"value too long", "k=" + strings.Repeat("v", MaxTagValueLength+1), InvalidTag, nil},
+		{"max tags", "a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9&j=10", StatusOK,
+			[]string{"a=1", "b=2", "c=3", "d=4", "e=5", "f=6", "g=7", "h=8", "i=9", "j=10"}},
+		{"too many tags", "a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9&j=10&k=11", InvalidTag, nil},
+	}
+
+	for _, tt := range tests {
+		hdr := make(http.Header)
+		if tt.val != "" {
+			hdr.Set(Tagging, tt.val)
+		}
+		tags, status, errmsg := parseTaggingHeader(hdr)
+		if status != tt.status {
+			t.Errorf("%s: status %d %s, want %d", tt.name, status, errmsg, tt.status)
+			continue
+		}
+		var kvs []string
+		for _, tag := range tags {
+			kvs = append(kvs, tag.Key+"="+tag.Value)
+		}
+		if strings.Join(kvs, ",") != strings.Join(tt.tags, ",") {
+			t.Errorf("%s: tags %v, want %v", tt.name, kvs, tt.tags)
+		}
+	}
+}
+
+func TestReadTagging(t *testing.T) {
+	tagSet := func(n int) string {
+		var b bytes.Buffer
+		b.WriteString("<Tagging><TagSet>")
+		for i := 0; i < n; i++ {
+			b.WriteString("<Tag><Key>k" + strings.Repeat("x", i) + "</Key><Value>v</Value></Tag>")
+		}
+		b.WriteString("</TagSet></Tagging>")
+		return b.String()
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		maxTags int
+		status  int
+		tags    int
+	}{
+		{"empty tag set", "<Tagging><TagSet></TagSet></Tagging>", MaxObjectTags, StatusOK, 0},
+		{"one tag", `<Tagging xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><TagSet>
+			<Tag><Key>k1</Key><Value>v1</Value></Tag></TagSet></Tagging>`, MaxObjectTags, StatusOK, 1},
+		{"empty value", "<Tagging><TagSet><Tag><Key>k1</Key><Value></Value></Tag></TagSet></Tagging>",
+			MaxObjectTags, StatusOK, 1},
+		{"max object tags", tagSet(MaxObjectTags), MaxObjectTags, StatusOK, MaxObjectTags},
+		{"too many object tags", tagSet(MaxObjectTags + 1), MaxObjectTags, InvalidTag, 0},
+		{"bucket tags", tagSet(MaxObjectTags + 1), MaxBucketTags, StatusOK, MaxObjectTags + 1},
+		{"duplicate key", `<Tagging><TagSet><Tag><Key>k1</Key><Value>v1</Value></Tag>
+			<Tag><Key>k1</Key><Value>v2</Value></Tag></TagSet></Tagging>`, MaxObjectTags, InvalidTag, 0},
+		{"empty key", "<Tagging><TagSet><Tag><Value>v1</Value></Tag></TagSet></Tagging>",
+			MaxObjectTags, InvalidTag, 0},
+		{"malformed", "<Tagging><TagSet>", MaxObjectTags, MalformedXML, 0},
+		{"other root", "<Tags></Tags>", MaxObjectTags, MalformedXML, 0},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/bk/obj?tagging", strings.NewReader(tt.body))
+		tags, status, errmsg := readTagging(context.Background(), r, tt.maxTags)
+		if status != tt.status {
+			t.Errorf("%s: status %d %s, want %d", tt.name, status, errmsg, tt.status)
+			continue
+		}
+		if len(tags) != tt.tags {
+			t.Errorf("%s: tags %d, want %d", tt.name, len(tags), tt.tags)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"test/util"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// Bucket versioning.
+//
+// The current version of the object is the ObjectMD, so get, head and list
+// without version id are not changed. When versioning is enabled, every put
+// writes the ObjectMD as the object version as well, the version id is the
+// uuid of the put. The null version, the object put before versioning is
+// enabled or when versioning is suspended, has the empty version id.
+//
+// The delete without version id creates the delete marker version, and
+// removes the current ObjectMD. The delete with version id logs the version
+// to the delete journal. If the version is the current version or the delete
+// marker, the newest remaining version becomes the current ObjectMD.
+//
+// The data blocks are deduplicated and referenced by the ObjectMD uuid, so
+// the versions of the same data only cost the metadata.
+
+type versioningConfiguration struct {
+	XMLName   xml.Name `xml:"VersioningConfiguration"`
+	Xmlns     string   `xml:"xmlns,attr,omitempty"`
+	Status    string   `xml:"Status,omitempty"`
+	MfaDelete string   `xml:"MfaDelete,omitempty"`
+}
+
+// one Version or DeleteMarker of ListVersionsResult, XMLName is set to keep
+// the versions and delete markers in the list order
+type listVersion struct {
+	XMLName      xml.Name
+	Key          string     `xml:"Key"`
+	VersionID    string     `xml:"VersionId"`
+	IsLatest     bool       `xml:"IsLatest"`
+	LastModified string     `xml:"LastModified"`
+	ETag         string     `xml:"ETag,omitempty"`
+	Size         *int64     `xml:"Size,omitempty"`
+	Owner        *listOwner `xml:"Owner"`
+	StorageClass string     `xml:"StorageClass,omitempty"`
+}
+
+type listVersionsResult struct {
+	XMLName             xml.Name           `xml:"ListVersionsResult"`
+	Xmlns               string             `xml:"xmlns,attr"`
+	Name                string             `xml:"Name"`
+	Prefix              string             `xml:"Prefix"`
+	KeyMarker           string             `xml:"KeyMarker"`
+	VersionIDMarker     string             `xml:"VersionIdMarker"`
+	NextKeyMarker       string             `xml:"NextKeyMarker,omitempty"`
+	NextVersionIDMarker string             `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int                `xml:"MaxKeys"`
+	Delimiter           string             `xml:"Delimiter,omitempty"`
+	EncodingType        string             `xml:"EncodingType,omitempty"`
+	IsTruncated         bool               `xml:"IsTruncated"`
+	Versions            []listVersion      `xml:"Version"`
+	CommonPrefixes      []listCommonPrefix `xml:"CommonPrefixes"`
+}
+
+// putBucketVersioning handles PUT /bucket?versioning
+func (s *S3Server) putBucketVersioning(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("put bucket versioning failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorln("failed to read versioning configuration", requuid, bkname, err)
+		writeError(w, r, InternalError, "failed to read request body")
+		return
+	}
+
+	conf := &versioningConfiguration{}
+	err = xml.Unmarshal(b, conf)
+	if err != nil {
+		glog.Errorln("invalid versioning configuration", requuid, bkname, err)
+		writeError(w, r, MalformedXML, "MalformedXML")
+		return
+	}
+	if conf.Status != VersioningEnabled && conf.Status != VersioningSuspended {
+		glog.Errorln("invalid versioning status", requuid, bkname, conf.Status)
+		writeError(w, r, IllegalVersioningConfiguration, "IllegalVersioningConfigurationException")
+		return
+	}
+	if conf.MfaDelete == VersioningEnabled {
+		glog.Errorln("mfa delete is not supported", requuid, bkname)
+		writeError(w, r, NotImplemented, NotImplementedStr)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	if bmd.ObjectLockEnabled && conf.Status != VersioningEnabled {
+		glog.Errorln("could not suspend versioning of the object lock bucket", requuid, bkname)
+		writeError(w, r, InvalidBucketState, "InvalidBucketState: An Object Lock configuration is present "+
+			"on this bucket, so the versioning state cannot be changed.")
+		return
+	}
+
+	bmd = proto.Clone(bmd).(*BucketMD)
+	bmd.Versioning = conf.Status
+	status, errmsg = s.bmds.Put(ctx, bkname, bmd)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	glog.Infoln("put bucket versioning success", requuid, bkname, conf.Status)
+	w.WriteHeader(StatusOK)
+}
+
+// getBucketVersioning handles GET /bucket?versioning. Status is not returned
+// if versioning was never enabled.
+func (s *S3Server) getBucketVersioning(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	status, errmsg := s.s3io.HeadBucket(bkname)
+	if status != StatusOK {
+		glog.Errorln("get bucket versioning failed to head bucket", requuid, bkname, status, errmsg)
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	bmd, status, errmsg := s.bmds.Get(ctx, bkname)
+	if status != StatusOK {
+		writeError(w, r, status, errmsg)
+		return
+	}
+
+	writeXMLResponse(ctx, w, &versioningConfiguration{Xmlns: XMLNS, Status: bmd.Versioning})
+}
+
+// getObjectVersion returns the ObjectMD of the object version, which could be
+// the delete marker. The object put before versioning does not have the
+// version object, it is the null version of the current ObjectMD.
+func (s *S3Server) getObjectVersion(ctx context.Context, bkname string, objname string,
+	versionID string) (md *ObjectMD, status int, errmsg string) {
+	md, status, errmsg = readObjectVersion(ctx, s.s3io, bkname, objname, versionID)
+	if status == NoSuchKey {
+		md, status, errmsg = readObjectMD(ctx, s.s3io, bkname, objname)
+		if status == StatusOK && objectVersionID(md) != versionID {
+			status, errmsg = NoSuchKey, "NoSuchKey"
+		}
+	}
+	if status == NoSuchKey || (status == StatusOK && s.journal.IsDeleted(md)) {
+		glog.V(2).Infoln("object version not exist", util.GetReqIDFromContext(ctx), bkname, objname, versionID)
+		return nil, NoSuchVersion, "NoSuchVersion"
+	}
+	return md, status, errmsg
+}
+
+// getObjectVersions returns all versions of the object, the newest first
+func (s *S3Server) getObjectVersions(ctx context.Context, bkname string,
+	objname string) (mds []*ObjectMD, status int, errmsg string) {
+	versionIDs, status, errmsg := s.s3io.ListObjectVersionIDs(bkname, objname)
+	if status != StatusOK {
+		glog.Errorln("failed to list object versions", util.GetReqIDFromContext(ctx), bkname, objname, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	uuids := make(map[string]bool)
+	for _, versionID := range versionIDs {
+		md, status, errmsg := readObjectVersion(ctx, s.s3io, bkname, objname, versionID)
+		if status == NoSuchKey {
+			// deleted after list
+			continue
+		}
+		if status != StatusOK {
+			return nil, status, errmsg
+		}
+		uuids[md.Uuid] = true
+		mds = append(mds, md)
+	}
+
+	// the current null version may not have the version object
+	cur, status, errmsg := readObjectMD(ctx, s.s3io, bkname, objname)
+	if status == StatusOK {
+		if !uuids[cur.Uuid] {
+			mds = append(mds, cur)
+		}
+	} else if status != NoSuchKey {
+		return nil, status, errmsg
+	}
+
+	// skip the deleted versions
+	versions := mds[:0]
+	for _, md := range mds {
+		if !s.journal.IsDeleted(md) {
+			versions = append(versions, md)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versionOrder(versions[i]) > versionOrder(versions[j])
+	})
+	return versions, StatusOK, StatusOKStr
+}
+
+// createDeleteMarker handles the object delete without version id in the
+// versioned bucket. If curUuid is not empty, the marker is created only if the
+// current object is still curUuid, otherwise PreconditionFailed is returned.
+// The marker is created under the commit lock of the object, so the current
+// object read here is not overwritten by the concurrent put.
+func (s *S3Server) createDeleteMarker(ctx context.Context, bmd *BucketMD, bkname string,
+	objname string, curUuid string) (marker *ObjectMD, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	lock := commitLock(bkname, objname)
+	lock.Lock()
+	defer lock.Unlock()
+
+	cur, status, errmsg := readObjectMD(ctx, s.s3io, bkname, objname)
+	if status == NoSuchKey || (status == StatusOK && s.journal.IsDeleted(cur)) {
+		cur = nil
+	} else if status != StatusOK {
+		return nil, status, errmsg
+	}
+	if curUuid != "" && (cur == nil || cur.Uuid != curUuid) {
+		glog.V(1).Infoln("current object is changed, not create delete marker", requuid, bkname, objname, curUuid)
+		return nil, PreconditionFailed, "PreconditionFailed"
+	}
+
+	marker = newObjectMD(requuid, bkname, objname)
+	marker.DeleteMarker = true
+	marker.VersionTime = time.Now().UnixNano()
+
+	// the replaced null version
+	var replaced *ObjectMD
+	if bmd.Versioning == VersioningEnabled {
+		marker.VersionId = marker.Uuid
+
+		// keep the current null version, which is not written as version yet
+		if cur != nil && cur.VersionId == "" {
+			status, errmsg = writeObjectVersion(ctx, s.s3io, cur)
+			if status != StatusOK {
+				return nil, status, errmsg
+			}
+		}
+	} else {
+		replaced, status, errmsg = getNullVersion(ctx, s.s3io, s.journal, bkname, objname, cur)
+		if status != StatusOK {
+			return nil, status, errmsg
+		}
+		if replaced != nil {
+			status, errmsg = checkObjectLock(replaced, time.Now(), false)
+			if status != StatusOK {
+				glog.Errorln("could not replace the locked null version", requuid, bkname, objname, replaced.Uuid, errmsg)
+				return nil, status, errmsg
+			}
+		}
+	}
+
+	status, errmsg = writeObjectVersion(ctx, s.s3io, marker)
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+
+	if replaced != nil {
+		// the current null version is removed by the journal as well
+		entry := &DeleteEntry{Bucket: bkname, Name: objname, Md: replaced, Version: true}
+		status, errmsg = s.journal.Log(ctx, []*DeleteEntry{entry})
+		if status != StatusOK {
+			glog.Errorln("failed to log the replaced null version", requuid, bkname, objname, replaced.Uuid, status, errmsg)
+			return nil, status, errmsg
+		}
+	}
+
+	if cur != nil && cur != replaced {
+		// the current version is kept as the version object, only remove the
+		// ObjectMD.
+		status, errmsg = s.s3io.DeleteObjectMD(bkname, objname)
+		if status != StatusOK && status != NoSuchKey {
+			glog.Errorln("failed to remove the current ObjectMD", requuid, bkname, objname, cur.Uuid, status, errmsg)
+			return nil, status, errmsg
+		}
+	}
+
+	glog.V(0).Infoln("created delete marker", requuid, bkname, objname, objectVersionID(marker))
+	return marker, StatusOK, StatusOKStr
+}
+
+// deleteObjectVersion deletes the object version. md is nil if the version
+// does not exist. The locked version is not deleted, bypassGovernance allows
+// deleting the version under the GOVERNANCE retention.
+func (s *S3Server) deleteObjectVersion(ctx context.Context, bkname string, objname string,
+	versionID string, bypassGovernance bool) (md *ObjectMD, status int, errmsg string) {
+	requuid := util.GetReqIDFromContext(ctx)
+
+	// the lock check and the promote are serialized with the puts and the
+	// metadata updates of the object
+	lock := commitLock(bkname, objname)
+	lock.Lock()
+	defer lock.Unlock()
+
+	md, status, errmsg = s.getObjectVersion(ctx, bkname, objname, versionID)
+	if status == NoSuchVersion {
+		return nil, StatusOK, StatusOKStr
+	}
+	if status != StatusOK {
+		return nil, status, errmsg
+	}
+
+	status, errmsg = checkObjectLock(md, time.Now(), bypassGovernance)
+	if status != StatusOK {
+		glog.Errorln("object version is locked", requuid, bkname, objname, versionID, md.LockMode,
+			md.LockRetainUntil, md.LegalHold)
+		return nil, status, errmsg
+	}
+
+	cur, status, errmsg := readObjectMD(ctx, s.s3io, bkname, objname)
+	if status != StatusOK && status != NoSuchKey {
+		return nil, status, errmsg
+	}
+	// the delete marker may be the latest version, which hides the current
+	// ObjectMD, the newest remaining version may become current.
+	promote := md.DeleteMarker || (cur != nil && cur.Uuid == md.Uuid)
+
+	// the journal removes the version object, and the current ObjectMD if
+	// it is still the same version.
+	entry := &DeleteEntry{Bucket: bkname, Name: objname, Md: md, Version: true, BypassGovernance: bypassGovernance}
+	status, errmsg = s.journal.Log(ctx, []*DeleteEntry{entry})
+	if status != StatusOK {
+		glog.Errorln("failed to log delete version", requuid, bkname, objname, versionID, status, errmsg)
+		return nil, status, errmsg
+	}
+
+	if promote {
+		// the newest remaining version becomes current, unless it is the delete
+		// marker.
+		versions, status, errmsg := s.getObjectVersions(ctx, bkname, objname)
+		if status != StatusOK {
+			glog.Errorln("failed to list the versions to promote", requuid, bkname, objname, status, errmsg)
+			return nil, status, errmsg
+		}
+		if len(versions) != 0 && !versions[0].DeleteMarker && (cur == nil || cur.Uuid != versions[0].Uuid) {
+			status, errmsg = writeObjectMD(ctx, s.s3io, versions[0])
+			if status != StatusOK {
+				glog.Errorln("failed to promote the version", requuid, bkname, objname,
+					objectVersionID(versions[0]), status, errmsg)
+				return nil, status, errmsg
+			}
+			glog.V(1).Infoln("promoted version", requuid, bkname, objname, objectVersionID(versions[0]))
+		}
+	}
+
+	glog.V(0).Infoln("delete object version success", requuid, bkname, objname, versionID, md.DeleteMarker)
+	return md, StatusOK, StatusOKStr
+}
+
+// listObjectVersions handles ListObjectVersions, GET /bucket?versions.
+//
+// The objects with versions are the union of the current objects, which may
+// be put before versioning, and the objects that have version objects. The
+// versions of one object are returned newest first. If the result is
+// truncated in the middle of the versions of one object, the next list
+// continues after the version id marker of the key marker.
+func (s *S3Server) listObjectVersions(ctx context.Context, w http.ResponseWriter, r *http.Request, bkname string) {
+	requuid := util.GetReqIDFromContext(ctx)
+	q := r.URL.Query()
+
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	keyMarker := q.Get("key-marker")
+	versionIDMarker := q.Get("version-id-marker")
+	encodingType := q.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		glog.Errorln("invalid encoding-type", requuid, bkname, encodingType)
+		writeError(w, r, InvalidArgument, "invalid encoding-type")
+		return
+	}
+	if versionIDMarker != "" && keyMarker == "" {
+		glog.Errorln("version-id-marker without key-marker", requuid, bkname, versionIDMarker)
+		writeError(w, r, InvalidArgument, "version-id-marker without key-marker")
+		return
+	}
+
+	maxKeys := BucketListMaxKeys
+	if str := q.Get("max-keys"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			glog.Errorln("invalid max-keys", requuid, bkname, str)
+			writeError(w, r, InvalidArgument, "invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	encode := func(str string) string {
+		if encodingType == "url" {
+			return url.QueryEscape(str)
+		}
+		return str
+	}
+
+	res := &listVersionsResult{Xmlns: XMLNS, Name: bkname, Prefix: encode(prefix),
+		KeyMarker: encode(keyMarker), VersionIDMarker: versionIDMarker, MaxKeys: maxKeys,
+		Delimiter: encode(delimiter), EncodingType: encodingType}
+
+	// the names in CloudIO have the leading "/"
+	scanPrefix := "/" + prefix
+	scanMarker := "/" + keyMarker
+	count := 0
+
+	// addVersions adds the versions of the object, returns false if max keys is reached
+	addVersions := func(objname string, afterVersionID string) (ok bool, status int, errmsg string) {
+		versions, status, errmsg := s.getObjectVersions(ctx, bkname, objname)
+		if status != StatusOK {
+			return false, status, errmsg
+		}
+
+		key := objectKey(objname)
+		for i, md := range versions {
+			if afterVersionID != "" {
+				if objectVersionID(md) == afterVersionID {
+					afterVersionID = ""
+				}
+				continue
+			}
+
+			if count == maxKeys {
+				res.IsTruncated = true
+				return false, StatusOK, StatusOKStr
+			}
+
+			v := listVersion{Key: encode(key), VersionID: objectVersionID(md), IsLatest: i == 0,
+				LastModified: time.Unix(md.Smd.Mtime, 0).UTC().Format(time.RFC3339)}
+			v.Owner = &listOwner{ID: DefaultOwnerID, DisplayName: DefaultOwnerDisplayName}
+			if md.DeleteMarker {
+				v.XMLName.Local = "DeleteMarker"
+			} else {
+				size := md.Smd.Size
+				v.XMLName.Local = "Version"
+				v.ETag = md.Smd.Etag
+				v.Size = &size
+				v.StorageClass = "STANDARD"
+			}
+			res.Versions = append(res.Versions, v)
+			res.NextKeyMarker = encode(key)
+			res.NextVersionIDMarker = v.VersionID
+			count++
+		}
+		return true, StatusOK, StatusOKStr
+	}
+
+	// continue the versions of the key marker
+	if keyMarker != "" && versionIDMarker != "" {
+		_, status, errmsg := addVersions(scanMarker, versionIDMarker)
+		if status != StatusOK {
+			glog.Errorln("failed to list the versions of key marker", requuid, bkname, keyMarker, status, errmsg)
+			writeError(w, r, status, errmsg)
+			return
+		}
+	}
+
+	for !res.IsTruncated {
+		objnames, isTruncated, status, errmsg := s.listVersionedObjects(bkname, scanPrefix, scanMarker, maxKeys-count+1)
+		if status != StatusOK {
+			glog.Errorln("failed to list versioned objects", requuid, bkname, prefix, scanMarker, status, errmsg)
+			writeError(w, r, status, errmsg)
+			return
+		}
+
+		jumped := false
+		for _, objname := range objnames {
+			key := objectKey(objname)
+			scanMarker = objname
+
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					commonPrefix := key[:len(prefix)+i+len(delimiter)]
+					if commonPrefix > keyMarker {
+						if count == maxKeys {
+							res.IsTruncated = true
+							break
+						}
+						res.CommonPrefixes = append(res.CommonPrefixes,
+							listCommonPrefix{Prefix: encode(commonPrefix)})
+						res.NextKeyMarker = encode(commonPrefix)
+						res.NextVersionIDMarker = ""
+						count++
+					}
+
+					// jump over all keys of the common prefix
+					scanMarker = "/" + commonPrefix + string(utf8.MaxRune)
+					jumped = true
+					break
+				}
+			}
+
+			ok, status, errmsg := addVersions(objname, "")
+			if status != StatusOK {
+				glog.Errorln("failed to list object versions", requuid, bkname, objname, status, errmsg)
+				writeError(w, r, status, errmsg)
+				return
+			}
+			if !ok {
+				break
+			}
+		}
+
+		if !jumped && !isTruncated {
+			break
+		}
+	}
+
+	if !res.IsTruncated {
+		res.NextKeyMarker = ""
+		res.NextVersionIDMarker = ""
+	}
+
+	glog.V(1).Infoln("list object versions success", requuid, bkname, prefix, delimiter, keyMarker,
+		versionIDMarker, "versions", len(res.Versions), "common prefixes", len(res.CommonPrefixes), res.IsTruncated)
+
+	writeXMLResponse(ctx, w, res)
+}
+
+// listVersionedObjects lists the names of the current objects and the objects
+// with versions after marker. isTruncated tells whether there are more names.
+func (s *S3Server) listVersionedObjects(bkname string, prefix string, marker string,
+	maxKeys int) (objnames []string, isTruncated bool, status int, errmsg string) {
+	smds, truncated1, status, errmsg := s.s3io.ListObjects(bkname, prefix, marker, maxKeys)
+	if status != StatusOK {
+		return nil, false, status, errmsg
+	}
+
+	names, truncated2, status, errmsg := s.s3io.ListVersionedObjects(bkname, prefix, marker, maxKeys)
+	if status != StatusOK {
+		return nil, false, status, errmsg
+	}
+
+	// the merged names are complete up to the last name of the truncated list
+	bound := ""
+	if truncated1 && len(smds) != 0 {
+		bound = smds[len(smds)-1].Name
+	}
+	if truncated2 && len(names) != 0 && (bound == "" || names[len(names)-1] < bound) {
+		bound = names[len(names)-1]
+	}
+
+	for _, smd := range smds {
+		names = append(names, smd.Name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		if bound != "" && name > bound {
+			break
+		}
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		objnames = append(objnames, name)
+	}
+	return objnames, truncated1 || truncated2, StatusOK, StatusOKStr
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+// testListVersions lists the object versions, and returns the version ids in
+// the listed order. The delete marker is prefixed with "dm:", the latest
+// version is suffixed with "*".
+func testListVersions(t *testing.T, s *S3Server, bkname string, objname string) []string {
+	res := &struct {
+		Items []listVersion `xml:",any"`
+	}{}
+	testS3XML(t, s, "GET", "/"+bkname+"?versions&prefix="+objname, nil, res)
+
+	var ids []string
+	for _, v := range res.Items {
+		id := v.VersionID
+		switch v.XMLName.Local {
+		case "DeleteMarker":
+			id = "dm:" + id
+		case "Version":
+		default:
+			continue
+		}
+		if v.IsLatest {
+			id += "*"
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// testGetCurrent checks the data of the current object, "" if the object does
+// not exist.
+func testGetCurrent(t *testing.T, s *S3Server, target string, data string) {
+	w := testS3Request(s, "GET", target, nil, nil)
+	if data == "" {
+		if code := testS3ErrorCode(w); code != "NoSuchKey" {
+			t.Fatal("get the deleted object", target, w.Code, code)
+		}
+		return
+	}
+	if w.Code != 200 || w.Body.String() != data {
+		t.Fatal("get", target, w.Code, w.Body.String(), "want", data)
+	}
+}
+
+func TestObjectVersioning(t *testing.T) {
+	s := newTestS3Server(t)
+	testS3OK(t, s, "PUT", "/bk", nil, nil)
+
+	// the object put before versioning is the null version
+	testS3OK(t, s, "PUT", "/bk/k", nil, []byte("v0"))
+	conf, _ := xml.Marshal(&versioningConfiguration{Status: VersioningEnabled})
+	testS3OK(t, s, "PUT", "/bk?versioning", nil, conf)
+
+	id1 := testS3OK(t, s, "PUT", "/bk/k", nil, []byte("v1")).Header().Get(VersionID)
+	id2 := testS3OK(t, s, "PUT", "/bk/k", nil, []byte("v2")).Header().Get(VersionID)
+	if id1 == "" || id2 == "" || id1 == id2 {
+		t.Fatal("version ids", id1, id2)
+	}
+	if ids := testListVersions(t, s, "bk", "k"); !reflect.DeepEqual(ids, []string{id2 + "*", id1, NullVersionID}) {
+		t.Fatal("versions", ids)
+	}
+
+	// the delete marker hides the object, the versions are kept
+	w := testS3OK(t, s, "DELETE", "/bk/k", nil, nil)
+	dm := w.Header().Get(VersionID)
+	if w.Header().Get(DeleteMarker) != "true" || dm == "" {
+		t.Fatal("delete marker", w.Header())
+	}
+	s.journal.ApplyBucket("bk")
+	testGetCurrent(t, s, "/bk/k", "")
+	testGetCurrent(t, s, "/bk/k?versionId="+id1, "v1")
+	testGetCurrent(t, s, "/bk/k?versionId="+NullVersionID, "v0")
+	w = testS3Request(s, "GET", "/bk/k?versionId="+dm, nil, nil)
+	if code := testS3ErrorCode(w); code != "MethodNotAllowed" || w.Header().Get(DeleteMarker) != "true" {
+		t.Fatal("get the delete marker", code, w.Header())
+	}
+	if ids := testListVersions(t, s, "bk", "k"); !reflect.DeepEqual(ids, []string{"dm:" + dm + "*", id2, id1, NullVersionID}) {
+		t.Fatal("versions after delete", ids)
+	}
+	if names, _ := testListAll(t, s, "bk", "", true); len(names) != 0 {
+		t.Fatal("the deleted object is listed", names)
+	}
+
+	// removing the delete marker promotes the newest version
+	w = testS3OK(t, s, "DELETE", "/bk/k?versionId="+dm, nil, nil)
+	if w.Header().Get(DeleteMarker) != "true" {
+		t.Fatal("delete the delete marker", w.Header())
+	}
+	testGetCurrent(t, s, "/bk/k", "v2")
+	s.journal.ApplyBucket("bk")
+	testGetCurrent(t, s, "/bk/k", "v2")
+
+	// deleting the noncurrent version does not change the current object
+	testS3OK(t, s, "DELETE", "/bk/k?versionId="+NullVersionID, nil, nil)
+	s.journal.ApplyBucket("bk")
+	testGetCurrent(t, s, "/bk/k", "v2")
+	if code := testS3ErrorCode(testS3Request(s, "GET", "/bk/k?versionId="+NullVersionID, nil, nil)); code != "NoSuchVersion" {
+		t.Fatal("get the deleted version", code)
+	}
+
+	// deleting the current version promotes the next version, before and
+	// after the delete is applied
+	testS3OK(t, s, "DELETE", "/bk/k?versionId="+id2, nil, nil)
+	testGetCurrent(t, s, "/bk/k", "v1")
+	s.journal.ApplyBucket("bk")
+	s.gc.Collect()
+	testBackdateBlocks(s.gc, true, true, int64(*gcGraceSecs))
+	s.gc.Collect()
+	testGetCurrent(t, s, "/bk/k", "v1")
+	if ids := testListVersions(t, s, "bk", "k"); !reflect.DeepEqual(ids, []string{id1 + "*"}) {
+		t.Fatal("versions after promote", ids)
+	}
+
+	// deleting the last version removes the object
+	testS3OK(t, s, "DELETE", "/bk/k?versionId="+id1, nil, nil)
+	testGetCurrent(t, s, "/bk/k", "")
+	s.journal.ApplyBucket("bk")
+	testGetCurrent(t, s, "/bk/k", "")
+	if ids := testListVersions(t, s, "bk", "k"); len(ids) != 0 {
+		t.Fatal("versions after the last version is deleted", ids)
+	}
+	testS3OK(t, s, "DELETE", "/bk", nil, nil)
+}
@@ -9,6 +9,20 @@ const (
 	// 30s timeout for every single read/write operation
 	RWTimeOutSecs = 30
 	ZeroDataETag  = "d41d8cd98f00b204e9800998ecf8427e"
+	// the interval of the background delete scanner
+	DeleteScanIntervalSecs = 60
+	// multipart upload limits
+	MinPartSize    = 5 * 1024 * 1024
+	MaxPartNumber  = 10000
+	MaxPartsList   = 1000
+	MaxUploadsList = 1000
+	// the max difference between the request time and the server time
+	MaxRequestTimeSkewSecs = 15 * 60
+	// the max expire seconds of the presigned url, 7 days
+	MaxPresignedExpiresSecs = 7 * 24 * 3600
+	// the max chunk size and the max line size of the aws-chunked body
+	MaxStreamingChunkSize = 16 * 1024 * 1024
+	MaxStreamingLineSize  = 4096
 )
 
 //const (
@@ -20,19 +34,39 @@ const (
 const (
 	XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
 
-	BucketListMaxKeys    = 1000
-	BucketListOp         = "/?list-type=2"
-	BucketAccelerate     = "/?accelerate"
-	BucketCors           = "/?cors"
-	BucketLifecycle      = "/?lifecycle"
-	BucketPolicy         = "/?policy"
-	BucketLogging        = "/?logging"
-	BucketNotification   = "/?notification"
-	BucketReplication    = "/?replication"
-	BucketTag            = "/?tagging"
-	BucketRequestPayment = "/?requestPayment"
-	BucketVersioning     = "/?versioning"
-	BucketWebsite        = "/?website"
+	BucketListMaxKeys = 1000
+	// the max objects of one multi-object delete
+	MaxDeleteObjects = 1000
+	// the default owner of the buckets and objects
+	DefaultOwnerID          = "cloudzzzz"
+	DefaultOwnerDisplayName = "cloudzzzz"
+
+	// the sub-resources, passed as the url query parameters, such as /b1?cors
+	BucketListOp         = "list-type"
+	BucketAccelerate     = "accelerate"
+	BucketCors           = "cors"
+	BucketDelete         = "delete"
+	BucketLifecycle      = "lifecycle"
+	BucketPolicy         = "policy"
+	BucketLogging        = "logging"
+	BucketNotification   = "notification"
+	BucketReplication    = "replication"
+	BucketTag            = "tagging"
+	BucketRequestPayment = "requestPayment"
+	BucketVersioning     = "versioning"
+	BucketVersions       = "versions"
+	BucketWebsite        = "website"
+	BucketUploads        = "uploads"
+	ObjectUploads        = "uploads"
+	ObjectUploadID       = "uploadId"
+	ObjectPartNumber     = "partNumber"
+	ObjectVersionID      = "versionId"
+	ObjectTagging        = "tagging"
+	BucketACL            = "acl"
+	ObjectACL            = "acl"
+	BucketObjectLock     = "object-lock"
+	ObjectRetention      = "retention"
+	ObjectLegalHold      = "legal-hold"
 
 	RequestID     = "x-request-id"
 	ServerName    = "CloudZzzz"
@@ -42,48 +76,209 @@ const (
 	ETag          = "ETag"
 	ContentLength = "Content-Length"
 	ContentType   = "Content-Type"
+	ContentRange  = "Content-Range"
+	ContentMD5    = "Content-MD5"
+	AcceptRanges  = "Accept-Ranges"
+	Range         = "Range"
+
+	ContentEncoding    = "Content-Encoding"
+	ContentLanguage    = "Content-Language"
+	ContentDisposition = "Content-Disposition"
+	CacheControl       = "Cache-Control"
+	Expires            = "Expires"
+	// S3 returns binary/octet-stream if the content type is not set at put
+	DefaultContentType = "binary/octet-stream"
+	// the query parameters to override the response headers of get object
+	ResponseContentType        = "response-content-type"
+	ResponseContentEncoding    = "response-content-encoding"
+	ResponseContentLanguage    = "response-content-language"
+	ResponseContentDisposition = "response-content-disposition"
+	ResponseCacheControl       = "response-cache-control"
+	ResponseExpires            = "response-expires"
+
+	// the aws-chunked streaming upload
+	AwsChunked           = "aws-chunked"
+	DecodedContentLength = "x-amz-decoded-content-length"
+	AmzTrailer           = "x-amz-trailer"
+
+	CopySource                  = "x-amz-copy-source"
+	CopySourceIfMatch           = "x-amz-copy-source-if-match"
+	CopySourceIfNoneMatch       = "x-amz-copy-source-if-none-match"
+	CopySourceIfModifiedSince   = "x-amz-copy-source-if-modified-since"
+	CopySourceIfUnmodifiedSince = "x-amz-copy-source-if-unmodified-since"
+	CopySourceVersionID         = "x-amz-copy-source-version-id"
+	MetadataDirective           = "x-amz-metadata-directive"
+	IfMatch                     = "If-Match"
+	IfNoneMatch                 = "If-None-Match"
+	IfModifiedSince             = "If-Modified-Since"
+	IfUnmodifiedSince           = "If-Unmodified-Since"
+	MetadataDirectiveCopy       = "COPY"
+	MetadataDirectiveReplace    = "REPLACE"
+
+	VersionID    = "x-amz-version-id"
+	DeleteMarker = "x-amz-delete-marker"
+
+	Origin                        = "Origin"
+	Vary                          = "Vary"
+	AccessControlRequestMethod    = "Access-Control-Request-Method"
+	AccessControlRequestHeaders   = "Access-Control-Request-Headers"
+	AccessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	AccessControlAllowMethods     = "Access-Control-Allow-Methods"
+	AccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	AccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	AccessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	AccessControlMaxAge           = "Access-Control-Max-Age"
+	// the max CORS rules of one bucket
+	MaxCorsRules = 100
+
+	Expiration = "x-amz-expiration"
+	// the lifecycle rule states
+	LifecycleEnabled  = "Enabled"
+	LifecycleDisabled = "Disabled"
+	// the max lifecycle rules of one bucket
+	MaxLifecycleRules = 1000
+	// the max size of the bucket policy
+	MaxBucketPolicySize = 20 * 1024
+
+	ACL              = "x-amz-acl"
+	GrantRead        = "x-amz-grant-read"
+	GrantWrite       = "x-amz-grant-write"
+	GrantReadACP     = "x-amz-grant-read-acp"
+	GrantWriteACP    = "x-amz-grant-write-acp"
+	GrantFullControl = "x-amz-grant-full-control"
+	// the canned acls
+	ACLPrivate                = "private"
+	ACLPublicRead             = "public-read"
+	ACLPublicReadWrite        = "public-read-write"
+	ACLAuthenticatedRead      = "authenticated-read"
+	ACLBucketOwnerRead        = "bucket-owner-read"
+	ACLBucketOwnerFullControl = "bucket-owner-full-control"
+	// the acl permissions
+	PermissionRead        = "READ"
+	PermissionWrite       = "WRITE"
+	PermissionReadACP     = "READ_ACP"
+	PermissionWriteACP    = "WRITE_ACP"
+	PermissionFullControl = "FULL_CONTROL"
+	// the grantee types and groups
+	GranteeCanonicalUser    = "CanonicalUser"
+	GranteeGroup            = "Group"
+	AllUsersGroup           = "http://acs.amazonaws.com/groups/global/AllUsers"
+	AuthenticatedUsersGroup = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+
+	Tagging                 = "x-amz-tagging"
+	TaggingCount            = "x-amz-tagging-count"
+	TaggingDirective        = "x-amz-tagging-directive"
+	TaggingDirectiveCopy    = "COPY"
+	TaggingDirectiveReplace = "REPLACE"
+	// the tag limits
+	MaxObjectTags     = 10
+	MaxBucketTags     = 50
+	MaxTagKeyLength   = 128
+	MaxTagValueLength = 256
+
+	// the bucket versioning states
+	VersioningEnabled   = "Enabled"
+	VersioningSuspended = "Suspended"
+	// the version id of the object put when versioning is not enabled
+	NullVersionID = "null"
+
+	// the server side encryption headers, SSE-S3 and SSE-C
+	SSE                            = "x-amz-server-side-encryption"
+	SSECustomerAlgorithm           = "x-amz-server-side-encryption-customer-algorithm"
+	SSECustomerKey                 = "x-amz-server-side-encryption-customer-key"
+	SSECustomerKeyMD5              = "x-amz-server-side-encryption-customer-key-MD5"
+	CopySourceSSECustomerAlgorithm = "x-amz-copy-source-server-side-encryption-customer-algorithm"
+	CopySourceSSECustomerKey       = "x-amz-copy-source-server-side-encryption-customer-key"
+	CopySourceSSECustomerKeyMD5    = "x-amz-copy-source-server-side-encryption-customer-key-MD5"
+	SSEAlgorithmAES256             = "AES256"
+	SSEAlgorithmKMSPrefix          = "aws:kms"
+
+	// the object lock headers
+	BucketObjectLockEnabled   = "x-amz-bucket-object-lock-enabled"
+	ObjectLockMode            = "x-amz-object-lock-mode"
+	ObjectLockRetainUntilDate = "x-amz-object-lock-retain-until-date"
+	ObjectLockLegalHold       = "x-amz-object-lock-legal-hold"
+	BypassGovernanceRetention = "x-amz-bypass-governance-retention"
+	// the object lock state, retention modes and legal hold status
+	ObjectLockEnabled  = "Enabled"
+	LockModeGovernance = "GOVERNANCE"
+	LockModeCompliance = "COMPLIANCE"
+	LegalHoldOn        = "ON"
+	LegalHoldOff       = "OFF"
+	// the max default retention, 100 years
+	MaxRetentionDays  = 36500
+	MaxRetentionYears = 100
+
+	// the prefix of the user metadata headers
+	UserMetadataPrefix = "x-amz-meta-"
+	// the max size of the user metadata keys and values
+	MaxUserMetadataSize = 2048
 )
 
-// S3 error code
+// S3 error code. Every error has its own code, the code is the http status
+// plus n*1000 for the errors that share the same http status, see httpStatus.
+// The first error of the http status, such as NoSuchKey for 404, is the
+// default error of the http status.
 const (
-	StatusOK                     = 200
-	StatusOKStr                  = "OK"
-	AccessDenied                 = 403
-	BadDigest                    = 400
-	BucketAlreadyExists          = 409
-	BucketNotEmpty               = 409
-	IncompleteBody               = 400
-	InternalError                = 500
-	InternalErrorStr             = "InternalError"
-	InvalidArgument              = 400
-	InvalidBucketName            = 400
-	InvalidDigest                = 400
-	InvalidLocationConstraint    = 400
-	InvalidPart                  = 400
-	InvalidPartOrder             = 400
-	InvalidRange                 = 416
-	InvalidRequest               = 400
-	InvalidURI                   = 400
-	KeyTooLong                   = 400
-	MalformedACLError            = 400
-	MalformedPOSTRequest         = 400
-	MalformedXML                 = 400
-	MaxMessageLengthExceeded     = 400
-	MetadataTooLarge             = 400
-	MethodNotAllowed             = 405
-	MissingContentLength         = 411
-	MissingRequestBodyError      = 400
-	NoSuchBucket                 = 404
-	NoSuchKey                    = 404
-	NoSuchLifecycleConfiguration = 404
-	NoSuchUpload                 = 404
-	NotImplemented               = 501
-	NotImplementedStr            = "NotImplemented"
-	OperationAborted             = 409
-	RequestTimeout               = 400
-	RequestTimeTooSkewed         = 403
-	SignatureDoesNotMatch        = 403
-	ServiceUnavailable           = 503
-	SlowDown                     = 503
-	TokenRefreshRequired         = 400
+	StatusOK                          = 200
+	StatusOKStr                       = "OK"
+	AccessDenied                      = 403
+	AccessForbidden                   = 1403
+	AuthorizationHeaderMalformed      = 1400
+	AuthorizationQueryParametersError = 2400
+	BadDigest                         = 3400
+	BucketAlreadyExists               = 1409
+	BucketAlreadyOwnedByYou           = 2409
+	BucketNotEmpty                    = 3409
+	EntityTooSmall                    = 4400
+	IncompleteBody                    = 5400
+	InternalError                     = 500
+	InternalErrorStr                  = "InternalError"
+	InvalidAccessKeyID                = 2403
+	IllegalVersioningConfiguration    = 6400
+	InvalidArgument                   = 400
+	InvalidBucketName                 = 7400
+	InvalidBucketState                = 4409
+	InvalidDigest                     = 8400
+	InvalidLocationConstraint         = 9400
+	InvalidPart                       = 10400
+	InvalidPartOrder                  = 11400
+	InvalidRange                      = 416
+	InvalidRequest                    = 12400
+	InvalidTag                        = 13400
+	InvalidURI                        = 14400
+	KeyTooLong                        = 15400
+	MalformedACLError                 = 16400
+	MalformedPolicy                   = 17400
+	MalformedPOSTRequest              = 18400
+	MalformedXML                      = 19400
+	MaxMessageLengthExceeded          = 20400
+	MetadataTooLarge                  = 21400
+	MethodNotAllowed                  = 405
+	MissingContentLength              = 411
+	MissingRequestBodyError           = 22400
+	MissingSecurityHeader             = 23400
+	NoSuchBucket                      = 1404
+	NoSuchBucketPolicy                = 2404
+	NoSuchCORSConfiguration           = 3404
+	NoSuchKey                         = 404
+	NoSuchLifecycleConfiguration      = 4404
+	NoSuchObjectLockConfiguration     = 5404
+	NoSuchTagSet                      = 6404
+	NoSuchUpload                      = 7404
+	NoSuchVersion                     = 8404
+	NotImplemented                    = 501
+	NotImplementedStr                 = "NotImplemented"
+	NotModified                       = 304
+	ObjectLockConfigurationNotFound   = 9404
+	OperationAborted                  = 409
+	PreconditionFailed                = 412
+	RequestTimeout                    = 24400
+	RequestTimeTooSkewed              = 3403
+	SignatureDoesNotMatch             = 4403
+	ServiceUnavailable                = 503
+	SlowDown                          = 1503
+	TokenRefreshRequired              = 25400
+	UnexpectedContent                 = 26400
+	XAmzContentSHA256Mismatch         = 27400
 )
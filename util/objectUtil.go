@@ -19,6 +19,12 @@ func GenPartName(uuid string, partNum int) string {
 	return uuid + DefaultSeparator + strconv.Itoa(partNum)
 }
 
+// GenBlockRef generates the reference to the data blocks
+// ref format: bucket/object.uuid, objname has the leading "/"
+func GenBlockRef(bkname string, objname string, uuid string) string {
+	return bkname + objname + DefaultSeparator + uuid
+}
+
 // GenRequestID generates a uuid as request id
 func GenRequestID() (id string, err error) {
 	// generate uuid as request id
@@ -0,0 +1,216 @@
+package util
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 definitions
+const (
+	SigV4Algorithm   = "AWS4-HMAC-SHA256"
+	SigV4Service     = "s3"
+	SigV4Terminator  = "aws4_request"
+	AmzDateFormat    = "20060102T150405Z"
+	ShortDateFormat  = "20060102"
+	UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// the payload hash prefix of the aws-chunked payloads, such as
+	// STREAMING-AWS4-HMAC-SHA256-PAYLOAD
+	StreamingPayloadPrefix = "STREAMING-"
+	// the aws-chunked payloads with the signed chunks, and the unsigned
+	// chunks with the trailing headers
+	StreamingPayload                = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingPayloadTrailer         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	StreamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	ChunkAlgorithm                  = "AWS4-HMAC-SHA256-PAYLOAD"
+	TrailerAlgorithm                = "AWS4-HMAC-SHA256-TRAILER"
+
+	AmzDate          = "X-Amz-Date"
+	AmzContentSha256 = "X-Amz-Content-Sha256"
+	Authorization    = "Authorization"
+)
+
+// SHA256Hex returns the hex encoded sha256 of the data
+func SHA256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// URIEncode encodes the string as SigV4 requires. Every byte except the
+// unreserved characters A-Z, a-z, 0-9, '-', '.', '_' and '~' is encoded.
+// '/' is kept if encodeSlash is false, which is used for the object key in path.
+func URIEncode(s string, encodeSlash bool) string {
+	const hexchars = "0123456789ABCDEF"
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexchars[c>>4])
+		b.WriteByte(hexchars[c&15])
+	}
+	return b.String()
+}
+
+// CanonicalQueryString returns the sorted and encoded query string, the skip
+// key, such as X-Amz-Signature of the presigned url, is excluded.
+func CanonicalQueryString(q url.Values, skip string) string {
+	var params []string
+	for k, vs := range q {
+		if k == skip {
+			continue
+		}
+		for _, v := range vs {
+			params = append(params, URIEncode(k, true)+"="+URIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// CanonicalHeaderValue returns the value of the header to sign. The host
+// header is not in http.Header of the incoming request, so it is passed in.
+func CanonicalHeaderValue(hdr http.Header, host string, name string) string {
+	if name == "host" {
+		return host
+	}
+	vals := hdr[http.CanonicalHeaderKey(name)]
+	trimmed := make([]string, len(vals))
+	for i, v := range vals {
+		trimmed[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// CanonicalRequest creates the SigV4 canonical request. path is the decoded
+// url path, signedHeaders are the sorted lower case header names.
+func CanonicalRequest(method string, path string, query string, hdr http.Header, host string,
+	signedHeaders []string, payloadHash string) string {
+	var b bytes.Buffer
+	b.WriteString(method + "\n")
+	b.WriteString(URIEncode(path, false) + "\n")
+	b.WriteString(query + "\n")
+	for _, name := range signedHeaders {
+		b.WriteString(name + ":" + CanonicalHeaderValue(hdr, host, name) + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.Join(signedHeaders, ";") + "\n")
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+// CredentialScope returns the scope, date/region/s3/aws4_request
+func CredentialScope(t time.Time, region string) string {
+	return t.UTC().Format(ShortDateFormat) + "/" + region + "/" + SigV4Service + "/" + SigV4Terminator
+}
+
+// StringToSign creates the SigV4 string to sign
+func StringToSign(t time.Time, scope string, canonicalRequest string) string {
+	return SigV4Algorithm + "\n" + t.UTC().Format(AmzDateFormat) + "\n" + scope + "\n" +
+		SHA256Hex([]byte(canonicalRequest))
+}
+
+// SigningKey derives the SigV4 signing key
+func SigningKey(secretKey string, date string, region string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secretKey), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, SigV4Service)
+	return hmacSHA256(k, SigV4Terminator)
+}
+
+// Signature signs the string with the signing key
+func Signature(signingKey []byte, stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+// ChunkSignature computes the signature of one aws-chunked chunk. Every chunk
+// is chained to the signature of the previous chunk, the first chunk is
+// chained to the seed signature of the request.
+func ChunkSignature(signingKey []byte, t time.Time, scope string, prevSignature string,
+	data []byte) string {
+	sts := ChunkAlgorithm + "\n" + t.UTC().Format(AmzDateFormat) + "\n" + scope + "\n" +
+		prevSignature + "\n" + EmptyPayloadHash + "\n" + SHA256Hex(data)
+	return Signature(signingKey, sts)
+}
+
+// TrailerSignature computes the signature of the trailing headers, which are
+// formatted as "name:value\n".
+func TrailerSignature(signingKey []byte, t time.Time, scope string, prevSignature string,
+	trailer []byte) string {
+	sts := TrailerAlgorithm + "\n" + t.UTC().Format(AmzDateFormat) + "\n" + scope + "\n" +
+		prevSignature + "\n" + SHA256Hex(trailer)
+	return Signature(signingKey, sts)
+}
+
+// SignRequest signs the request with the Authorization header. All x-amz-*
+// headers, host, content-md5 and content-type are signed.
+func SignRequest(r *http.Request, accessKey string, secretKey string, region string,
+	payloadHash string, t time.Time) {
+	r.Header.Set(AmzDate, t.UTC().Format(AmzDateFormat))
+	r.Header.Set(AmzContentSha256, payloadHash)
+
+	signedHeaders := []string{"host"}
+	for k := range r.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-md5" || name == "content-type" {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	cr := CanonicalRequest(r.Method, r.URL.Path, CanonicalQueryString(r.URL.Query(), ""),
+		r.Header, r.URL.Host, signedHeaders, payloadHash)
+	scope := CredentialScope(t, region)
+	sig := Signature(SigningKey(secretKey, t.UTC().Format(ShortDateFormat), region), StringToSign(t, scope, cr))
+
+	r.Header.Set(Authorization, SigV4Algorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+sig)
+}
+
+// PresignURL creates the presigned url for the method, bucket and key. The
+// url is valid for expires after t. Only host is signed, the payload is
+// not signed.
+func PresignURL(method string, endpoint string, bkname string, key string, accessKey string,
+	secretKey string, region string, expires time.Duration, t time.Time) (string, error) {
+	path := "/" + bkname
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + URIEncode(path, false))
+	if err != nil {
+		return "", err
+	}
+
+	scope := CredentialScope(t, region)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", SigV4Algorithm)
+	q.Set("X-Amz-Credential", accessKey+"/"+scope)
+	q.Set("X-Amz-Date", t.UTC().Format(AmzDateFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	query := CanonicalQueryString(q, "")
+	cr := CanonicalRequest(method, path, query, nil, u.Host, []string{"host"}, UnsignedPayload)
+	sig := Signature(SigningKey(secretKey, t.UTC().Format(ShortDateFormat), region), StringToSign(t, scope, cr))
+
+	u.RawQuery = query + "&X-Amz-Signature=" + sig
+	return u.String(), nil
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestURIEncode(t *testing.T) {
+	tests := []struct {
+		s           string
+		encodeSlash bool
+		want        string
+	}{
+		{"abc-._~XYZ019", true, "abc-._~XYZ019"},
+		{"a b+c", true, "a%20b%2Bc"},
+		{"dir/a b", false, "dir/a%20b"},
+		{"dir/a b", true, "dir%2Fa%20b"},
+		{"test$file.text", false, "test%24file.text"},
+		{"é*", true, "%C3%A9%2A"},
+	}
+	for _, tt := range tests {
+		if got := URIEncode(tt.s, tt.encodeSlash); got != tt.want {
+			t.Errorf("URIEncode(%q, %v) = %q, want %q", tt.s, tt.encodeSlash, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalQueryString(t *testing.T) {
+	tests := []struct {
+		query string
+		skip  string
+		want  string
+	}{
+		{"", "", ""},
+		{"lifecycle", "", "lifecycle="},
+		{"prefix=J&max-keys=2", "", "max-keys=2&prefix=J"},
+		{"a=2&a=1&b=x%20y", "", "a=1&a=2&b=x%20y"},
+		{"X-Amz-Signature=abc&X-Amz-Date=20130524T000000Z", "X-Amz-Signature", "X-Amz-Date=20130524T000000Z"},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(tt.query, err)
+		}
+		if got := CanonicalQueryString(q, tt.skip); got != tt.want {
+			t.Errorf("CanonicalQueryString(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}